@@ -0,0 +1,582 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Where the tree in an archive appears, in the ArchiveFs reading it.
+const ARCHIVE_ROOT string = "/archive"
+
+// Create a LocalStore on the tree in a tar, gzipped tar or zip archive,
+// or on the directory at subdir within it, so that the archive can be
+// the source of a patch without being extracted to disk.
+func NewArchiveStore(path string, subdir string, repo NodeRepo) (LocalStore, os.Error) {
+	archiveFs, err := OpenArchive(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLocalStoreWith(filepath.Join(ARCHIVE_ROOT, subdir), repo, LocalOptions{FileSystem: archiveFs})
+}
+
+// A read-only FileSystem on the tree in an archive, beneath ARCHIVE_ROOT.
+//
+// Only the listing of the archive is held in memory. The contents of a
+// member are read from the archive when its file is read. Members of a
+// gzipped tar can only be reached by decompressing the archive from the
+// start, so seeking back within one starts again from there.
+type ArchiveFs struct {
+	entries map[string]*archiveEntry
+
+	// When the archive was modified, for members which have no time.
+	mtime int64
+}
+
+type archiveEntry struct {
+	isDir bool
+	mode  uint32
+	size  int64
+	mtime int64
+
+	// Names of a directory's entries.
+	children map[string]bool
+
+	// Open a file's contents in the archive, from the start.
+	open func() (io.ReadCloser, os.Error)
+}
+
+// Read the listing of a tar, gzipped tar or zip archive into a new
+// ArchiveFs. The format is chosen by the archive's file extension.
+//
+// Only directories, regular files, and hard links to files earlier in the
+// archive can be read. An archive with any other kind of member, such as
+// a symbolic link, is refused.
+func OpenArchive(path string) (*ArchiveFs, os.Error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveFs := &ArchiveFs{entries: make(map[string]*archiveEntry), mtime: info.Mtime_ns}
+	archiveFs.entries["/"] = &archiveEntry{
+		isDir: true, mode: 0755, mtime: info.Mtime_ns, children: make(map[string]bool)}
+	if err = archiveFs.addDir(ARCHIVE_ROOT, 0755, info.Mtime_ns); err != nil {
+		return nil, err
+	}
+
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		err = archiveFs.readTar(path, true)
+	case strings.HasSuffix(lower, ".tar"):
+		err = archiveFs.readTar(path, false)
+	case strings.HasSuffix(lower, ".zip"):
+		err = archiveFs.readZip(path, info.Size)
+	default:
+		err = os.NewError(fmt.Sprintf("Unknown archive format: %s", path))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return archiveFs, nil
+}
+
+// Get where an archive member belongs beneath root, refusing those which
+// would be placed outside it.
+func archivePath(root string, name string) (string, os.Error) {
+	relpath := filepath.Clean(name)
+	if filepath.IsAbs(relpath) || relpath == ".." || strings.HasPrefix(relpath, "../") {
+		return "", os.NewError(fmt.Sprintf("Archive member outside of root: %s", name))
+	}
+	return filepath.Join(root, relpath), nil
+}
+
+// Add a directory, or set the mode of one already added. Missing parents
+// are added with mode 0755.
+func (archiveFs *ArchiveFs) addDir(path string, mode uint32, mtime int64) os.Error {
+	if entry, has := archiveFs.entries[path]; has {
+		if !entry.isDir {
+			return memPathError("mkdir", path, syscall.ENOTDIR)
+		}
+		entry.mode, entry.mtime = mode&07777, mtime
+		return nil
+	}
+
+	if err := archiveFs.addChild(path); err != nil {
+		return err
+	}
+	archiveFs.entries[path] = &archiveEntry{
+		isDir: true, mode: mode & 07777, mtime: mtime, children: make(map[string]bool)}
+	return nil
+}
+
+// Add a file, replacing any file added at the same path before it.
+func (archiveFs *ArchiveFs) addFile(path string, entry *archiveEntry) os.Error {
+	if other, has := archiveFs.entries[path]; has && other.isDir {
+		return memPathError("open", path, syscall.EISDIR)
+	}
+
+	if err := archiveFs.addChild(path); err != nil {
+		return err
+	}
+	archiveFs.entries[path] = entry
+	return nil
+}
+
+// List an entry in its parent directory, adding the parent if it is missing.
+func (archiveFs *ArchiveFs) addChild(path string) os.Error {
+	parentPath := filepath.Dir(path)
+	if _, has := archiveFs.entries[parentPath]; !has {
+		if err := archiveFs.addDir(parentPath, 0755, archiveFs.mtime); err != nil {
+			return err
+		}
+	}
+
+	parent := archiveFs.entries[parentPath]
+	if !parent.isDir {
+		return memPathError("mkdir", parentPath, syscall.ENOTDIR)
+	}
+	parent.children[filepath.Base(path)] = true
+	return nil
+}
+
+// A reader which counts the bytes read through it.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(buf []byte) (int, os.Error) {
+	n, err := counter.reader.Read(buf)
+	counter.count += int64(n)
+	return n, err
+}
+
+// Read the listing of a tar archive, recording where in the tar stream
+// the contents of each file begin.
+func (archiveFs *ArchiveFs) readTar(path string, gzipped bool) os.Error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	counter := &countingReader{reader: fh}
+	if gzipped {
+		gzipReader, err := gzip.NewReader(fh)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		counter.reader = gzipReader
+	}
+
+	tarReader := tar.NewReader(counter)
+	for {
+		header, err := tarReader.Next()
+		if err == os.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		memberPath, err := archivePath(ARCHIVE_ROOT, header.Name)
+		if err != nil {
+			return err
+		}
+
+		mtime := header.Mtime * 1e9
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = archiveFs.addDir(memberPath, uint32(header.Mode), mtime)
+		case tar.TypeReg, tar.TypeRegA:
+			err = archiveFs.addFile(memberPath, &archiveEntry{
+				mode: uint32(header.Mode) & 07777, size: header.Size, mtime: mtime,
+				open: tarMember(path, gzipped, counter.count, header.Size)})
+		case tar.TypeLink:
+			var target string
+			if target, err = archivePath(ARCHIVE_ROOT, header.Linkname); err != nil {
+				return err
+			}
+			entry, has := archiveFs.entries[target]
+			if !has || entry.isDir {
+				return os.NewError(fmt.Sprintf(
+					"Archive member %s links to %s, which is not a file before it", header.Name, header.Linkname))
+			}
+			link := *entry
+			link.mode, link.mtime = uint32(header.Mode)&07777, mtime
+			err = archiveFs.addFile(memberPath, &link)
+		default:
+			return os.NewError(fmt.Sprintf(
+				"Archive member %s is of unsupported type '%c'", header.Name, header.Typeflag))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	panic("unreachable")
+}
+
+// A section of an archive file, which closes the file with it.
+type sectionCloser struct {
+	*io.SectionReader
+	fh *os.File
+}
+
+func (section *sectionCloser) Close() os.Error { return section.fh.Close() }
+
+// A reader of a gzipped tar member, which closes the decompressor and the
+// archive file with it.
+type gzipMember struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (member *gzipMember) Close() (err os.Error) {
+	for _, closer := range member.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Get how to open the contents of a tar member, which are size bytes at
+// offset in the tar stream of the archive at path.
+func tarMember(path string, gzipped bool, offset int64, size int64) func() (io.ReadCloser, os.Error) {
+	return func() (io.ReadCloser, os.Error) {
+		fh, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if !gzipped {
+			return &sectionCloser{SectionReader: io.NewSectionReader(fh, offset, size), fh: fh}, nil
+		}
+
+		gzipReader, err := gzip.NewReader(fh)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		member := &gzipMember{Reader: io.LimitReader(gzipReader, size), closers: []io.Closer{gzipReader, fh}}
+		if _, err = io.Copyn(ioutil.Discard, gzipReader, offset); err != nil {
+			member.Close()
+			return nil, err
+		}
+		return member, nil
+	}
+}
+
+// Read the listing of a zip archive of size bytes. The archive is kept
+// open to read members from while the ArchiveFs is in use. Zip archives
+// do not carry permissions in a portable way, so directories have mode
+// 0755 and files 0644.
+func (archiveFs *ArchiveFs) readZip(path string, size int64) os.Error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	zipReader, err := zip.NewReader(fh, size)
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	for _, member := range zipReader.File {
+		memberPath, err := archivePath(ARCHIVE_ROOT, member.Name)
+		if err == nil {
+			if strings.HasSuffix(member.Name, "/") {
+				err = archiveFs.addDir(memberPath, 0755, archiveFs.mtime)
+			} else {
+				file := member
+				err = archiveFs.addFile(memberPath, &archiveEntry{
+					mode: 0644, size: int64(member.UncompressedSize), mtime: archiveFs.mtime,
+					open: func() (io.ReadCloser, os.Error) { return file.Open() }})
+			}
+		}
+		if err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (entry *archiveEntry) info(path string) *os.FileInfo {
+	info := &os.FileInfo{
+		Name:     filepath.Base(path),
+		Nlink:    1,
+		Mode:     entry.mode,
+		Size:     entry.size,
+		Atime_ns: entry.mtime,
+		Mtime_ns: entry.mtime,
+		Ctime_ns: entry.mtime}
+	if entry.isDir {
+		info.Mode |= syscall.S_IFDIR
+	} else {
+		info.Mode |= syscall.S_IFREG
+	}
+	return info
+}
+
+func (archiveFs *ArchiveFs) Open(name string) (Handle, os.Error) {
+	entry, has := archiveFs.entries[memPath(name)]
+	if !has {
+		return nil, memPathError("open", name, syscall.ENOENT)
+	}
+	return &archiveHandle{name: name, entry: entry}, nil
+}
+
+func (archiveFs *ArchiveFs) Create(name string) (Handle, os.Error) {
+	return nil, memPathError("open", name, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) OpenFile(name string, flag int, perm uint32) (Handle, os.Error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, memPathError("open", name, syscall.EROFS)
+	}
+	return archiveFs.Open(name)
+}
+
+func (archiveFs *ArchiveFs) TempFile(dir string, prefix string) (Handle, os.Error) {
+	return nil, memPathError("open", filepath.Join(dir, prefix), syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) Stat(name string) (*os.FileInfo, os.Error) {
+	path := memPath(name)
+	entry, has := archiveFs.entries[path]
+	if !has {
+		return nil, memPathError("stat", name, syscall.ENOENT)
+	}
+	return entry.info(path), nil
+}
+
+func (archiveFs *ArchiveFs) Lstat(name string) (*os.FileInfo, os.Error) {
+	return archiveFs.Stat(name)
+}
+
+func (archiveFs *ArchiveFs) ReadDir(name string) ([]*os.FileInfo, os.Error) {
+	path := memPath(name)
+	switch entry, has := archiveFs.entries[path]; {
+	case !has:
+		return nil, memPathError("open", name, syscall.ENOENT)
+	case !entry.isDir:
+		return nil, memPathError("readdirent", name, syscall.ENOTDIR)
+	}
+
+	names := []string{}
+	for child, _ := range archiveFs.entries[path].children {
+		names = append(names, child)
+	}
+	sort.SortStrings(names)
+
+	infos := make([]*os.FileInfo, len(names))
+	for i, child := range names {
+		childPath := filepath.Join(path, child)
+		infos[i] = archiveFs.entries[childPath].info(childPath)
+	}
+	return infos, nil
+}
+
+func (archiveFs *ArchiveFs) Mkdir(name string, perm uint32) os.Error {
+	return memPathError("mkdir", name, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) MkdirAll(path string, perm uint32) os.Error {
+	return memPathError("mkdir", path, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) Remove(name string) os.Error {
+	return memPathError("remove", name, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) RemoveAll(path string) os.Error {
+	return memPathError("remove", path, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) Rename(oldname string, newname string) os.Error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Error: os.Errno(syscall.EROFS)}
+}
+
+func (archiveFs *ArchiveFs) Truncate(name string, size int64) os.Error {
+	return memPathError("truncate", name, syscall.EROFS)
+}
+
+func (archiveFs *ArchiveFs) Chmod(name string, mode uint32) os.Error {
+	return memPathError("chmod", name, syscall.EROFS)
+}
+
+// A file opened in an ArchiveFs. Its contents are opened in the archive
+// when they are first read.
+type archiveHandle struct {
+	name   string
+	entry  *archiveEntry
+	reader io.ReadCloser
+	pos    int64
+}
+
+func (fh *archiveHandle) Name() string { return fh.name }
+
+func (fh *archiveHandle) open() (err os.Error) {
+	if fh.entry.isDir {
+		return memPathError("read", fh.name, syscall.EISDIR)
+	}
+	if fh.reader == nil {
+		fh.reader, err = fh.entry.open()
+		fh.pos = 0
+	}
+	return err
+}
+
+func (fh *archiveHandle) Read(buf []byte) (int, os.Error) {
+	if err := fh.open(); err != nil {
+		return 0, err
+	}
+	n, err := fh.reader.Read(buf)
+	fh.pos += int64(n)
+	return n, err
+}
+
+func (fh *archiveHandle) ReadAt(buf []byte, off int64) (int, os.Error) {
+	if _, err := fh.Seek(off, 0); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(fh, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = os.EOF
+	}
+	return n, err
+}
+
+func (fh *archiveHandle) Seek(offset int64, whence int) (int64, os.Error) {
+	if err := fh.open(); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case 1:
+		offset += fh.pos
+	case 2:
+		offset += fh.entry.size
+	}
+	if offset < 0 {
+		return fh.pos, memPathError("seek", fh.name, syscall.EINVAL)
+	}
+
+	if seeker, isSeeker := fh.reader.(io.Seeker); isSeeker {
+		pos, err := seeker.Seek(offset, 0)
+		if err == nil {
+			fh.pos = pos
+		}
+		return pos, err
+	}
+
+	// Contents which can only be read in order are read again from the
+	// start to go back, and read through to go forward
+	if offset < fh.pos {
+		fh.reader.Close()
+		fh.reader = nil
+		if err := fh.open(); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.Copyn(ioutil.Discard, fh, offset-fh.pos); err != nil && err != os.EOF {
+		return fh.pos, err
+	}
+	return fh.pos, nil
+}
+
+func (fh *archiveHandle) Write(buf []byte) (int, os.Error) {
+	return 0, memPathError("write", fh.name, syscall.EBADF)
+}
+
+func (fh *archiveHandle) Truncate(size int64) os.Error {
+	return memPathError("truncate", fh.name, syscall.EBADF)
+}
+
+func (fh *archiveHandle) Stat() (*os.FileInfo, os.Error) {
+	return fh.entry.info(fh.name), nil
+}
+
+func (fh *archiveHandle) Close() os.Error {
+	if fh.reader == nil {
+		return nil
+	}
+	err := fh.reader.Close()
+	fh.reader = nil
+	return err
+}
+
+// Write the tree in a store out to a tar stream, with the contents of its
+// files read from the store. Entries are named by their path relative to
+// the root of the tree, and stamped with the time of the export.
+func ExportTar(store BlockStore, writer io.Writer) (err os.Error) {
+	root, err := store.Repo().Root()
+	if err != nil {
+		return err
+	}
+
+	tarWriter := tar.NewWriter(writer)
+	now := time.Seconds()
+
+	walkErr := CheckedWalk(root, func(node Node) bool {
+		if err != nil {
+			return false
+		}
+
+		switch node := node.(type) {
+		case Dir:
+			var relpath string
+			if relpath, err = CheckedRelPath(node); err != nil {
+				return false
+			} else if relpath == "" {
+				return true
+			}
+			err = tarWriter.WriteHeader(&tar.Header{
+				Name:     relpath + "/",
+				Mode:     int64(node.Mode() & 07777),
+				Mtime:    now,
+				Typeflag: tar.TypeDir})
+			return err == nil
+		case File:
+			var relpath string
+			if relpath, err = CheckedRelPath(node); err != nil {
+				return false
+			} else if relpath == "" {
+				relpath = node.Name()
+			}
+			err = tarWriter.WriteHeader(&tar.Header{
+				Name:     relpath,
+				Mode:     int64(node.Mode() & 07777),
+				Size:     node.Info().Size,
+				Mtime:    now,
+				Typeflag: tar.TypeReg})
+			if err == nil {
+				_, err = store.ReadInto(node.Info().Strong, 0, node.Info().Size, tarWriter)
+			}
+		}
+		return false
+	})
+
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
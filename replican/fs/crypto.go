@@ -0,0 +1,283 @@
+package fs
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Iterations of PBKDF2 used to derive the keys for a new key file.
+const KEY_ITERATIONS int = 100000
+
+const keyFileHeader string = "replican-keys 1"
+const keyCheckText string = "replican key check"
+
+// Size of the random salt in a key file, and of each derived key.
+const keySize int = 32
+
+// Keys derived from a passphrase, for keeping a repository's contents
+// and names secret from whoever stores it.
+//
+// Block contents are encrypted with AES-256 in CTR mode under a random
+// IV, then authenticated with HMAC-SHA256. Blocks are addressed by a
+// keyed HMAC of their strong checksum, so that the address does not tell
+// which content it holds. Names are encrypted deterministically, with
+// the IV taken from an HMAC of the name, so that equal names still
+// compare equal once encrypted. Checksums are encrypted in the same way,
+// and weak checksums are shuffled by a keyed permutation, so that they
+// can still be looked up without telling which content they belong to.
+type Keys struct {
+	cipher     []byte
+	auth       []byte
+	address    []byte
+	nameCiph   []byte
+	nameAuth   []byte
+	strongCiph []byte
+	strongAuth []byte
+	weak       cipher.Block
+	keyCheck   string
+}
+
+// Derive keys from a secret, such as a passphrase or the contents of a
+// key file, and a salt.
+func DeriveKeys(secret []byte, salt []byte, iterations int) *Keys {
+	master := pbkdf2(secret, salt, iterations, keySize)
+	subkey := func(purpose string) []byte {
+		return hmacSum(master, []byte(purpose))
+	}
+
+	keys := &Keys{
+		cipher:     subkey("block cipher"),
+		auth:       subkey("block auth"),
+		address:    subkey("block address"),
+		nameCiph:   subkey("name cipher"),
+		nameAuth:   subkey("name auth"),
+		strongCiph: subkey("strong cipher"),
+		strongAuth: subkey("strong auth")}
+	keys.weak = aesBlock(subkey("weak"))
+	keys.keyCheck = hex.EncodeToString(hmacSum(keys.auth, []byte(keyCheckText)))
+	return keys
+}
+
+func hmacSum(key []byte, data []byte) []byte {
+	mac := hmac.NewSHA256(key)
+	mac.Write(data)
+	return mac.Sum()
+}
+
+// Derive a key from a password, as in PKCS #5 v2.0, with HMAC-SHA256.
+func pbkdf2(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.NewSHA256(password)
+	key := []byte{}
+	for block := 1; len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum()
+
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum()
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Open the key file at path with a secret, or create it with a new salt
+// if there is none. The key file holds no keys, only what is needed to
+// derive them again and to check that the secret is the right one.
+func UnlockKeys(path string, secret []byte) (*Keys, os.Error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		if pathErr, isPathErr := err.(*os.PathError); !isPathErr || pathErr.Error != os.ENOENT {
+			return nil, err
+		}
+		return createKeyFile(path, secret)
+	}
+	defer fh.Close()
+
+	var header, version, saltHex, check string
+	var iterations int
+	rd := bufio.NewReader(fh)
+	if _, err = fmt.Fscanf(rd, "%s %s\n%d\n%s\n%s\n",
+		&header, &version, &iterations, &saltHex, &check); err != nil {
+		return nil, os.NewError(fmt.Sprintf("Corrupt key file %s: %v", path, err))
+	} else if header+" "+version != keyFileHeader {
+		return nil, os.NewError(fmt.Sprintf("Unsupported key file %s", path))
+	}
+
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("Corrupt key file %s: %v", path, err))
+	}
+
+	keys := DeriveKeys(secret, salt, iterations)
+	if subtle.ConstantTimeCompare([]byte(keys.keyCheck), []byte(check)) != 1 {
+		return nil, os.NewError(fmt.Sprintf("Wrong passphrase or key for %s", path))
+	}
+	return keys, nil
+}
+
+func createKeyFile(path string, secret []byte) (*Keys, os.Error) {
+	salt := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	keys := DeriveKeys(secret, salt, KEY_ITERATIONS)
+
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	if _, err = fmt.Fprintf(fh, "%s\n%d\n%s\n%s\n",
+		keyFileHeader, KEY_ITERATIONS, hex.EncodeToString(salt), keys.keyCheck); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func aesBlock(key []byte) cipher.Block {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err.String()) // Only for a bad key size
+	}
+	return block
+}
+
+func ctrStream(key []byte, iv []byte) cipher.Stream {
+	return cipher.NewCTR(aesBlock(key), iv)
+}
+
+// Get the address a block is stored under, from its strong checksum.
+func (keys *Keys) Address(strong string) string {
+	return hex.EncodeToString(hmacSum(keys.address, []byte(strong)))
+}
+
+// Encrypt and authenticate block contents.
+func (keys *Keys) Seal(plain []byte) ([]byte, os.Error) {
+	sealed := make([]byte, aes.BlockSize+len(plain))
+	iv := sealed[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	ctrStream(keys.cipher, iv).XORKeyStream(sealed[aes.BlockSize:], plain)
+
+	mac := hmac.NewSHA256(keys.auth)
+	mac.Write(sealed)
+	return append(sealed, mac.Sum()...), nil
+}
+
+// Authenticate and decrypt block contents sealed with the same keys.
+func (keys *Keys) Open(sealed []byte) ([]byte, os.Error) {
+	mac := hmac.NewSHA256(keys.auth)
+	if len(sealed) < aes.BlockSize+mac.Size() {
+		return nil, os.NewError("Sealed block is truncated")
+	}
+
+	body := sealed[:len(sealed)-mac.Size()]
+	mac.Write(body)
+	if subtle.ConstantTimeCompare(mac.Sum(), sealed[len(body):]) != 1 {
+		return nil, os.NewError("Sealed block failed authentication")
+	}
+
+	plain := make([]byte, len(body)-aes.BlockSize)
+	ctrStream(keys.cipher, body[:aes.BlockSize]).XORKeyStream(plain, body[aes.BlockSize:])
+	return plain, nil
+}
+
+// Encrypt text so that the same text always encrypts the same way. The IV
+// is a keyed HMAC of the text, which also authenticates it when opened.
+func sealText(ciph []byte, auth []byte, text string) string {
+	iv := hmacSum(auth, []byte(text))[:aes.BlockSize]
+	sealed := make([]byte, aes.BlockSize+len(text))
+	copy(sealed, iv)
+	ctrStream(ciph, iv).XORKeyStream(sealed[aes.BlockSize:], []byte(text))
+	return base64.URLEncoding.EncodeToString(sealed)
+}
+
+func openText(ciph []byte, auth []byte, sealed string, what string) (string, os.Error) {
+	buf, err := base64.URLEncoding.DecodeString(sealed)
+	if err != nil || len(buf) < aes.BlockSize {
+		return "", os.NewError(fmt.Sprintf("Not a sealed %s: %s", what, sealed))
+	}
+
+	iv := buf[:aes.BlockSize]
+	text := make([]byte, len(buf)-aes.BlockSize)
+	ctrStream(ciph, iv).XORKeyStream(text, buf[aes.BlockSize:])
+
+	if subtle.ConstantTimeCompare(hmacSum(auth, text)[:aes.BlockSize], iv) != 1 {
+		return "", os.NewError(fmt.Sprintf("Sealed %s failed authentication: %s", what, sealed))
+	}
+	return string(text), nil
+}
+
+// Encrypt a file or directory name, so that the same name always
+// encrypts the same way.
+func (keys *Keys) SealName(name string) string {
+	return sealText(keys.nameCiph, keys.nameAuth, name)
+}
+
+// Decrypt a name sealed with the same keys.
+func (keys *Keys) OpenName(sealed string) (string, os.Error) {
+	return openText(keys.nameCiph, keys.nameAuth, sealed, "name")
+}
+
+// Encrypt a strong checksum, so that the same checksum always encrypts
+// the same way, and can be looked up by its sealed form.
+func (keys *Keys) SealStrong(strong string) string {
+	return sealText(keys.strongCiph, keys.strongAuth, strong)
+}
+
+// Decrypt a strong checksum sealed with the same keys.
+func (keys *Keys) OpenStrong(sealed string) (string, os.Error) {
+	return openText(keys.strongCiph, keys.strongAuth, sealed, "checksum")
+}
+
+// Rounds of the Feistel network which permutes weak checksums.
+const weakRounds int = 4
+
+// One round of the Feistel network: half of the value, encrypted
+// with the round number.
+func (keys *Keys) weakRound(round int, half uint32) uint32 {
+	in, out := make([]byte, aes.BlockSize), make([]byte, aes.BlockSize)
+	in[0] = byte(round)
+	in[1], in[2], in[3], in[4] = byte(half>>24), byte(half>>16), byte(half>>8), byte(half)
+	keys.weak.Encrypt(out, in)
+	return uint32(out[0])<<24 | uint32(out[1])<<16 | uint32(out[2])<<8 | uint32(out[3])
+}
+
+// Shuffle a weak checksum by a keyed permutation of 64-bit values,
+// so that equal checksums still compare equal once sealed.
+func (keys *Keys) SealWeak(weak int64) int64 {
+	left, right := uint32(uint64(weak)>>32), uint32(weak)
+	for round := 0; round < weakRounds; round++ {
+		left, right = right, left^keys.weakRound(round, right)
+	}
+	return int64(uint64(left)<<32 | uint64(right))
+}
+
+// Recover a weak checksum sealed with the same keys.
+func (keys *Keys) OpenWeak(sealed int64) int64 {
+	left, right := uint32(uint64(sealed)>>32), uint32(sealed)
+	for round := weakRounds - 1; round >= 0; round-- {
+		left, right = right^keys.weakRound(round, left), left
+	}
+	return int64(uint64(left)<<32 | uint64(right))
+}
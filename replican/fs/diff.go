@@ -0,0 +1,299 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Kinds of structural changes between two hierarchical tree models.
+type ChangeKind int
+
+const (
+	// Node exists in the destination tree, but not in the source.
+	Added ChangeKind = iota
+
+	// Node exists in the source tree, but not in the destination.
+	Removed
+
+	// Node exists at the same path in both trees with different contents.
+	Modified
+
+	// Node contents in the source were found at a different path in the destination.
+	Moved
+
+	// Node exists at the same path in both trees with the same contents but a different mode.
+	ModeChanged
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case Moved:
+		return "moved"
+	case ModeChanged:
+		return "mode"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(kind))
+}
+
+// A change event between a source and destination tree.
+// Paths are relative to the roots being compared.
+type Change struct {
+	Kind ChangeKind
+
+	// Node in the source tree, nil if Added.
+	Src     FsNode
+	SrcPath string
+
+	// Node in the destination tree, nil if Removed.
+	Dst     FsNode
+	DstPath string
+}
+
+// Test if the change applies to a directory.
+func (change *Change) IsDir() bool {
+	node := change.Src
+	if node == nil {
+		node = change.Dst
+	}
+	_, isDir := node.(Dir)
+	return isDir
+}
+
+func (change *Change) String() string {
+	switch change.Kind {
+	case Added:
+		return fmt.Sprintf("%v\t%s", change.Kind, change.DstPath)
+	case Moved:
+		return fmt.Sprintf("%v\t%s -> %s", change.Kind, change.SrcPath, change.DstPath)
+	}
+	return fmt.Sprintf("%v\t%s", change.Kind, change.SrcPath)
+}
+
+// Visitor function to receive change events from Diff.
+type ChangeVisitor func(*Change)
+
+// Compare the roots of two repositories. See Diff.
+func DiffRepos(src NodeRepo, dst NodeRepo, visitor ChangeVisitor) os.Error {
+	srcRoot, err := src.Root()
+	if err != nil {
+		return err
+	}
+	dstRoot, err := dst.Root()
+	if err != nil {
+		return err
+	}
+
+	return Diff(srcRoot, dstRoot, visitor)
+}
+
+// Compare two hierarchical tree models and report how dst differs from src.
+//
+// Directories with equal strong checksums are considered identical and
+// are not descended into, so only the mode of the directory itself is
+// compared in that case.
+//
+// Modified and ModeChanged events are delivered as they are found.
+// Nodes present on only one side are held back until the traversal
+// is complete, so that nodes with the same strong checksum can be paired
+// up and delivered as Moved, rather than Removed and Added.
+//
+// Stops at the first directory whose contents cannot be read, without
+// delivering the held back events, since nodes on one side may only
+// appear to be missing from the other.
+func Diff(src FsNode, dst FsNode, visitor ChangeVisitor) os.Error {
+	differ := &differ{visitor: visitor}
+
+	srcDir, isSrcDir := src.(Dir)
+	dstDir, isDstDir := dst.(Dir)
+	switch {
+	case src == nil && dst == nil:
+		return nil
+	case src == nil:
+		differ.added(dst, "")
+	case dst == nil:
+		differ.removed(src, "")
+	case isSrcDir && isDstDir:
+		if err := differ.diffDir(srcDir, dstDir, ""); err != nil {
+			return err
+		}
+	case !isSrcDir && !isDstDir:
+		differ.diffFile(src.(File), dst.(File), "")
+	default:
+		differ.removed(src, "")
+		differ.added(dst, "")
+	}
+
+	differ.flush()
+	return nil
+}
+
+type differ struct {
+	visitor ChangeVisitor
+
+	removedChanges []*Change
+	addedChanges   []*Change
+}
+
+// Get the strong checksum of a file or directory.
+func fsNodeStrong(node FsNode) string {
+	if dir, is := node.(Dir); is {
+		return dir.Info().Strong
+	} else if file, is := node.(File); is {
+		return file.Info().Strong
+	}
+	return ""
+}
+
+func (differ *differ) removed(node FsNode, path string) {
+	differ.removedChanges = append(differ.removedChanges,
+		&Change{Kind: Removed, Src: node, SrcPath: path})
+}
+
+func (differ *differ) added(node FsNode, path string) {
+	differ.addedChanges = append(differ.addedChanges,
+		&Change{Kind: Added, Dst: node, DstPath: path})
+}
+
+func (differ *differ) diffFile(srcFile File, dstFile File, path string) {
+	change := &Change{Src: srcFile, SrcPath: path, Dst: dstFile, DstPath: path}
+	if srcFile.Info().Strong != dstFile.Info().Strong {
+		change.Kind = Modified
+		differ.visitor(change)
+	} else if srcFile.Mode() != dstFile.Mode() {
+		change.Kind = ModeChanged
+		differ.visitor(change)
+	}
+}
+
+func (differ *differ) diffDir(srcDir Dir, dstDir Dir, path string) os.Error {
+	if path != "" && srcDir.Mode() != dstDir.Mode() {
+		differ.visitor(&Change{Kind: ModeChanged,
+			Src: srcDir, SrcPath: path, Dst: dstDir, DstPath: path})
+	}
+
+	// Identical contents all the way down, nothing more to see here.
+	if srcDir.Info().Strong == dstDir.Info().Strong {
+		return nil
+	}
+
+	srcSubdirList, err := ReadSubDirs(srcDir)
+	if err != nil {
+		return err
+	}
+	srcFileList, err := ReadFiles(srcDir)
+	if err != nil {
+		return err
+	}
+	dstSubdirList, err := ReadSubDirs(dstDir)
+	if err != nil {
+		return err
+	}
+	dstFileList, err := ReadFiles(dstDir)
+	if err != nil {
+		return err
+	}
+
+	dstSubdirs := make(map[string]Dir)
+	for _, dstSubdir := range dstSubdirList {
+		dstSubdirs[dstSubdir.Name()] = dstSubdir
+	}
+	dstFiles := make(map[string]File)
+	for _, dstFile := range dstFileList {
+		dstFiles[dstFile.Name()] = dstFile
+	}
+
+	for _, srcSubdir := range srcSubdirList {
+		name := srcSubdir.Name()
+		subpath := filepath.Join(path, name)
+		if dstSubdir, has := dstSubdirs[name]; has {
+			dstSubdirs[name] = nil, false
+			if err := differ.diffDir(srcSubdir, dstSubdir, subpath); err != nil {
+				return err
+			}
+		} else if dstFile, has := dstFiles[name]; has {
+			dstFiles[name] = nil, false
+			differ.removed(srcSubdir, subpath)
+			differ.added(dstFile, subpath)
+		} else {
+			differ.removed(srcSubdir, subpath)
+		}
+	}
+
+	for _, srcFile := range srcFileList {
+		name := srcFile.Name()
+		subpath := filepath.Join(path, name)
+		if dstFile, has := dstFiles[name]; has {
+			dstFiles[name] = nil, false
+			differ.diffFile(srcFile, dstFile, subpath)
+		} else if dstSubdir, has := dstSubdirs[name]; has {
+			dstSubdirs[name] = nil, false
+			differ.removed(srcFile, subpath)
+			differ.added(dstSubdir, subpath)
+		} else {
+			differ.removed(srcFile, subpath)
+		}
+	}
+
+	// Whatever is left over in dst was not in src
+	for _, dstSubdir := range dstSubdirList {
+		if _, has := dstSubdirs[dstSubdir.Name()]; has {
+			differ.added(dstSubdir, filepath.Join(path, dstSubdir.Name()))
+		}
+	}
+	for _, dstFile := range dstFileList {
+		if _, has := dstFiles[dstFile.Name()]; has {
+			differ.added(dstFile, filepath.Join(path, dstFile.Name()))
+		}
+	}
+	return nil
+}
+
+// Pair up removed and added nodes of the same kind and contents as moves,
+// then deliver the remaining removes and adds.
+func (differ *differ) flush() {
+	removedByStrong := make(map[string][]*Change)
+	for _, removed := range differ.removedChanges {
+		strong := fsNodeStrong(removed.Src)
+		removedByStrong[strong] = append(removedByStrong[strong], removed)
+	}
+
+	moved := make(map[*Change]bool)
+	for _, added := range differ.addedChanges {
+		strong := fsNodeStrong(added.Dst)
+		_, isAddedDir := added.Dst.(Dir)
+
+		candidates := removedByStrong[strong]
+		for i, removed := range candidates {
+			if _, isRemovedDir := removed.Src.(Dir); isRemovedDir != isAddedDir {
+				continue
+			}
+
+			added.Kind = Moved
+			added.Src = removed.Src
+			added.SrcPath = removed.SrcPath
+			moved[removed] = true
+
+			removedByStrong[strong] = append(candidates[:i], candidates[i+1:]...)
+			break
+		}
+	}
+
+	for _, removed := range differ.removedChanges {
+		if !moved[removed] {
+			differ.visitor(removed)
+		}
+	}
+	for _, added := range differ.addedChanges {
+		differ.visitor(added)
+	}
+
+	differ.removedChanges = nil
+	differ.addedChanges = nil
+}
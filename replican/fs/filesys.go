@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// A file opened on a FileSystem. *os.File is one.
+type Handle interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+
+	Name() string
+
+	Stat() (*os.FileInfo, os.Error)
+
+	Truncate(size int64) os.Error
+}
+
+// The file operations by which a LocalStore is indexed and patched, named
+// after their counterparts in os and ioutil. Besides the OS, a FileSystem
+// might be held in memory, or read from an archive. Failures should be reported as os
+// reports them, in a *os.PathError or *os.LinkError, so that callers can
+// tell the cause.
+type FileSystem interface {
+	Open(name string) (Handle, os.Error)
+
+	Create(name string) (Handle, os.Error)
+
+	OpenFile(name string, flag int, perm uint32) (Handle, os.Error)
+
+	// Create a new file in dir with a name beginning with prefix,
+	// as ioutil.TempFile does.
+	TempFile(dir string, prefix string) (Handle, os.Error)
+
+	Stat(name string) (*os.FileInfo, os.Error)
+
+	Lstat(name string) (*os.FileInfo, os.Error)
+
+	// List a directory's entries, sorted by name, as ioutil.ReadDir does.
+	ReadDir(name string) ([]*os.FileInfo, os.Error)
+
+	Mkdir(name string, perm uint32) os.Error
+
+	MkdirAll(path string, perm uint32) os.Error
+
+	Remove(name string) os.Error
+
+	RemoveAll(path string) os.Error
+
+	Rename(oldname string, newname string) os.Error
+
+	Truncate(name string, size int64) os.Error
+
+	Chmod(name string, mode uint32) os.Error
+}
+
+// The operating system's filesystem.
+type OsFs struct{}
+
+// The FileSystem stores use unless given another.
+var OS FileSystem = &OsFs{}
+
+// Return a *os.File as a Handle, or a nil Handle if there is none,
+// rather than a Handle holding a nil *os.File.
+func osHandle(f *os.File, err os.Error) (Handle, os.Error) {
+	if f == nil {
+		return nil, err
+	}
+	return f, err
+}
+
+func (osFs *OsFs) Open(name string) (Handle, os.Error) { return osHandle(os.Open(name)) }
+
+func (osFs *OsFs) Create(name string) (Handle, os.Error) { return osHandle(os.Create(name)) }
+
+func (osFs *OsFs) OpenFile(name string, flag int, perm uint32) (Handle, os.Error) {
+	return osHandle(os.OpenFile(name, flag, perm))
+}
+
+func (osFs *OsFs) TempFile(dir string, prefix string) (Handle, os.Error) {
+	return osHandle(ioutil.TempFile(dir, prefix))
+}
+
+func (osFs *OsFs) Stat(name string) (*os.FileInfo, os.Error) { return os.Stat(name) }
+
+func (osFs *OsFs) Lstat(name string) (*os.FileInfo, os.Error) { return os.Lstat(name) }
+
+func (osFs *OsFs) ReadDir(name string) ([]*os.FileInfo, os.Error) { return ioutil.ReadDir(name) }
+
+func (osFs *OsFs) Mkdir(name string, perm uint32) os.Error { return os.Mkdir(name, perm) }
+
+func (osFs *OsFs) MkdirAll(path string, perm uint32) os.Error { return os.MkdirAll(path, perm) }
+
+func (osFs *OsFs) Remove(name string) os.Error { return os.Remove(name) }
+
+func (osFs *OsFs) RemoveAll(path string) os.Error { return os.RemoveAll(path) }
+
+func (osFs *OsFs) Rename(oldname string, newname string) os.Error { return os.Rename(oldname, newname) }
+
+func (osFs *OsFs) Truncate(name string, size int64) os.Error { return os.Truncate(name, size) }
+
+func (osFs *OsFs) Chmod(name string, mode uint32) os.Error { return os.Chmod(name, mode) }
@@ -0,0 +1,202 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+)
+
+// Summary of the records and bytes reclaimed by garbage collection.
+type GCReport struct {
+	Dirs   int64
+	Files  int64
+	Blocks int64
+
+	// Bytes of block contents no longer referenced.
+	Bytes int64
+}
+
+// Accumulate another report into this one.
+func (report *GCReport) Add(other *GCReport) {
+	report.Dirs += other.Dirs
+	report.Files += other.Files
+	report.Blocks += other.Blocks
+	report.Bytes += other.Bytes
+}
+
+func (report *GCReport) String() string {
+	return fmt.Sprintf("Reclaimed %d dirs, %d files, %d blocks, %d bytes",
+		report.Dirs, report.Files, report.Blocks, report.Bytes)
+}
+
+// Mark the strong checksums of every block reachable from the given roots.
+// A failure to read any of them is returned, as a partial marking would
+// sweep blocks which are still in use.
+func markBlocks(roots []FsNode) (map[string]bool, os.Error) {
+	marked := make(map[string]bool)
+	for _, root := range roots {
+		err := CheckedWalk(root, func(node Node) bool {
+			if block, isBlock := node.(Block); isBlock {
+				marked[block.Info().Strong] = true
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return marked, nil
+}
+
+// Length of a block's contents, from the size of the file it belongs to.
+func blockLength(block *BlockInfo, fileSize int64) int64 {
+	length := int64(BLOCKSIZE)
+	if rest := fileSize - block.Offset(); rest < length {
+		length = rest
+	}
+	return length
+}
+
+// Mark a node and everything beneath it.
+// Reads the node fields directly, as the repo lock is already held.
+func (repo *MemRepo) mark(node FsNode, marked map[Node]bool) {
+	marked[node] = true
+	switch mnode := node.(type) {
+	case *memFile:
+		for _, block := range mnode.blocks {
+			marked[block] = true
+		}
+	case *memDir:
+		for _, subdir := range mnode.subdirs {
+			repo.mark(subdir, marked)
+		}
+		for _, file := range mnode.files {
+			repo.mark(file, marked)
+		}
+	}
+}
+
+// Sweep lookup entries for nodes no longer reachable from the root.
+func (repo *MemRepo) Collect() *GCReport {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	report := &GCReport{}
+
+	marked := make(map[Node]bool)
+	if repo.root != nil {
+		repo.mark(repo.root, marked)
+	}
+
+	// Removal shifts the entries of a key, so range over copies
+	for strong, blocks := range repo.blocks {
+		for _, node := range append([]Node{}, blocks...) {
+			if block := node.(*memBlock); !marked[block] {
+				repo.blocks.remove(strong, block)
+				repo.weakBlocks.remove(weakKey(block.info.Weak), block)
+				report.Blocks++
+				if mfile, is := block.parent.(*memFile); is {
+					report.Bytes += blockLength(block.info, mfile.info.Size)
+				} else {
+					report.Bytes += int64(BLOCKSIZE)
+				}
+			}
+		}
+	}
+
+	for strong, files := range repo.files {
+		for _, file := range append([]Node{}, files...) {
+			if !marked[file] {
+				repo.files.remove(strong, file)
+				report.Files++
+			}
+		}
+	}
+
+	for strong, dirs := range repo.dirs {
+		for _, dir := range append([]Node{}, dirs...) {
+			if !marked[dir] {
+				repo.dirs.remove(strong, dir)
+				report.Dirs++
+			}
+		}
+	}
+
+	return report
+}
+
+// Remove every block not reachable from the given roots.
+//
+// Packfiles holding unreachable blocks are rewritten: their remaining blocks
+// are copied into a new pack before the old pack is deleted, so an
+// interrupted collection leaves duplicates behind rather than losing data.
+func (store *ObjectStore) Collect(roots ...FsNode) (*GCReport, os.Error) {
+	reachable, err := markBlocks(roots)
+	if err != nil {
+		return nil, err
+	}
+	marked := make(map[string]bool)
+	for strong, _ := range reachable {
+		marked[store.address(strong)] = true
+	}
+	report := &GCReport{}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// Don't rewrite into a pack being collected
+	store.closePack()
+
+	packBlocks := make(map[int][]string)
+	for address, loc := range store.index {
+		packBlocks[loc.pack] = append(packBlocks[loc.pack], address)
+	}
+
+	for pack, addresses := range packBlocks {
+		live := [][]byte{}
+		dead := []string{}
+		for _, address := range addresses {
+			if !marked[address] {
+				dead = append(dead, address)
+				continue
+			}
+
+			buf, err := store.readObject(address)
+			if err != nil {
+				return report, err
+			}
+			live = append(live, buf)
+		}
+
+		if len(dead) == 0 {
+			continue
+		}
+
+		for _, address := range addresses {
+			if !marked[address] {
+				report.Blocks++
+				report.Bytes += store.index[address].length
+			}
+			store.index[address] = nil, false
+		}
+
+		for _, buf := range live {
+			if _, err := store.putBlock(buf); err != nil {
+				return report, err
+			}
+		}
+
+		if fh, has := store.readers[pack]; has {
+			fh.Close()
+			store.readers[pack] = nil, false
+		}
+		if err := os.Remove(store.packPath(pack, packIndexSuffix)); err != nil {
+			return report, err
+		}
+		if err := os.Remove(store.packPath(pack, packDataSuffix)); err != nil {
+			return report, err
+		}
+	}
+
+	store.closePack()
+	return report, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"hash"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -73,11 +74,20 @@ type Indexer struct {
 	Filter IndexFilter
 	Errors chan<- os.Error
 
+	// The filesystem Path is on. The OS's, when nil.
+	FileSystem FileSystem
+
+	// Limits the rate files are read at, when not nil.
+	Throttle *Throttle
+
 	root   Dir
 	dirMap map[string]Dir
+
+	// The first error from Repo, which stops indexing.
+	err os.Error
 }
 
-// Initialize the Indexer for filepath.Walk visit
+// Initialize the Indexer for FsWalk visit
 func (indexer *Indexer) initWalk() {
 	indexer.Path = filepath.Clean(indexer.Path)
 	indexer.Path = strings.TrimRight(indexer.Path, "/\\")
@@ -85,11 +95,15 @@ func (indexer *Indexer) initWalk() {
 	if indexer.Filter == nil {
 		indexer.Filter = AlwaysMatch
 	}
+	if indexer.FileSystem == nil {
+		indexer.FileSystem = OS
+	}
 
 	indexer.root = nil
 	indexer.dirMap = make(map[string]Dir)
+	indexer.err = nil
 
-	if rootInfo, err := os.Stat(indexer.Path); err == nil {
+	if rootInfo, err := indexer.FileSystem.Stat(indexer.Path); err == nil {
 		indexer.VisitDir(indexer.Path, rootInfo)
 		indexer.root = indexer.dirMap[indexer.Path]
 	}
@@ -97,7 +111,7 @@ func (indexer *Indexer) initWalk() {
 
 // Indexer callback for directories
 func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
-	if !indexer.Filter(path, f) {
+	if indexer.err != nil || !indexer.Filter(path, f) {
 		return false
 	}
 
@@ -111,12 +125,17 @@ func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
 		info := &DirInfo{
 			Name: basename,
 			Mode: f.Mode}
+		var err os.Error
 		if hasParent {
 			info.Parent = parentDir.Info().Strong
-			dir = indexer.Repo.AddDir(parentDir, info)
+			dir, err = indexer.Repo.AddDir(parentDir, info)
 		} else {
 			info.Name = ""
-			dir = indexer.Repo.AddDir(nil, info)
+			dir, err = indexer.Repo.AddDir(nil, info)
+		}
+		if err != nil {
+			indexer.err = err
+			return false
 		}
 		indexer.dirMap[path] = dir
 	}
@@ -126,19 +145,20 @@ func (indexer *Indexer) VisitDir(path string, f *os.FileInfo) bool {
 
 // IndexDir visitor callback for files
 func (indexer *Indexer) VisitFile(path string, f *os.FileInfo) {
-	if !indexer.Filter(path, f) {
+	if indexer.err != nil || !indexer.Filter(path, f) {
 		return
 	}
 
-	fileInfo, blocksInfo, err := IndexFile(path)
+	fileInfo, blocksInfo, err := IndexFileWith(path,
+		LocalOptions{FileSystem: indexer.FileSystem, IndexLimit: indexer.Throttle})
 	if err == nil {
 		dirpath, _ := filepath.Split(path)
 		dirpath = filepath.Clean(dirpath)
-		if dirinfo, err := os.Stat(dirpath); err == nil {
+		if dirinfo, err := indexer.FileSystem.Stat(dirpath); err == nil {
 			indexer.VisitDir(dirpath, dirinfo)
 
 			if fileParent, hasParent := indexer.dirMap[dirpath]; hasParent {
-				indexer.Repo.AddFile(fileParent, fileInfo, blocksInfo)
+				_, indexer.err = indexer.Repo.AddFile(fileParent, fileInfo, blocksInfo)
 				return
 			} else if indexer.Errors != nil {
 				indexer.Errors <- os.NewError("cannot locate parent directory")
@@ -150,12 +170,22 @@ func (indexer *Indexer) VisitFile(path string, f *os.FileInfo) {
 }
 
 func IndexDir(path string, repo NodeRepo) (Dir, []os.Error) {
+	return IndexDirWith(path, repo, LocalOptions{})
+}
+
+// Index a directory into repo like IndexDir, with the given options.
+func IndexDirWith(path string, repo NodeRepo, options LocalOptions) (Dir, []os.Error) {
 	errors := []os.Error{}
 	dirChan := make(chan Dir, 1)
 	errorChan := make(chan os.Error, 1)
-	indexer := &Indexer{Path: path, Repo: repo, Errors: errorChan}
+	indexer := &Indexer{Path: path, Repo: repo, Errors: errorChan,
+		FileSystem: options.FileSystem, Throttle: options.IndexLimit}
 	go func() {
-		dirChan <- indexer.Index()
+		dir, err := indexer.Index()
+		if err != nil {
+			errorChan <- err
+		}
+		dirChan <- dir
 		close(errorChan)
 	}()
 	for error := range errorChan {
@@ -165,46 +195,89 @@ func IndexDir(path string, repo NodeRepo) (Dir, []os.Error) {
 	return dir, errors
 }
 
-func (indexer *Indexer) Index() Dir {
+// Index the tree at Path into Repo.
+//
+// Errors reading the tree are sent to Errors, if it is not nil, and
+// indexing carries on without the paths concerned. An error from Repo
+// stops indexing, and is returned. If Repo is a BulkRepo, the whole tree
+// is added as one bulk load, which is aborted if indexing stops.
+func (indexer *Indexer) Index() (root Dir, err os.Error) {
+	if bulk, isBulk := indexer.Repo.(BulkRepo); isBulk {
+		var load BulkLoad
+		if load, err = bulk.BeginBulk(); err != nil {
+			return nil, err
+		}
+		indexer.Repo = load
+		defer func() {
+			indexer.Repo = bulk
+			if err != nil {
+				load.AbortBulk()
+			} else if endErr := load.EndBulk(); endErr != nil {
+				root, err = nil, endErr
+			}
+		}()
+	}
+
+	return indexer.index()
+}
+
+func (indexer *Indexer) index() (Dir, os.Error) {
 	control := make(chan bool)
 	indexer.initWalk()
+	if indexer.err != nil {
+		return nil, indexer.err
+	}
 
 	go func() {
-		filepath.Walk(indexer.Path, indexer, indexer.Errors)
+		FsWalk(indexer.FileSystem, indexer.Path, indexer, indexer.Errors)
 		close(control)
 	}()
 	<-control
 
+	if indexer.err != nil {
+		return nil, indexer.err
+	}
+
 	if indexer.root != nil {
-		indexer.root.UpdateStrong()
+		if _, err := CheckedUpdateStrong(indexer.root); err != nil {
+			return nil, err
+		}
 	}
 
-	return indexer.root
+	return indexer.root, nil
 }
 
 // Build a hierarchical tree model representing a file's contents
 func IndexFile(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
-	var f *os.File
+	return IndexFileWith(path, LocalOptions{})
+}
+
+// Build a hierarchical tree model representing a file's contents
+// like IndexFile, with the given options.
+func IndexFileWith(path string, options LocalOptions) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os.Error) {
 	var buf [BLOCKSIZE]byte
+	fileSys := options.fileSystem()
 
-	stat, err := os.Stat(path)
+	stat, err := fileSys.Stat(path)
 	if stat == nil {
 		return nil, nil, err
 	} else if !stat.IsRegular() {
 		return nil, nil, os.NewError(fmt.Sprintf("%s: not a regular file", path))
 	}
 
-	f, err = os.Open(path)
-	if f == nil {
+	f, err := fileSys.Open(path)
+	if err != nil {
 		return nil, nil, err
 	}
 	defer f.Close()
+	reader := options.IndexLimit.Reader(f)
 
 	_, basename := filepath.Split(path)
 	fileInfo = &FileInfo{
-		Name: basename,
-		Mode: stat.Mode,
-		Size: stat.Size}
+		Name:  basename,
+		Mode:  stat.Mode,
+		Size:  stat.Size,
+		Mtime: stat.Mtime_ns}
 
 	var block *BlockInfo
 	sha1 := sha1.New()
@@ -212,8 +285,14 @@ func IndexFile(path string) (fileInfo *FileInfo, blocksInfo []*BlockInfo, err os
 	blocksInfo = []*BlockInfo{}
 
 	for {
-		switch rd, err := f.Read(buf[:]); true {
-		case rd < 0:
+		// Other filesystems may read less than a block at a time
+		rd, err := io.ReadFull(reader, buf[:])
+		if err == io.ErrUnexpectedEOF || err == os.EOF {
+			err = nil
+		}
+
+		switch {
+		case err != nil:
 			return nil, nil, err
 		case rd == 0:
 			fileInfo.Strong = toHexString(sha1)
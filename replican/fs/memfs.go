@@ -0,0 +1,494 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A FileSystem held in memory, for tests which should not touch the disk.
+// Paths are cleaned and taken from its root, whether they are absolute or
+// not. Created files and directories have permissions as if under a umask
+// of 022, and there are no links.
+type MemFs struct {
+	lock     sync.Mutex
+	entries  map[string]*memEntry
+	lastIno  uint64
+	lastTemp int
+}
+
+type memEntry struct {
+	isDir bool
+	perm  uint32
+	data  []byte
+	mtime int64
+	ino   uint64
+}
+
+const memUmask uint32 = 022
+
+func NewMemFs() *MemFs {
+	memFs := &MemFs{entries: make(map[string]*memEntry)}
+	memFs.entries["/"] = memFs.newEntry(true, 0755)
+	return memFs
+}
+
+func (memFs *MemFs) newEntry(isDir bool, perm uint32) *memEntry {
+	memFs.lastIno++
+	return &memEntry{isDir: isDir, perm: perm & 0777 &^ memUmask,
+		mtime: time.Nanoseconds(), ino: memFs.lastIno}
+}
+
+func memPath(name string) string {
+	return filepath.Join("/", name)
+}
+
+func memPathError(op string, name string, errno int) os.Error {
+	return &os.PathError{Op: op, Path: name, Error: os.Errno(errno)}
+}
+
+func (entry *memEntry) info(path string) *os.FileInfo {
+	info := &os.FileInfo{
+		Name:     filepath.Base(path),
+		Ino:      entry.ino,
+		Nlink:    1,
+		Mode:     entry.perm,
+		Size:     int64(len(entry.data)),
+		Atime_ns: entry.mtime,
+		Mtime_ns: entry.mtime,
+		Ctime_ns: entry.mtime}
+	if entry.isDir {
+		info.Mode |= syscall.S_IFDIR
+	} else {
+		info.Mode |= syscall.S_IFREG
+	}
+	return info
+}
+
+func (entry *memEntry) resize(size int64) {
+	if size <= int64(len(entry.data)) {
+		entry.data = entry.data[:size]
+	} else {
+		entry.data = append(entry.data, make([]byte, size-int64(len(entry.data)))...)
+	}
+	entry.mtime = time.Nanoseconds()
+}
+
+// Check that the parent of a path is a directory. Call with the lock held.
+func (memFs *MemFs) checkParent(op string, name string, path string) os.Error {
+	parent, has := memFs.entries[filepath.Dir(path)]
+	switch {
+	case !has:
+		return memPathError(op, name, syscall.ENOENT)
+	case !parent.isDir:
+		return memPathError(op, name, syscall.ENOTDIR)
+	}
+	return nil
+}
+
+// List the paths beneath a directory. Call with the lock held.
+func (memFs *MemFs) beneath(path string) []string {
+	prefix := path + "/"
+	if path == "/" {
+		prefix = path
+	}
+
+	result := []string{}
+	for other, _ := range memFs.entries {
+		if other != path && strings.HasPrefix(other, prefix) {
+			result = append(result, other)
+		}
+	}
+	return result
+}
+
+func (memFs *MemFs) Open(name string) (Handle, os.Error) {
+	return memFs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (memFs *MemFs) Create(name string) (Handle, os.Error) {
+	return memFs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (memFs *MemFs) OpenFile(name string, flag int, perm uint32) (Handle, os.Error) {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	entry, has := memFs.entries[path]
+	switch {
+	case has && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, syscall.EEXIST)
+	case has && entry.isDir && writable:
+		return nil, memPathError("open", name, syscall.EISDIR)
+	case has:
+		if writable && flag&os.O_TRUNC != 0 {
+			entry.resize(0)
+		}
+	case flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, syscall.ENOENT)
+	default:
+		if err := memFs.checkParent("open", name, path); err != nil {
+			return nil, err
+		}
+		entry = memFs.newEntry(false, perm)
+		memFs.entries[path] = entry
+	}
+
+	return &memHandle{memFs: memFs, name: name, path: path, entry: entry, flag: flag}, nil
+}
+
+func (memFs *MemFs) TempFile(dir string, prefix string) (Handle, os.Error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	for {
+		memFs.lock.Lock()
+		memFs.lastTemp++
+		name := filepath.Join(dir, prefix+strconv.Itoa(memFs.lastTemp))
+		memFs.lock.Unlock()
+
+		fh, err := memFs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if pathErr, isPathErr := err.(*os.PathError); isPathErr && pathErr.Error == os.EEXIST {
+			continue
+		}
+		return fh, err
+	}
+	panic("unreachable")
+}
+
+func (memFs *MemFs) Stat(name string) (*os.FileInfo, os.Error) {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	entry, has := memFs.entries[path]
+	if !has {
+		return nil, memPathError("stat", name, syscall.ENOENT)
+	}
+	return entry.info(path), nil
+}
+
+func (memFs *MemFs) Lstat(name string) (*os.FileInfo, os.Error) {
+	return memFs.Stat(name)
+}
+
+func (memFs *MemFs) ReadDir(name string) ([]*os.FileInfo, os.Error) {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	switch entry, has := memFs.entries[path]; {
+	case !has:
+		return nil, memPathError("open", name, syscall.ENOENT)
+	case !entry.isDir:
+		return nil, memPathError("readdirent", name, syscall.ENOTDIR)
+	}
+
+	names := []string{}
+	for other, _ := range memFs.entries {
+		if other != path && filepath.Dir(other) == path {
+			names = append(names, other)
+		}
+	}
+	sort.SortStrings(names)
+
+	infos := make([]*os.FileInfo, len(names))
+	for i, other := range names {
+		infos[i] = memFs.entries[other].info(other)
+	}
+	return infos, nil
+}
+
+func (memFs *MemFs) Mkdir(name string, perm uint32) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	if _, has := memFs.entries[path]; has {
+		return memPathError("mkdir", name, syscall.EEXIST)
+	}
+	if err := memFs.checkParent("mkdir", name, path); err != nil {
+		return err
+	}
+
+	memFs.entries[path] = memFs.newEntry(true, perm)
+	return nil
+}
+
+func (memFs *MemFs) MkdirAll(name string, perm uint32) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := "/"
+	for _, dirName := range SplitNames(strings.TrimLeft(memPath(name), "/")) {
+		path = filepath.Join(path, dirName)
+		if entry, has := memFs.entries[path]; !has {
+			memFs.entries[path] = memFs.newEntry(true, perm)
+		} else if !entry.isDir {
+			return memPathError("mkdir", name, syscall.ENOTDIR)
+		}
+	}
+	return nil
+}
+
+func (memFs *MemFs) Remove(name string) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	switch _, has := memFs.entries[path]; {
+	case !has:
+		return memPathError("remove", name, syscall.ENOENT)
+	case path == "/":
+		return memPathError("remove", name, syscall.EBUSY)
+	case len(memFs.beneath(path)) > 0:
+		return memPathError("remove", name, syscall.ENOTEMPTY)
+	}
+
+	memFs.entries[path] = nil, false
+	return nil
+}
+
+func (memFs *MemFs) RemoveAll(name string) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	path := memPath(name)
+	if path == "/" {
+		return memPathError("remove", name, syscall.EBUSY)
+	}
+
+	for _, other := range memFs.beneath(path) {
+		memFs.entries[other] = nil, false
+	}
+	memFs.entries[path] = nil, false
+	return nil
+}
+
+func (memFs *MemFs) Rename(oldname string, newname string) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	linkError := func(errno int) os.Error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Error: os.Errno(errno)}
+	}
+
+	oldPath, newPath := memPath(oldname), memPath(newname)
+	entry, has := memFs.entries[oldPath]
+	if !has {
+		return linkError(syscall.ENOENT)
+	} else if oldPath == newPath {
+		return nil
+	} else if oldPath == "/" || strings.HasPrefix(newPath, oldPath+"/") {
+		return linkError(syscall.EINVAL)
+	}
+
+	if parent, has := memFs.entries[filepath.Dir(newPath)]; !has {
+		return linkError(syscall.ENOENT)
+	} else if !parent.isDir {
+		return linkError(syscall.ENOTDIR)
+	}
+
+	if replaced, has := memFs.entries[newPath]; has {
+		switch {
+		case replaced.isDir && !entry.isDir:
+			return linkError(syscall.EISDIR)
+		case !replaced.isDir && entry.isDir:
+			return linkError(syscall.ENOTDIR)
+		case len(memFs.beneath(newPath)) > 0:
+			return linkError(syscall.ENOTEMPTY)
+		}
+	}
+
+	for _, other := range memFs.beneath(oldPath) {
+		memFs.entries[newPath+other[len(oldPath):]] = memFs.entries[other]
+		memFs.entries[other] = nil, false
+	}
+	memFs.entries[newPath] = entry
+	memFs.entries[oldPath] = nil, false
+	return nil
+}
+
+func (memFs *MemFs) Truncate(name string, size int64) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	entry, has := memFs.entries[memPath(name)]
+	switch {
+	case !has:
+		return memPathError("truncate", name, syscall.ENOENT)
+	case entry.isDir:
+		return memPathError("truncate", name, syscall.EISDIR)
+	case size < 0:
+		return memPathError("truncate", name, syscall.EINVAL)
+	}
+
+	entry.resize(size)
+	return nil
+}
+
+func (memFs *MemFs) Chmod(name string, mode uint32) os.Error {
+	memFs.lock.Lock()
+	defer memFs.lock.Unlock()
+
+	entry, has := memFs.entries[memPath(name)]
+	if !has {
+		return memPathError("chmod", name, syscall.ENOENT)
+	}
+	entry.perm = mode & 07777
+	return nil
+}
+
+// A file open on a MemFs. Like an open file on disk, it still refers to
+// the same contents after the file is renamed or removed.
+type memHandle struct {
+	memFs  *MemFs
+	name   string
+	path   string
+	entry  *memEntry
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (fh *memHandle) Name() string { return fh.name }
+
+// What a handle is used for, so that begin can check it is allowed.
+const (
+	memAny = iota
+	memRead
+	memWrite
+)
+
+// Check that the handle can be used, and lock its filesystem if it can.
+func (fh *memHandle) begin(op string, access int) os.Error {
+	fh.memFs.lock.Lock()
+
+	var errno int
+	switch {
+	case fh.closed:
+		errno = syscall.EINVAL
+	case access == memAny:
+		return nil
+	case access == memWrite && fh.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		errno = syscall.EBADF
+	case access == memRead && fh.flag&os.O_WRONLY != 0:
+		errno = syscall.EBADF
+	case fh.entry.isDir:
+		errno = syscall.EISDIR
+	default:
+		return nil
+	}
+
+	fh.memFs.lock.Unlock()
+	return memPathError(op, fh.name, errno)
+}
+
+func (fh *memHandle) end() { fh.memFs.lock.Unlock() }
+
+func (fh *memHandle) Read(buf []byte) (int, os.Error) {
+	n, err := fh.ReadAt(buf, fh.pos)
+	fh.pos += int64(n)
+	return n, err
+}
+
+func (fh *memHandle) ReadAt(buf []byte, off int64) (int, os.Error) {
+	if err := fh.begin("read", memRead); err != nil {
+		return 0, err
+	}
+	defer fh.end()
+
+	if off >= int64(len(fh.entry.data)) {
+		if len(buf) == 0 {
+			return 0, nil
+		}
+		return 0, os.EOF
+	}
+
+	n := copy(buf, fh.entry.data[off:])
+	if n < len(buf) {
+		return n, os.EOF
+	}
+	return n, nil
+}
+
+func (fh *memHandle) Write(buf []byte) (int, os.Error) {
+	if err := fh.begin("write", memWrite); err != nil {
+		return 0, err
+	}
+	defer fh.end()
+
+	if fh.flag&os.O_APPEND != 0 {
+		fh.pos = int64(len(fh.entry.data))
+	}
+	if end := fh.pos + int64(len(buf)); end > int64(len(fh.entry.data)) {
+		fh.entry.resize(end)
+	}
+
+	n := copy(fh.entry.data[fh.pos:], buf)
+	fh.pos += int64(n)
+	fh.entry.mtime = time.Nanoseconds()
+	return n, nil
+}
+
+func (fh *memHandle) Seek(offset int64, whence int) (int64, os.Error) {
+	if err := fh.begin("seek", memAny); err != nil {
+		return 0, err
+	}
+	defer fh.end()
+
+	switch whence {
+	case 1:
+		offset += fh.pos
+	case 2:
+		offset += int64(len(fh.entry.data))
+	}
+	if offset < 0 {
+		return fh.pos, memPathError("seek", fh.name, syscall.EINVAL)
+	}
+
+	fh.pos = offset
+	return fh.pos, nil
+}
+
+func (fh *memHandle) Close() os.Error {
+	fh.memFs.lock.Lock()
+	defer fh.memFs.lock.Unlock()
+
+	if fh.closed {
+		return memPathError("close", fh.name, syscall.EINVAL)
+	}
+	fh.closed = true
+	return nil
+}
+
+func (fh *memHandle) Stat() (*os.FileInfo, os.Error) {
+	if err := fh.begin("stat", memAny); err != nil {
+		return nil, err
+	}
+	defer fh.end()
+
+	return fh.entry.info(fh.path), nil
+}
+
+func (fh *memHandle) Truncate(size int64) os.Error {
+	if err := fh.begin("truncate", memWrite); err != nil {
+		return err
+	}
+	defer fh.end()
+
+	if size < 0 {
+		return memPathError("truncate", fh.name, syscall.EINVAL)
+	}
+	fh.entry.resize(size)
+	return nil
+}
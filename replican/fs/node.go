@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
 )
 
 // Block size used for checksum, comparison, transmitting deltas.
@@ -44,6 +46,60 @@ func RelPath(item FsNode) string {
 	return filepath.Join(parts...)
 }
 
+// Calculate the relative path to a filesystem node, as RelPath does,
+// returning the first failure to read its parents.
+func CheckedRelPath(item FsNode) (string, os.Error) {
+	parts := []string{}
+
+	for fsNode, hasParent := item, true; hasParent; {
+		parts = append([]string{fsNode.Name()}, parts...)
+
+		var err os.Error
+		if fsNode, hasParent, err = ReadParent(fsNode); err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(parts...), nil
+}
+
+// Get the node that contains a node, returning a failure to read it
+// if the node's repo is a CheckedRepo.
+func ReadParent(node Node) (FsNode, bool, os.Error) {
+	if repo, isChecked := node.Repo().(CheckedRepo); isChecked {
+		return repo.ParentOf(node)
+	}
+	parent, hasParent := node.Parent()
+	return parent, hasParent, nil
+}
+
+// Get the subdirectories of a directory, returning a failure to read
+// them if the directory's repo is a CheckedRepo.
+func ReadSubDirs(dir Dir) ([]Dir, os.Error) {
+	if repo, isChecked := dir.Repo().(CheckedRepo); isChecked {
+		return repo.SubdirsOf(dir)
+	}
+	return dir.SubDirs(), nil
+}
+
+// Get the files in a directory, returning a failure to read them if the
+// directory's repo is a CheckedRepo.
+func ReadFiles(dir Dir) ([]File, os.Error) {
+	if repo, isChecked := dir.Repo().(CheckedRepo); isChecked {
+		return repo.FilesOf(dir)
+	}
+	return dir.Files(), nil
+}
+
+// Get the blocks of a file, returning a failure to read them if the
+// file's repo is a CheckedRepo.
+func ReadBlocks(file File) ([]Block, os.Error) {
+	if repo, isChecked := file.Repo().(CheckedRepo); isChecked {
+		return repo.BlocksOf(file)
+	}
+	return file.Blocks(), nil
+}
+
 type Block interface {
 	Node
 
@@ -95,6 +151,10 @@ type FileInfo struct {
 	Size   int64
 	Strong string
 	Parent string
+
+	// When the file was last modified, in nanoseconds, or 0 if unknown.
+	// It is not part of the file's strong checksum.
+	Mtime int64
 }
 
 type Files struct {
@@ -123,6 +183,10 @@ type Dir interface {
 	Files() []File
 
 	UpdateStrong() string
+
+	// Recalculate the strong checksum from the current strong checksums
+	// of the directory's children, without descending into them.
+	UpdateShallowStrong() string
 }
 
 // Represent a directory in a hierarchical tree model.
@@ -149,29 +213,128 @@ func (dirs *Dirs) Swap(i, j int) {
 	dirs.Contents[i], dirs.Contents[j] = dirs.Contents[j], dirs.Contents[i]
 }
 
-// Calculate the strong checksum of a directory.
-func CalcStrong(dir Dir) string {
+// Calculate the strong checksum of a directory, returning the first
+// failure to read the tree beneath it.
+func CalcStrong(dir Dir) (string, os.Error) {
+	return calcStrong(dir, true)
+}
+
+// Calculate the strong checksum of a directory, trusting the strong
+// checksums its subdirectories already have.
+func CalcShallowStrong(dir Dir) (string, os.Error) {
+	return calcStrong(dir, false)
+}
+
+func calcStrong(dir Dir, deep bool) (string, os.Error) {
+	subdirs, err := ReadSubDirs(dir)
+	if err != nil {
+		return "", err
+	}
+	files, err := ReadFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	subdirStrongs := make(map[string]string)
+	for _, subdir := range subdirs {
+		strong := subdir.Info().Strong
+		if deep {
+			if strong, err = CheckedUpdateStrong(subdir); err != nil {
+				return "", err
+			}
+		}
+		subdirStrongs[subdir.Name()] = strong
+	}
+	fileStrongs := make(map[string]string)
+	for _, file := range files {
+		fileStrongs[file.Name()] = file.Info().Strong
+	}
+
+	return ContentsStrong(subdirStrongs, fileStrongs), nil
+}
+
+// Calculate the strong checksum of a directory from the strong checksums
+// of the subdirectories and files it contains, keyed by name. For repos
+// which recalculate strong checksums while they hold a lock, and so
+// cannot read the directory's contents through its nodes.
+//
+// Represents the directory's contents as a byte array, inspired by git.
+// Entries are ordered by name, as they would be when freshly indexed,
+// however they were added to the repo.
+func ContentsStrong(subdirs map[string]string, files map[string]string) string {
+	buf := bytes.NewBufferString("")
+	for _, name := range sortedNames(subdirs) {
+		fmt.Fprintf(buf, "%s\td\t%s\n", subdirs[name], name)
+	}
+	for _, name := range sortedNames(files) {
+		fmt.Fprintf(buf, "%s\tf\t%s\n", files[name], name)
+	}
+
 	var sha1 = sha1.New()
-	//	s := reprDir(dir)
-	//	fmt.Printf("%s\n", s)
-	//	sha1.Write(s)
-	sha1.Write(reprDir(dir))
+	sha1.Write(buf.Bytes())
 	return toHexString(sha1)
 }
 
-// Represent the directory's distinct deep contents as a byte array.
-// Inspired by git.
-func reprDir(dir Dir) []byte {
-	buf := bytes.NewBufferString("")
+func sortedNames(strongs map[string]string) []string {
+	names := make([]string, 0, len(strongs))
+	for name, _ := range strongs {
+		names = append(names, name)
+	}
+	sort.SortStrings(names)
+	return names
+}
+
+// Recalculate and store the strong checksum of a directory, as
+// UpdateStrong does, returning the first failure to read or store the
+// tree if the directory's repo is a CheckedRepo.
+func CheckedUpdateStrong(dir Dir) (string, os.Error) {
+	return checkedUpdateStrong(dir, true)
+}
+
+// Recalculate and store the strong checksum of a directory from those
+// of its children, as UpdateShallowStrong does, returning the first
+// failure to read or store the tree if the directory's repo is a
+// CheckedRepo.
+func CheckedUpdateShallowStrong(dir Dir) (string, os.Error) {
+	return checkedUpdateStrong(dir, false)
+}
+
+func checkedUpdateStrong(dir Dir, deep bool) (string, os.Error) {
+	repo, isChecked := dir.Repo().(CheckedRepo)
+	if !isChecked {
+		if deep {
+			return dir.UpdateStrong(), nil
+		}
+		return dir.UpdateShallowStrong(), nil
+	}
 
-	for _, subdir := range dir.SubDirs() {
-		fmt.Fprintf(buf, "%s\td\t%s\n", subdir.UpdateStrong(), subdir.Name())
+	strong, err := calcStrong(dir, deep)
+	if err != nil {
+		return "", err
 	}
-	for _, file := range dir.Files() {
-		fmt.Fprintf(buf, "%s\tf\t%s\n", file.Info().Strong, file.Name())
+	if err = repo.SetStrong(dir, strong); err != nil {
+		return "", err
 	}
+	return strong, nil
+}
+
+// Recalculate the strong checksums of dir and each directory above it,
+// after a change to the contents of dir. Stops at the first failure to
+// read or store the tree, and returns it.
+func UpdateStrongsToRoot(dir Dir) os.Error {
+	for node, hasParent := FsNode(dir), true; hasParent; {
+		if parent, isDir := node.(Dir); isDir {
+			if _, err := CheckedUpdateShallowStrong(parent); err != nil {
+				return err
+			}
+		}
 
-	return buf.Bytes()
+		var err os.Error
+		if node, hasParent, err = ReadParent(node); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func Lookup(dir Dir, relpath string) (fsNode FsNode, hasItem bool) {
@@ -203,9 +366,91 @@ func Lookup(dir Dir, relpath string) (fsNode FsNode, hasItem bool) {
 	return cwd, true
 }
 
+// Look up a relative path beneath a directory, as Lookup does, returning
+// the first failure to read the directories along it. A path which is not
+// there is not an error.
+func CheckedLookup(dir Dir, relpath string) (FsNode, bool, os.Error) {
+	parts := SplitNames(relpath)
+	cwd := dir
+
+	for i, l := 0, len(parts); i < l; i++ {
+		if i == l-1 {
+			files, err := ReadFiles(cwd)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, file := range files {
+				if file.Name() == parts[i] {
+					return file, true, nil
+				}
+			}
+		}
+
+		subdirs, err := ReadSubDirs(cwd)
+		if err != nil {
+			return nil, false, err
+		}
+		hasSubdir := false
+		for _, subdir := range subdirs {
+			if subdir.Name() == parts[i] {
+				cwd = subdir
+				hasSubdir = true
+				break
+			}
+		}
+		if !hasSubdir {
+			return nil, false, nil
+		}
+	}
+
+	return cwd, true, nil
+}
+
 // Visitor function to traverse a hierarchical tree model.
 type NodeVisitor func(Node) bool
 
+// Traverse the hierarchical tree model with a user-defined NodeVisitor
+// function, as Walk does, stopping at the first failure to read the
+// tree and returning it.
+func CheckedWalk(node Node, visitor NodeVisitor) os.Error {
+	nodestack := []Node{}
+	nodestack = append(nodestack, node)
+
+	for len(nodestack) > 0 {
+		current := nodestack[0]
+		nodestack = nodestack[1:]
+		if visitor(current) {
+
+			if dir, isDir := current.(Dir); isDir {
+				subdirs, err := ReadSubDirs(dir)
+				if err != nil {
+					return err
+				}
+				for _, subdir := range subdirs {
+					nodestack = append(nodestack, subdir)
+				}
+				files, err := ReadFiles(dir)
+				if err != nil {
+					return err
+				}
+				for _, file := range files {
+					nodestack = append(nodestack, file)
+				}
+			} else if file, isFile := current.(File); isFile {
+				blocks, err := ReadBlocks(file)
+				if err != nil {
+					return err
+				}
+				for _, block := range blocks {
+					nodestack = append(nodestack, block)
+				}
+			}
+
+		}
+	}
+	return nil
+}
+
 // Traverse the hierarchical tree model with a user-defined NodeVisitor function.
 func Walk(node Node, visitor NodeVisitor) {
 	nodestack := []Node{}
@@ -232,3 +477,98 @@ func Walk(node Node, visitor NodeVisitor) {
 		}
 	}
 }
+
+// Copy the hierarchical tree model beneath node into another repository,
+// where it becomes the new root. A directory copied this way is given
+// an empty name, just like the root directory of an index, so that
+// relative paths in the copy begin beneath it.
+func CopyTree(node FsNode, repo NodeRepo) (FsNode, os.Error) {
+	if dir, isDir := node.(Dir); isDir {
+		info := *dir.Info()
+		info.Name = ""
+		info.Parent = ""
+		root, err := repo.AddDir(nil, &info)
+		if err != nil {
+			return nil, err
+		}
+		return root, copySubtree(dir, root, repo)
+	} else if file, isFile := node.(File); isFile {
+		copied, err := copyFile(file, nil, repo)
+		if err != nil {
+			return nil, err
+		}
+		return copied, nil
+	}
+	return nil, nil
+}
+
+// Copy the hierarchical tree model beneath node into another repository,
+// placing it within the directory parent. The strong checksums of parent
+// and the directories above it are not updated.
+func CopyInto(node FsNode, parent Dir, repo NodeRepo) (FsNode, os.Error) {
+	if dir, isDir := node.(Dir); isDir {
+		info := *dir.Info()
+		info.Parent = parent.Info().Strong
+		subdir, err := repo.AddDir(parent, &info)
+		if err != nil {
+			return nil, err
+		}
+		return subdir, copySubtree(dir, subdir, repo)
+	} else if file, isFile := node.(File); isFile {
+		copied, err := copyFile(file, parent, repo)
+		if err != nil {
+			return nil, err
+		}
+		return copied, nil
+	}
+	return nil, nil
+}
+
+func copySubtree(src Dir, dst Dir, repo NodeRepo) os.Error {
+	srcSubdirs, err := ReadSubDirs(src)
+	if err != nil {
+		return err
+	}
+	for _, srcSubdir := range srcSubdirs {
+		info := *srcSubdir.Info()
+		info.Parent = dst.Info().Strong
+		dstSubdir, err := repo.AddDir(dst, &info)
+		if err != nil {
+			return err
+		}
+		if err = copySubtree(srcSubdir, dstSubdir, repo); err != nil {
+			return err
+		}
+	}
+
+	srcFiles, err := ReadFiles(src)
+	if err != nil {
+		return err
+	}
+	for _, srcFile := range srcFiles {
+		if _, err := copyFile(srcFile, dst, repo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src File, dst Dir, repo NodeRepo) (File, os.Error) {
+	info := *src.Info()
+	info.Parent = ""
+	if dst != nil {
+		info.Parent = dst.Info().Strong
+	}
+
+	blocks, err := ReadBlocks(src)
+	if err != nil {
+		return nil, err
+	}
+	blocksInfo := []*BlockInfo{}
+	for _, block := range blocks {
+		blockInfo := *block.Info()
+		blocksInfo = append(blocksInfo, &blockInfo)
+	}
+
+	return repo.AddFile(dst, &info, blocksInfo)
+}
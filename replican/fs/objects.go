@@ -0,0 +1,465 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Maximum size of a packfile before a new one is started.
+const PACKSIZE int64 = 64 * 1024 * 1024
+
+const packPrefix string = "pack-"
+const packDataSuffix string = ".dat"
+const packIndexSuffix string = ".idx"
+
+// Location of a block's bytes within a packfile.
+type objectLoc struct {
+	pack   int
+	offset int64
+	length int64
+}
+
+// Packfiles of deduplicated block contents, shared by all views of an ObjectStore.
+//
+// Block contents are appended to the current packfile, and an entry recording
+// the block's strong checksum, offset and length is appended to the pack's index.
+// A block that was written without its index entry is simply unreachable.
+//
+// When the packs are encrypted, the index is keyed by block address rather
+// than strong checksum, and each block is stored sealed.
+//
+// The packs may be used from several goroutines at once. Exported methods
+// hold the mutex; unexported methods expect it to be held already.
+type objectPacks struct {
+	mutex sync.Mutex
+
+	rootPath string
+	index    map[string]*objectLoc
+	readers  map[int]*os.File
+	keys     *Keys
+
+	pack     int
+	packSize int64
+	data     *os.File
+	idx      *os.File
+}
+
+// A BlockStore that keeps its own copy of block contents in a local
+// object directory, keyed by strong checksum. Trees backed up into an
+// ObjectStore can be restored after the original files have changed,
+// using the ObjectStore as the source of a PatchPlan.
+type ObjectStore struct {
+	*objectPacks
+	repo NodeRepo
+}
+
+// Open an object directory, creating it if necessary.
+// The repo provides the hierarchical tree model of the contents to be
+// read through this store. It may be nil if the store is only written to.
+func NewObjectStore(rootPath string, repo NodeRepo) (*ObjectStore, os.Error) {
+	return NewEncryptedObjectStore(rootPath, repo, nil)
+}
+
+// Open an object directory whose blocks are encrypted with keys, creating
+// it if necessary. Without keys, the blocks are stored as they are.
+// An object directory must always be opened with the keys it was
+// created with.
+func NewEncryptedObjectStore(rootPath string, repo NodeRepo, keys *Keys) (*ObjectStore, os.Error) {
+	if err := os.MkdirAll(rootPath, 0755); err != nil {
+		return nil, err
+	}
+
+	packs := &objectPacks{
+		rootPath: rootPath,
+		index:    make(map[string]*objectLoc),
+		readers:  make(map[int]*os.File),
+		keys:     keys}
+	if err := packs.load(); err != nil {
+		return nil, err
+	}
+
+	return &ObjectStore{objectPacks: packs, repo: repo}, nil
+}
+
+// Get a view of the same objects, described by a different tree model.
+func (store *ObjectStore) WithRepo(repo NodeRepo) *ObjectStore {
+	return &ObjectStore{objectPacks: store.objectPacks, repo: repo}
+}
+
+func (store *ObjectStore) Repo() NodeRepo { return store.repo }
+
+func (packs *objectPacks) RootPath() string { return packs.rootPath }
+
+// Get the key a block is indexed by, from its strong checksum.
+func (packs *objectPacks) address(strong string) string {
+	if packs.keys == nil {
+		return strong
+	}
+	return packs.keys.Address(strong)
+}
+
+func (packs *objectPacks) packPath(pack int, suffix string) string {
+	return filepath.Join(packs.rootPath, fmt.Sprintf("%s%08d%s", packPrefix, pack, suffix))
+}
+
+// Read all pack indexes into memory.
+func (packs *objectPacks) load() os.Error {
+	dir, err := os.Open(packs.rootPath)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(0)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		suffix := filepath.Ext(name)
+		if !strings.HasPrefix(name, packPrefix) ||
+			(suffix != packIndexSuffix && suffix != packDataSuffix) {
+			continue
+		}
+
+		pack, err := strconv.Atoi(name[len(packPrefix) : len(name)-len(suffix)])
+		if err != nil {
+			continue
+		}
+
+		// Packfile data left without its index by a crash is unreachable,
+		// but its number is still taken.
+		if pack > packs.pack {
+			packs.pack = pack
+		}
+
+		if suffix == packIndexSuffix {
+			if err = packs.loadIndex(pack); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (packs *objectPacks) loadIndex(pack int) os.Error {
+	fh, err := os.Open(packs.packPath(pack, packIndexSuffix))
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	rd := bufio.NewReader(fh)
+	for {
+		line, err := rd.ReadString('\n')
+		if err == os.EOF {
+			// An unterminated last entry was torn by a crash while it was
+			// written, and its block is unreachable.
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var address string
+		loc := &objectLoc{pack: pack}
+		if _, err = fmt.Sscanf(line, "%s %d %d\n", &address, &loc.offset, &loc.length); err != nil {
+			return os.NewError(fmt.Sprintf("Corrupt pack index %d: %v", pack, err))
+		}
+		packs.index[address] = loc
+	}
+	panic("Impossible")
+}
+
+// Test if a block with the given strong checksum is stored.
+func (packs *objectPacks) HasBlock(strong string) bool {
+	packs.mutex.Lock()
+	defer packs.mutex.Unlock()
+
+	_, has := packs.index[packs.address(strong)]
+	return has
+}
+
+// Store the contents of a block, unless an identical block is already present.
+// Returns the strong checksum of the block.
+func (packs *objectPacks) PutBlock(buf []byte) (string, os.Error) {
+	packs.mutex.Lock()
+	defer packs.mutex.Unlock()
+
+	return packs.putBlock(buf)
+}
+
+func (packs *objectPacks) putBlock(buf []byte) (strong string, err os.Error) {
+	strong = StrongChecksum(buf)
+	address := packs.address(strong)
+	if _, has := packs.index[address]; has {
+		return strong, nil
+	}
+
+	if packs.keys != nil {
+		if buf, err = packs.keys.Seal(buf); err != nil {
+			return "", err
+		}
+	}
+
+	if packs.data == nil || packs.packSize+int64(len(buf)) > PACKSIZE {
+		if err = packs.nextPack(); err != nil {
+			return "", err
+		}
+	}
+
+	loc := &objectLoc{pack: packs.pack, offset: packs.packSize, length: int64(len(buf))}
+	if _, err = packs.data.Write(buf); err != nil {
+		return "", err
+	}
+	packs.packSize += loc.length
+
+	if _, err = fmt.Fprintf(packs.idx, "%s %d %d\n", address, loc.offset, loc.length); err != nil {
+		return "", err
+	}
+
+	packs.index[address] = loc
+	return strong, nil
+}
+
+// Close the current pack, and start a new one.
+func (packs *objectPacks) nextPack() (err os.Error) {
+	packs.closePack()
+	packs.pack++
+	packs.packSize = 0
+
+	packs.data, err = os.OpenFile(packs.packPath(packs.pack, packDataSuffix),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	packs.idx, err = os.OpenFile(packs.packPath(packs.pack, packIndexSuffix),
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	return err
+}
+
+func (packs *objectPacks) closePack() {
+	if packs.data != nil {
+		packs.data.Close()
+		packs.data = nil
+	}
+	if packs.idx != nil {
+		packs.idx.Close()
+		packs.idx = nil
+	}
+}
+
+// Close all open packfiles.
+func (packs *objectPacks) Close() {
+	packs.mutex.Lock()
+	defer packs.mutex.Unlock()
+
+	packs.closePack()
+	for pack, fh := range packs.readers {
+		fh.Close()
+		packs.readers[pack] = nil, false
+	}
+}
+
+func (packs *objectPacks) ReadBlock(strong string) ([]byte, os.Error) {
+	packs.mutex.Lock()
+	defer packs.mutex.Unlock()
+
+	address := packs.address(strong)
+	if _, has := packs.index[address]; !has {
+		return nil, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s not found", strong))
+	}
+
+	buf, err := packs.readObject(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// A sealed block is authentic, but may be stored under another's address
+	if packs.keys != nil && StrongChecksum(buf) != strong {
+		return nil, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s is corrupt", strong))
+	}
+
+	return buf, nil
+}
+
+// Read the contents of the block stored at an address, checking that
+// they are intact.
+func (packs *objectPacks) readObject(address string) ([]byte, os.Error) {
+	loc, has := packs.index[address]
+	if !has {
+		return nil, os.NewError(fmt.Sprintf("Block at %s not found", address))
+	}
+
+	fh, has := packs.readers[loc.pack]
+	if !has {
+		var err os.Error
+		if fh, err = os.Open(packs.packPath(loc.pack, packDataSuffix)); err != nil {
+			return nil, err
+		}
+		packs.readers[loc.pack] = fh
+	}
+
+	buf := make([]byte, loc.length)
+	if _, err := fh.ReadAt(buf, loc.offset); err != nil {
+		return nil, err
+	}
+
+	if packs.keys != nil {
+		plain, err := packs.keys.Open(buf)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("Block at %s: %v", address, err))
+		}
+		return plain, nil
+	}
+
+	if StrongChecksum(buf) != address {
+		return nil, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s is corrupt", address))
+	}
+
+	return buf, nil
+}
+
+func (store *ObjectStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	file, has, err := store.repo.File(strong)
+	if err != nil {
+		return 0, err
+	} else if !has {
+		return 0,
+			os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	contents, err := ReadBlocks(file)
+	if err != nil {
+		return 0, err
+	}
+	blocks := &Blocks{Contents: contents}
+	sort.Sort(blocks)
+
+	to := from + length
+	written := int64(0)
+	for _, block := range blocks.Contents {
+		blockFrom := block.Info().Offset()
+		blockTo := blockFrom + int64(BLOCKSIZE)
+		if blockTo > file.Info().Size {
+			blockTo = file.Info().Size
+		}
+		if blockTo <= from || blockFrom >= to {
+			continue
+		}
+
+		buf, err := store.ReadBlock(block.Info().Strong)
+		if err != nil {
+			return written, err
+		}
+
+		start, end := int64(0), int64(len(buf))
+		if from > blockFrom {
+			start = from - blockFrom
+		}
+		if to < blockTo {
+			end = to - blockFrom
+		}
+
+		n, err := writer.Write(buf[start:end])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if written < length {
+		return written, io.ErrUnexpectedEOF
+	}
+	return written, nil
+}
+
+// Copy the contents of every file in a source store's tree into this store.
+// Files whose blocks are all present already are not read.
+func (store *ObjectStore) Backup(src BlockStore) (err os.Error) {
+	root, err := src.Repo().Root()
+	if err != nil {
+		return err
+	}
+
+	walkErr := CheckedWalk(root, func(node Node) bool {
+		if err != nil {
+			return false
+		}
+
+		file, isFile := node.(File)
+		if !isFile {
+			_, isDir := node.(Dir)
+			return isDir
+		}
+
+		var has bool
+		if has, err = store.hasFile(file); has || err != nil {
+			return false
+		}
+
+		writer := &blockWriter{packs: store.objectPacks, buf: &bytes.Buffer{}}
+		if _, err = src.ReadInto(file.Info().Strong, 0, file.Info().Size, writer); err == nil {
+			err = writer.flush()
+		}
+		return false
+	})
+	if err == nil {
+		err = walkErr
+	}
+	return err
+}
+
+// Test if all the blocks of a file are stored. A file which is not empty
+// but has no blocks has not been indexed completely, and is not stored.
+func (store *ObjectStore) hasFile(file File) (bool, os.Error) {
+	blocks, err := ReadBlocks(file)
+	if err != nil {
+		return false, err
+	}
+	if len(blocks) == 0 && file.Info().Size > 0 {
+		return false, nil
+	}
+
+	for _, block := range blocks {
+		if !store.HasBlock(block.Info().Strong) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Split a stream of file contents into blocks, and store them.
+type blockWriter struct {
+	packs *objectPacks
+	buf   *bytes.Buffer
+}
+
+func (writer *blockWriter) Write(p []byte) (int, os.Error) {
+	n, _ := writer.buf.Write(p)
+	for writer.buf.Len() >= BLOCKSIZE {
+		if _, err := writer.packs.PutBlock(writer.buf.Next(BLOCKSIZE)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (writer *blockWriter) flush() os.Error {
+	if writer.buf.Len() > 0 {
+		_, err := writer.packs.PutBlock(writer.buf.Next(writer.buf.Len()))
+		return err
+	}
+	return nil
+}
@@ -2,30 +2,121 @@ package fs
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 )
 
+// A repository of hierarchical tree models, with lookups by checksum.
+//
+// Implementations are safe for concurrent use by multiple goroutines,
+// so a tree may be read while another goroutine indexes into it. Each
+// call is atomic, but a sequence of calls is not: a reader walking a
+// tree during a write may see parts of the tree from before the write
+// and parts from after it. Writers changing the same part of the tree at
+// once may leave the strong checksums of common ancestors out of date,
+// until UpdateStrong is called on them.
+//
+// Repository methods return an error when the storage behind the repo
+// fails. A lookup which finds nothing is not an error; it reports that
+// nothing was found. Node methods cannot return errors, and return what
+// they can read.
 type NodeRepo interface {
-	Root() FsNode
+	// The root of the tree, or nil if the repo is empty.
+	Root() (FsNode, os.Error)
 
-	WeakBlock(weak int) (Block, bool)
+	WeakBlock(weak int) (Block, bool, os.Error)
 
-	Block(strong string) (Block, bool)
+	Block(strong string) (Block, bool, os.Error)
 
-	File(strong string) (File, bool)
+	File(strong string) (File, bool, os.Error)
 
-	Dir(strong string) (Dir, bool)
+	Dir(strong string) (Dir, bool, os.Error)
 
-	AddBlock(file File, blockInfo *BlockInfo) Block
+	AddBlock(file File, blockInfo *BlockInfo) (Block, os.Error)
 
-	AddFile(dir Dir, fileInfo *FileInfo, blocksInfo []*BlockInfo) File
+	AddFile(dir Dir, fileInfo *FileInfo, blocksInfo []*BlockInfo) (File, os.Error)
 
-	AddDir(dir Dir, subdirInfo *DirInfo) Dir
+	AddDir(dir Dir, subdirInfo *DirInfo) (Dir, os.Error)
+
+	// Remove a block from its file.
+	// The file's strong checksum is left as it was.
+	RemoveBlock(block Block) os.Error
+
+	// Remove a file and all of its blocks, and recalculate the
+	// strong checksums of the directories above it.
+	RemoveFile(file File) os.Error
+
+	// Remove a directory and everything beneath it, and recalculate
+	// the strong checksums of the directories above it.
+	RemoveDir(dir Dir) os.Error
+
+	// Replace the contents of a file, keeping its name and place in the tree,
+	// and recalculate the strong checksums of the directories above it.
+	UpdateFile(file File, fileInfo *FileInfo, blocksInfo []*BlockInfo) (File, os.Error)
+
+	// Move a file or directory into dir, giving it a new name, and
+	// recalculate the strong checksums of the directories above both
+	// its old and new places.
+	Rename(node FsNode, dir Dir, name string) (FsNode, os.Error)
 
 	Close()
 
 	IndexFilter() IndexFilter
 }
 
+// A NodeRepo which can add many nodes at once more cheaply than
+// it can add them one at a time. The Indexer makes its additions through
+// the BulkLoad returned by BeginBulk when its repo is a BulkRepo, and
+// brackets them with EndBulk, or AbortBulk if indexing fails.
+//
+// Changes made through the repo itself wait until the load ends, so that
+// an aborted load discards nothing but its own additions. Reads do not
+// wait, and see the additions as they are made.
+// Lookups by checksum may be slower during a bulk load, but they still
+// find what was added.
+type BulkRepo interface {
+	NodeRepo
+
+	// Prepare for many additions, and get the repo to make them through.
+	// Waits for any other bulk load to end first.
+	BeginBulk() (BulkLoad, os.Error)
+}
+
+// The repo of a bulk load in progress. Loads may nest: calling BeginBulk
+// on a load returns the same load, only the outermost EndBulk completes
+// it, and an AbortBulk at any depth discards all of it.
+type BulkLoad interface {
+	BulkRepo
+
+	// Complete the additions made since the matching BeginBulk.
+	EndBulk() os.Error
+
+	// Discard the additions made since the outermost BeginBulk.
+	AbortBulk() os.Error
+}
+
+// A NodeRepo whose storage can fail while nodes are read from it, as a
+// database can. Node methods log such failures and return what they
+// could read; the methods of a CheckedRepo return them instead. The
+// Checked functions and the Read functions use them, where a repo has them,
+// and are what this package and its users read trees with.
+type CheckedRepo interface {
+	NodeRepo
+
+	ParentOf(node Node) (FsNode, bool, os.Error)
+
+	SubdirsOf(dir Dir) ([]Dir, os.Error)
+
+	FilesOf(dir Dir) ([]File, os.Error)
+
+	BlocksOf(file File) ([]Block, os.Error)
+
+	// Store a directory's new strong checksum.
+	SetStrong(dir Dir, strong string) os.Error
+}
+
 type memBlock struct {
 	info   *BlockInfo
 	repo   *MemRepo
@@ -53,19 +144,27 @@ type memFile struct {
 }
 
 func (file *memFile) Parent() (FsNode, bool) {
+	file.repo.mutex.RLock()
+	defer file.repo.mutex.RUnlock()
 	dir, is := file.parent.(*memDir)
 	return dir, is
 }
 
 func (file *memFile) Info() *FileInfo {
+	file.repo.mutex.RLock()
+	defer file.repo.mutex.RUnlock()
 	return file.info
 }
 
 func (file *memFile) Name() string {
+	file.repo.mutex.RLock()
+	defer file.repo.mutex.RUnlock()
 	return file.info.Name
 }
 
 func (file *memFile) Mode() uint32 {
+	file.repo.mutex.RLock()
+	defer file.repo.mutex.RUnlock()
 	return file.info.Mode
 }
 
@@ -74,7 +173,9 @@ func (file *memFile) Repo() NodeRepo {
 }
 
 func (file *memFile) Blocks() []Block {
-	return file.blocks
+	file.repo.mutex.RLock()
+	defer file.repo.mutex.RUnlock()
+	return append([]Block{}, file.blocks...)
 }
 
 type memDir struct {
@@ -86,19 +187,27 @@ type memDir struct {
 }
 
 func (dir *memDir) Parent() (FsNode, bool) {
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
 	parentDir, is := dir.parent.(*memDir)
 	return parentDir, is
 }
 
 func (dir *memDir) Info() *DirInfo {
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
 	return dir.info
 }
 
 func (dir *memDir) Name() string {
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
 	return dir.info.Name
 }
 
 func (dir *memDir) Mode() uint32 {
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
 	return dir.info.Mode
 }
 
@@ -107,96 +216,420 @@ func (dir *memDir) Repo() NodeRepo {
 }
 
 func (dir *memDir) Files() []File {
-	return dir.files
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
+	return append([]File{}, dir.files...)
 }
 
 func (dir *memDir) SubDirs() []Dir {
-	return dir.subdirs
+	dir.repo.mutex.RLock()
+	defer dir.repo.mutex.RUnlock()
+	return append([]Dir{}, dir.subdirs...)
+}
+
+// Test if the directory has a node other than node with the given name.
+// Expects the mutex to be held.
+func (dir *memDir) hasOther(name string, node FsNode) bool {
+	for _, file := range dir.files {
+		if mfile := file.(*memFile); mfile.info.Name == name && FsNode(mfile) != node {
+			return true
+		}
+	}
+	for _, subdir := range dir.subdirs {
+		if mdir := subdir.(*memDir); mdir.info.Name == name && FsNode(mdir) != node {
+			return true
+		}
+	}
+	return false
 }
 
+// Reading a MemRepo cannot fail, so neither can calculating its strong
+// checksums.
 func (dir *memDir) UpdateStrong() string {
-	newStrong := CalcStrong(dir)
+	strong, _ := CalcStrong(dir)
+	return dir.setStrong(strong)
+}
+
+func (dir *memDir) UpdateShallowStrong() string {
+	strong, _ := CalcShallowStrong(dir)
+	return dir.setStrong(strong)
+}
+
+func (dir *memDir) setStrong(newStrong string) string {
+	dir.repo.mutex.Lock()
+	defer dir.repo.mutex.Unlock()
+
+	return dir.storeStrong(newStrong)
+}
+
+// Expects the mutex to be held.
+func (dir *memDir) storeStrong(newStrong string) string {
 	if newStrong != dir.info.Strong {
-		dir.repo.dirs[dir.info.Strong] = nil, false
-		dir.repo.dirs[newStrong] = dir
-		dir.info.Strong = newStrong
+		dir.repo.dirs.remove(dir.info.Strong, dir)
+		dir.repo.dirs.add(newStrong, dir)
+
+		info := *dir.info
+		info.Strong = newStrong
+		dir.info = &info
 	}
 	return newStrong
 }
 
+// A lookup map from checksum to all the nodes which have it.
+// The most recently added node is the one found by a lookup.
+type nodeMap map[string][]Node
+
+// Weak checksums are looked up by their decimal string.
+func weakKey(weak int) string {
+	return strconv.Itoa(weak)
+}
+
+func (m nodeMap) add(key string, node Node) {
+	m[key] = append(m[key], node)
+}
+
+func (m nodeMap) get(key string) (Node, bool) {
+	if nodes, has := m[key]; has {
+		return nodes[len(nodes)-1], true
+	}
+	return nil, false
+}
+
+func (m nodeMap) remove(key string, node Node) {
+	nodes := m[key]
+	for i := range nodes {
+		if nodes[i] == node {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			break
+		}
+	}
+	if len(nodes) == 0 {
+		m[key] = nil, false
+	} else {
+		m[key] = nodes
+	}
+}
+
+// A NodeRepo held in memory.
+//
+// Nodes are updated by replacing their info rather than modifying it,
+// so the info returned by a node's Info method never changes.
 type MemRepo struct {
-	blocks     map[string]*memBlock
-	files      map[string]*memFile
-	dirs       map[string]*memDir
-	weakBlocks map[int]*memBlock
+	blocks     nodeMap
+	files      nodeMap
+	dirs       nodeMap
+	weakBlocks nodeMap
 	root       FsNode
+	nTmp       int
+
+	// Guards the lookups, the root and the fields of every node.
+	// Unexported methods expect it to be held.
+	mutex sync.RWMutex
 }
 
 func NewMemRepo() *MemRepo {
 	return &MemRepo{
-		blocks:     make(map[string]*memBlock),
-		files:      make(map[string]*memFile),
-		dirs:       make(map[string]*memDir),
-		weakBlocks: make(map[int]*memBlock)}
+		blocks:     make(nodeMap),
+		files:      make(nodeMap),
+		dirs:       make(nodeMap),
+		weakBlocks: make(nodeMap)}
+}
+
+func (repo *MemRepo) Root() (FsNode, os.Error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+	return repo.root, nil
+}
+
+func (repo *MemRepo) WeakBlock(weak int) (Block, bool, os.Error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	if block, has := repo.weakBlocks.get(weakKey(weak)); has {
+		return block.(*memBlock), true, nil
+	}
+	return nil, false, nil
 }
 
-func (repo *MemRepo) Root() FsNode { return repo.root }
+func (repo *MemRepo) Block(strong string) (Block, bool, os.Error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
 
-func (repo *MemRepo) WeakBlock(weak int) (block Block, has bool) {
-	block, has = repo.weakBlocks[weak]
-	return block, has
+	if block, has := repo.blocks.get(strong); has {
+		return block.(*memBlock), true, nil
+	}
+	return nil, false, nil
 }
 
-func (repo *MemRepo) Block(strong string) (block Block, has bool) {
-	block, has = repo.blocks[strong]
-	return block, has
+func (repo *MemRepo) File(strong string) (File, bool, os.Error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	if file, has := repo.files.get(strong); has {
+		return file.(*memFile), true, nil
+	}
+	return nil, false, nil
 }
 
-func (repo *MemRepo) File(strong string) (file File, has bool) {
-	file, has = repo.files[strong]
-	return file, has
+func (repo *MemRepo) Dir(strong string) (Dir, bool, os.Error) {
+	repo.mutex.RLock()
+	defer repo.mutex.RUnlock()
+
+	if dir, has := repo.dirs.get(strong); has {
+		return dir.(*memDir), true, nil
+	}
+	return nil, false, nil
 }
 
-func (repo *MemRepo) Dir(strong string) (dir Dir, has bool) {
-	dir, has = repo.dirs[strong]
-	return dir, has
+func (repo *MemRepo) AddBlock(file File, info *BlockInfo) (Block, os.Error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	return repo.addBlock(file.(*memFile), info), nil
 }
 
-func (repo *MemRepo) AddBlock(file File, info *BlockInfo) Block {
-	block := &memBlock{repo: repo, info: info, parent: file}
-	repo.blocks[info.Strong] = block
-	repo.weakBlocks[info.Weak] = block
-	mfile := file.(*memFile)
+func (repo *MemRepo) addBlock(mfile *memFile, info *BlockInfo) Block {
+	block := &memBlock{repo: repo, info: info, parent: mfile}
+	repo.blocks.add(info.Strong, block)
+	repo.weakBlocks.add(weakKey(info.Weak), block)
 	mfile.blocks = append(mfile.blocks, block)
 	return block
 }
 
-func (repo *MemRepo) AddFile(dir Dir, fileInfo *FileInfo, blocksInfo []*BlockInfo) File {
+func (repo *MemRepo) AddFile(dir Dir, fileInfo *FileInfo, blocksInfo []*BlockInfo) (File, os.Error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
 	file := &memFile{repo: repo, info: fileInfo, parent: dir}
-	repo.files[fileInfo.Strong] = file
+	repo.files.add(fileInfo.Strong, file)
 	for _, blockInfo := range blocksInfo {
-		repo.AddBlock(file, blockInfo)
+		repo.addBlock(file, blockInfo)
 	}
 	if mdir, is := dir.(*memDir); is {
 		mdir.files = append(mdir.files, file)
 	} else {
 		repo.root = file
 	}
-	return file
+	return file, nil
 }
 
-func (repo *MemRepo) AddDir(dir Dir, info *DirInfo) Dir {
+func (repo *MemRepo) AddDir(dir Dir, info *DirInfo) (Dir, os.Error) {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
 	if info.Strong == "" {
-		info.Strong = fmt.Sprintf("tmp%d", len(repo.dirs))
+		info.Strong = fmt.Sprintf("tmp%d", repo.nTmp)
+		repo.nTmp++
 	}
 	subdir := &memDir{repo: repo, info: info, parent: dir}
-	repo.dirs[info.Strong] = subdir
+	repo.dirs.add(info.Strong, subdir)
 	if mdir, is := dir.(*memDir); is {
 		mdir.subdirs = append(mdir.subdirs, subdir)
 	} else {
 		repo.root = subdir
 	}
-	return subdir
+	return subdir, nil
+}
+
+func (repo *MemRepo) RemoveBlock(block Block) os.Error {
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	mblock := block.(*memBlock)
+	repo.blocks.remove(mblock.info.Strong, mblock)
+	repo.weakBlocks.remove(weakKey(mblock.info.Weak), mblock)
+
+	if mfile, is := mblock.parent.(*memFile); is {
+		for i, sibling := range mfile.blocks {
+			if sibling == block {
+				mfile.blocks = append(mfile.blocks[:i], mfile.blocks[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (repo *MemRepo) RemoveFile(file File) os.Error {
+	mfile := file.(*memFile)
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	repo.removeFile(mfile)
+	repo.updateParent(mfile.parent)
+	return nil
+}
+
+func (repo *MemRepo) RemoveDir(dir Dir) os.Error {
+	mdir := dir.(*memDir)
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	repo.removeDir(mdir)
+	repo.updateParent(mdir.parent)
+	return nil
+}
+
+func (repo *MemRepo) UpdateFile(file File, fileInfo *FileInfo, blocksInfo []*BlockInfo) (File, os.Error) {
+	mfile := file.(*memFile)
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	repo.dropBlocks(mfile)
+	repo.files.remove(mfile.info.Strong, mfile)
+
+	info := *fileInfo
+	info.Name = mfile.info.Name
+	mfile.info = &info
+	repo.files.add(info.Strong, mfile)
+	for _, blockInfo := range blocksInfo {
+		repo.addBlock(mfile, blockInfo)
+	}
+
+	repo.updateParent(mfile.parent)
+	return mfile, nil
+}
+
+func (repo *MemRepo) Rename(node FsNode, dir Dir, name string) (FsNode, os.Error) {
+	mdir, is := dir.(*memDir)
+	if !is || mdir.repo != repo {
+		return nil, os.NewError(fmt.Sprintf("Cannot rename into %s, which is not in this repo", dir.Name()))
+	}
+
+	var owner *MemRepo
+	switch mnode := node.(type) {
+	case *memFile:
+		owner = mnode.repo
+	case *memDir:
+		owner = mnode.repo
+	}
+	if owner != repo {
+		return nil, os.NewError(fmt.Sprintf("Cannot rename %s, which is not in this repo", node.Name()))
+	}
+
+	repo.mutex.Lock()
+	defer repo.mutex.Unlock()
+
+	if mdir.hasOther(name, node) {
+		return nil, nameTaken(mdir, name)
+	}
+
+	var oldParent Dir
+	switch mnode := node.(type) {
+	case *memFile:
+		oldParent = mnode.parent
+		repo.detachFile(mnode)
+		info := *mnode.info
+		info.Name = name
+		info.Parent = mdir.info.Strong
+		mnode.info = &info
+		mnode.parent = mdir
+		mdir.files = append(mdir.files, mnode)
+	case *memDir:
+		for ancestor := mdir; ancestor != nil; ancestor, _ = ancestor.parent.(*memDir) {
+			if ancestor == mnode {
+				return nil, os.NewError(fmt.Sprintf("Cannot move %s beneath itself", mnode.info.Name))
+			}
+		}
+		oldParent = mnode.parent
+		repo.detachDir(mnode)
+		info := *mnode.info
+		info.Name = name
+		info.Parent = mdir.info.Strong
+		mnode.info = &info
+		mnode.parent = mdir
+		mdir.subdirs = append(mdir.subdirs, mnode)
+	}
+
+	repo.updateParent(oldParent)
+	repo.updateStrongsToRoot(mdir)
+	return node, nil
+}
+
+// The error for renaming a node to the name of another in the same directory.
+// Expects the mutex to be held.
+func nameTaken(mdir *memDir, name string) os.Error {
+	return os.NewError(fmt.Sprintf("Cannot rename to %s in %s, which already exists",
+		name, mdir.info.Name))
+}
+
+// Recalculate strong checksums from a node's former parent up to the root.
+func (repo *MemRepo) updateParent(parent Dir) {
+	if mdir, is := parent.(*memDir); is {
+		repo.updateStrongsToRoot(mdir)
+	}
+}
+
+// Recalculate the strong checksums of a directory and each directory above
+// it, as UpdateStrongsToRoot does, without releasing the mutex in between.
+func (repo *MemRepo) updateStrongsToRoot(mdir *memDir) {
+	for ; mdir != nil; mdir, _ = mdir.parent.(*memDir) {
+		subdirs := make(map[string]string)
+		for _, subdir := range mdir.subdirs {
+			info := subdir.(*memDir).info
+			subdirs[info.Name] = info.Strong
+		}
+		files := make(map[string]string)
+		for _, file := range mdir.files {
+			info := file.(*memFile).info
+			files[info.Name] = info.Strong
+		}
+		mdir.storeStrong(ContentsStrong(subdirs, files))
+	}
+}
+
+func (repo *MemRepo) dropBlocks(mfile *memFile) {
+	for _, block := range mfile.blocks {
+		mblock := block.(*memBlock)
+		repo.blocks.remove(mblock.info.Strong, mblock)
+		repo.weakBlocks.remove(weakKey(mblock.info.Weak), mblock)
+	}
+	mfile.blocks = nil
+}
+
+func (repo *MemRepo) removeFile(mfile *memFile) {
+	repo.dropBlocks(mfile)
+	repo.files.remove(mfile.info.Strong, mfile)
+	repo.detachFile(mfile)
+}
+
+func (repo *MemRepo) removeDir(mdir *memDir) {
+	for len(mdir.subdirs) > 0 {
+		repo.removeDir(mdir.subdirs[0].(*memDir))
+	}
+	for len(mdir.files) > 0 {
+		repo.removeFile(mdir.files[0].(*memFile))
+	}
+	repo.dirs.remove(mdir.info.Strong, mdir)
+	repo.detachDir(mdir)
+}
+
+// Take a file out of its parent directory.
+func (repo *MemRepo) detachFile(mfile *memFile) {
+	if parent, is := mfile.parent.(*memDir); is {
+		for i, sibling := range parent.files {
+			if sibling == mfile {
+				parent.files = append(parent.files[:i], parent.files[i+1:]...)
+				break
+			}
+		}
+	} else if repo.root == mfile {
+		repo.root = nil
+	}
+}
+
+// Take a directory out of its parent directory.
+func (repo *MemRepo) detachDir(mdir *memDir) {
+	if parent, is := mdir.parent.(*memDir); is {
+		for i, sibling := range parent.subdirs {
+			if sibling == mdir {
+				parent.subdirs = append(parent.subdirs[:i], parent.subdirs[i+1:]...)
+				break
+			}
+		}
+	} else if repo.root == mdir {
+		repo.root = nil
+	}
 }
 
 func (repo *MemRepo) Close() {
@@ -0,0 +1,180 @@
+package sqlite3
+
+import (
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/kuroneko/gosqlite3"
+)
+
+// Indexes on checksums, which are dropped for the length of a bulk load,
+// and built once at the end rather than updated with each insert.
+var deferredIndexes = []struct{ name, create string }{
+	{"bl_strong", `CREATE INDEX IF NOT EXISTS bl_strong ON blocks (strong)`},
+	{"bl_weak", `CREATE INDEX IF NOT EXISTS bl_weak ON blocks (weak)`},
+	{"fi_strong", `CREATE INDEX IF NOT EXISTS fi_strong ON files (strong)`},
+	{"di_strong", `CREATE INDEX IF NOT EXISTS di_strong ON dirs (strong)`}}
+
+// Begin a bulk load, and get the repo to make its changes through.
+// Everything added through it until the matching EndBulk is written in one
+// transaction, with prepared statements reused between inserts. Indexes
+// on checksums are not updated until the end, so lookups by checksum scan
+// their tables in the meantime.
+//
+// Changes made through this repo, rather than the load, wait until the
+// load ends. Begun on a load, a nested load is begun in it.
+func (dbRepo *DbRepo) BeginBulk() (fs.BulkLoad, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	// Only the load itself gets past lockWriter while it is in progress
+	if dbRepo.bulk > 0 {
+		dbRepo.bulk++
+		return dbRepo, nil
+	}
+
+	if _, err := dbRepo.db.Execute("BEGIN"); err != nil {
+		return nil, err
+	}
+	for _, index := range deferredIndexes {
+		if _, err := dbRepo.db.Execute(`DROP INDEX IF EXISTS ` + index.name); err != nil {
+			dbRepo.db.Execute("ROLLBACK")
+			return nil, err
+		}
+	}
+
+	dbRepo.bulk = 1
+	dbRepo.stmts = make(map[string]*sqlite3.Statement)
+	return &DbRepo{dbConn: dbRepo.dbConn, RootPath: dbRepo.RootPath, loading: true}, nil
+}
+
+// Refuse to end a bulk load from a repo which is not making it.
+func (dbRepo *DbRepo) checkLoading() os.Error {
+	if dbRepo.bulk == 0 || !dbRepo.loading {
+		return os.NewError("No bulk load in progress")
+	}
+	return nil
+}
+
+// End a bulk load. The outermost EndBulk rebuilds the deferred indexes
+// and commits the load. If that fails, or the load was aborted, the
+// whole load is rolled back.
+func (dbRepo *DbRepo) EndBulk() os.Error {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	if err := dbRepo.checkLoading(); err != nil {
+		return err
+	}
+	dbRepo.bulk--
+	if dbRepo.bulk > 0 {
+		return nil
+	}
+	defer dbRepo.bulkEnded.Broadcast()
+
+	if dbRepo.aborted {
+		if err := dbRepo.rollbackBulk(); err != nil {
+			return err
+		}
+		return os.NewError("Bulk load was aborted, and rolled back")
+	}
+
+	dbRepo.finalizeStmts()
+	for _, index := range deferredIndexes {
+		if _, err := dbRepo.db.Execute(index.create); err != nil {
+			dbRepo.db.Execute("ROLLBACK")
+			return err
+		}
+	}
+
+	if _, err := dbRepo.db.Execute("COMMIT"); err != nil {
+		dbRepo.db.Execute("ROLLBACK")
+		return err
+	}
+	return nil
+}
+
+// Abort a bulk load. Nothing added since the outermost BeginBulk is kept,
+// and the deferred indexes are restored as they were. Within a nested
+// load, the rollback waits until the outermost load ends.
+func (dbRepo *DbRepo) AbortBulk() os.Error {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	if err := dbRepo.checkLoading(); err != nil {
+		return err
+	}
+	dbRepo.bulk--
+	dbRepo.aborted = true
+	if dbRepo.bulk > 0 {
+		return nil
+	}
+	defer dbRepo.bulkEnded.Broadcast()
+	return dbRepo.rollbackBulk()
+}
+
+func (dbRepo *DbRepo) rollbackBulk() os.Error {
+	dbRepo.finalizeStmts()
+	dbRepo.aborted = false
+	_, err := dbRepo.db.Execute("ROLLBACK")
+	return err
+}
+
+// Prepare a statement with values bound to it. During a bulk load,
+// statements are kept and rebound, rather than prepared for each use.
+func (dbRepo *DbRepo) prepare(sql string, values ...interface{}) (*sqlite3.Statement, os.Error) {
+	if dbRepo.stmts == nil {
+		return dbRepo.db.Prepare(sql, values...)
+	}
+
+	stmt, has := dbRepo.stmts[sql]
+	if !has {
+		stmt, err := dbRepo.db.Prepare(sql, values...)
+		if err != nil {
+			return nil, err
+		}
+		dbRepo.stmts[sql] = stmt
+		return stmt, nil
+	}
+
+	if err := stmt.Reset(); err != nil {
+		return nil, err
+	}
+	if err, _ := stmt.BindAll(values...); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// Finish with a statement from prepare.
+func (dbRepo *DbRepo) release(stmt *sqlite3.Statement) {
+	if dbRepo.stmts == nil {
+		stmt.Finalize()
+	}
+}
+
+func (dbRepo *DbRepo) finalizeStmts() {
+	for _, stmt := range dbRepo.stmts {
+		stmt.Finalize()
+	}
+	dbRepo.stmts = nil
+}
+
+// Begin a transaction, or a nested one within a bulk load.
+func (dbRepo *DbRepo) begin() os.Error {
+	_, err := dbRepo.db.Execute("SAVEPOINT tx")
+	return err
+}
+
+func (dbRepo *DbRepo) commit() os.Error {
+	_, err := dbRepo.db.Execute("RELEASE tx")
+	return err
+}
+
+func (dbRepo *DbRepo) rollback() {
+	dbRepo.db.Execute("ROLLBACK TO tx")
+	dbRepo.db.Execute("RELEASE tx")
+}
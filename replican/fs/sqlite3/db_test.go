@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
 	"github.com/cmars/replican-sync/replican/treegen"
 
 	"github.com/bmizerany/assert"
@@ -78,3 +79,273 @@ func TestRootWorks(t *testing.T) {
 	_, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
 	assert.Equalf(t, 0, len(errors), "%v", errors)
 }
+
+func TestDbConformance(t *testing.T) {
+	fstest.DoTestConformance(t, func(t *testing.T) (fs.NodeRepo, func()) {
+		dbrepo, dbpath := createDbRepo(t)
+		return dbrepo, func() { os.Remove(dbpath) }
+	})
+}
+
+func TestDurableDbConformance(t *testing.T) {
+	fstest.DoTestConformance(t, func(t *testing.T) (fs.NodeRepo, func()) {
+		dbpath, _ := ioutil.TempFile("", "test.db")
+		dbpath.Close()
+		dbrepo, err := OpenDbRepo(dbpath.Name(), DbOptions{Durable: true})
+		assert.Tf(t, err == nil, "%v", err)
+		return dbrepo, func() {
+			os.Remove(dbpath.Name())
+			os.Remove(dbpath.Name() + "-wal")
+			os.Remove(dbpath.Name() + "-shm")
+		}
+	})
+}
+
+func TestReadOnly(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dbrepo.Close()
+
+	_, err := OpenDbRepo(dbpath+"-missing", DbOptions{ReadOnly: true})
+	assert.T(t, err != nil)
+	_, err = os.Stat(dbpath + "-missing")
+	assert.T(t, err != nil)
+
+	reader, err := OpenDbRepo(dbpath, DbOptions{ReadOnly: true})
+	assert.Tf(t, err == nil, "%v", err)
+	defer reader.Close()
+
+	root, isDir := fstest.Root(t, reader).(fs.Dir)
+	assert.T(t, isDir)
+	assert.Equal(t, foo.Info().Strong, root.Info().Strong)
+	bar, has := fs.Lookup(root, "bar")
+	assert.T(t, has)
+
+	_, err = reader.AddDir(root, &fs.DirInfo{Name: "baz"})
+	assert.T(t, err != nil)
+	err = reader.RemoveFile(bar.(fs.File))
+	assert.T(t, err != nil)
+	_, err = reader.Rename(bar, root, "baz")
+	assert.T(t, err != nil)
+
+	_, err = reader.Snapshot("v1", root)
+	assert.T(t, err != nil)
+	_, err = reader.Collect()
+	assert.T(t, err != nil)
+
+	_, has = fs.Lookup(fstest.RootDir(t, reader), "bar")
+	assert.T(t, has)
+}
+
+func TestBeginRead(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar", tg.F("A", tg.B(42, 65537))),
+		tg.D("baz", tg.F("B", tg.B(43, 65537)))))
+	defer os.RemoveAll(path)
+
+	dbpath, _ := ioutil.TempFile("", "test.db")
+	dbpath.Close()
+	defer os.Remove(dbpath.Name())
+	defer os.Remove(dbpath.Name() + "-wal")
+	defer os.Remove(dbpath.Name() + "-shm")
+
+	dbrepo, err := OpenDbRepo(dbpath.Name(), DbOptions{Durable: true})
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	before := foo.Info().Strong
+
+	reader, err := dbrepo.BeginRead()
+	assert.Tf(t, err == nil, "%v", err)
+
+	bar, has := fs.Lookup(foo, "bar")
+	assert.T(t, has)
+	err = dbrepo.RemoveDir(bar.(fs.Dir))
+	assert.Tf(t, err == nil, "%v", err)
+	after := fstest.RootDir(t, dbrepo).Info().Strong
+	assert.T(t, before != after)
+
+	// The reader still sees the tree as it was
+	root := fstest.RootDir(t, reader)
+	assert.Equal(t, before, root.Info().Strong)
+	_, has = fs.Lookup(root, "bar/A")
+	assert.T(t, has)
+	reader.Close()
+
+	reader, err = dbrepo.BeginRead()
+	assert.Tf(t, err == nil, "%v", err)
+	defer reader.Close()
+
+	root = fstest.RootDir(t, reader)
+	assert.Equal(t, after, root.Info().Strong)
+	_, has = fs.Lookup(root, "bar")
+	assert.T(t, !has)
+
+	memrepo, err := NewDbRepo(":memory:")
+	assert.T(t, err == nil)
+	_, err = memrepo.BeginRead()
+	assert.T(t, err != nil)
+}
+
+func TestBulk(t *testing.T) {
+	dbpath, _ := ioutil.TempFile("", "test.db")
+	dbpath.Close()
+	defer os.Remove(dbpath.Name())
+	defer os.Remove(dbpath.Name() + "-wal")
+	defer os.Remove(dbpath.Name() + "-shm")
+
+	dbrepo, err := OpenDbRepo(dbpath.Name(), DbOptions{Durable: true})
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+
+	load, err := dbrepo.BeginBulk()
+	assert.Tf(t, err == nil, "%v", err)
+	nested, err := load.BeginBulk()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, nested == load)
+
+	root, err := load.AddDir(nil, &fs.DirInfo{Mode: 0755})
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = load.AddFile(root,
+		&fs.FileInfo{Name: "bar", Mode: 0644, Size: 1, Strong: "filebar"},
+		[]*fs.BlockInfo{&fs.BlockInfo{Strong: "blockbar", Weak: 42}})
+	assert.Tf(t, err == nil, "%v", err)
+	root.UpdateStrong()
+
+	// Checksum lookups still work without their indexes
+	_, has, err := dbrepo.File("filebar")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, has)
+	_, has, err = dbrepo.WeakBlock(42)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, has)
+
+	// Transactions nest within the load
+	_, err = load.(*DbRepo).Snapshot("v1", root)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Only the load can end it
+	assert.T(t, dbrepo.EndBulk() != nil)
+	assert.T(t, dbrepo.AbortBulk() != nil)
+
+	// Nothing is committed until the outermost load ends
+	assert.T(t, load.EndBulk() == nil)
+	reader, err := dbrepo.BeginRead()
+	assert.Tf(t, err == nil, "%v", err)
+	node, err := reader.Root()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, node == nil)
+	reader.Close()
+
+	assert.T(t, load.EndBulk() == nil)
+	assert.T(t, load.EndBulk() != nil)
+
+	reader, err = dbrepo.BeginRead()
+	assert.Tf(t, err == nil, "%v", err)
+	defer reader.Close()
+	assert.Equal(t, root.Info().Strong, fstest.RootDir(t, reader).Info().Strong)
+	_, has, err = reader.Block("blockbar")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, has)
+
+	for _, index := range deferredIndexes {
+		_, has, err := dbrepo.queryInt(
+			`SELECT rowid FROM sqlite_master WHERE type = 'index' AND name = ?`, index.name)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Tf(t, has, "%s", index.name)
+	}
+
+	readOnly, err := OpenDbRepo(dbpath.Name(), DbOptions{ReadOnly: true})
+	assert.Tf(t, err == nil, "%v", err)
+	defer readOnly.Close()
+	_, err = readOnly.BeginBulk()
+	assert.T(t, err != nil)
+}
+
+// Fails to add files after the first few.
+type failingRepo struct {
+	*DbRepo
+	files int
+}
+
+// Make the additions of a bulk load fail in the same way.
+func (repo *failingRepo) BeginBulk() (fs.BulkLoad, os.Error) {
+	load, err := repo.DbRepo.BeginBulk()
+	if err != nil {
+		return nil, err
+	}
+	return &failingRepo{DbRepo: load.(*DbRepo), files: repo.files}, nil
+}
+
+func (repo *failingRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) (fs.File, os.Error) {
+	if repo.files == 0 {
+		return nil, os.NewError("Injected failure")
+	}
+	repo.files--
+	return repo.DbRepo.AddFile(dir, fileInfo, blocksInfo)
+}
+
+func countRows(t *testing.T, dbrepo *DbRepo) []int64 {
+	counts := []int64{}
+	for _, table := range []string{"dirs", "files", "blocks"} {
+		n, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM ` + table)
+		assert.Tf(t, err == nil, "%v", err)
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// Indexing which fails part way adds nothing.
+func TestBulkAborted(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar",
+			tg.F("a", tg.B(42, 65537)),
+			tg.F("b", tg.B(43, 65537))),
+		tg.F("c", tg.B(44, 65537)),
+		tg.F("d", tg.B(45, 65537))))
+	defer os.RemoveAll(path)
+
+	_, errors := fs.IndexDir(filepath.Join(path, "foo", "bar"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	before := countRows(t, dbrepo)
+	root := fstest.RootDir(t, dbrepo).Info().Strong
+
+	indexer := &fs.Indexer{Path: filepath.Join(path, "foo"), Repo: &failingRepo{DbRepo: dbrepo, files: 2}}
+	_, err := indexer.Index()
+	assert.T(t, err != nil)
+
+	assert.Equal(t, before, countRows(t, dbrepo))
+	assert.Equal(t, root, fstest.RootDir(t, dbrepo).Info().Strong)
+	for _, index := range deferredIndexes {
+		_, has, err := dbrepo.queryInt(
+			`SELECT rowid FROM sqlite_master WHERE type = 'index' AND name = ?`, index.name)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Tf(t, has, "%s", index.name)
+	}
+
+	// Nested loads are rolled back when the outermost one ends
+	load, err := dbrepo.BeginBulk()
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = load.BeginBulk()
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = load.AddDir(nil, &fs.DirInfo{Mode: 0755})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, load.AbortBulk() == nil)
+	assert.T(t, load.EndBulk() != nil)
+	assert.Equal(t, before, countRows(t, dbrepo))
+	assert.T(t, load.AbortBulk() != nil)
+}
@@ -1,18 +1,211 @@
 package sqlite3
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/cmars/replican-sync/replican/fs"
 	"github.com/kuroneko/gosqlite3"
 )
 
+// A NodeRepo stored in a sqlite3 database.
+//
+// A DbRepo is safe for concurrent use by multiple goroutines. All access
+// to the database connection is serialized, so each method call sees a
+// consistent state. Nodes are independent copies of their records; a
+// node should not be shared between goroutines while it is being renamed
+// or updated.
 type DbRepo struct {
+	*dbConn
 	RootPath string
-	db       *sqlite3.Database
-	dbpath   string
+
+	// Whether this is the repo of a bulk load, begun by BeginBulk, which
+	// makes its changes while those made through the DbRepo it was begun
+	// from wait.
+	loading bool
+}
+
+// A database connection, shared by a DbRepo and its bulk loads.
+type dbConn struct {
+	db     *sqlite3.Database
+	dbpath string
+
+	// Guards db. Unexported helpers which use db expect it to be held.
+	mutex sync.Mutex
+
+	readOnly bool
+
+	// Keys to seal file and directory names with, if they are kept secret.
+	keys *fs.Keys
+
+	// Whether a read transaction is open, begun by BeginRead.
+	reading bool
+
+	// The depth of nested bulk loads, and the statements prepared
+	// during them, kept for reuse until the outermost one ends.
+	bulk  int
+	stmts map[string]*sqlite3.Statement
+
+	// Whether the bulk load in progress has been aborted.
+	aborted bool
+
+	// Signalled on the mutex when the outermost bulk load ends.
+	bulkEnded *sync.Cond
+}
+
+// Options for opening a DbRepo.
+type DbOptions struct {
+	// Open an existing database without creating or changing anything in it.
+	// Changes to the repo panic, or return an error where they can.
+	ReadOnly bool
+
+	// Write through a write-ahead log, synced at each checkpoint, so that
+	// a crash cannot corrupt the database. Readers in other connections
+	// also see a consistent tree while it is being written, without
+	// blocking the writer. Otherwise, writes are not synced at all,
+	// which is faster but unsafe.
+	Durable bool
+
+	// Store file and directory names and checksums sealed with these keys,
+	// so that they cannot be read without them, and a known file cannot be
+	// found in the database by its checksum. Otherwise, they are stored as
+	// they are. Snapshot names and modes are stored as they are either way.
+	// A database can only be opened with the keys it was written with, and
+	// one written without keys cannot be opened with any.
+	Keys *fs.Keys
+}
+
+const readOnlyDb = "Database was opened read-only"
+
+// Take the mutex to change the database, first waiting for any bulk load
+// to end, unless this is the repo making its changes.
+func (dbRepo *DbRepo) lockWriter() {
+	dbRepo.mutex.Lock()
+	for dbRepo.bulk > 0 && !dbRepo.loading {
+		dbRepo.bulkEnded.Wait()
+	}
+}
+
+// Refuse to change a read-only database.
+func (dbRepo *DbRepo) checkWritable() os.Error {
+	if dbRepo.readOnly {
+		return os.NewError(readOnlyDb)
+	}
+	return nil
+}
+
+// Test if anything has been written to the database.
+func (dbRepo *DbRepo) hasRecords() (bool, os.Error) {
+	for _, table := range []string{"dirs", "files", "blocks", "snapshots"} {
+		_, has, err := dbRepo.queryInt(`SELECT rowid FROM ` + table + ` LIMIT 1`)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+// The value sealed into a database written with keys, to check that it
+// is opened with the same keys.
+const keyCheck = "replican key check"
+
+// Refuse to open a database with other keys than it was written with.
+// A database which has not recorded whether it is sealed yet records it,
+// unless it is read-only. Only an empty database is sealed with the keys
+// it is first opened with; one with records from before they were
+// recorded, which were written without keys, is recorded as not sealed.
+func (dbRepo *DbRepo) checkKeys() os.Error {
+	row, err := dbRepo.queryRow(`SELECT sealed, value FROM key_check`)
+	if err != nil {
+		return err
+	} else if row == nil {
+		used, err := dbRepo.hasRecords()
+		if err != nil {
+			return err
+		}
+
+		sealed, value := int64(0), ""
+		if dbRepo.keys != nil && !used {
+			sealed, value = 1, dbRepo.keys.SealName(keyCheck)
+		}
+		if !dbRepo.readOnly {
+			err = dbRepo.exec(`INSERT INTO key_check (sealed, value) VALUES (?,?)`, sealed, value)
+			if err != nil {
+				return err
+			}
+		}
+		row = []interface{}{sealed, value}
+	}
+
+	switch sealed := row[0].(int64) != 0; {
+	case !sealed && dbRepo.keys != nil:
+		return os.NewError(fmt.Sprintf(
+			"%s is not encrypted, and cannot be opened with keys", dbRepo.dbpath))
+	case sealed && dbRepo.keys == nil:
+		return os.NewError(fmt.Sprintf(
+			"%s is encrypted, and cannot be opened without its keys", dbRepo.dbpath))
+	case sealed:
+		if opened, err := dbRepo.keys.OpenName(row[1].(string)); err != nil || opened != keyCheck {
+			return os.NewError(fmt.Sprintf(
+				"%s is encrypted with other keys than those given", dbRepo.dbpath))
+		}
+	}
+	return nil
+}
+
+// Seal a file or directory name for storing, if names are kept secret.
+// The empty name of a root is stored as it is.
+func (dbRepo *DbRepo) sealName(name string) string {
+	if dbRepo.keys == nil || name == "" {
+		return name
+	}
+	return dbRepo.keys.SealName(name)
+}
+
+// Open a name as it was stored. A name which cannot be opened was not
+// sealed with the repo's keys, and is an error.
+func (dbRepo *DbRepo) openName(value interface{}) (string, os.Error) {
+	name := value.(string)
+	if dbRepo.keys == nil || name == "" {
+		return name, nil
+	}
+	return dbRepo.keys.OpenName(name)
+}
+
+// Seal a strong checksum for storing, if checksums are kept secret.
+// The empty strong of a node not yet checksummed is stored as it is.
+func (dbRepo *DbRepo) sealStrong(strong string) string {
+	if dbRepo.keys == nil || strong == "" {
+		return strong
+	}
+	return dbRepo.keys.SealStrong(strong)
+}
+
+// Open a strong checksum as it was stored, like openName.
+func (dbRepo *DbRepo) openStrong(strong string) (string, os.Error) {
+	if dbRepo.keys == nil || strong == "" {
+		return strong, nil
+	}
+	return dbRepo.keys.OpenStrong(strong)
+}
+
+// Seal a weak checksum for storing, if checksums are kept secret.
+func (dbRepo *DbRepo) sealWeak(weak int) int64 {
+	if dbRepo.keys == nil {
+		return int64(weak)
+	}
+	return dbRepo.keys.SealWeak(int64(weak))
+}
+
+// Open a weak checksum as it was stored.
+func (dbRepo *DbRepo) openWeak(value interface{}) int {
+	if dbRepo.keys == nil {
+		return int(value.(int64))
+	}
+	return int(dbRepo.keys.OpenWeak(value.(int64)))
 }
 
 type dbBlock struct {
@@ -25,7 +218,7 @@ type dbBlock struct {
 func (dbb *dbBlock) Repo() fs.NodeRepo { return dbb.repo }
 
 func (dbb *dbBlock) Parent() (fs.FsNode, bool) {
-	return dbb.repo.ParentOf(dbb)
+	return logParent(dbb.repo.ParentOf(dbb))
 }
 
 func (dbb *dbBlock) Info() *fs.BlockInfo {
@@ -42,7 +235,7 @@ type dbFile struct {
 func (dbf *dbFile) Repo() fs.NodeRepo { return dbf.repo }
 
 func (dbf *dbFile) Parent() (fs.FsNode, bool) {
-	return dbf.repo.ParentOf(dbf)
+	return logParent(dbf.repo.ParentOf(dbf))
 }
 
 func (dbf *dbFile) Info() *fs.FileInfo {
@@ -58,7 +251,11 @@ func (dbf *dbFile) Mode() uint32 {
 }
 
 func (dbf *dbFile) Blocks() []fs.Block {
-	return dbf.repo.BlocksOf(dbf)
+	blocks, err := dbf.repo.BlocksOf(dbf)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return blocks
 }
 
 type dbDir struct {
@@ -71,7 +268,7 @@ type dbDir struct {
 func (dbd *dbDir) Repo() fs.NodeRepo { return dbd.repo }
 
 func (dbd *dbDir) Parent() (fs.FsNode, bool) {
-	return dbd.repo.ParentOf(dbd)
+	return logParent(dbd.repo.ParentOf(dbd))
 }
 
 func (dbd *dbDir) Info() *fs.DirInfo {
@@ -87,439 +284,811 @@ func (dbd *dbDir) Mode() uint32 {
 }
 
 func (dbd *dbDir) SubDirs() []fs.Dir {
-	return dbd.repo.SubdirsOf(dbd)
+	subdirs, err := dbd.repo.SubdirsOf(dbd)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return subdirs
 }
 
 func (dbd *dbDir) Files() []fs.File {
-	return dbd.repo.FilesOf(dbd)
+	files, err := dbd.repo.FilesOf(dbd)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return files
 }
 
 func (dbd *dbDir) UpdateStrong() string {
-	return dbd.repo.UpdateStrong(dbd)
+	return logStrong(dbd, fs.CheckedUpdateStrong(dbd))
 }
 
-func (dbRepo *DbRepo) Root() fs.FsNode {
-	stmt, _ := dbRepo.db.Prepare(
-		"SELECT rowid, strong, name, mode FROM dirs WHERE parent IS NULL")
-	defer stmt.Finalize()
-	stmt.Step()
-	values := stmt.Row()
-	//log.Printf("%v", values)
-	if values[0] == nil { // row came back null -- no matches?!
-		return nil
+func (dbd *dbDir) UpdateShallowStrong() string {
+	return logStrong(dbd, fs.CheckedUpdateShallowStrong(dbd))
+}
+
+// A directory whose strong checksum cannot be updated keeps the one it had.
+func logStrong(dbd *dbDir, strong string, err os.Error) string {
+	if err != nil {
+		log.Printf("%v", err)
+		return dbd.info.Strong
 	}
-	dir := &dbDir{
-		repo: dbRepo,
-		id:   values[0].(int64),
-		info: &fs.DirInfo{
-			Strong: values[1].(string),
-			Name:   values[2].(string),
-			Mode:   uint32(values[3].(int64))}}
-	return dir
-}
-
-func (dbRepo *DbRepo) WeakBlock(weak int) (fs.Block, bool) {
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT b.rowid, p.rowid, b.pos, b.strong, p.strong 
-			FROM blocks AS b LEFT OUTER JOIN files AS p ON b.parent = p.rowid
-			WHERE b.weak = ?`, weak)
-	defer stmt.Finalize()
-	stmt.Step()
-	values := stmt.Row()
-	if values[0] == nil { // row came back null -- no matches
+	return strong
+}
+
+// Node methods can't return errors, so they log them instead,
+// and carry on as if nothing was found. Nothing in this tree reads a
+// DbRepo through them: the fs Checked and Read functions use the DbRepo's
+// fs.CheckedRepo methods, which return the errors.
+func logParent(parent fs.FsNode, has bool, err os.Error) (fs.FsNode, bool) {
+	if err != nil {
+		log.Printf("%v", err)
 		return nil, false
 	}
-	block := &dbBlock{
-		repo:   dbRepo,
-		id:     values[0].(int64),
-		parent: values[1].(int64),
-		info: &fs.BlockInfo{
-			Weak:     weak,
-			Position: int(values[2].(int64)),
-			Strong:   values[3].(string),
-			Parent:   values[4].(string)}}
-	return block, true
-}
-
-func (dbRepo *DbRepo) Block(strong string) (fs.Block, bool) {
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT b.rowid, p.rowid, b.weak, b.pos, p.strong 
-			FROM blocks AS b LEFT OUTER JOIN files AS p ON b.parent = p.rowid
-			WHERE b.strong = ?`, strong)
-	defer stmt.Finalize()
-	stmt.Step()
-	values := stmt.Row()
-	if values[0] == nil { // row came back null -- no matches
-		return nil, false
+	return parent, has
+}
+
+// Selections of nodes with their parents' rowids and strong checksums,
+// to be read with scanBlock, scanFile and scanDir.
+const selectBlocks = `SELECT b.rowid, p.rowid, b.weak, b.pos, b.strong, p.strong
+	FROM blocks AS b LEFT OUTER JOIN files AS p ON b.parent = p.rowid`
+const selectFiles = `SELECT f.rowid, p.rowid, f.name, f.mode, f.size, f.strong, p.strong, f.mtime
+	FROM files AS f LEFT OUTER JOIN dirs AS p ON f.parent = p.rowid`
+const selectDirs = `SELECT d.rowid, p.rowid, d.name, d.mode, d.strong, p.strong
+	FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid`
+
+// Nodes without a parent have a parent rowid of -1.
+func parentId(value interface{}) int64 {
+	if value == nil {
+		return int64(-1)
+	}
+	return value.(int64)
+}
+
+func parentStrong(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return value.(string)
+}
+
+func (dbRepo *DbRepo) scanBlock(values []interface{}) (*dbBlock, os.Error) {
+	strong, err := dbRepo.openStrong(values[4].(string))
+	if err != nil {
+		return nil, err
+	}
+	parent, err := dbRepo.openStrong(parentStrong(values[5]))
+	if err != nil {
+		return nil, err
 	}
-	block := &dbBlock{
+	return &dbBlock{
 		repo:   dbRepo,
 		id:     values[0].(int64),
-		parent: values[1].(int64),
+		parent: parentId(values[1]),
 		info: &fs.BlockInfo{
-			Weak:     int(values[2].(int64)),
+			Weak:     dbRepo.openWeak(values[2]),
 			Position: int(values[3].(int64)),
 			Strong:   strong,
-			Parent:   values[4].(string)}}
-	return block, true
-}
-
-func (dbRepo *DbRepo) File(strong string) (fs.File, bool) {
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT f.rowid, p.rowid, f.name, f.mode, f.size, p.strong
-			FROM files AS f LEFT OUTER JOIN dirs AS p ON f.parent = p.rowid
-			WHERE f.strong = ?`, strong)
-	defer stmt.Finalize()
-	stmt.Step()
-	values := stmt.Row()
-	if values[0] == nil { // row came back null -- no matches
-		return nil, false
+			Parent:   parent}}, nil
+}
+
+func (dbRepo *DbRepo) scanFile(values []interface{}) (*dbFile, os.Error) {
+	name, err := dbRepo.openName(values[2])
+	if err != nil {
+		return nil, err
 	}
-	if values[1] == nil {
-		values[1] = int64(-1)
+	strong, err := dbRepo.openStrong(values[5].(string))
+	if err != nil {
+		return nil, err
 	}
-	if values[5] == nil {
-		values[5] = ""
+	parent, err := dbRepo.openStrong(parentStrong(values[6]))
+	if err != nil {
+		return nil, err
 	}
-	file := &dbFile{
+	return &dbFile{
 		repo:   dbRepo,
 		id:     values[0].(int64),
-		parent: values[1].(int64),
+		parent: parentId(values[1]),
 		info: &fs.FileInfo{
-			Strong: strong,
-			Name:   values[2].(string),
+			Name:   name,
 			Mode:   uint32(values[3].(int64)),
 			Size:   values[4].(int64),
-			Parent: values[5].(string)}}
-	return file, true
-}
-
-func (dbRepo *DbRepo) Dir(strong string) (fs.Dir, bool) {
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT d.rowid, p.rowid, d.name, d.mode, p.strong 
-			FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid
-			WHERE d.strong = ?`, strong)
-	defer stmt.Finalize()
-	stmt.Step()
-	values := stmt.Row()
-	if values[0] == nil {
-		return nil, false
+			Strong: strong,
+			Parent: parent,
+			Mtime:  values[7].(int64)}}, nil
+}
+
+func (dbRepo *DbRepo) scanDir(values []interface{}) (*dbDir, os.Error) {
+	name, err := dbRepo.openName(values[2])
+	if err != nil {
+		return nil, err
 	}
-	if values[1] == nil {
-		values[1] = int64(-1)
+	strong, err := dbRepo.openStrong(values[4].(string))
+	if err != nil {
+		return nil, err
 	}
-	if values[4] == nil {
-		values[4] = ""
+	parent, err := dbRepo.openStrong(parentStrong(values[5]))
+	if err != nil {
+		return nil, err
 	}
-	dir := &dbDir{
+	return &dbDir{
 		repo:   dbRepo,
 		id:     values[0].(int64),
-		parent: values[1].(int64),
+		parent: parentId(values[1]),
 		info: &fs.DirInfo{
-			Name:   values[2].(string),
+			Name:   name,
 			Mode:   uint32(values[3].(int64)),
 			Strong: strong,
-			Parent: values[4].(string)}}
-	return dir, true
+			Parent: parent}}, nil
 }
 
-func (dbRepo *DbRepo) AddBlock(file fs.File, blockInfo *fs.BlockInfo) fs.Block {
-	dbfile := file.(*dbFile)
-	stmt, _ := dbRepo.db.Prepare(
+func (dbRepo *DbRepo) Root() (fs.FsNode, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	values, err := dbRepo.queryRow(selectDirs + ` WHERE d.parent IS NULL`)
+	if err != nil || values == nil {
+		return nil, err
+	}
+	root, err := dbRepo.scanDir(values)
+	if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func (dbRepo *DbRepo) WeakBlock(weak int) (fs.Block, bool, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	values, err := dbRepo.queryRow(selectBlocks+` WHERE b.weak = ?`, dbRepo.sealWeak(weak))
+	if err != nil || values == nil {
+		return nil, false, err
+	}
+	node, err := dbRepo.scanBlock(values)
+	if err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
+
+func (dbRepo *DbRepo) Block(strong string) (fs.Block, bool, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	values, err := dbRepo.queryRow(selectBlocks+` WHERE b.strong = ?`, dbRepo.sealStrong(strong))
+	if err != nil || values == nil {
+		return nil, false, err
+	}
+	node, err := dbRepo.scanBlock(values)
+	if err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
+
+func (dbRepo *DbRepo) File(strong string) (fs.File, bool, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	values, err := dbRepo.queryRow(selectFiles+` WHERE f.strong = ?`, dbRepo.sealStrong(strong))
+	if err != nil || values == nil {
+		return nil, false, err
+	}
+	node, err := dbRepo.scanFile(values)
+	if err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
+
+func (dbRepo *DbRepo) Dir(strong string) (fs.Dir, bool, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	values, err := dbRepo.queryRow(selectDirs+` WHERE d.strong = ?`, dbRepo.sealStrong(strong))
+	if err != nil || values == nil {
+		return nil, false, err
+	}
+	node, err := dbRepo.scanDir(values)
+	if err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
+
+func (dbRepo *DbRepo) AddBlock(file fs.File, blockInfo *fs.BlockInfo) (fs.Block, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	return dbRepo.addBlock(file.(*dbFile), blockInfo)
+}
+
+func (dbRepo *DbRepo) addBlock(dbfile *dbFile, blockInfo *fs.BlockInfo) (fs.Block, os.Error) {
+	err := dbRepo.exec(
 		`INSERT INTO blocks (parent, strong, weak, pos) VALUES (?,?,?,?)`,
-		dbfile.id, blockInfo.Strong, int64(blockInfo.Weak), int64(blockInfo.Position))
-	stmt.Step()
-	stmt.Finalize()
-
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
-	stmt.Step()
-	values := stmt.Row()
-	stmt.Finalize()
-	block := &dbBlock{
-		repo:   dbRepo,
-		id:     values[0].(int64),
-		parent: dbfile.id,
-		info:   blockInfo}
-	return block
+		dbfile.id, dbRepo.sealStrong(blockInfo.Strong), dbRepo.sealWeak(blockInfo.Weak),
+		int64(blockInfo.Position))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := dbRepo.lastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &dbBlock{repo: dbRepo, id: id, parent: dbfile.id, info: blockInfo}, nil
 }
 
-func (dbRepo *DbRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) fs.File {
-	dbdir := dir.(*dbDir)
-	stmt, _ := dbRepo.db.Prepare(
-		`INSERT INTO files (parent, strong, name, mode, size) VALUES (?,?,?,?,?)`,
-		dbdir.id, fileInfo.Strong, fileInfo.Name, int64(fileInfo.Mode), fileInfo.Size)
-	stmt.Step()
-	stmt.Finalize()
-
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
-	stmt.Step()
-	values := stmt.Row()
-	stmt.Finalize()
-	file := &dbFile{
-		repo:   dbRepo,
-		id:     values[0].(int64),
-		parent: dbdir.id,
-		info:   fileInfo}
+// The rowid of a parent directory, as a value to insert.
+// Nodes added without a parent are stored with a NULL one.
+func parentValue(dir fs.Dir) (id int64, value interface{}) {
+	if dbdir, is := dir.(*dbDir); is {
+		return dbdir.id, dbdir.id
+	}
+	return int64(-1), nil
+}
+
+func (dbRepo *DbRepo) AddFile(dir fs.Dir, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) (fs.File, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	parent, parentRef := parentValue(dir)
+	err := dbRepo.exec(
+		`INSERT INTO files (parent, strong, name, mode, size, mtime) VALUES (?,?,?,?,?,?)`,
+		parentRef, dbRepo.sealStrong(fileInfo.Strong), dbRepo.sealName(fileInfo.Name),
+		int64(fileInfo.Mode), fileInfo.Size, fileInfo.Mtime)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := dbRepo.lastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	file := &dbFile{repo: dbRepo, id: id, parent: parent, info: fileInfo}
 
 	for _, blockInfo := range blocksInfo {
-		dbRepo.AddBlock(file, blockInfo)
+		if _, err = dbRepo.addBlock(file, blockInfo); err != nil {
+			return nil, err
+		}
 	}
 
-	return file
+	return file, nil
 }
 
-func (dbRepo *DbRepo) AddDir(dir fs.Dir, subdirInfo *fs.DirInfo) fs.Dir {
-	var id int64
-	var stmt *sqlite3.Statement
-	var err os.Error
-	sql := `INSERT INTO dirs (parent, strong, name, mode) VALUES (?1,?2,?3,?4)`
-	if dbdir, is := dir.(*dbDir); is {
-		id = dbdir.id
-		stmt, err = dbRepo.db.Prepare(sql,
-			dbdir.id, subdirInfo.Strong, subdirInfo.Name, int64(subdirInfo.Mode))
-	} else {
-		id = int64(-1)
-		stmt, err = dbRepo.db.Prepare(sql,
-			nil, subdirInfo.Strong, subdirInfo.Name, int64(subdirInfo.Mode))
+func (dbRepo *DbRepo) AddDir(dir fs.Dir, subdirInfo *fs.DirInfo) (fs.Dir, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
 	}
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	parent, parentRef := parentValue(dir)
+	err := dbRepo.exec(
+		`INSERT INTO dirs (parent, strong, name, mode) VALUES (?,?,?,?)`,
+		parentRef, dbRepo.sealStrong(subdirInfo.Strong), dbRepo.sealName(subdirInfo.Name),
+		int64(subdirInfo.Mode))
 	if err != nil {
-		log.Printf("%v\n", err)
+		return nil, err
 	}
-	stmt.Step()
-	stmt.Finalize()
 
-	stmt, _ = dbRepo.db.Prepare(`SELECT last_insert_rowid()`)
-	stmt.Step()
-	values := stmt.Row()
-	stmt.Finalize()
-	subdir := &dbDir{
-		repo:   dbRepo,
-		id:     values[0].(int64),
-		parent: id,
-		info:   subdirInfo}
-	return subdir
+	id, err := dbRepo.lastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &dbDir{repo: dbRepo, id: id, parent: parent, info: subdirInfo}, nil
 }
 
-func (dbRepo *DbRepo) ParentOf(node fs.Node) (fs.FsNode, bool) {
-	var sql string
-	var id int64
-	switch node.(type) {
-	case *dbBlock:
-		id = node.(*dbBlock).parent
-		if id == -1 {
-			return nil, false
+func (dbRepo *DbRepo) RemoveBlock(block fs.Block) os.Error {
+	if err := dbRepo.checkWritable(); err != nil {
+		return err
+	}
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	return dbRepo.exec(`DELETE FROM blocks WHERE rowid = ?`, block.(*dbBlock).id)
+}
+
+func (dbRepo *DbRepo) RemoveFile(file fs.File) os.Error {
+	if err := dbRepo.checkWritable(); err != nil {
+		return err
+	}
+	dbfile := file.(*dbFile)
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	if err := dbRepo.removeFile(dbfile); err != nil {
+		return err
+	}
+	return dbRepo.updateParentStrongs(dbfile.parent)
+}
+
+func (dbRepo *DbRepo) RemoveDir(dir fs.Dir) os.Error {
+	if err := dbRepo.checkWritable(); err != nil {
+		return err
+	}
+	dbdir := dir.(*dbDir)
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	if err := dbRepo.removeDir(dbdir); err != nil {
+		return err
+	}
+	return dbRepo.updateParentStrongs(dbdir.parent)
+}
+
+func (dbRepo *DbRepo) UpdateFile(file fs.File, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) (fs.File, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+	dbfile := file.(*dbFile)
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	if err := dbRepo.updateFile(dbfile, fileInfo, blocksInfo); err != nil {
+		return nil, err
+	}
+	if err := dbRepo.updateParentStrongs(dbfile.parent); err != nil {
+		return nil, err
+	}
+	return dbfile, nil
+}
+
+// Expects the mutex to be held.
+func (dbRepo *DbRepo) updateFile(dbfile *dbFile, fileInfo *fs.FileInfo, blocksInfo []*fs.BlockInfo) os.Error {
+	if err := dbRepo.exec(`DELETE FROM blocks WHERE parent = ?`, dbfile.id); err != nil {
+		return err
+	}
+	if err := dbRepo.exec(`UPDATE files SET strong = ?, mode = ?, size = ?, mtime = ? WHERE rowid = ?`,
+		dbRepo.sealStrong(fileInfo.Strong), int64(fileInfo.Mode), fileInfo.Size, fileInfo.Mtime,
+		dbfile.id); err != nil {
+		return err
+	}
+
+	info := *fileInfo
+	info.Name = dbfile.info.Name
+	dbfile.info = &info
+	for _, blockInfo := range blocksInfo {
+		if _, err := dbRepo.addBlock(dbfile, blockInfo); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+func (dbRepo *DbRepo) Rename(node fs.FsNode, dir fs.Dir, name string) (fs.FsNode, os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+	dbdir, isDbDir := dir.(*dbDir)
+	if !isDbDir || dbdir.repo.dbConn != dbRepo.dbConn {
+		return nil, os.NewError(fmt.Sprintf("Cannot rename into %s, which is not in this repo", dir.Name()))
+	}
 
-		sql = `SELECT f.rowid, p.rowid, f.name, f.mode, f.size, f.strong, p.strong
-			FROM files AS f LEFT OUTER JOIN dirs AS p ON f.parent = p.rowid
-			WHERE f.rowid = ?`
+	// The move and the strong checksums it changes are committed together,
+	// and no other change is made to the repo in between.
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
 
-		stmt, _ := dbRepo.db.Prepare(sql, id)
-		stmt.Step()
-		values := stmt.Row()
-		if values[0] == nil { // row came back null -- no matches
-			return nil, false
+	var table string
+	var id, oldParentId int64
+	switch dbnode := node.(type) {
+	case *dbFile:
+		if dbnode.repo.dbConn != dbRepo.dbConn {
+			break
 		}
-		if values[1] == nil {
-			values[1] = int64(-1)
+		table, id, oldParentId = "files", dbnode.id, dbnode.parent
+	case *dbDir:
+		if dbnode.repo.dbConn != dbRepo.dbConn {
+			break
 		}
-		if values[6] == nil {
-			values[6] = ""
+		for ancestor := dbdir; ; {
+			if ancestor.id == dbnode.id {
+				return nil, os.NewError(fmt.Sprintf("Cannot move %s beneath itself", dbnode.Name()))
+			}
+			next, has, err := dbRepo.parentDir(ancestor.parent)
+			if err != nil {
+				return nil, err
+			} else if !has {
+				break
+			}
+			ancestor = next.(*dbDir)
 		}
-		stmt.Finalize()
-		return &dbFile{
-			repo:   dbRepo,
-			id:     values[0].(int64),
-			parent: values[1].(int64),
-			info: &fs.FileInfo{
-				Name:   values[2].(string),
-				Mode:   uint32(values[3].(int64)),
-				Size:   values[4].(int64),
-				Strong: values[5].(string),
-				Parent: values[6].(string)}}, true
+		table, id, oldParentId = "dirs", dbnode.id, dbnode.parent
+	}
+	if table == "" {
+		return nil, os.NewError(fmt.Sprintf("Cannot rename %s, which is not in this repo", node.Name()))
+	}
 
+	taken, err := dbRepo.nameTaken(dbdir, name, table, id)
+	if err != nil {
+		return nil, err
+	} else if taken {
+		return nil, os.NewError(fmt.Sprintf("Cannot rename to %s in %s, which already exists",
+			name, dbdir.Name()))
+	}
+
+	if err = dbRepo.begin(); err != nil {
+		return nil, err
+	}
+
+	var undo func()
+	switch dbnode := node.(type) {
 	case *dbFile:
-		id = node.(*dbFile).parent
-		sql = `SELECT d.rowid, p.rowid, d.name, d.mode, d.strong, p.strong 
-			FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid 
-			WHERE d.rowid = ?`
+		parent, info := dbnode.parent, *dbnode.info
+		undo = func() { dbnode.parent, *dbnode.info = parent, info }
+		dbnode.parent = dbdir.id
+		dbnode.info.Name = name
+		dbnode.info.Parent = dbdir.info.Strong
 	case *dbDir:
-		id = node.(*dbDir).parent
-		sql = `SELECT d.rowid, p.rowid, d.name, d.mode, d.strong, p.strong 
-			FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid 
-			WHERE d.rowid = ?`
+		parent, info := dbnode.parent, *dbnode.info
+		undo = func() { dbnode.parent, *dbnode.info = parent, info }
+		dbnode.parent = dbdir.id
+		dbnode.info.Name = name
+		dbnode.info.Parent = dbdir.info.Strong
 	}
+	dirStrong := dbdir.info.Strong
 
-	if id == -1 {
-		return nil, false
+	err = dbRepo.exec(`UPDATE `+table+` SET parent = ?, name = ? WHERE rowid = ?`,
+		dbdir.id, dbRepo.sealName(name), id)
+	if err == nil {
+		err = dbRepo.updateParentStrongs(oldParentId)
+	}
+	if err == nil {
+		err = dbRepo.updateStrongsToRoot(dbdir)
 	}
 
-	stmt, _ := dbRepo.db.Prepare(sql, id)
-	stmt.Step()
-	values := stmt.Row()
-	stmt.Finalize()
-	//	log.Printf("%v %v", id, values)
+	if err == nil {
+		err = dbRepo.commit()
+	} else {
+		dbRepo.rollback()
+	}
+	if err != nil {
+		undo()
+		dbdir.info.Strong = dirStrong
+		return nil, err
+	}
+	return node, nil
+}
 
-	if values[0] == nil { // row came back null -- no matches
-		return nil, false
+// Recalculate the strong checksums of dir and each directory above it,
+// as fs.UpdateStrongsToRoot does. Expects the mutex to be held.
+func (dbRepo *DbRepo) updateStrongsToRoot(dbdir *dbDir) os.Error {
+	for {
+		subdirs, err := dbRepo.subdirsOf(dbdir)
+		if err != nil {
+			return err
+		}
+		files, err := dbRepo.filesOf(dbdir)
+		if err != nil {
+			return err
+		}
+		subdirStrongs := make(map[string]string)
+		for _, subdir := range subdirs {
+			subdirStrongs[subdir.Name()] = subdir.Info().Strong
+		}
+		fileStrongs := make(map[string]string)
+		for _, file := range files {
+			fileStrongs[file.Name()] = file.Info().Strong
+		}
+		if err = dbRepo.setStrong(dbdir, fs.ContentsStrong(subdirStrongs, fileStrongs)); err != nil {
+			return err
+		}
+
+		parent, has, err := dbRepo.parentDir(dbdir.parent)
+		if err != nil || !has {
+			return err
+		}
+		dbdir = parent.(*dbDir)
 	}
+	panic("unreachable")
+}
 
-	if values[1] == nil {
-		values[1] = int64(-1)
+// Recalculate the strong checksums from the directory with rowid id up to
+// the root, after a change to its contents. Expects the mutex to be held.
+func (dbRepo *DbRepo) updateParentStrongs(id int64) os.Error {
+	parent, has, err := dbRepo.parentDir(id)
+	if err != nil || !has {
+		return err
 	}
-	if values[5] == nil {
-		values[5] = ""
+	return dbRepo.updateStrongsToRoot(parent.(*dbDir))
+}
+
+// Test if a directory has a file or subdirectory with the given name,
+// other than the node in table with rowid id. Expects the mutex to be held.
+func (dbRepo *DbRepo) nameTaken(dbdir *dbDir, name string, table string, id int64) (bool, os.Error) {
+	for _, other := range []string{"files", "dirs"} {
+		self := int64(-1)
+		if other == table {
+			self = id
+		}
+
+		_, has, err := dbRepo.queryInt(
+			`SELECT rowid FROM `+other+` WHERE parent = ? AND name = ? AND rowid != ?`,
+			dbdir.id, dbRepo.sealName(name), self)
+		if err != nil || has {
+			return has, err
+		}
 	}
+	return false, nil
+}
 
-	return &dbDir{
-		repo:   dbRepo,
-		id:     values[0].(int64),
-		parent: values[1].(int64),
-		info: &fs.DirInfo{
-			Name:   values[2].(string),
-			Mode:   uint32(values[3].(int64)),
-			Strong: values[4].(string),
-			Parent: values[5].(string)}}, true
+func (dbRepo *DbRepo) removeFile(dbfile *dbFile) os.Error {
+	if err := dbRepo.exec(`DELETE FROM blocks WHERE parent = ?`, dbfile.id); err != nil {
+		return err
+	}
+	return dbRepo.exec(`DELETE FROM files WHERE rowid = ?`, dbfile.id)
+}
+
+func (dbRepo *DbRepo) removeDir(dbdir *dbDir) os.Error {
+	subdirs, err := dbRepo.subdirsOf(dbdir)
+	if err != nil {
+		return err
+	}
+	for _, subdir := range subdirs {
+		if err = dbRepo.removeDir(subdir.(*dbDir)); err != nil {
+			return err
+		}
+	}
+
+	files, err := dbRepo.filesOf(dbdir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = dbRepo.removeFile(file.(*dbFile)); err != nil {
+			return err
+		}
+	}
+
+	return dbRepo.exec(`DELETE FROM dirs WHERE rowid = ?`, dbdir.id)
+}
+
+func (dbRepo *DbRepo) ParentOf(node fs.Node) (fs.FsNode, bool, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	switch dbnode := node.(type) {
+	case *dbBlock:
+		if dbnode.parent == -1 {
+			return nil, false, nil
+		}
+		values, err := dbRepo.queryRow(selectFiles+` WHERE f.rowid = ?`, dbnode.parent)
+		if err != nil || values == nil {
+			return nil, false, err
+		}
+		file, err := dbRepo.scanFile(values)
+		if err != nil {
+			return nil, false, err
+		}
+		return file, true, nil
+
+	case *dbFile:
+		return dbRepo.parentDir(dbnode.parent)
+	case *dbDir:
+		return dbRepo.parentDir(dbnode.parent)
+	}
+	return nil, false, nil
+}
+
+func (dbRepo *DbRepo) parentDir(id int64) (fs.FsNode, bool, os.Error) {
+	if id == -1 {
+		return nil, false, nil
+	}
+	values, err := dbRepo.queryRow(selectDirs+` WHERE d.rowid = ?`, id)
+	if err != nil || values == nil {
+		return nil, false, err
+	}
+	node, err := dbRepo.scanDir(values)
+	if err != nil {
+		return nil, false, err
+	}
+	return node, true, nil
+}
+
+func (dbRepo *DbRepo) SubdirsOf(dir fs.Dir) ([]fs.Dir, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	return dbRepo.subdirsOf(dir.(*dbDir))
 }
 
-func (dbRepo *DbRepo) SubdirsOf(dir *dbDir) []fs.Dir {
+func (dbRepo *DbRepo) subdirsOf(dir *dbDir) ([]fs.Dir, os.Error) {
 	result := []fs.Dir{}
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT d.rowid, p.rowid, d.name, d.mode, d.strong, p.strong 
-			FROM dirs AS d LEFT OUTER JOIN dirs AS p ON d.parent = p.rowid
-			WHERE p.rowid = ?`, dir.id)
-	_, err := stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
-		result = append(result, &dbDir{
-			repo:   dbRepo,
-			id:     values[0].(int64),
-			parent: values[1].(int64),
-			info: &fs.DirInfo{
-				Name:   values[2].(string),
-				Mode:   uint32(values[3].(int64)),
-				Strong: values[4].(string),
-				Parent: values[5].(string)}})
-	})
+	err := dbRepo.queryAll(func(values []interface{}) os.Error {
+		subdir, err := dbRepo.scanDir(values)
+		if err == nil {
+			result = append(result, subdir)
+		}
+		return err
+	}, selectDirs+` WHERE d.parent = ?`, dir.id)
 	if err != nil {
-		log.Printf("%v", err)
+		return nil, err
 	}
-	return result
-}
-
-func (dbRepo *DbRepo) FilesOf(dir *dbDir) []fs.File {
-	var result []fs.File
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT f.rowid, p.rowid, f.name, f.mode, f.size, f.strong, p.strong 
-			FROM files AS f LEFT OUTER JOIN dirs AS p ON f.parent = p.rowid
-			WHERE p.rowid = ?`, dir.id)
-	_, err := stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
-		result = append(result, &dbFile{
-			repo:   dbRepo,
-			id:     values[0].(int64),
-			parent: values[1].(int64),
-			info: &fs.FileInfo{
-				Name:   values[2].(string),
-				Mode:   uint32(values[3].(int64)),
-				Size:   values[4].(int64),
-				Strong: values[5].(string),
-				Parent: values[6].(string)}})
-	})
+	return result, nil
+}
+
+func (dbRepo *DbRepo) FilesOf(dir fs.Dir) ([]fs.File, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	return dbRepo.filesOf(dir.(*dbDir))
+}
+
+func (dbRepo *DbRepo) filesOf(dir *dbDir) ([]fs.File, os.Error) {
+	result := []fs.File{}
+	err := dbRepo.queryAll(func(values []interface{}) os.Error {
+		file, err := dbRepo.scanFile(values)
+		if err == nil {
+			result = append(result, file)
+		}
+		return err
+	}, selectFiles+` WHERE f.parent = ?`, dir.id)
 	if err != nil {
-		log.Printf("%v", err)
+		return nil, err
 	}
-	return result
+	return result, nil
 }
 
-func (dbRepo *DbRepo) BlocksOf(file *dbFile) []fs.Block {
+func (dbRepo *DbRepo) BlocksOf(file fs.File) ([]fs.Block, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
 	result := []fs.Block{}
-	stmt, _ := dbRepo.db.Prepare(
-		`SELECT b.rowid, p.rowid, b.weak, b.pos, b.strong, p.strong 
-			FROM blocks AS b LEFT OUTER JOIN files AS p ON b.parent = p.rowid
-			WHERE p.rowid = ?`, file.id)
-	stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
-		result = append(result, &dbBlock{
-			repo:   dbRepo,
-			id:     values[0].(int64),
-			parent: values[1].(int64),
-			info: &fs.BlockInfo{
-				Weak:     int(values[2].(int64)),
-				Position: int(values[3].(int64)),
-				Strong:   values[4].(string),
-				Parent:   values[5].(string)}})
-	})
-	return result
-}
-
-func (dbRepo *DbRepo) UpdateStrong(dir *dbDir) string {
-	newStrong := fs.CalcStrong(dir)
-	if newStrong != dir.info.Strong {
-		//		log.Printf("newStrong: %v dir: %v", newStrong, dir)
-		stmt, err := dbRepo.db.Prepare(
-			`UPDATE dirs SET strong = ? WHERE rowid = ?`, newStrong, dir.id)
-		if err != nil {
-			log.Printf("%v", err)
+	err := dbRepo.queryAll(func(values []interface{}) os.Error {
+		block, err := dbRepo.scanBlock(values)
+		if err == nil {
+			result = append(result, block)
 		}
-		stmt.Step()
-		stmt.Finalize()
+		return err
+	}, selectBlocks+` WHERE b.parent = ?`, file.(*dbFile).id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Store a directory's new strong checksum.
+// A read-only repo only calculates it, and stores nothing.
+func (dbRepo *DbRepo) SetStrong(dir fs.Dir, newStrong string) os.Error {
+	dbdir := dir.(*dbDir)
+	if newStrong == dbdir.info.Strong || dbRepo.readOnly {
+		return nil
+	}
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
 
-		dir.info.Strong = newStrong
+	return dbRepo.setStrong(dbdir, newStrong)
+}
+
+// Store a directory's new strong checksum. Expects the mutex to be held.
+func (dbRepo *DbRepo) setStrong(dbdir *dbDir, newStrong string) os.Error {
+	if newStrong == dbdir.info.Strong || dbRepo.readOnly {
+		return nil
+	}
+
+	err := dbRepo.exec(`UPDATE dirs SET strong = ? WHERE rowid = ?`,
+		dbRepo.sealStrong(newStrong), dbdir.id)
+	if err != nil {
+		return err
 	}
-	return newStrong
+	dbdir.info.Strong = newStrong
+	return nil
 }
 
 func (dbRepo *DbRepo) Close() {
-	dbRepo.db.Close()
-	dbRepo.db = nil
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	if dbRepo.db != nil {
+		if dbRepo.reading || dbRepo.bulk > 0 {
+			dbRepo.finalizeStmts()
+			dbRepo.db.Execute("ROLLBACK")
+		}
+		dbRepo.db.Close()
+		dbRepo.db = nil
+	}
 }
 
+// Open a database for reading and writing, creating it if necessary.
 func NewDbRepo(dbpath string) (*DbRepo, os.Error) {
+	return OpenDbRepo(dbpath, DbOptions{})
+}
+
+// Open a database with the given options.
+func OpenDbRepo(dbpath string, options DbOptions) (*DbRepo, os.Error) {
+	if options.ReadOnly && dbpath != ":memory:" {
+		// Opening would otherwise create it
+		if _, err := os.Stat(dbpath); err != nil {
+			return nil, err
+		}
+	}
+
 	db, err := sqlite3.Open(dbpath)
 	if err != nil {
 		return nil, err
 	}
 
-	dbRepo := &DbRepo{db: db, dbpath: dbpath}
-	err = dbRepo.createTables()
-	return dbRepo, err
-}
-
-const cr_blocks = `CREATE TABLE IF NOT EXISTS blocks (
-		parent INTEGER,
-		strong TEXT,
-		weak INTEGER,
-		pos INTEGER);`
-
-const cr_bl_parent = `CREATE INDEX IF NOT EXISTS bl_parent ON blocks (parent);`
-const cr_bl_strong = `CREATE INDEX IF NOT EXISTS bl_strong ON blocks (strong);`
-const cr_bl_weak = `CREATE INDEX IF NOT EXISTS bl_weak ON blocks (weak);`
-const cr_files = `CREATE TABLE IF NOT EXISTS files (
-		parent INTEGER,
-		strong TEXT,
-		name TEXT,
-		mode INTEGER,
-		size INTEGER);`
-const cr_fi_parent = `CREATE INDEX IF NOT EXISTS fi_parent ON files (parent);`
-const cr_fi_strong = `CREATE INDEX IF NOT EXISTS fi_strong ON files (strong);`
-const cr_dirs = `CREATE TABLE IF NOT EXISTS dirs (
-		parent INTEGER,
-		strong TEXT,
-		name TEXT,
-		mode INTEGER);`
-const cr_di_parent = `CREATE INDEX IF NOT EXISTS di_parent ON dirs (parent);`
-const cr_di_strong = `CREATE INDEX IF NOT EXISTS di_strong ON dirs (strong);`
+	conn := &dbConn{db: db, dbpath: dbpath, readOnly: options.ReadOnly, keys: options.Keys}
+	conn.bulkEnded = sync.NewCond(&conn.mutex)
+	dbRepo := &DbRepo{dbConn: conn}
+	if options.ReadOnly {
+		if _, err = db.Execute(queryOnly); err == nil {
+			err = dbRepo.checkVersion()
+		}
+	} else {
+		err = dbRepo.createTables(options.Durable)
+	}
+	if err == nil {
+		err = dbRepo.checkKeys()
+	}
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return dbRepo, nil
+}
+
+// Open a second, read-only connection to the database, and begin a
+// transaction in it. Until it is closed, the repo returned sees the tree
+// as it was when the transaction began, however this repo changes.
+//
+// Unless the database is Durable, it cannot be written to while the
+// transaction is open.
+func (dbRepo *DbRepo) BeginRead() (*DbRepo, os.Error) {
+	if dbRepo.dbpath == ":memory:" {
+		return nil, os.NewError("In-memory databases cannot be read from another connection")
+	}
+
+	reader, err := OpenDbRepo(dbRepo.dbpath, DbOptions{ReadOnly: true, Keys: dbRepo.keys})
+	if err != nil {
+		return nil, err
+	}
+	reader.RootPath = dbRepo.RootPath
+
+	// The transaction takes its view of the database at the first read
+	if _, err = reader.db.Execute("BEGIN"); err == nil {
+		reader.reading = true
+		_, _, err = reader.queryInt(`SELECT COUNT(*) FROM dirs`)
+	}
+
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
 const dangerous = `PRAGMA synchronous = OFF;`
+const walJournal = `PRAGMA journal_mode = WAL;`
+const syncNormal = `PRAGMA synchronous = NORMAL;`
+const queryOnly = `PRAGMA query_only = ON;`
 
-func (dbRepo *DbRepo) createTables() os.Error {
-	for _, sql := range []string{
-		cr_blocks, cr_bl_parent, cr_bl_strong, cr_bl_weak,
-		cr_files, cr_fi_parent, cr_fi_strong,
-		cr_dirs, cr_di_parent, cr_di_strong,
-		dangerous} {
+func (dbRepo *DbRepo) createTables(durable bool) os.Error {
+	pragmas := []string{dangerous}
+	if durable {
+		pragmas = []string{walJournal, syncNormal}
+	}
+
+	for _, sql := range pragmas {
 		_, err := dbRepo.db.Execute(sql)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return dbRepo.migrate()
 }
 
 func (dbRepo *DbRepo) IndexFilter() fs.IndexFilter {
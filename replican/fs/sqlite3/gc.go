@@ -0,0 +1,184 @@
+package sqlite3
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Forget a snapshot. Its records remain until the next Collect.
+func (dbRepo *DbRepo) DeleteSnapshot(name string) os.Error {
+	if err := dbRepo.checkWritable(); err != nil {
+		return err
+	}
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	if _, has, err := dbRepo.queryInt(
+		`SELECT rowid FROM snapshots WHERE name = ?`, name); err != nil {
+		return err
+	} else if !has {
+		return os.NewError(fmt.Sprintf("Snapshot %s not found", name))
+	}
+
+	return dbRepo.exec(`DELETE FROM snapshots WHERE name = ?`, name)
+}
+
+// Mark and sweep records no longer reachable from any retained root.
+//
+// In the live tree, every directory without a parent is a root, and
+// anything left without a parent is swept. In the snapshot tables, the
+// roots are the snapshots which have not been deleted.
+func (dbRepo *DbRepo) Collect() (report *fs.GCReport, err os.Error) {
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	report = &fs.GCReport{}
+
+	if err = dbRepo.begin(); err != nil {
+		return nil, err
+	}
+
+	if err = dbRepo.collectLive(report); err == nil {
+		err = dbRepo.collectSnapshots(report)
+	}
+	if err == nil {
+		err = dbRepo.forgetUnreached()
+	}
+
+	if err != nil {
+		dbRepo.rollback()
+		return nil, err
+	}
+
+	if err = dbRepo.commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Execute a statement, and return the number of rows it changed.
+func (dbRepo *DbRepo) execCount(sql string, values ...interface{}) (int64, os.Error) {
+	if err := dbRepo.exec(sql, values...); err != nil {
+		return 0, err
+	}
+	n, _, err := dbRepo.queryInt(`SELECT changes()`)
+	return n, err
+}
+
+func (dbRepo *DbRepo) collectLive(report *fs.GCReport) os.Error {
+	// Removing a directory orphans its subdirectories, so keep
+	// sweeping until there are no more.
+	for {
+		n, err := dbRepo.execCount(
+			`DELETE FROM dirs WHERE parent IS NOT NULL
+				AND parent NOT IN (SELECT rowid FROM dirs)`)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		report.Dirs += n
+	}
+
+	n, err := dbRepo.execCount(
+		`DELETE FROM files WHERE parent NOT IN (SELECT rowid FROM dirs)`)
+	if err != nil {
+		return err
+	}
+	report.Files += n
+
+	// The size of an orphaned block's file is no longer known,
+	// so its bytes are not counted.
+	n, err = dbRepo.execCount(
+		`DELETE FROM blocks WHERE parent NOT IN (SELECT rowid FROM files)`)
+	report.Blocks += n
+	return err
+}
+
+func (dbRepo *DbRepo) collectSnapshots(report *fs.GCReport) os.Error {
+	// Mark every directory reachable from a snapshot root
+	for _, sql := range []string{
+		`CREATE TEMP TABLE snap_marked (id INTEGER PRIMARY KEY)`,
+		`INSERT OR IGNORE INTO snap_marked SELECT root FROM snapshots`} {
+		if _, err := dbRepo.db.Execute(sql); err != nil {
+			return err
+		}
+	}
+	defer dbRepo.db.Execute(`DROP TABLE snap_marked`)
+
+	for {
+		n, err := dbRepo.execCount(
+			`INSERT OR IGNORE INTO snap_marked
+				SELECT child FROM snap_entries
+				WHERE isdir = 1 AND dir IN (SELECT id FROM snap_marked)`)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	// Sweep everything unmarked, and whatever only it referred to
+	n, err := dbRepo.execCount(
+		`DELETE FROM snap_dirs WHERE rowid NOT IN (SELECT id FROM snap_marked)`)
+	if err != nil {
+		return err
+	}
+	report.Dirs += n
+
+	if _, err = dbRepo.execCount(
+		`DELETE FROM snap_entries WHERE dir NOT IN (SELECT id FROM snap_marked)`); err != nil {
+		return err
+	}
+
+	unreferenced := `rowid NOT IN (SELECT child FROM snap_entries WHERE isdir = 0)`
+	if err = dbRepo.sumOrphanBlocks(report,
+		`SELECT COUNT(*), TOTAL(MIN(f.size - b.pos * ?, ?))
+			FROM snap_blocks AS b JOIN snap_files AS f ON b.file = f.rowid
+			WHERE f.`+unreferenced); err != nil {
+		return err
+	}
+
+	n, err = dbRepo.execCount(`DELETE FROM snap_files WHERE ` + unreferenced)
+	if err != nil {
+		return err
+	}
+	report.Files += n
+
+	_, err = dbRepo.execCount(
+		`DELETE FROM snap_blocks WHERE file NOT IN (SELECT rowid FROM snap_files)`)
+	return err
+}
+
+// Count blocks about to be swept, and the bytes of content they held.
+func (dbRepo *DbRepo) sumOrphanBlocks(report *fs.GCReport, sql string) os.Error {
+	stmt, err := dbRepo.db.Prepare(sql, int64(fs.BLOCKSIZE), int64(fs.BLOCKSIZE))
+	if err != nil {
+		return err
+	}
+	defer stmt.Finalize()
+
+	if err = stmt.Step(); err != nil {
+		return err
+	}
+	row := stmt.Row()
+	if len(row) < 2 {
+		return nil
+	}
+	if n, is := row[0].(int64); is {
+		report.Blocks += n
+	}
+	if bytes, is := row[1].(float64); is {
+		report.Bytes += int64(bytes)
+	}
+	return nil
+}
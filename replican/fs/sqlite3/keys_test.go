@@ -0,0 +1,271 @@
+package sqlite3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+// Names are sealed in the database, and read back through the keys.
+func TestSealedNames(t *testing.T) {
+	dbF, err := ioutil.TempFile("", "test.db")
+	assert.T(t, err == nil)
+	dbF.Close()
+	defer os.Remove(dbF.Name())
+
+	keys := fs.DeriveKeys([]byte("secret"), []byte("salt"), 10)
+	dbrepo, err := OpenDbRepo(dbF.Name(), DbOptions{Keys: keys})
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.D("secrets",
+			tg.F("plans", tg.B(42, 65537))),
+		tg.F("diary", tg.B(43, 1000))))
+	defer os.RemoveAll(path)
+
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	_, err = dbrepo.Snapshot("v1", foo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	names := []string{}
+	for _, sql := range []string{
+		`SELECT name FROM files`, `SELECT name FROM dirs`, `SELECT name FROM snap_entries`} {
+		err = dbrepo.queryAll(func(values []interface{}) os.Error {
+			names = append(names, values[0].(string))
+			return nil
+		}, sql)
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	assert.Equal(t, 7, len(names))
+	for _, name := range names {
+		for _, plain := range []string{"foo", "secrets", "plans", "diary"} {
+			assert.Tf(t, name != plain, "%s stored in plain", plain)
+		}
+	}
+
+	// Read back the live tree and the snapshot
+	for _, repo := range []fs.NodeRepo{dbrepo, mustOpenSnapshot(t, dbrepo, "v1")} {
+		root := fstest.RootDir(t, repo)
+		assert.Equal(t, foo.Info().Strong, root.Info().Strong)
+		node, found := fs.Lookup(root, filepath.Join("secrets", "plans"))
+		assert.T(t, found)
+		assert.Equal(t, "plans", node.Name())
+		assert.Equal(t, filepath.Join("secrets", "plans"), fs.RelPath(node))
+	}
+
+	// Renames are sealed too
+	diary, found := fs.Lookup(fstest.RootDir(t, dbrepo), "diary")
+	assert.T(t, found)
+	_, err = dbrepo.Rename(diary, fstest.RootDir(t, dbrepo), "journal")
+	assert.Tf(t, err == nil, "%v", err)
+	_, found = fs.Lookup(fstest.RootDir(t, dbrepo), "journal")
+	assert.T(t, found)
+	n, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM files WHERE name = ?`, "journal")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(0), n)
+}
+
+// No checksum is stored in plain, but nodes can still be found by them.
+func TestSealedChecksums(t *testing.T) {
+	dbF, err := ioutil.TempFile("", "test.db")
+	assert.T(t, err == nil)
+	dbF.Close()
+	defer os.Remove(dbF.Name())
+
+	keys := fs.DeriveKeys([]byte("secret"), []byte("salt"), 10)
+	dbrepo, err := OpenDbRepo(dbF.Name(), DbOptions{Keys: keys})
+	assert.Tf(t, err == nil, "%v", err)
+
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.D("secrets",
+			tg.F("plans", tg.B(42, 65537))),
+		tg.F("diary", tg.B(43, 1000))))
+	defer os.RemoveAll(path)
+
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	_, err = dbrepo.Snapshot("v1", foo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Everything a known copy of the tree would reveal
+	plain, errors := fs.IndexDir(filepath.Join(path, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	strongs, weaks := []string{}, []int{}
+	fs.Walk(plain, func(node fs.Node) bool {
+		switch node := node.(type) {
+		case fs.Dir:
+			strongs = append(strongs, node.Info().Strong)
+		case fs.File:
+			strongs = append(strongs, node.Info().Strong)
+		case fs.Block:
+			strongs = append(strongs, node.Info().Strong)
+			weaks = append(weaks, node.Info().Weak)
+		}
+		return true
+	})
+	assert.T(t, len(weaks) > 0)
+
+	for _, repo := range []fs.NodeRepo{dbrepo, mustOpenSnapshot(t, dbrepo, "v1")} {
+		for _, strong := range strongs {
+			_, hasDir, err := repo.Dir(strong)
+			assert.Tf(t, err == nil, "%v", err)
+			_, hasFile, err := repo.File(strong)
+			assert.Tf(t, err == nil, "%v", err)
+			_, hasBlock, err := repo.Block(strong)
+			assert.Tf(t, err == nil, "%v", err)
+			assert.Tf(t, hasDir || hasFile || hasBlock, "%s not found", strong)
+		}
+		for _, weak := range weaks {
+			block, has, err := repo.WeakBlock(weak)
+			assert.Tf(t, err == nil, "%v", err)
+			assert.Tf(t, has, "weak %d not found", weak)
+			assert.Equal(t, weak, block.Info().Weak)
+		}
+	}
+
+	n, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM blocks WHERE weak = ?`, int64(weaks[0]))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(0), n)
+	dbrepo.Close()
+
+	raw, err := ioutil.ReadFile(dbF.Name())
+	assert.Tf(t, err == nil, "%v", err)
+	for _, strong := range strongs {
+		assert.Tf(t, !bytes.Contains(raw, []byte(strong)), "%s stored in plain", strong)
+	}
+}
+
+// A sealed name which cannot be opened is an error, not a name.
+func TestUnopenableName(t *testing.T) {
+	keys := fs.DeriveKeys([]byte("secret"), []byte("salt"), 10)
+	dbrepo, path := createDbRepoWith(t, keys)
+	defer os.Remove(path)
+	defer dbrepo.Close()
+
+	tg := treegen.New()
+	treePath := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar", tg.F("baz", tg.B(42, 1000)))))
+	defer os.RemoveAll(treePath)
+	foo, errors := fs.IndexDir(filepath.Join(treePath, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	_, err := dbrepo.Snapshot("v1", foo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	for _, sql := range []string{
+		`UPDATE files SET name = 'garbage'`,
+		`UPDATE snap_entries SET name = 'garbage' WHERE isdir = 0`} {
+		assert.T(t, dbrepo.exec(sql) == nil)
+	}
+
+	otherPath := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar", tg.F("baz", tg.B(43, 1000)))))
+	defer os.RemoveAll(otherPath)
+	other, errors := fs.IndexDir(filepath.Join(otherPath, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	for _, repo := range []fs.NodeRepo{dbrepo, mustOpenSnapshot(t, dbrepo, "v1")} {
+		root := fstest.RootDir(t, repo)
+		_, _, err = fs.CheckedLookup(root, filepath.Join("bar", "baz"))
+		assert.T(t, err != nil)
+		err = fs.CheckedWalk(root, func(node fs.Node) bool { return true })
+		assert.T(t, err != nil)
+		err = fs.Diff(root, other, func(change *fs.Change) {})
+		assert.T(t, err != nil)
+	}
+}
+
+// A database is only opened with the keys it was written with.
+func TestKeyCheck(t *testing.T) {
+	keys := fs.DeriveKeys([]byte("secret"), []byte("salt"), 10)
+	otherKeys := fs.DeriveKeys([]byte("guess"), []byte("salt"), 10)
+
+	sealedDb, sealedPath := createDbRepoWith(t, keys)
+	defer os.Remove(sealedPath)
+	sealedDb.Close()
+	plainDb, plainPath := createDbRepoWith(t, nil)
+	defer os.Remove(plainPath)
+	plainDb.Close()
+
+	for i, open := range []struct {
+		path string
+		keys *fs.Keys
+		ok   bool
+	}{
+		{sealedPath, keys, true},
+		{sealedPath, otherKeys, false},
+		{sealedPath, nil, false},
+		{plainPath, nil, true},
+		{plainPath, keys, false}} {
+		for _, readOnly := range []bool{false, true} {
+			dbrepo, err := OpenDbRepo(open.path, DbOptions{ReadOnly: readOnly, Keys: open.keys})
+			assert.Equalf(t, open.ok, err == nil, "open %d: %v", i, err)
+			if dbrepo != nil {
+				dbrepo.Close()
+			}
+		}
+	}
+}
+
+// A database written before it recorded its keys is not sealed by the
+// first keys it is opened with, unless it is empty.
+func TestKeyCheckUnrecorded(t *testing.T) {
+	keys := fs.DeriveKeys([]byte("secret"), []byte("salt"), 10)
+
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 1000))))
+	defer os.RemoveAll(path)
+
+	usedDb, usedPath := createDbRepoWith(t, nil)
+	defer os.Remove(usedPath)
+	_, errors := fs.IndexDir(filepath.Join(path, "foo"), usedDb)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	emptyDb, emptyPath := createDbRepoWith(t, nil)
+	defer os.Remove(emptyPath)
+
+	for _, dbrepo := range []*DbRepo{usedDb, emptyDb} {
+		assert.T(t, dbrepo.exec(`DELETE FROM key_check`) == nil)
+		dbrepo.Close()
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		_, err := OpenDbRepo(usedPath, DbOptions{ReadOnly: readOnly, Keys: keys})
+		assert.T(t, err != nil)
+	}
+	dbrepo, err := OpenDbRepo(usedPath, DbOptions{})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, fstest.RootDir(t, dbrepo) != nil)
+	dbrepo.Close()
+
+	dbrepo, err = OpenDbRepo(emptyPath, DbOptions{Keys: keys})
+	assert.Tf(t, err == nil, "%v", err)
+	dbrepo.Close()
+	_, err = OpenDbRepo(emptyPath, DbOptions{})
+	assert.T(t, err != nil)
+}
+
+func createDbRepoWith(t *testing.T, keys *fs.Keys) (*DbRepo, string) {
+	dbF, err := ioutil.TempFile("", "test.db")
+	assert.T(t, err == nil)
+	dbF.Close()
+	dbrepo, err := OpenDbRepo(dbF.Name(), DbOptions{Keys: keys})
+	assert.Tf(t, err == nil, "%v", err)
+	return dbrepo, dbF.Name()
+}
+
+func mustOpenSnapshot(t *testing.T, dbrepo *DbRepo, name string) *SnapshotRepo {
+	snapshot, err := dbrepo.OpenSnapshot(name)
+	assert.Tf(t, err == nil, "%v", err)
+	return snapshot
+}
@@ -0,0 +1,177 @@
+package sqlite3
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// The schema, as a series of migrations. Each one brings the database
+// from the version before it up to its own, numbering from 1.
+//
+// A migration must never change once it has been released, since
+// databases which have applied it will not apply it again. The schema is
+// only changed by adding migrations.
+//
+// Databases made before the schema was versioned already have the tables
+// of version 1, so its statements must succeed if they exist.
+var migrations = [][]string{
+	// 1: The live tree and snapshots
+	[]string{
+		`CREATE TABLE IF NOT EXISTS blocks (
+			parent INTEGER,
+			strong TEXT,
+			weak INTEGER,
+			pos INTEGER)`,
+		`CREATE INDEX IF NOT EXISTS bl_parent ON blocks (parent)`,
+		`CREATE INDEX IF NOT EXISTS bl_strong ON blocks (strong)`,
+		`CREATE INDEX IF NOT EXISTS bl_weak ON blocks (weak)`,
+		`CREATE TABLE IF NOT EXISTS files (
+			parent INTEGER,
+			strong TEXT,
+			name TEXT,
+			mode INTEGER,
+			size INTEGER)`,
+		`CREATE INDEX IF NOT EXISTS fi_parent ON files (parent)`,
+		`CREATE INDEX IF NOT EXISTS fi_strong ON files (strong)`,
+		`CREATE TABLE IF NOT EXISTS dirs (
+			parent INTEGER,
+			strong TEXT,
+			name TEXT,
+			mode INTEGER)`,
+		`CREATE INDEX IF NOT EXISTS di_parent ON dirs (parent)`,
+		`CREATE INDEX IF NOT EXISTS di_strong ON dirs (strong)`,
+		`CREATE TABLE IF NOT EXISTS snapshots (
+			name TEXT UNIQUE,
+			tstamp INTEGER,
+			root INTEGER,
+			mode INTEGER)`,
+		`CREATE TABLE IF NOT EXISTS snap_dirs (
+			key TEXT UNIQUE,
+			strong TEXT)`,
+		`CREATE INDEX IF NOT EXISTS sd_strong ON snap_dirs (strong)`,
+		`CREATE TABLE IF NOT EXISTS snap_files (
+			strong TEXT UNIQUE,
+			size INTEGER)`,
+		`CREATE TABLE IF NOT EXISTS snap_blocks (
+			file INTEGER,
+			strong TEXT,
+			weak INTEGER,
+			pos INTEGER)`,
+		`CREATE INDEX IF NOT EXISTS sb_file ON snap_blocks (file)`,
+		`CREATE INDEX IF NOT EXISTS sb_strong ON snap_blocks (strong)`,
+		`CREATE INDEX IF NOT EXISTS sb_weak ON snap_blocks (weak)`,
+		`CREATE TABLE IF NOT EXISTS snap_entries (
+			dir INTEGER,
+			name TEXT,
+			mode INTEGER,
+			isdir INTEGER,
+			child INTEGER)`,
+		`CREATE INDEX IF NOT EXISTS se_dir ON snap_entries (dir)`,
+		`CREATE INDEX IF NOT EXISTS se_child ON snap_entries (isdir, child)`},
+
+	// 2: File modification times, so that a kept index can be checked
+	// against its directory without reading every file again
+	[]string{`ALTER TABLE files ADD COLUMN mtime INTEGER NOT NULL DEFAULT 0`},
+
+	// 3: Whether names and checksums are sealed, with a value sealed by
+	// the keys, so that the database is only opened with those keys
+	[]string{`CREATE TABLE IF NOT EXISTS key_check (sealed INTEGER, value TEXT)`},
+}
+
+const cr_schema_version = `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER,
+		tstamp INTEGER);`
+
+// The version of the schema this package reads and writes.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// The version of the schema in the database, which is 0 if it
+// has never been migrated.
+func (dbRepo *DbRepo) schemaVersion() (int, os.Error) {
+	if _, has, err := dbRepo.queryInt(
+		`SELECT rowid FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'`); err != nil {
+		return 0, err
+	} else if !has {
+		return 0, nil
+	}
+
+	version, _, err := dbRepo.queryInt(`SELECT MAX(version) FROM schema_version`)
+	return int(version), err
+}
+
+// Refuse a database with a schema newer than this package knows.
+func (dbRepo *DbRepo) checkNewer(version int) os.Error {
+	if version > SchemaVersion() {
+		return os.NewError(fmt.Sprintf(
+			"%s has schema version %d, newer than the supported version %d",
+			dbRepo.dbpath, version, SchemaVersion()))
+	}
+	return nil
+}
+
+// Check that a database can be read without migrating it.
+func (dbRepo *DbRepo) checkVersion() os.Error {
+	version, err := dbRepo.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if err = dbRepo.checkNewer(version); err != nil {
+		return err
+	}
+	if version < SchemaVersion() {
+		return os.NewError(fmt.Sprintf(
+			"%s has schema version %d, and must be opened for writing to upgrade it to %d",
+			dbRepo.dbpath, version, SchemaVersion()))
+	}
+	return nil
+}
+
+// Bring the database up to the current schema version.
+// Each migration is applied in its own transaction.
+func (dbRepo *DbRepo) migrate() os.Error {
+	if _, err := dbRepo.db.Execute(cr_schema_version); err != nil {
+		return err
+	}
+
+	version, err := dbRepo.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if err = dbRepo.checkNewer(version); err != nil {
+		return err
+	}
+
+	for ; version < SchemaVersion(); version++ {
+		if err = dbRepo.applyMigration(version + 1); err != nil {
+			return os.NewError(fmt.Sprintf(
+				"Failed to migrate %s to schema version %d: %v", dbRepo.dbpath, version+1, err))
+		}
+	}
+	return nil
+}
+
+func (dbRepo *DbRepo) applyMigration(version int) os.Error {
+	if _, err := dbRepo.db.Execute("BEGIN"); err != nil {
+		return err
+	}
+
+	for _, sql := range migrations[version-1] {
+		if _, err := dbRepo.db.Execute(sql); err != nil {
+			dbRepo.db.Execute("ROLLBACK")
+			return err
+		}
+	}
+
+	err := dbRepo.exec(`INSERT INTO schema_version (version, tstamp) VALUES (?,?)`,
+		int64(version), time.Seconds())
+	if err != nil {
+		dbRepo.db.Execute("ROLLBACK")
+		return err
+	}
+
+	_, err = dbRepo.db.Execute("COMMIT")
+	return err
+}
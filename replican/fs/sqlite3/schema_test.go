@@ -0,0 +1,127 @@
+package sqlite3
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+	"github.com/kuroneko/gosqlite3"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	version, err := dbrepo.schemaVersion()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, SchemaVersion(), version)
+
+	// Opening again doesn't migrate again
+	dbrepo.Close()
+	dbrepo, err = NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	count, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM schema_version`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(SchemaVersion()), count)
+}
+
+func TestMigrateUnversioned(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), dbrepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dbrepo.Close()
+
+	// Make it look like a database from before versioning, whose
+	// files have no mtime column
+	db, err := sqlite3.Open(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	for _, sql := range []string{
+		`DROP TABLE schema_version`,
+		`CREATE TABLE old_files (parent INTEGER, strong TEXT, name TEXT, mode INTEGER, size INTEGER)`,
+		`INSERT INTO old_files (rowid, parent, strong, name, mode, size)
+			SELECT rowid, parent, strong, name, mode, size FROM files`,
+		`DROP TABLE files`,
+		`ALTER TABLE old_files RENAME TO files`} {
+		_, err = db.Execute(sql)
+		assert.Tf(t, err == nil, "%s: %v", sql, err)
+	}
+	db.Close()
+
+	_, err = OpenDbRepo(dbpath, DbOptions{ReadOnly: true})
+	assert.T(t, err != nil)
+
+	dbrepo, err = NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+
+	version, err := dbrepo.schemaVersion()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, SchemaVersion(), version)
+	assert.Equal(t, foo.Info().Strong, fstest.RootDir(t, dbrepo).Info().Strong)
+}
+
+func TestMigrateForward(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	dbrepo.Close()
+
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(append([][]string{}, saved...),
+		[]string{`ALTER TABLE dirs ADD COLUMN mtime INTEGER`})
+
+	dbrepo, err := NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+
+	version, err := dbrepo.schemaVersion()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, len(saved)+1, version)
+	assert.Tf(t, dbrepo.exec(`SELECT mtime FROM dirs`) == nil, "column not added")
+}
+
+func TestMigrateFailure(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	dbrepo.Close()
+
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(append([][]string{}, saved...),
+		[]string{`ALTER TABLE dirs ADD COLUMN mtime INTEGER`, `NOT SQL`})
+
+	_, err := NewDbRepo(dbpath)
+	assert.T(t, err != nil)
+
+	// The failed migration was rolled back entirely
+	migrations = saved
+	dbrepo, err = NewDbRepo(dbpath)
+	assert.Tf(t, err == nil, "%v", err)
+	defer dbrepo.Close()
+	assert.T(t, dbrepo.exec(`SELECT mtime FROM dirs`) != nil)
+}
+
+func TestNewerSchema(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	err := dbrepo.exec(`INSERT INTO schema_version (version, tstamp) VALUES (?,?)`,
+		int64(SchemaVersion()+1), int64(0))
+	assert.Tf(t, err == nil, "%v", err)
+	dbrepo.Close()
+
+	_, err = NewDbRepo(dbpath)
+	assert.T(t, err != nil)
+	_, err = OpenDbRepo(dbpath, DbOptions{ReadOnly: true})
+	assert.T(t, err != nil)
+}
@@ -0,0 +1,880 @@
+package sqlite3
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/kuroneko/gosqlite3"
+)
+
+// Snapshots are named, timestamped copies of a directory tree
+// kept in the snap_* tables of a DbRepo.
+//
+// Unlike the live tree, snapshot records are content-addressed and
+// shared between snapshots: a file's contents and blocks are stored once
+// per strong checksum, and a directory listing is stored once per
+// strong checksum and entry modes. Names and modes live on the
+// entries that link a directory to its contents.
+
+// A named, timestamped version of a directory tree.
+type Snapshot struct {
+	Name string
+
+	// Time the snapshot was taken, in seconds since the epoch.
+	Time int64
+
+	// Strong checksum of the root directory.
+	Strong string
+
+	root int64
+	mode uint32
+}
+
+// Store a copy of the tree at root as a new snapshot.
+// The tree may come from any NodeRepo.
+func (dbRepo *DbRepo) Snapshot(name string, root fs.FsNode) (*Snapshot, os.Error) {
+	rootDir, isDir := root.(fs.Dir)
+	if !isDir {
+		return nil, os.NewError("Only directories can be snapshotted")
+	}
+	if err := dbRepo.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	// Reading our own tree while holding the lock would deadlock,
+	// so take a copy of it first.
+	if dbRepo.owns(rootDir.Repo()) {
+		copied, err := fs.CopyTree(rootDir, fs.NewMemRepo())
+		if err != nil {
+			return nil, err
+		}
+		rootDir = copied.(fs.Dir)
+	}
+
+	dbRepo.lockWriter()
+	defer dbRepo.mutex.Unlock()
+
+	if _, has, err := dbRepo.queryInt(
+		`SELECT rowid FROM snapshots WHERE name = ?`, name); err != nil {
+		return nil, err
+	} else if has {
+		return nil, os.NewError(fmt.Sprintf("Snapshot %s already exists", name))
+	}
+
+	if err := dbRepo.begin(); err != nil {
+		return nil, err
+	}
+
+	snapshot, err := dbRepo.putSnapshot(name, rootDir)
+	if err != nil {
+		dbRepo.rollback()
+		return nil, err
+	}
+
+	if err = dbRepo.commit(); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Determine whether a NodeRepo reads from this repository's database.
+func (dbRepo *DbRepo) owns(repo fs.NodeRepo) bool {
+	switch r := repo.(type) {
+	case *DbRepo:
+		return r.dbConn == dbRepo.dbConn
+	case *SnapshotRepo:
+		return r.dbRepo.dbConn == dbRepo.dbConn
+	}
+	return false
+}
+
+func (dbRepo *DbRepo) putSnapshot(name string, rootDir fs.Dir) (*Snapshot, os.Error) {
+	rootId, _, err := dbRepo.putSnapDir(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Name:   name,
+		Time:   time.Seconds(),
+		Strong: rootDir.Info().Strong,
+		root:   rootId,
+		mode:   rootDir.Mode()}
+	err = dbRepo.exec(
+		`INSERT INTO snapshots (name, tstamp, root, mode) VALUES (?,?,?,?)`,
+		name, snapshot.Time, rootId, int64(snapshot.mode))
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+type snapEntry struct {
+	name  string
+	mode  uint32
+	isDir bool
+	child int64
+}
+
+// Store a directory listing and everything beneath it, if not already present.
+// Returns the snap_dirs rowid and the key under which it is shared.
+func (dbRepo *DbRepo) putSnapDir(dir fs.Dir) (id int64, key string, err os.Error) {
+	entries := []*snapEntry{}
+	keyBuf := &bytes.Buffer{}
+
+	// Order entries by name, so that equal listings share a key
+	// however their trees were built.
+	dirContents, err := fs.ReadSubDirs(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	fileContents, err := fs.ReadFiles(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	subdirs := &fs.Dirs{Contents: append([]fs.Dir{}, dirContents...)}
+	sort.Sort(subdirs)
+	files := &fs.Files{Contents: append([]fs.File{}, fileContents...)}
+	sort.Sort(files)
+
+	for _, subdir := range subdirs.Contents {
+		childId, childKey, err := dbRepo.putSnapDir(subdir)
+		if err != nil {
+			return 0, "", err
+		}
+		entries = append(entries, &snapEntry{
+			name: subdir.Name(), mode: subdir.Mode(), isDir: true, child: childId})
+		fmt.Fprintf(keyBuf, "%s\td\t%o\t%s\n", childKey, subdir.Mode(), subdir.Name())
+	}
+
+	for _, file := range files.Contents {
+		childId, err := dbRepo.putSnapFile(file)
+		if err != nil {
+			return 0, "", err
+		}
+		entries = append(entries, &snapEntry{
+			name: file.Name(), mode: file.Mode(), isDir: false, child: childId})
+		fmt.Fprintf(keyBuf, "%s\tf\t%o\t%s\n", file.Info().Strong, file.Mode(), file.Name())
+	}
+
+	key = fs.StrongChecksum(keyBuf.Bytes())
+	if dbRepo.keys != nil {
+		// The key must not tell which names are in the listing
+		key = dbRepo.keys.Address(key)
+	}
+	if id, has, err := dbRepo.queryInt(
+		`SELECT rowid FROM snap_dirs WHERE key = ?`, key); err != nil || has {
+		return id, key, err
+	}
+
+	err = dbRepo.exec(`INSERT INTO snap_dirs (key, strong) VALUES (?,?)`,
+		key, dbRepo.sealStrong(dir.Info().Strong))
+	if err != nil {
+		return 0, "", err
+	}
+	if id, err = dbRepo.lastInsertId(); err != nil {
+		return 0, "", err
+	}
+
+	for _, entry := range entries {
+		isDir := int64(0)
+		if entry.isDir {
+			isDir = 1
+		}
+		err = dbRepo.exec(
+			`INSERT INTO snap_entries (dir, name, mode, isdir, child) VALUES (?,?,?,?,?)`,
+			id, dbRepo.sealName(entry.name), int64(entry.mode), isDir, entry.child)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	return id, key, nil
+}
+
+// Store a file's contents and blocks, if not already present.
+// Returns the snap_files rowid.
+func (dbRepo *DbRepo) putSnapFile(file fs.File) (id int64, err os.Error) {
+	strong := dbRepo.sealStrong(file.Info().Strong)
+	if id, has, err := dbRepo.queryInt(
+		`SELECT rowid FROM snap_files WHERE strong = ?`, strong); err != nil || has {
+		return id, err
+	}
+
+	err = dbRepo.exec(`INSERT INTO snap_files (strong, size) VALUES (?,?)`,
+		strong, file.Info().Size)
+	if err != nil {
+		return 0, err
+	}
+	if id, err = dbRepo.lastInsertId(); err != nil {
+		return 0, err
+	}
+
+	blocks, err := fs.ReadBlocks(file)
+	if err != nil {
+		return 0, err
+	}
+	for _, block := range blocks {
+		err = dbRepo.exec(
+			`INSERT INTO snap_blocks (file, strong, weak, pos) VALUES (?,?,?,?)`,
+			id, dbRepo.sealStrong(block.Info().Strong), dbRepo.sealWeak(block.Info().Weak),
+			int64(block.Info().Position))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// List all the snapshots in the repository, oldest first.
+func (dbRepo *DbRepo) Snapshots() ([]*Snapshot, os.Error) {
+	dbRepo.mutex.Lock()
+	defer dbRepo.mutex.Unlock()
+
+	result := []*Snapshot{}
+	err := dbRepo.queryAll(func(values []interface{}) os.Error {
+		strong, err := dbRepo.openStrong(values[4].(string))
+		if err != nil {
+			return err
+		}
+		result = append(result, &Snapshot{
+			Name:   values[0].(string),
+			Time:   values[1].(int64),
+			root:   values[2].(int64),
+			mode:   uint32(values[3].(int64)),
+			Strong: strong})
+		return nil
+	}, `SELECT s.name, s.tstamp, s.root, s.mode, d.strong
+			FROM snapshots AS s LEFT OUTER JOIN snap_dirs AS d ON s.root = d.rowid
+			ORDER BY s.tstamp, s.rowid`)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Open a named snapshot as a read-only NodeRepo.
+// The snapshot remains valid until the DbRepo is closed.
+func (dbRepo *DbRepo) OpenSnapshot(name string) (*SnapshotRepo, os.Error) {
+	snapshots, err := dbRepo.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			// The records reached are kept in the connection's transaction,
+			// so they must not be written into a bulk load that may abort.
+			dbRepo.lockWriter()
+			defer dbRepo.mutex.Unlock()
+
+			if err = dbRepo.reachSnapshot(snapshot.root); err != nil {
+				return nil, err
+			}
+			return &SnapshotRepo{Snapshot: snapshot, dbRepo: dbRepo}, nil
+		}
+	}
+
+	return nil, os.NewError(fmt.Sprintf("Snapshot %s not found", name))
+}
+
+// Temporary tables of the directories and files reachable from each
+// snapshot root opened, so that records found by checksum are only
+// searched for within the snapshot.
+var reachedTables = []string{
+	`CREATE TEMP TABLE IF NOT EXISTS snap_reached_dirs (
+		root INTEGER,
+		dir INTEGER,
+		PRIMARY KEY (root, dir))`,
+	`CREATE TEMP TABLE IF NOT EXISTS snap_reached_files (
+		root INTEGER,
+		file INTEGER,
+		PRIMARY KEY (root, file))`}
+
+// Record the directories and files reachable from a snapshot root.
+// Snapshots are immutable, so this is only done the first time
+// a snapshot with that root is opened.
+func (dbRepo *DbRepo) reachSnapshot(root int64) os.Error {
+	if dbRepo.readOnly {
+		// Only the connection's own temporary tables are written,
+		// which a read-only database may still have.
+		if _, err := dbRepo.db.Execute(`PRAGMA query_only = OFF;`); err != nil {
+			return err
+		}
+		defer dbRepo.db.Execute(queryOnly)
+	}
+
+	for _, sql := range reachedTables {
+		if _, err := dbRepo.db.Execute(sql); err != nil {
+			return err
+		}
+	}
+
+	if _, has, err := dbRepo.queryInt(
+		`SELECT dir FROM snap_reached_dirs WHERE root = ? AND dir = ?`, root, root); err != nil || has {
+		return err
+	}
+
+	err := dbRepo.exec(`INSERT INTO snap_reached_dirs (root, dir) VALUES (?,?)`, root, root)
+	if err != nil {
+		return err
+	}
+	for {
+		n, err := dbRepo.execCount(
+			`INSERT OR IGNORE INTO snap_reached_dirs
+				SELECT ?, e.child FROM snap_entries AS e
+				WHERE e.isdir = 1 AND e.dir IN (
+					SELECT dir FROM snap_reached_dirs WHERE root = ?)`, root, root)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	return dbRepo.exec(
+		`INSERT OR IGNORE INTO snap_reached_files
+			SELECT ?, e.child FROM snap_entries AS e
+			WHERE e.isdir = 0 AND e.dir IN (
+				SELECT dir FROM snap_reached_dirs WHERE root = ?)`, root, root)
+}
+
+// Forget the records reached from roots which no snapshot has any more,
+// since they may have been collected.
+func (dbRepo *DbRepo) forgetUnreached() os.Error {
+	for _, sql := range reachedTables {
+		if _, err := dbRepo.db.Execute(sql); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"snap_reached_dirs", "snap_reached_files"} {
+		err := dbRepo.exec(`DELETE FROM ` + table + ` WHERE root NOT IN (SELECT root FROM snapshots)`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compare two snapshots and report how the second differs from the first.
+// See fs.Diff.
+func (dbRepo *DbRepo) DiffSnapshots(from string, to string, visitor fs.ChangeVisitor) os.Error {
+	fromRepo, err := dbRepo.OpenSnapshot(from)
+	if err != nil {
+		return err
+	}
+
+	toRepo, err := dbRepo.OpenSnapshot(to)
+	if err != nil {
+		return err
+	}
+
+	return fs.DiffRepos(fromRepo, toRepo, visitor)
+}
+
+func (dbRepo *DbRepo) exec(sql string, values ...interface{}) os.Error {
+	stmt, err := dbRepo.prepare(sql, values...)
+	if err != nil {
+		return err
+	}
+	defer dbRepo.release(stmt)
+	return stmt.Step()
+}
+
+// Query for a single integer value.
+// Also indicates whether a row was found.
+func (dbRepo *DbRepo) queryInt(sql string, values ...interface{}) (int64, bool, os.Error) {
+	stmt, err := dbRepo.prepare(sql, values...)
+	if err != nil {
+		return 0, false, err
+	}
+	defer dbRepo.release(stmt)
+
+	if err = stmt.Step(); err != nil {
+		return 0, false, err
+	}
+	row := stmt.Row()
+	if len(row) == 0 || row[0] == nil {
+		return 0, false, nil
+	}
+	return row[0].(int64), true, nil
+}
+
+// Query for a single row, which is nil if there was no match.
+func (dbRepo *DbRepo) queryRow(sql string, values ...interface{}) ([]interface{}, os.Error) {
+	stmt, err := dbRepo.prepare(sql, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer dbRepo.release(stmt)
+
+	if err = stmt.Step(); err != nil {
+		return nil, err
+	}
+	row := stmt.Row()
+	if len(row) == 0 || row[0] == nil {
+		return nil, nil
+	}
+	return row, nil
+}
+
+// Query for every matching row, passing each to f.
+// The first error f returns is returned, and the rows after it are skipped.
+func (dbRepo *DbRepo) queryAll(f func(values []interface{}) os.Error, sql string, values ...interface{}) os.Error {
+	stmt, err := dbRepo.prepare(sql, values...)
+	if err != nil {
+		return err
+	}
+	defer dbRepo.release(stmt)
+
+	var rowErr os.Error
+	_, err = stmt.All(func(_ *sqlite3.Statement, values ...interface{}) {
+		if rowErr == nil {
+			rowErr = f(values)
+		}
+	})
+	if err == nil {
+		err = rowErr
+	}
+	return err
+}
+
+func (dbRepo *DbRepo) lastInsertId() (int64, os.Error) {
+	id, _, err := dbRepo.queryInt(`SELECT last_insert_rowid()`)
+	return id, err
+}
+
+// A read-only view of a snapshot as a hierarchical tree model.
+//
+// Nodes are loaded on demand. Because directory and file records are
+// shared between snapshots, a node found by checksum is located in
+// this snapshot by searching upward from its record to the snapshot's root,
+// through only the records reachable from that root.
+type SnapshotRepo struct {
+	*Snapshot
+	dbRepo *DbRepo
+}
+
+type snapBlock struct {
+	repo   *SnapshotRepo
+	info   *fs.BlockInfo
+	parent *snapFile
+}
+
+func (block *snapBlock) Repo() fs.NodeRepo { return block.repo }
+
+func (block *snapBlock) Parent() (fs.FsNode, bool) { return block.parent, true }
+
+func (block *snapBlock) Info() *fs.BlockInfo { return block.info }
+
+type snapFile struct {
+	repo   *SnapshotRepo
+	id     int64
+	info   *fs.FileInfo
+	parent *snapDir
+}
+
+func (file *snapFile) Repo() fs.NodeRepo { return file.repo }
+
+func (file *snapFile) Parent() (fs.FsNode, bool) {
+	if file.parent == nil {
+		return nil, false
+	}
+	return file.parent, true
+}
+
+func (file *snapFile) Info() *fs.FileInfo { return file.info }
+
+func (file *snapFile) Name() string { return file.info.Name }
+
+func (file *snapFile) Mode() uint32 { return file.info.Mode }
+
+func (file *snapFile) Blocks() []fs.Block {
+	blocks, err := file.repo.BlocksOf(file)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return blocks
+}
+
+func (repo *SnapshotRepo) BlocksOf(node fs.File) ([]fs.Block, os.Error) {
+	file := node.(*snapFile)
+	file.repo.dbRepo.mutex.Lock()
+	defer file.repo.dbRepo.mutex.Unlock()
+
+	result := []fs.Block{}
+	err := file.repo.dbRepo.queryAll(func(values []interface{}) os.Error {
+		strong, err := file.repo.dbRepo.openStrong(values[0].(string))
+		if err != nil {
+			return err
+		}
+		result = append(result, &snapBlock{
+			repo:   file.repo,
+			parent: file,
+			info: &fs.BlockInfo{
+				Strong:   strong,
+				Weak:     file.repo.dbRepo.openWeak(values[1]),
+				Position: int(values[2].(int64)),
+				Parent:   file.info.Strong}})
+		return nil
+	}, `SELECT strong, weak, pos FROM snap_blocks WHERE file = ? ORDER BY pos`, file.id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type snapDir struct {
+	repo   *SnapshotRepo
+	id     int64
+	info   *fs.DirInfo
+	parent *snapDir
+}
+
+func (dir *snapDir) Repo() fs.NodeRepo { return dir.repo }
+
+func (dir *snapDir) Parent() (fs.FsNode, bool) {
+	if dir.parent == nil {
+		return nil, false
+	}
+	return dir.parent, true
+}
+
+func (dir *snapDir) Info() *fs.DirInfo { return dir.info }
+
+func (dir *snapDir) Name() string { return dir.info.Name }
+
+func (dir *snapDir) Mode() uint32 { return dir.info.Mode }
+
+// Snapshots are immutable, so the stored strong checksum is always current.
+func (dir *snapDir) UpdateStrong() string { return dir.info.Strong }
+
+func (dir *snapDir) UpdateShallowStrong() string { return dir.info.Strong }
+
+func (dir *snapDir) SubDirs() []fs.Dir {
+	subdirs, err := dir.repo.SubdirsOf(dir)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return subdirs
+}
+
+func (dir *snapDir) Files() []fs.File {
+	files, err := dir.repo.FilesOf(dir)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return files
+}
+
+func (repo *SnapshotRepo) SubdirsOf(node fs.Dir) ([]fs.Dir, os.Error) {
+	dir := node.(*snapDir)
+	dir.repo.dbRepo.mutex.Lock()
+	defer dir.repo.dbRepo.mutex.Unlock()
+
+	result := []fs.Dir{}
+	err := dir.repo.dbRepo.queryAll(func(values []interface{}) os.Error {
+		name, err := dir.repo.dbRepo.openName(values[1])
+		if err != nil {
+			return err
+		}
+		strong, err := dir.repo.dbRepo.openStrong(values[3].(string))
+		if err != nil {
+			return err
+		}
+		result = append(result, &snapDir{
+			repo:   dir.repo,
+			id:     values[0].(int64),
+			parent: dir,
+			info: &fs.DirInfo{
+				Name:   name,
+				Mode:   uint32(values[2].(int64)),
+				Strong: strong,
+				Parent: dir.info.Strong}})
+		return nil
+	}, `SELECT e.child, e.name, e.mode, d.strong
+			FROM snap_entries AS e JOIN snap_dirs AS d ON e.child = d.rowid
+			WHERE e.dir = ? AND e.isdir = 1 ORDER BY e.rowid`, dir.id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (repo *SnapshotRepo) FilesOf(node fs.Dir) ([]fs.File, os.Error) {
+	dir := node.(*snapDir)
+	dir.repo.dbRepo.mutex.Lock()
+	defer dir.repo.dbRepo.mutex.Unlock()
+
+	result := []fs.File{}
+	err := dir.repo.dbRepo.queryAll(func(values []interface{}) os.Error {
+		name, err := dir.repo.dbRepo.openName(values[1])
+		if err != nil {
+			return err
+		}
+		strong, err := dir.repo.dbRepo.openStrong(values[3].(string))
+		if err != nil {
+			return err
+		}
+		result = append(result, &snapFile{
+			repo:   dir.repo,
+			id:     values[0].(int64),
+			parent: dir,
+			info: &fs.FileInfo{
+				Name:   name,
+				Mode:   uint32(values[2].(int64)),
+				Strong: strong,
+				Size:   values[4].(int64),
+				Parent: dir.info.Strong}})
+		return nil
+	}, `SELECT e.child, e.name, e.mode, f.strong, f.size
+			FROM snap_entries AS e JOIN snap_files AS f ON e.child = f.rowid
+			WHERE e.dir = ? AND e.isdir = 0 ORDER BY e.rowid`, dir.id)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Parents are held by the nodes of a snapshot, so finding them cannot fail.
+func (repo *SnapshotRepo) ParentOf(node fs.Node) (fs.FsNode, bool, os.Error) {
+	parent, hasParent := node.Parent()
+	return parent, hasParent, nil
+}
+
+// Snapshots are immutable, so a directory's strong checksum can only be
+// set to the one it has.
+func (repo *SnapshotRepo) SetStrong(dir fs.Dir, strong string) os.Error {
+	if strong != dir.Info().Strong {
+		return os.NewError(readOnly)
+	}
+	return nil
+}
+
+func (repo *SnapshotRepo) root() *snapDir {
+	return &snapDir{
+		repo: repo,
+		id:   repo.Snapshot.root,
+		info: &fs.DirInfo{
+			Name:   "",
+			Mode:   repo.Snapshot.mode,
+			Strong: repo.Snapshot.Strong}}
+}
+
+func (repo *SnapshotRepo) Root() (fs.FsNode, os.Error) { return repo.root(), nil }
+
+// Find the chain of entries leading from the snapshot root
+// down to a directory or file record, root first.
+func (repo *SnapshotRepo) pathTo(isDir bool, id int64, seen map[int64]bool) ([]*snapEntry, bool, os.Error) {
+	if isDir {
+		if id == repo.Snapshot.root {
+			return []*snapEntry{}, true, nil
+		}
+		if seen[id] {
+			return nil, false, nil
+		}
+		seen[id] = true
+	}
+
+	isDirValue := int64(0)
+	if isDir {
+		isDirValue = 1
+	}
+
+	type parentEntry struct {
+		dir   int64
+		entry *snapEntry
+	}
+	parents := []*parentEntry{}
+
+	err := repo.dbRepo.queryAll(func(values []interface{}) os.Error {
+		name, err := repo.dbRepo.openName(values[1])
+		if err != nil {
+			return err
+		}
+		parents = append(parents, &parentEntry{
+			dir: values[0].(int64),
+			entry: &snapEntry{
+				name:  name,
+				mode:  uint32(values[2].(int64)),
+				isDir: isDir,
+				child: id}})
+		return nil
+	}, `SELECT dir, name, mode FROM snap_entries
+			WHERE isdir = ? AND child = ? AND dir IN (
+				SELECT dir FROM snap_reached_dirs WHERE root = ?)`,
+		isDirValue, id, repo.Snapshot.root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, parent := range parents {
+		path, found, err := repo.pathTo(true, parent.dir, seen)
+		if err != nil {
+			return nil, false, err
+		} else if found {
+			return append(path, parent.entry), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Descend from the root along a chain of entries to the directory it leads to.
+func (repo *SnapshotRepo) descend(path []*snapEntry) (*snapDir, os.Error) {
+	dir := repo.root()
+	for _, entry := range path {
+		row, err := repo.dbRepo.queryRow(`SELECT strong FROM snap_dirs WHERE rowid = ?`, entry.child)
+		if err != nil {
+			return nil, err
+		} else if row == nil {
+			return nil, os.NewError(fmt.Sprintf(
+				"Snapshot %s has an entry for missing directory %d", repo.Snapshot.Name, entry.child))
+		}
+		strong, err := repo.dbRepo.openStrong(row[0].(string))
+		if err != nil {
+			return nil, err
+		}
+
+		dir = &snapDir{
+			repo:   repo,
+			id:     entry.child,
+			parent: dir,
+			info: &fs.DirInfo{
+				Name:   entry.name,
+				Mode:   entry.mode,
+				Strong: strong,
+				Parent: dir.info.Strong}}
+	}
+	return dir, nil
+}
+
+// Locate a file record within this snapshot.
+func (repo *SnapshotRepo) fileById(id int64, strong string, size int64) (*snapFile, bool, os.Error) {
+	path, found, err := repo.pathTo(false, id, make(map[int64]bool))
+	if err != nil || !found || len(path) == 0 {
+		return nil, false, err
+	}
+
+	parent, err := repo.descend(path[:len(path)-1])
+	if err != nil {
+		return nil, false, err
+	}
+	entry := path[len(path)-1]
+	return &snapFile{
+		repo:   repo,
+		id:     id,
+		parent: parent,
+		info: &fs.FileInfo{
+			Name:   entry.name,
+			Mode:   entry.mode,
+			Strong: strong,
+			Size:   size,
+			Parent: parent.info.Strong}}, true, nil
+}
+
+func (repo *SnapshotRepo) Dir(strong string) (fs.Dir, bool, os.Error) {
+	if strong == repo.Snapshot.Strong {
+		return repo.root(), true, nil
+	}
+
+	repo.dbRepo.mutex.Lock()
+	defer repo.dbRepo.mutex.Unlock()
+
+	ids := []int64{}
+	err := repo.dbRepo.queryAll(func(values []interface{}) os.Error {
+		ids = append(ids, values[0].(int64))
+		return nil
+	}, `SELECT rowid FROM snap_dirs WHERE strong = ? AND rowid IN (
+			SELECT dir FROM snap_reached_dirs WHERE root = ?)`,
+		repo.dbRepo.sealStrong(strong), repo.Snapshot.root)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, id := range ids {
+		path, found, err := repo.pathTo(true, id, make(map[int64]bool))
+		if err != nil {
+			return nil, false, err
+		} else if found {
+			dir, err := repo.descend(path)
+			if err != nil {
+				return nil, false, err
+			}
+			return dir, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (repo *SnapshotRepo) File(strong string) (fs.File, bool, os.Error) {
+	repo.dbRepo.mutex.Lock()
+	defer repo.dbRepo.mutex.Unlock()
+
+	row, err := repo.dbRepo.queryRow(`SELECT rowid, size FROM snap_files WHERE strong = ? AND rowid IN (
+			SELECT file FROM snap_reached_files WHERE root = ?)`,
+		repo.dbRepo.sealStrong(strong), repo.Snapshot.root)
+	if err != nil || row == nil {
+		return nil, false, err
+	}
+
+	file, found, err := repo.fileById(row[0].(int64), strong, row[1].(int64))
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return file, true, nil
+}
+
+// Find the first block matching a condition on snap_blocks AS b
+// that belongs to this snapshot.
+func (repo *SnapshotRepo) findBlock(cond string, value interface{}) (fs.Block, bool, os.Error) {
+	repo.dbRepo.mutex.Lock()
+	defer repo.dbRepo.mutex.Unlock()
+
+	row, err := repo.dbRepo.queryRow(
+		`SELECT b.file, f.strong, f.size, b.strong, b.weak, b.pos
+			FROM snap_blocks AS b JOIN snap_files AS f ON b.file = f.rowid
+			WHERE `+cond+` AND b.file IN (
+				SELECT file FROM snap_reached_files WHERE root = ?)
+			LIMIT 1`, value, repo.Snapshot.root)
+	if err != nil || row == nil {
+		return nil, false, err
+	}
+
+	fileStrong, err := repo.dbRepo.openStrong(row[1].(string))
+	if err != nil {
+		return nil, false, err
+	}
+	strong, err := repo.dbRepo.openStrong(row[3].(string))
+	if err != nil {
+		return nil, false, err
+	}
+
+	file, found, err := repo.fileById(row[0].(int64), fileStrong, row[2].(int64))
+	if err != nil || !found {
+		return nil, false, err
+	}
+	return &snapBlock{
+		repo:   repo,
+		parent: file,
+		info: &fs.BlockInfo{
+			Strong:   strong,
+			Weak:     repo.dbRepo.openWeak(row[4]),
+			Position: int(row[5].(int64)),
+			Parent:   fileStrong}}, true, nil
+}
+
+func (repo *SnapshotRepo) Block(strong string) (fs.Block, bool, os.Error) {
+	return repo.findBlock(`b.strong = ?`, repo.dbRepo.sealStrong(strong))
+}
+
+func (repo *SnapshotRepo) WeakBlock(weak int) (fs.Block, bool, os.Error) {
+	return repo.findBlock(`b.weak = ?`, repo.dbRepo.sealWeak(weak))
+}
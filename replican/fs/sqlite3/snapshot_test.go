@@ -0,0 +1,234 @@
+package sqlite3
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSnapshots(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	tg := treegen.New()
+	v1Spec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(43, 65537))))
+	v1path := treegen.TestTree(t, v1Spec)
+	defer os.RemoveAll(v1path)
+
+	tg = treegen.New()
+	v2Spec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(44, 65537))))
+	v2path := treegen.TestTree(t, v2Spec)
+	defer os.RemoveAll(v2path)
+
+	v1, errors := fs.IndexDir(filepath.Join(v1path, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	v2, errors := fs.IndexDir(filepath.Join(v2path, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	_, err := dbrepo.Snapshot("v1", v1)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = dbrepo.Snapshot("v2", v2)
+	assert.Tf(t, err == nil, "%v", err)
+
+	_, err = dbrepo.Snapshot("v1", v2)
+	assert.T(t, err != nil)
+
+	snapshots, err := dbrepo.Snapshots()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 2, len(snapshots))
+	assert.Equal(t, "v1", snapshots[0].Name)
+	assert.Equal(t, v1.Info().Strong, snapshots[0].Strong)
+	assert.Equal(t, "v2", snapshots[1].Name)
+	assert.Equal(t, v2.Info().Strong, snapshots[1].Strong)
+
+	// Unchanged dir and its files are shared between snapshots
+	nDirs, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM snap_dirs`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(5), nDirs)
+	nFiles, _, err := dbrepo.queryInt(`SELECT COUNT(*) FROM snap_files`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(3), nFiles)
+
+	snap1, err := dbrepo.OpenSnapshot("v1")
+	assert.Tf(t, err == nil, "%v", err)
+	root := fstest.RootDir(t, snap1)
+	assert.Equal(t, v1.Info().Strong, root.Info().Strong)
+	strong, err := fs.CalcStrong(root)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, strong, root.Info().Strong)
+
+	node, found := fs.Lookup(root, filepath.Join("baz", "B"))
+	assert.T(t, found)
+	B := node.(fs.File)
+
+	file, found, err := snap1.File(B.Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, found)
+	assert.Equal(t, filepath.Join("baz", "B"), fs.RelPath(file))
+	assert.Equal(t, 9, len(file.Blocks()))
+
+	block, found, err := snap1.WeakBlock(B.Blocks()[0].Info().Weak)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, found)
+	parent, _ := block.Parent()
+	assert.Equal(t, filepath.Join("baz", "B"), fs.RelPath(parent))
+
+	// v2's version of B is not in v1
+	snap2, err := dbrepo.OpenSnapshot("v2")
+	assert.Tf(t, err == nil, "%v", err)
+	node, found = fs.Lookup(fstest.RootDir(t, snap2), filepath.Join("baz", "B"))
+	assert.T(t, found)
+	_, found, err = snap1.File(node.(fs.File).Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, !found)
+	_, found, err = snap1.Block(node.(fs.File).Blocks()[0].Info().Strong)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, !found)
+
+	changes := []*fs.Change{}
+	err = dbrepo.DiffSnapshots("v1", "v2", func(change *fs.Change) {
+		changes = append(changes, change)
+	})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equalf(t, 1, len(changes), "%v", changes)
+	assert.Equal(t, fs.Modified, changes[0].Kind)
+	assert.Equal(t, filepath.Join("baz", "B"), changes[0].SrcPath)
+
+	_, err = dbrepo.OpenSnapshot("v3")
+	assert.T(t, err != nil)
+}
+
+func TestSnapshotCollect(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.Remove(dbpath)
+	defer dbrepo.Close()
+
+	tg := treegen.New()
+	v1Spec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(43, 65537))))
+	v1path := treegen.TestTree(t, v1Spec)
+	defer os.RemoveAll(v1path)
+
+	tg = treegen.New()
+	v2Spec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(44, 65537))))
+	v2path := treegen.TestTree(t, v2Spec)
+	defer os.RemoveAll(v2path)
+
+	v1, errors := fs.IndexDir(filepath.Join(v1path, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	v2, errors := fs.IndexDir(filepath.Join(v2path, "foo"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	_, err := dbrepo.Snapshot("v1", v1)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = dbrepo.Snapshot("v2", v2)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Nothing is collected while both snapshots are retained
+	report, err := dbrepo.Collect()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(0), report.Dirs)
+	assert.Equal(t, int64(0), report.Files)
+
+	err = dbrepo.DeleteSnapshot("v3")
+	assert.T(t, err != nil)
+	err = dbrepo.DeleteSnapshot("v1")
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Only v1's root, its baz, and the B within it were unique to v1
+	report, err = dbrepo.Collect()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(2), report.Dirs)
+	assert.Equal(t, int64(1), report.Files)
+	assert.Equal(t, int64(9), report.Blocks)
+	assert.Equal(t, int64(65537), report.Bytes)
+
+	_, err = dbrepo.OpenSnapshot("v1")
+	assert.T(t, err != nil)
+
+	snap2, err := dbrepo.OpenSnapshot("v2")
+	assert.Tf(t, err == nil, "%v", err)
+	root := fstest.RootDir(t, snap2)
+	strong, err := fs.CalcStrong(root)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, v2.Info().Strong, strong)
+	for _, relpath := range []string{
+		filepath.Join("bar", "A"), filepath.Join("baz", "B")} {
+		node, found := fs.Lookup(root, relpath)
+		assert.Tf(t, found, "%s not found", relpath)
+		assert.Equal(t, 9, len(node.(fs.File).Blocks()))
+	}
+}
+
+// Look up a block shared by many snapshots in the last of them.
+func BenchmarkSnapshotWeakBlock(b *testing.B) {
+	b.StopTimer()
+	dbpath, err := ioutil.TempFile("", "bench.db")
+	if err != nil {
+		panic(err)
+	}
+	dbpath.Close()
+	defer os.Remove(dbpath.Name())
+
+	dbrepo, err := NewDbRepo(dbpath.Name())
+	if err != nil {
+		panic(err)
+	}
+	defer dbrepo.Close()
+
+	// Each snapshot shares a file with the others, and has one of its own
+	const nSnapshots = 200
+	for i := 0; i < nSnapshots; i++ {
+		repo := fs.NewMemRepo()
+		root, _ := repo.AddDir(nil, &fs.DirInfo{
+			Name: "", Mode: 0755, Strong: fmt.Sprintf("root%d", i)})
+		repo.AddFile(root, &fs.FileInfo{Name: "shared", Mode: 0644, Strong: "shared", Size: 1},
+			[]*fs.BlockInfo{&fs.BlockInfo{Strong: "sharedblock", Weak: 1}})
+		own, _ := repo.AddDir(root, &fs.DirInfo{
+			Name: "own", Mode: 0755, Strong: fmt.Sprintf("own%d", i)})
+		repo.AddFile(own, &fs.FileInfo{
+			Name: "file", Mode: 0644, Strong: fmt.Sprintf("file%d", i), Size: 1},
+			[]*fs.BlockInfo{&fs.BlockInfo{Strong: fmt.Sprintf("block%d", i), Weak: i + 2}})
+		if _, err = dbrepo.Snapshot(fmt.Sprintf("v%d", i), root); err != nil {
+			panic(err)
+		}
+	}
+
+	snapshot, err := dbrepo.OpenSnapshot(fmt.Sprintf("v%d", nSnapshots-1))
+	if err != nil {
+		panic(err)
+	}
+
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found, err := snapshot.WeakBlock(1); err != nil || !found {
+			panic(fmt.Sprintf("shared block not found: %v", err))
+		}
+	}
+}
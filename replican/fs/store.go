@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -33,6 +32,9 @@ type LocalStore interface {
 
 	RootPath() string
 
+	// The filesystem the store's files are indexed, read and patched through.
+	FileSystem() FileSystem
+
 	reindex() os.Error
 }
 
@@ -40,6 +42,10 @@ type localBase struct {
 	rootPath string
 	repo     NodeRepo
 	relocs   map[string]string
+	fileSys  FileSystem
+
+	// Limits the rate files are read at when indexing, if not nil.
+	indexLimit *Throttle
 }
 
 type LocalDirStore struct {
@@ -52,21 +58,51 @@ type LocalFileStore struct {
 	file File
 }
 
+// Options for creating a LocalStore, and for indexing files.
+type LocalOptions struct {
+	// The filesystem files are indexed, read and patched through.
+	// The OS's, when nil.
+	FileSystem FileSystem
+
+	// Limits the rate files are read at while they are indexed,
+	// when not nil.
+	IndexLimit *Throttle
+}
+
+func (options LocalOptions) fileSystem() FileSystem {
+	if options.FileSystem == nil {
+		return OS
+	}
+	return options.FileSystem
+}
+
+func newLocalBase(rootPath string, repo NodeRepo, options LocalOptions) *localBase {
+	return &localBase{
+		rootPath:   rootPath,
+		repo:       repo,
+		relocs:     make(map[string]string),
+		fileSys:    options.fileSystem(),
+		indexLimit: options.IndexLimit}
+}
+
 func NewLocalStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Error) {
-	rootInfo, err := os.Stat(rootPath)
+	return NewLocalStoreWith(rootPath, repo, LocalOptions{})
+}
+
+// Create a LocalStore like NewLocalStore, with the given options.
+func NewLocalStoreWith(rootPath string, repo NodeRepo, options LocalOptions) (local LocalStore, err os.Error) {
+	localBase := newLocalBase(rootPath, repo, options)
+	rootInfo, err := localBase.fileSys.Stat(rootPath)
 	if err != nil {
 		return nil, err
 	}
 
-	localBase := &localBase{rootPath: rootPath, repo: repo}
 	if rootInfo.IsDirectory() {
 		local = &LocalDirStore{localBase: localBase}
 	} else if rootInfo.IsRegular() {
 		local = &LocalFileStore{localBase: localBase}
 	}
 
-	localBase.relocs = make(map[string]string)
-
 	if err := local.reindex(); err != nil {
 		return nil, err
 	}
@@ -74,12 +110,31 @@ func NewLocalStore(rootPath string, repo NodeRepo) (local LocalStore, err os.Err
 	return local, nil
 }
 
+// Create a LocalStore over a directory which is already indexed in repo,
+// without indexing it again.
+func OpenLocalStore(rootPath string, repo NodeRepo, options LocalOptions) (LocalStore, os.Error) {
+	root, err := repo.Root()
+	if err != nil {
+		return nil, err
+	}
+	dir, isDir := root.(Dir)
+	if !isDir {
+		return nil, os.NewError(fmt.Sprintf("No directory is indexed for %s", rootPath))
+	}
+
+	return &LocalDirStore{localBase: newLocalBase(rootPath, repo, options), dir: dir}, nil
+}
+
 func (store *LocalDirStore) reindex() (err os.Error) {
 	indexer := &Indexer{
-		Path:   store.RootPath(),
-		Repo:   store.repo,
-		Filter: store.repo.IndexFilter()}
-	store.dir = indexer.Index()
+		Path:       store.RootPath(),
+		Repo:       store.repo,
+		Filter:     store.repo.IndexFilter(),
+		FileSystem: store.fileSys,
+		Throttle:   store.indexLimit}
+	if store.dir, err = indexer.Index(); err != nil {
+		return err
+	}
 	if store.dir == nil {
 		return os.NewError(fmt.Sprintf("Failed to reindex root: %s", store.RootPath()))
 	}
@@ -88,10 +143,12 @@ func (store *LocalDirStore) reindex() (err os.Error) {
 }
 
 func (store *LocalFileStore) reindex() (err os.Error) {
-	if fileInfo, blocksInfo, err := IndexFile(store.RootPath()); err == nil {
-		store.file = store.repo.AddFile(nil, fileInfo, blocksInfo)
-		return nil
+	fileInfo, blocksInfo, err := IndexFileWith(store.RootPath(),
+		LocalOptions{FileSystem: store.fileSys, IndexLimit: store.indexLimit})
+	if err != nil {
+		return err
 	}
+	store.file, err = store.repo.AddFile(nil, fileInfo, blocksInfo)
 	return err
 }
 
@@ -104,7 +161,7 @@ func (store *localBase) RelPath(fullpath string) (relpath string) {
 const RELOC_PREFIX string = "_reloc"
 
 func (store *localBase) Relocate(fullpath string) (relocFullpath string, err os.Error) {
-	relocFh, err := ioutil.TempFile(store.RootPath(), RELOC_PREFIX)
+	relocFh, err := store.fileSys.TempFile(store.RootPath(), RELOC_PREFIX)
 	if err != nil {
 		return "", err
 	}
@@ -116,12 +173,12 @@ func (store *localBase) Relocate(fullpath string) (relocFullpath string, err os.
 		return "", err
 	}
 
-	err = os.Remove(relocFh.Name())
+	err = store.fileSys.Remove(relocFh.Name())
 	if err != nil {
 		return "", err
 	}
 
-	err = Move(fullpath, relocFullpath)
+	err = FsMove(store.fileSys, fullpath, relocFullpath)
 	if err != nil {
 		return "", err
 	}
@@ -149,20 +206,35 @@ func (store *localBase) RootPath() string { return store.rootPath }
 
 func (store *localBase) Repo() NodeRepo { return store.repo }
 
+func (store *localBase) FileSystem() FileSystem { return store.fileSys }
+
 func (store *LocalDirStore) Root() FsNode { return store.dir }
 
 func (store *LocalFileStore) Root() FsNode { return store.file }
 
 func (store *localBase) ReadBlock(strong string) ([]byte, os.Error) {
-	block, has := store.repo.Block(strong)
-	if !has {
+	block, has, err := store.repo.Block(strong)
+	if err != nil {
+		return nil, err
+	} else if !has {
 		return nil, os.NewError(
 			fmt.Sprintf("Block with strong checksum %s not found", strong))
 	}
 
+	parent, hasParent, err := ReadParent(block)
+	if err != nil {
+		return nil, err
+	}
+	file, isFile := parent.(File)
+	if !hasParent || !isFile {
+		return nil, os.NewError(
+			fmt.Sprintf("Block with strong checksum %s has no file", strong))
+	}
+
+	// The last block of a file may be short
 	buf := &bytes.Buffer{}
-	_, err := store.ReadInto(block.Info().Strong, block.Info().Offset(), int64(BLOCKSIZE), buf)
-	if err == nil {
+	_, err = store.ReadInto(file.Info().Strong, block.Info().Offset(), int64(BLOCKSIZE), buf)
+	if err != nil && err != os.EOF {
 		return nil, err
 	}
 
@@ -171,33 +243,44 @@ func (store *localBase) ReadBlock(strong string) ([]byte, os.Error) {
 
 func (store *localBase) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
 
-	file, has := store.repo.File(strong)
-	if !has {
+	file, has, err := store.repo.File(strong)
+	if err != nil {
+		return 0, err
+	} else if !has {
 		return 0,
 			os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
 	}
 
-	path := store.Resolve(RelPath(file))
-	return store.readInto(path, from, length, writer)
+	relpath, err := CheckedRelPath(file)
+	if err != nil {
+		return 0, err
+	}
+	return store.readInto(store.Resolve(relpath), from, length, writer)
 }
 
 func (store *LocalFileStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
 
-	file, has := store.repo.File(strong)
-	if !has {
+	file, has, err := store.repo.File(strong)
+	if err != nil {
+		return 0, err
+	} else if !has {
 		return 0,
 			os.NewError(fmt.Sprintf("File with strong checksum %s not found", strong))
 	}
 
-	path := store.Resolve(RelPath(file))
-	return store.readInto(path, from, length, writer)
+	relpath, err := CheckedRelPath(file)
+	if err != nil {
+		return 0, err
+	}
+	return store.readInto(store.Resolve(relpath), from, length, writer)
 }
 
 func (store *localBase) readInto(path string, from int64, length int64, writer io.Writer) (int64, os.Error) {
-	fh, err := os.Open(path)
-	if fh == nil {
+	fh, err := store.fileSys.Open(path)
+	if err != nil {
 		return 0, err
 	}
+	defer fh.Close()
 
 	_, err = fh.Seek(from, 0)
 	if err != nil {
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A limit on the rate of reads or writes, shared by everything using it.
+// Each read or write of n bytes is paced so that, on average, no more than
+// BytesPerSec bytes and OpsPerSec operations pass through per second.
+// Time spent idle is not saved up for a burst later.
+//
+// A nil Throttle does not limit anything.
+type Throttle struct {
+	// Zero for no limit on either.
+	BytesPerSec int64
+	OpsPerSec   int64
+
+	lock sync.Mutex
+
+	// When the next operation may start, in nanoseconds.
+	next int64
+}
+
+func NewThrottle(bytesPerSec int64, opsPerSec int64) *Throttle {
+	return &Throttle{BytesPerSec: bytesPerSec, OpsPerSec: opsPerSec}
+}
+
+// Wait until an operation on n bytes may proceed.
+func (throttle *Throttle) Wait(n int) {
+	if throttle == nil {
+		return
+	}
+
+	throttle.lock.Lock()
+	now := time.Nanoseconds()
+	if throttle.next < now {
+		throttle.next = now
+	}
+	delay := throttle.next - now
+
+	if throttle.BytesPerSec > 0 {
+		throttle.next += int64(n) * 1e9 / throttle.BytesPerSec
+	}
+	if throttle.OpsPerSec > 0 {
+		throttle.next += 1e9 / throttle.OpsPerSec
+	}
+	throttle.lock.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+type throttledReader struct {
+	reader   io.Reader
+	throttle *Throttle
+}
+
+func (tr *throttledReader) Read(p []byte) (int, os.Error) {
+	n, err := tr.reader.Read(p)
+	tr.throttle.Wait(n)
+	return n, err
+}
+
+// Limit the rate of reads from reader.
+func (throttle *Throttle) Reader(reader io.Reader) io.Reader {
+	if throttle == nil {
+		return reader
+	}
+	return &throttledReader{reader: reader, throttle: throttle}
+}
+
+type throttledWriter struct {
+	writer   io.Writer
+	throttle *Throttle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, os.Error) {
+	tw.throttle.Wait(len(p))
+	return tw.writer.Write(p)
+}
+
+// Limit the rate of writes to writer.
+func (throttle *Throttle) Writer(writer io.Writer) io.Writer {
+	if throttle == nil {
+		return writer
+	}
+	return &throttledWriter{writer: writer, throttle: throttle}
+}
@@ -20,45 +20,88 @@ func SplitNames(path string) []string {
 // Move src to dst.
 // Try a rename. If that fails due to different filesystems,
 // try a copy/delete instead.
-func Move(src string, dst string) (err os.Error) {
-	if _, err = os.Stat(dst); err == nil {
-		os.Remove(dst)
+func Move(src string, dst string) os.Error {
+	return FsMove(OS, src, dst)
+}
+
+// Move src to dst on a FileSystem. A file at dst is replaced by the
+// rename where the filesystem allows it, so that it is never missing.
+func FsMove(fileSys FileSystem, src string, dst string) (err os.Error) {
+	err = fileSys.Rename(src, dst)
+	if err != nil && !isCrossDevice(err) {
+		if _, statErr := fileSys.Stat(dst); statErr == nil {
+			fileSys.Remove(dst)
+			err = fileSys.Rename(src, dst)
+		}
 	}
 
-	if err = os.Rename(src, dst); err != nil {
-		linkErr, isLinkErr := err.(*os.LinkError)
-		if !isLinkErr {
+	if err != nil && isCrossDevice(err) {
+		srcF, err := fileSys.Open(src)
+		if err != nil {
 			return err
 		}
+		defer srcF.Close()
 
-		if causeErr, isErrno := linkErr.Error.(os.Errno); isErrno && causeErr == syscall.EXDEV {
-			srcF, err := os.Open(src)
-			if err != nil {
-				return err
-			}
-			defer srcF.Close()
+		dstF, err := fileSys.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer dstF.Close()
 
-			dstF, err := os.Create(dst)
-			if err != nil {
-				return err
-			}
-			defer dstF.Close()
+		_, err = io.Copy(dstF, srcF)
+		if err != nil {
+			return err
+		}
 
-			_, err = io.Copy(dstF, srcF)
-			if err != nil {
-				return err
-			}
+		srcF.Close()
+		err = fileSys.Remove(src)
 
-			srcF.Close()
-			err = os.Remove(src)
+		return err
+	}
 
-			return err
+	return err
+}
+
+// Test whether a rename failed because it was between filesystems.
+func isCrossDevice(err os.Error) bool {
+	linkErr, isLinkErr := err.(*os.LinkError)
+	if !isLinkErr {
+		return false
+	}
+
+	causeErr, isErrno := linkErr.Error.(os.Errno)
+	return isErrno && causeErr == syscall.EXDEV
+}
+
+// Walk the tree at root on a FileSystem, as filepath.Walk does.
+func FsWalk(fileSys FileSystem, root string, visitor filepath.Visitor, errors chan<- os.Error) {
+	info, err := fileSys.Lstat(root)
+	if err != nil {
+		if errors != nil {
+			errors <- err
 		}
+		return
+	}
+	fsWalk(fileSys, root, info, visitor, errors)
+}
 
-		return err
+func fsWalk(fileSys FileSystem, path string, info *os.FileInfo, visitor filepath.Visitor, errors chan<- os.Error) {
+	if !info.IsDirectory() {
+		visitor.VisitFile(path, info)
+		return
+	}
+
+	if !visitor.VisitDir(path, info) {
+		return
 	}
 
-	return nil
+	entries, err := fileSys.ReadDir(path)
+	if err != nil && errors != nil {
+		errors <- err
+	}
+	for _, entry := range entries {
+		fsWalk(fileSys, filepath.Join(path, entry.Name), entry, visitor, errors)
+	}
 }
 
 type postNode struct {
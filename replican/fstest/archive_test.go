@@ -0,0 +1,186 @@
+package fstest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+// A tree exported to tar and loaded back indexes the same.
+func TestArchiveTar(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz",
+			tg.F("quux", tg.B(43, 1000)),
+			tg.F("empty"))))
+	defer os.RemoveAll(path)
+
+	store, err := fs.NewLocalStore(filepath.Join(path, "foo"), fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	barContents, err := ioutil.ReadFile(filepath.Join(path, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	strong := RootDir(t, store.Repo()).Info().Strong
+
+	tarBuf := &bytes.Buffer{}
+	assert.T(t, fs.ExportTar(store, tarBuf) == nil)
+	tarPath := filepath.Join(path, "foo.tar")
+	assert.T(t, ioutil.WriteFile(tarPath, tarBuf.Bytes(), 0644) == nil)
+
+	gzBuf := &bytes.Buffer{}
+	gzWriter, err := gzip.NewWriter(gzBuf)
+	assert.Tf(t, err == nil, "%v", err)
+	gzWriter.Write(tarBuf.Bytes())
+	assert.T(t, gzWriter.Close() == nil)
+	tgzPath := filepath.Join(path, "foo.tar.gz")
+	assert.T(t, ioutil.WriteFile(tgzPath, gzBuf.Bytes(), 0644) == nil)
+
+	for _, archive := range []string{tarPath, tgzPath} {
+		archiveStore, err := fs.NewArchiveStore(archive, "", fs.NewMemRepo())
+		assert.Tf(t, err == nil, "%s: %v", archive, err)
+		assert.Equal(t, strong, RootDir(t, archiveStore.Repo()).Info().Strong)
+
+		// Ranges within a member are read from the archive
+		bar, has := fs.Lookup(RootDir(t, archiveStore.Repo()), "bar")
+		assert.T(t, has)
+		buf := &bytes.Buffer{}
+		_, err = archiveStore.ReadInto(bar.(fs.File).Info().Strong, 60000, 1000, buf)
+		assert.Tf(t, err == nil, "%s: %v", archive, err)
+		assert.Equal(t, barContents[60000:61000], buf.Bytes())
+
+		// The subdirectory of an archive can be a store too
+		subStore, err := fs.NewArchiveStore(archive, "baz", fs.NewMemRepo())
+		assert.Tf(t, err == nil, "%s: %v", archive, err)
+		baz, has := fs.Lookup(RootDir(t, store.Repo()), "baz")
+		assert.T(t, has)
+		assert.Equal(t, baz.(fs.Dir).Info().Strong,
+			RootDir(t, subStore.Repo()).Info().Strong)
+	}
+}
+
+func writeTar(t *testing.T, headers ...*tar.Header) []byte {
+	buf := &bytes.Buffer{}
+	tarWriter := tar.NewWriter(buf)
+	for _, header := range headers {
+		assert.T(t, tarWriter.WriteHeader(header) == nil)
+		tarWriter.Write(make([]byte, header.Size))
+	}
+	assert.T(t, tarWriter.Close() == nil)
+	return buf.Bytes()
+}
+
+// Members of a tar are listed, and read from the archive on demand.
+func TestOpenArchive(t *testing.T) {
+	path, err := ioutil.TempDir("", treegen.PREFIX)
+	assert.T(t, err == nil)
+	defer os.RemoveAll(path)
+
+	tarPath := filepath.Join(path, "foo.tar")
+	assert.T(t, ioutil.WriteFile(tarPath, writeTar(t,
+		&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir},
+		&tar.Header{Name: "./foo/bar", Mode: 0600, Size: 10, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "./foo/baz", Mode: 0644, Linkname: "foo/bar", Typeflag: tar.TypeLink}),
+		0644) == nil)
+
+	archiveFs, err := fs.OpenArchive(tarPath)
+	assert.Tf(t, err == nil, "%v", err)
+	info, err := archiveFs.Stat(filepath.Join(fs.ARCHIVE_ROOT, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(10), info.Size)
+	assert.Equal(t, uint32(0600), info.Mode&07777)
+
+	fh, err := archiveFs.Open(filepath.Join(fs.ARCHIVE_ROOT, "foo", "baz"))
+	assert.Tf(t, err == nil, "%v", err)
+	defer fh.Close()
+	info, err = fh.Stat()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(10), info.Size)
+	contents, err := ioutil.ReadAll(fh)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, make([]byte, 10), contents)
+
+	_, err = archiveFs.Create(filepath.Join(fs.ARCHIVE_ROOT, "quux"))
+	assert.Equal(t, os.EROFS, ErrorCause(err))
+
+	// Symbolic links are refused rather than left out
+	assert.T(t, ioutil.WriteFile(tarPath, writeTar(t,
+		&tar.Header{Name: "./quux", Linkname: "foo", Typeflag: tar.TypeSymlink}), 0644) == nil)
+	_, err = fs.OpenArchive(tarPath)
+	assert.T(t, err != nil)
+
+	// Members may not escape the root
+	assert.T(t, ioutil.WriteFile(tarPath, writeTar(t,
+		&tar.Header{Name: "../foo", Size: 10, Typeflag: tar.TypeReg}), 0644) == nil)
+	_, err = fs.OpenArchive(tarPath)
+	assert.T(t, err != nil)
+}
+
+// Build a zip archive which stores its members uncompressed.
+func storedZip(names []string, contents []string) []byte {
+	buf, central := &bytes.Buffer{}, &bytes.Buffer{}
+	write := func(buf *bytes.Buffer, values ...interface{}) {
+		for _, value := range values {
+			binary.Write(buf, binary.LittleEndian, value)
+		}
+	}
+
+	for i, name := range names {
+		offset := uint32(buf.Len())
+		crc, size := crc32.ChecksumIEEE([]byte(contents[i])), uint32(len(contents[i]))
+		write(buf, uint32(0x04034b50), uint16(20), uint16(0), uint16(0),
+			uint16(0), uint16(0), crc, size, size, uint16(len(name)), uint16(0))
+		buf.WriteString(name)
+		buf.WriteString(contents[i])
+
+		write(central, uint32(0x02014b50), uint16(20), uint16(20), uint16(0),
+			uint16(0), uint16(0), uint16(0), crc, size, size, uint16(len(name)),
+			uint16(0), uint16(0), uint16(0), uint16(0), uint32(0), offset)
+		central.WriteString(name)
+	}
+
+	centralOffset, centralSize := uint32(buf.Len()), uint32(central.Len())
+	buf.Write(central.Bytes())
+	write(buf, uint32(0x06054b50), uint16(0), uint16(0), uint16(len(names)),
+		uint16(len(names)), centralSize, centralOffset, uint16(0))
+	return buf.Bytes()
+}
+
+func TestArchiveZip(t *testing.T) {
+	path, err := ioutil.TempDir("", treegen.PREFIX)
+	assert.T(t, err == nil)
+	defer os.RemoveAll(path)
+
+	zipPath := filepath.Join(path, "foo.zip")
+	assert.T(t, ioutil.WriteFile(zipPath, storedZip(
+		[]string{"foo/", "foo/bar", "foo/baz/quux"},
+		[]string{"", "hello world", "hello again"}), 0644) == nil)
+
+	store, err := fs.NewArchiveStore(zipPath, "foo", fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	root := RootDir(t, store.Repo())
+	bar, has := fs.Lookup(root, "bar")
+	assert.T(t, has)
+	assert.Equal(t, int64(11), bar.(fs.File).Info().Size)
+	quux, has := fs.Lookup(root, filepath.Join("baz", "quux"))
+	assert.T(t, has)
+
+	buf := &bytes.Buffer{}
+	_, err = store.ReadInto(quux.(fs.File).Info().Strong, 0, 11, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "hello again", buf.String())
+
+	rarPath := filepath.Join(path, "foo.rar")
+	assert.T(t, ioutil.WriteFile(rarPath, []byte("Rar!"), 0644) == nil)
+	_, err = fs.NewArchiveStore(rarPath, "", fs.NewMemRepo())
+	assert.T(t, err != nil)
+}
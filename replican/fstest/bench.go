@@ -0,0 +1,61 @@
+package fstest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+// Times part of each iteration of a benchmark, and counts the heap
+// allocations made while it is running, which testing.B does not.
+type BenchTimer struct {
+	b    *testing.B
+	name string
+
+	mallocs, bytes           uint64
+	startMallocs, startBytes uint64
+}
+
+// Stop the benchmark's timer, to be started around each timed part.
+func NewBenchTimer(b *testing.B, name string) *BenchTimer {
+	b.StopTimer()
+	return &BenchTimer{b: b, name: name}
+}
+
+func (timer *BenchTimer) Start() {
+	runtime.UpdateMemStats()
+	timer.startMallocs = runtime.MemStats.Mallocs
+	timer.startBytes = runtime.MemStats.TotalAlloc
+	timer.b.StartTimer()
+}
+
+func (timer *BenchTimer) Stop() {
+	timer.b.StopTimer()
+	runtime.UpdateMemStats()
+	timer.mallocs += runtime.MemStats.Mallocs - timer.startMallocs
+	timer.bytes += runtime.MemStats.TotalAlloc - timer.startBytes
+}
+
+// Print the allocations per iteration.
+func (timer *BenchTimer) Report() {
+	n := uint64(timer.b.N)
+	fmt.Fprintf(os.Stderr, "%s\t%d\t%d allocs/op\t%d B/op\n",
+		timer.name, n, timer.mallocs/n, timer.bytes/n)
+}
+
+// Fabricate a tree for a benchmark, and return the temporary directory
+// it is in. Benchmarks have no way to fail, so this panics if it cannot.
+func BenchTree(g treegen.Generated) string {
+	path, err := ioutil.TempDir("", treegen.PREFIX)
+	if err == nil {
+		err = treegen.Fab(path, g)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return path
+}
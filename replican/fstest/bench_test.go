@@ -0,0 +1,114 @@
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+const benchDirs = 10
+const benchFiles = 50
+const benchFileSize = 4096
+
+// A tree of many small files, which loads the repo more than the disk.
+func benchTree() treegen.Generated {
+	tg := treegen.New()
+	dirs := []treegen.Generated{}
+	for i := 0; i < benchDirs; i++ {
+		files := []treegen.Generated{}
+		for j := 0; j < benchFiles; j++ {
+			files = append(files, tg.F("", tg.B(int64(i*benchFiles+j), benchFileSize)))
+		}
+		dirs = append(dirs, tg.D("", files...))
+	}
+	return tg.D("bench", dirs...)
+}
+
+// Index the bench tree into a new repo from mkrepo at each iteration.
+func benchmarkIndex(b *testing.B, name string, mkrepo func() (fs.NodeRepo, func())) {
+	timer := NewBenchTimer(b, name)
+	path := BenchTree(benchTree())
+	defer os.RemoveAll(path)
+	b.SetBytes(benchDirs * benchFiles * benchFileSize)
+
+	for i := 0; i < b.N; i++ {
+		repo, dispose := mkrepo()
+		indexer := &fs.Indexer{Path: path, Repo: repo}
+
+		timer.Start()
+		_, err := indexer.Index()
+		timer.Stop()
+
+		repo.Close()
+		dispose()
+		if err != nil {
+			panic(err)
+		}
+	}
+	timer.Report()
+}
+
+func benchDbRepo() (*sqlite3.DbRepo, func()) {
+	dbpath, err := ioutil.TempFile("", "bench.db")
+	if err != nil {
+		panic(err)
+	}
+	dbpath.Close()
+
+	dbrepo, err := sqlite3.NewDbRepo(dbpath.Name())
+	if err != nil {
+		panic(err)
+	}
+	return dbrepo, func() { os.Remove(dbpath.Name()) }
+}
+
+// Hides the bulk load methods of the repo it wraps.
+type unbatchedRepo struct {
+	fs.NodeRepo
+}
+
+func BenchmarkIndexMemRepo(b *testing.B) {
+	benchmarkIndex(b, "IndexMemRepo", func() (fs.NodeRepo, func()) {
+		return fs.NewMemRepo(), func() {}
+	})
+}
+
+func BenchmarkIndexDbRepo(b *testing.B) {
+	benchmarkIndex(b, "IndexDbRepo", func() (fs.NodeRepo, func()) {
+		dbrepo, dispose := benchDbRepo()
+		return dbrepo, dispose
+	})
+}
+
+func BenchmarkIndexDbRepoUnbatched(b *testing.B) {
+	benchmarkIndex(b, "IndexDbRepoUnbatched", func() (fs.NodeRepo, func()) {
+		dbrepo, dispose := benchDbRepo()
+		return &unbatchedRepo{dbrepo}, dispose
+	})
+}
+
+const benchBigFileSize = 4 << 20
+
+func BenchmarkIndexFile(b *testing.B) {
+	timer := NewBenchTimer(b, "IndexFile")
+	tg := treegen.New()
+	path := BenchTree(tg.F("big", tg.B(42, benchBigFileSize)))
+	defer os.RemoveAll(path)
+	b.SetBytes(benchBigFileSize)
+
+	for i := 0; i < b.N; i++ {
+		timer.Start()
+		_, _, err := fs.IndexFile(filepath.Join(path, "big"))
+		timer.Stop()
+
+		if err != nil {
+			panic(err)
+		}
+	}
+	timer.Report()
+}
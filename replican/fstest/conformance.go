@@ -0,0 +1,595 @@
+package fstest
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+// Make a new, empty NodeRepo for a conformance test. The dispose function
+// releases anything the repo stored outside of memory, once it is closed.
+type RepoMaker func(t *testing.T) (repo fs.NodeRepo, dispose func())
+
+// A test of one part of the NodeRepo contract.
+type ConformanceTest struct {
+	Name string
+	Test func(t *testing.T, mkrepo RepoMaker)
+}
+
+// Every test a NodeRepo implementation should pass. None of them depend
+// on files outside of those they generate, so they can be run from the
+// package of any implementation.
+var ConformanceTests = []ConformanceTest{
+	single("NodeRelPath", DoTestNodeRelPath),
+	single("StoreRelPath", DoTestStoreRelPath),
+	single("DirResolve", DoTestDirResolve),
+	single("DirDescent", DoTestDirDescent),
+	single("ParentRefs", DoTestParentRefs),
+	single("Lookups", DoTestLookups),
+	single("DuplicateContent", DoTestDuplicateContent),
+	single("EmptyFiles", DoTestEmptyFiles),
+	single("EmptyDirs", DoTestEmptyDirs),
+	single("GeneratedTree", DoTestGeneratedTree),
+	single("ConcurrentReads", DoTestConcurrentReads),
+	single("ConcurrentIndex", DoTestConcurrentIndex),
+	single("ConcurrentWrites", DoTestConcurrentWrites),
+	single("ConcurrentBulk", DoTestConcurrentBulk),
+	single("Remove", DoTestRemove),
+	single("RemoveUpdatesStrongs", DoTestRemoveUpdatesStrongs),
+	single("UpdateFile", DoTestUpdateFile),
+	single("Rename", DoTestRename),
+	single("RenameCollision", DoTestRenameCollision),
+	single("ObjectStore", DoTestObjectStore),
+	single("ObjectStoreCollect", DoTestObjectStoreCollect),
+	single("ObjectStoreConcurrent", DoTestObjectStoreConcurrent),
+	ConformanceTest{"Diff", func(t *testing.T, mkrepo RepoMaker) {
+		srcRepo, disposeSrc := mkrepo(t)
+		defer disposeSrc()
+		defer srcRepo.Close()
+		dstRepo, disposeDst := mkrepo(t)
+		defer disposeDst()
+		defer dstRepo.Close()
+		DoTestDiff(t, srcRepo, dstRepo)
+	}},
+	ConformanceTest{"Close", DoTestClose},
+}
+
+// Run a test of a single repo, closing and disposing of it afterwards.
+func single(name string, test func(*testing.T, fs.NodeRepo)) ConformanceTest {
+	return ConformanceTest{name, func(t *testing.T, mkrepo RepoMaker) {
+		repo, dispose := mkrepo(t)
+		defer dispose()
+		defer repo.Close()
+		test(t, repo)
+	}}
+}
+
+// Run every conformance test against a NodeRepo implementation.
+func DoTestConformance(t *testing.T, mkrepo RepoMaker) {
+	for _, test := range ConformanceTests {
+		t.Logf("NodeRepo conformance: %s", test.Name)
+		test.Test(t, mkrepo)
+	}
+}
+
+// Index a generated tree into repo, and into a MemRepo for reference.
+func indexGenerated(t *testing.T, repo fs.NodeRepo, treeSpec treegen.Generated) (root fs.Dir, expect fs.Dir, path string) {
+	path = treegen.TestTree(t, treeSpec)
+
+	root, errors := fs.IndexDir(path, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	expect, errors = fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	assert.Equal(t, expect.Info().Strong, root.Info().Strong)
+	return root, expect, path
+}
+
+// Assert that every node in a tree can be found by its checksums,
+// and by its path.
+func assertLookups(t *testing.T, repo fs.NodeRepo, root fs.Dir) {
+	fs.Walk(root, func(node fs.Node) bool {
+		switch node := node.(type) {
+		case fs.Dir:
+			dir, found, _ := repo.Dir(node.Info().Strong)
+			assert.Tf(t, found, "dir %s not found by strong", fs.RelPath(node))
+			assert.Equal(t, node.Info().Strong, dir.Info().Strong)
+
+			relpath := fs.RelPath(node)
+			byPath, found := fs.Lookup(root, relpath)
+			assert.Tf(t, found, "dir %s not found by path", relpath)
+			assert.Equal(t, node.Info().Strong, byPath.(fs.Dir).Info().Strong)
+
+		case fs.File:
+			file, found, _ := repo.File(node.Info().Strong)
+			assert.Tf(t, found, "file %s not found by strong", fs.RelPath(node))
+			assert.Equal(t, node.Info().Strong, file.Info().Strong)
+			assert.Equal(t, node.Info().Size, file.Info().Size)
+
+			relpath := fs.RelPath(node)
+			byPath, found := fs.Lookup(root, relpath)
+			assert.Tf(t, found, "file %s not found by path", relpath)
+			assert.Equal(t, node.Info().Strong, byPath.(fs.File).Info().Strong)
+
+			nBlocks := (node.Info().Size + int64(fs.BLOCKSIZE) - 1) / int64(fs.BLOCKSIZE)
+			assert.Equalf(t, int(nBlocks), len(node.Blocks()), "blocks in %s", relpath)
+			positions := make(map[int]bool)
+			for _, block := range node.Blocks() {
+				positions[block.Info().Position] = true
+			}
+			for i := 0; i < int(nBlocks); i++ {
+				assert.Tf(t, positions[i], "block %d missing from %s", i, relpath)
+			}
+
+		case fs.Block:
+			block, found, _ := repo.Block(node.Info().Strong)
+			assert.Tf(t, found, "block %s not found by strong", node.Info().Strong)
+			assert.Equal(t, node.Info().Strong, block.Info().Strong)
+
+			block, found, _ = repo.WeakBlock(node.Info().Weak)
+			assert.Tf(t, found, "block %s not found by weak", node.Info().Strong)
+			assert.Equal(t, node.Info().Weak, block.Info().Weak)
+
+			parent, hasParent := block.Parent()
+			assert.T(t, hasParent)
+			_, isFile := parent.(fs.File)
+			assert.T(t, isFile)
+		}
+		return true
+	})
+}
+
+func DoTestLookups(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("B", tg.B(43, 100))),
+		tg.F("C", tg.B(44, 8192), tg.B(45, 8192)))
+
+	root, _, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	assertLookups(t, repo, root)
+
+	_, found, _ := repo.Dir("nope")
+	assert.T(t, !found)
+	_, found, _ = repo.File("nope")
+	assert.T(t, !found)
+	_, found, _ = repo.Block("nope")
+	assert.T(t, !found)
+
+	// The weak checksum packs two positive sums, so it is never negative
+	_, found, _ = repo.WeakBlock(-1)
+	assert.T(t, !found)
+
+	// The root has no parent, and is the repo's root
+	_, hasParent := root.Parent()
+	assert.T(t, !hasParent)
+	repoRoot, isDir := Root(t, repo).(fs.Dir)
+	assert.T(t, isDir)
+	assert.Equal(t, root.Info().Strong, repoRoot.Info().Strong)
+}
+
+func DoTestDuplicateContent(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("A", tg.B(42, 65537))),
+		tg.D("quux",
+			tg.F("A", tg.B(42, 65537))),
+		tg.F("AA", tg.B(42, 65537), tg.B(42, 65537)))
+
+	root, _, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	assertLookups(t, repo, root)
+
+	bazNode, _ := fs.Lookup(root, filepath.Join("foo", "baz"))
+	quuxNode, _ := fs.Lookup(root, filepath.Join("foo", "quux"))
+	baz := bazNode.(fs.Dir)
+	quux := quuxNode.(fs.Dir)
+	assert.Equal(t, baz.Info().Strong, quux.Info().Strong)
+
+	// Any one of identical nodes may be found
+	dir, found, _ := repo.Dir(baz.Info().Strong)
+	assert.T(t, found)
+	dirPath := fs.RelPath(dir)
+	assert.Tf(t, dirPath == fs.RelPath(baz) || dirPath == fs.RelPath(quux),
+		"unexpected dir: %s", dirPath)
+
+	ANode, _ := fs.Lookup(root, filepath.Join("foo", "bar", "A"))
+	A := ANode.(fs.File)
+	file, found, _ := repo.File(A.Info().Strong)
+	assert.T(t, found)
+	assert.Tf(t, file.Name() == "A" || file.Name() == "a", "unexpected file: %s", file.Name())
+
+	// Repeated content within a file is found in that file or another
+	AANode, _ := fs.Lookup(root, filepath.Join("foo", "AA"))
+	AA := AANode.(fs.File)
+	assert.Equal(t, 17, len(AA.Blocks()))
+	block, found, _ := repo.Block(A.Blocks()[0].Info().Strong)
+	assert.T(t, found)
+	parent, _ := block.Parent()
+	assert.Tf(t, parent.Name() == "A" || parent.Name() == "a" || parent.Name() == "AA",
+		"unexpected block parent: %s", parent.Name())
+}
+
+func DoTestEmptyFiles(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("empty"),
+		tg.F("void"),
+		tg.F("full", tg.B(42, 100)))
+
+	root, _, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	assertLookups(t, repo, root)
+
+	emptyStrong := fmt.Sprintf("%x", sha1.New().Sum())
+	for _, name := range []string{"empty", "void"} {
+		node, found := fs.Lookup(root, filepath.Join("foo", name))
+		assert.T(t, found)
+		file := node.(fs.File)
+		assert.Equal(t, int64(0), file.Info().Size)
+		assert.Equal(t, emptyStrong, file.Info().Strong)
+		assert.Equal(t, 0, len(file.Blocks()))
+	}
+
+	file, found, _ := repo.File(emptyStrong)
+	assert.T(t, found)
+	assert.Tf(t, file.Name() == "empty" || file.Name() == "void",
+		"unexpected file: %s", file.Name())
+}
+
+func DoTestEmptyDirs(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("empty"),
+		tg.D("nested",
+			tg.D("inner")),
+		tg.F("full", tg.B(42, 100)))
+
+	root, _, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	assertLookups(t, repo, root)
+
+	for _, relpath := range []string{
+		filepath.Join("foo", "empty"),
+		filepath.Join("foo", "nested", "inner")} {
+		node, found := fs.Lookup(root, relpath)
+		assert.Tf(t, found, "%s not found", relpath)
+		dir := node.(fs.Dir)
+		assert.Equal(t, 0, len(dir.SubDirs()))
+		assert.Equal(t, 0, len(dir.Files()))
+		strong, err := fs.CalcStrong(dir)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, strong, dir.Info().Strong)
+	}
+
+	node, _ := fs.Lookup(root, filepath.Join("foo", "nested"))
+	nested := node.(fs.Dir)
+	assert.Equal(t, 1, len(nested.SubDirs()))
+	assert.Equal(t, 0, len(nested.Files()))
+}
+
+// Test a generated tree of odd names, deep nesting and sizes on either
+// side of block boundaries.
+func DoTestGeneratedTree(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	bs := int64(fs.BLOCKSIZE)
+	treeSpec := tg.D("foo",
+		tg.F("", tg.B(1, 1)),
+		tg.F("", tg.B(2, bs-1)),
+		tg.F("", tg.B(3, bs)),
+		tg.F("", tg.B(4, bs+1)),
+		tg.F("", tg.B(5, 3*bs)),
+		tg.D("",
+			tg.D("",
+				tg.D("",
+					tg.D("",
+						tg.F("", tg.B(6, 2*bs+1)))))),
+		tg.D("",
+			tg.F("", tg.B(1, 1)),
+			tg.D("")),
+		tg.D("with space",
+			tg.F("it's \"quoted\"", tg.B(7, 100))))
+
+	root, expect, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	assertLookups(t, repo, root)
+	assertLookups(t, expect.Repo(), expect)
+}
+
+// Test that lookups from many goroutines at once find the same nodes
+// as lookups made one at a time.
+func DoTestConcurrentReads(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("B", tg.B(43, 65537))),
+		tg.D("baz",
+			tg.F("C", tg.B(44, 65537))))
+
+	root, _, path := indexGenerated(t, repo, treeSpec)
+	defer os.RemoveAll(path)
+
+	strongs := []string{}
+	fs.Walk(root, func(node fs.Node) bool {
+		if block, isBlock := node.(fs.Block); isBlock {
+			strongs = append(strongs, block.Info().Strong)
+		}
+		return true
+	})
+
+	const readers = 8
+	done := make(chan int)
+	for i := 0; i < readers; i++ {
+		go func() {
+			found := 0
+			for _, strong := range strongs {
+				if block, has, _ := repo.Block(strong); has && block.Info().Strong == strong {
+					if _, hasParent := block.Parent(); hasParent {
+						found++
+					}
+				}
+			}
+			done <- found
+		}()
+	}
+
+	for i := 0; i < readers; i++ {
+		assert.Equal(t, len(strongs), <-done)
+	}
+}
+
+// Walk the repo's tree over and over until stop is closed, then send
+// the number of nodes found that could not find their own parent,
+// counting a failure to read the root as one of them.
+func walkUntil(repo fs.NodeRepo, stop <-chan bool, orphans chan<- int) {
+	n := 0
+	for {
+		select {
+		case <-stop:
+			orphans <- n
+			return
+		default:
+		}
+
+		root, err := repo.Root()
+		if err != nil {
+			n++
+		} else if root != nil {
+			fs.Walk(root, func(node fs.Node) bool {
+				if fsNode, isFsNode := node.(fs.FsNode); isFsNode && fsNode != root {
+					if _, hasParent := fsNode.Parent(); !hasParent {
+						n++
+					}
+				}
+				return true
+			})
+		}
+	}
+}
+
+// Test reading a tree from several goroutines while it is indexed.
+func DoTestConcurrentIndex(t *testing.T, repo fs.NodeRepo) {
+	// Run goroutines in parallel, so they interleave within calls
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("", tg.B(1, 65537)),
+		tg.F("", tg.B(2, 65537)),
+		tg.D("",
+			tg.F("", tg.B(3, 3*fs.BLOCKSIZE)),
+			tg.F("", tg.B(4, 100)),
+			tg.D("",
+				tg.F("", tg.B(5, 2*fs.BLOCKSIZE+1)))),
+		tg.D("",
+			tg.F("", tg.B(6, 65537))))
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	const readers = 4
+	stop := make(chan bool)
+	orphans := make(chan int)
+	for i := 0; i < readers; i++ {
+		go walkUntil(repo, stop, orphans)
+	}
+
+	root, errors := fs.IndexDir(path, repo)
+	close(stop)
+	for i := 0; i < readers; i++ {
+		assert.Equal(t, 0, <-orphans)
+	}
+
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assertLookups(t, repo, root)
+
+	expect, _ := fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equal(t, expect.Info().Strong, root.Info().Strong)
+}
+
+// Test adding, updating and removing nodes from several goroutines
+// at once, while others read.
+func DoTestConcurrentWrites(t *testing.T, repo fs.NodeRepo) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	tg := treegen.New()
+	root, _, path := indexGenerated(t, repo,
+		tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	const writers = 4
+	const files = 10
+
+	stop := make(chan bool)
+	orphans := make(chan int)
+	go walkUntil(repo, stop, orphans)
+
+	done := make(chan os.Error)
+	for i := 0; i < writers; i++ {
+		go func(writer int) {
+			subdir, err := repo.AddDir(root, &fs.DirInfo{
+				Name:   fmt.Sprintf("writer%d", writer),
+				Mode:   0755,
+				Parent: root.Info().Strong})
+			if err != nil {
+				done <- err
+				return
+			}
+
+			added := []fs.File{}
+			for j := 0; j < files; j++ {
+				strong := fmt.Sprintf("%d-%d", writer, j)
+				file, err := repo.AddFile(subdir,
+					&fs.FileInfo{
+						Name:   fmt.Sprintf("file%d", j),
+						Mode:   0644,
+						Size:   1,
+						Strong: "file" + strong,
+						Parent: subdir.Info().Strong},
+					[]*fs.BlockInfo{&fs.BlockInfo{
+						Strong: "block" + strong,
+						Weak:   writer*files + j}})
+				if err != nil {
+					done <- err
+					return
+				}
+				added = append(added, file)
+			}
+
+			// Keep the even files, updated, and remove the odd ones
+			for j, file := range added {
+				if j%2 == 0 {
+					strong := fmt.Sprintf("%d-%d-updated", writer, j)
+					_, err = repo.UpdateFile(file,
+						&fs.FileInfo{Mode: 0644, Size: 1, Strong: "file" + strong},
+						[]*fs.BlockInfo{&fs.BlockInfo{Strong: "block" + strong}})
+				} else {
+					err = repo.RemoveFile(file)
+				}
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}(i)
+	}
+
+	for i := 0; i < writers; i++ {
+		err := <-done
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	close(stop)
+	assert.Equal(t, 0, <-orphans)
+
+	root = RootDir(t, repo)
+	assert.Equal(t, writers, len(root.SubDirs()))
+	for _, subdir := range root.SubDirs() {
+		assert.Equalf(t, files/2, len(subdir.Files()), "%s", subdir.Name())
+	}
+
+	for i := 0; i < writers; i++ {
+		for j := 0; j < files; j++ {
+			strong := fmt.Sprintf("%d-%d", i, j)
+			if j%2 == 0 {
+				strong += "-updated"
+			}
+			_, hasFile, _ := repo.File("file" + strong)
+			_, hasBlock, _ := repo.Block("block" + strong)
+			assert.Equalf(t, j%2 == 0, hasFile, "file%s", strong)
+			assert.Equalf(t, j%2 == 0, hasBlock, "block%s", strong)
+		}
+	}
+
+	// Concurrent writers may leave strongs behind, until updated
+	strong := root.UpdateStrong()
+	found, has, _ := repo.Dir(strong)
+	assert.T(t, has)
+	assert.Equal(t, fs.RelPath(root), fs.RelPath(found))
+}
+
+// Test that a change made through a BulkRepo waits for a bulk load in
+// progress to end, and is kept when the load is aborted.
+func DoTestConcurrentBulk(t *testing.T, repo fs.NodeRepo) {
+	bulk, isBulk := repo.(fs.BulkRepo)
+	if !isBulk {
+		return
+	}
+
+	tg := treegen.New()
+	root, _, path := indexGenerated(t, repo,
+		tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(path)
+
+	load, err := bulk.BeginBulk()
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = load.AddDir(root, &fs.DirInfo{Name: "loaded", Mode: 0755})
+	assert.Tf(t, err == nil, "%v", err)
+
+	done := make(chan os.Error)
+	go func() {
+		_, err := repo.AddDir(root, &fs.DirInfo{Name: "written", Mode: 0755})
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		t.Fatalf("added during a bulk load: %v", err)
+	case <-time.After(100 * 1000 * 1000):
+	}
+
+	// Reads see the load in the meantime
+	_, found := fs.Lookup(RootDir(t, repo), "loaded")
+	assert.T(t, found)
+
+	assert.T(t, load.AbortBulk() == nil)
+	err = <-done
+	assert.Tf(t, err == nil, "%v", err)
+
+	_, found = fs.Lookup(RootDir(t, repo), "loaded")
+	assert.T(t, !found)
+	_, found = fs.Lookup(RootDir(t, repo), "written")
+	assert.T(t, found)
+}
+
+// Test closing a repo which has been used, and closing it again.
+func DoTestClose(t *testing.T, mkrepo RepoMaker) {
+	repo, dispose := mkrepo(t)
+	defer dispose()
+
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 100))))
+	defer os.RemoveAll(path)
+
+	_, errors := fs.IndexDir(path, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	// Closing a closed repo does nothing
+	closeTwice := func() (failure interface{}) {
+		defer func() { failure = recover() }()
+		repo.Close()
+		repo.Close()
+		return nil
+	}
+	failure := closeTwice()
+	assert.Tf(t, failure == nil, "second Close failed: %v", failure)
+}
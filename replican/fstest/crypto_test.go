@@ -0,0 +1,165 @@
+package fstest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+func testKeys(secret string) *fs.Keys {
+	return fs.DeriveKeys([]byte(secret), []byte("salt"), 10)
+}
+
+func TestKeysSeal(t *testing.T) {
+	keys := testKeys("secret")
+	plain := []byte("hello world")
+
+	sealed1, err := keys.Seal(plain)
+	assert.Tf(t, err == nil, "%v", err)
+	sealed2, err := keys.Seal(plain)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, !bytes.Equal(sealed1, sealed2))
+	assert.T(t, !bytes.Contains(sealed1, plain))
+
+	opened, err := keys.Open(sealed1)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, plain, opened)
+
+	// Tampering and other keys are detected
+	sealed1[20] ^= 1
+	_, err = keys.Open(sealed1)
+	assert.T(t, err != nil)
+	_, err = testKeys("other").Open(sealed2)
+	assert.T(t, err != nil)
+	_, err = keys.Open(sealed2[:10])
+	assert.T(t, err != nil)
+
+	assert.Equal(t, keys.Address("abc"), testKeys("secret").Address("abc"))
+	assert.T(t, keys.Address("abc") != testKeys("other").Address("abc"))
+}
+
+func TestKeysSealName(t *testing.T) {
+	keys := testKeys("secret")
+	sealed := keys.SealName("foo")
+	assert.Equal(t, sealed, keys.SealName("foo"))
+	assert.T(t, sealed != keys.SealName("bar"))
+	assert.T(t, !strings.Contains(sealed, "foo"))
+	assert.Equal(t, filepath.Base(sealed), sealed)
+
+	name, err := keys.OpenName(sealed)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "foo", name)
+
+	_, err = testKeys("other").OpenName(sealed)
+	assert.T(t, err != nil)
+	_, err = keys.OpenName("foo")
+	assert.T(t, err != nil)
+}
+
+func TestKeysSealChecksums(t *testing.T) {
+	keys := testKeys("secret")
+	strong := fs.StrongChecksum([]byte("hello world"))
+	sealed := keys.SealStrong(strong)
+	assert.Equal(t, sealed, keys.SealStrong(strong))
+	assert.T(t, !strings.Contains(sealed, strong))
+	assert.T(t, sealed != keys.SealName(strong))
+
+	opened, err := keys.OpenStrong(sealed)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, strong, opened)
+	_, err = testKeys("other").OpenStrong(sealed)
+	assert.T(t, err != nil)
+
+	for _, weak := range []int64{0, 1, 65537, -1, 1 << 40} {
+		sealedWeak := keys.SealWeak(weak)
+		assert.T(t, sealedWeak != weak)
+		assert.Equal(t, sealedWeak, keys.SealWeak(weak))
+		assert.Equal(t, weak, keys.OpenWeak(sealedWeak))
+		assert.T(t, sealedWeak != testKeys("other").SealWeak(weak))
+	}
+}
+
+func TestUnlockKeys(t *testing.T) {
+	path, err := ioutil.TempDir("", treegen.PREFIX)
+	assert.T(t, err == nil)
+	defer os.RemoveAll(path)
+	keyPath := filepath.Join(path, "keys")
+
+	created, err := fs.UnlockKeys(keyPath, []byte("secret"))
+	assert.Tf(t, err == nil, "%v", err)
+	unlocked, err := fs.UnlockKeys(keyPath, []byte("secret"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, created.Address("abc"), unlocked.Address("abc"))
+
+	_, err = fs.UnlockKeys(keyPath, []byte("wrong"))
+	assert.T(t, err != nil)
+}
+
+func TestEncryptedObjectStore(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(42, 65537)),
+		tg.F("blop", tg.B(43, 100))))
+	defer os.RemoveAll(path)
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+
+	repo := fs.NewMemRepo()
+	local, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	keys := testKeys("secret")
+	objects, err := fs.NewEncryptedObjectStore(objpath, repo, keys)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, objects.Backup(local) == nil)
+	objects.Close()
+
+	// Neither the contents nor their checksums are in the packs
+	node, found := fs.Lookup(RootDir(t, repo), filepath.Join("foo", "bar"))
+	assert.T(t, found)
+	bar := node.(fs.File)
+	contents, err := ioutil.ReadFile(filepath.Join(path, "foo", "bar"))
+	assert.T(t, err == nil)
+	packs, err := filepath.Glob(filepath.Join(objpath, "pack-*"))
+	assert.T(t, err == nil)
+	assert.Equal(t, 2, len(packs))
+	for _, pack := range packs {
+		packContents, err := ioutil.ReadFile(pack)
+		assert.T(t, err == nil)
+		assert.T(t, !bytes.Contains(packContents, contents[:64]))
+		assert.T(t, !bytes.Contains(packContents, []byte(bar.Blocks()[0].Info().Strong)))
+	}
+
+	objects, err = fs.NewEncryptedObjectStore(objpath, repo, keys)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+	buf := &bytes.Buffer{}
+	_, err = objects.ReadInto(bar.Info().Strong, 0, bar.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, contents, buf.Bytes())
+
+	// Collection keeps what is still reachable
+	blop, found := fs.Lookup(RootDir(t, repo), filepath.Join("foo", "blop"))
+	assert.T(t, found)
+	report, err := objects.Collect(blop)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(9), report.Blocks)
+	assert.T(t, objects.HasBlock(blop.(fs.File).Blocks()[0].Info().Strong))
+	assert.T(t, !objects.HasBlock(bar.Blocks()[0].Info().Strong))
+
+	// Without the keys, nothing can be found
+	plain, err := fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	defer plain.Close()
+	assert.T(t, !plain.HasBlock(blop.(fs.File).Blocks()[0].Info().Strong))
+}
@@ -64,3 +64,47 @@ func TestDbParentRefs(t *testing.T) {
 	defer os.RemoveAll(dbpath)
 	DoTestParentRefs(t, dbrepo)
 }
+
+func TestDbDiff(t *testing.T) {
+	srcRepo, srcDbpath := createDbRepo(t)
+	defer os.RemoveAll(srcDbpath)
+	dstRepo, dstDbpath := createDbRepo(t)
+	defer os.RemoveAll(dstDbpath)
+	DoTestDiff(t, srcRepo, dstRepo)
+}
+
+func TestDbObjectStore(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestObjectStore(t, dbrepo)
+}
+
+func TestDbRemove(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestRemove(t, dbrepo)
+}
+
+func TestDbObjectStoreCollect(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestObjectStoreCollect(t, dbrepo)
+}
+
+func TestDbUpdateFile(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestUpdateFile(t, dbrepo)
+}
+
+func TestDbRename(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestRename(t, dbrepo)
+}
+
+func TestDbRemoveUpdatesStrongs(t *testing.T) {
+	dbrepo, dbpath := createDbRepo(t)
+	defer os.RemoveAll(dbpath)
+	DoTestRemoveUpdatesStrongs(t, dbrepo)
+}
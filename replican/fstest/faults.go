@@ -0,0 +1,266 @@
+package fstest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// The cause of every failure after a FaultFs crashes.
+var ErrCrashed = os.NewError("Filesystem crashed")
+
+// A failure for a FaultFs to inject. Once a number of calls matching it
+// have succeeded, every later one fails.
+type Fault struct {
+	// The FileSystem or Handle method to fail, such as "Rename" or
+	// "Write". Any method matches when empty.
+	Op string
+
+	// A substring of the paths to fail. Any path matches when empty.
+	Path string
+
+	// How many matching calls succeed before the fault.
+	After int
+
+	// The cause of the failure, such as os.ENOSPC.
+	Err os.Error
+
+	// Fail every call to any method once the fault is reached,
+	// as if the process had died part way through.
+	Crash bool
+}
+
+func (fault *Fault) matches(op string, path string) bool {
+	return (fault.Op == "" || fault.Op == op) && strings.Contains(path, fault.Path)
+}
+
+// A FileSystem which passes calls through to another, but for those
+// which faults are injected into.
+type FaultFs struct {
+	fs.FileSystem
+
+	lock    sync.Mutex
+	faults  []*Fault
+	crashed bool
+	calls   []string
+}
+
+func NewFaultFs(inner fs.FileSystem, faults ...*Fault) *FaultFs {
+	return &FaultFs{FileSystem: inner, faults: faults}
+}
+
+// Add a fault, to be reached by calls after this one.
+func (faultFs *FaultFs) Inject(fault *Fault) {
+	faultFs.lock.Lock()
+	defer faultFs.lock.Unlock()
+	faultFs.faults = append(faultFs.faults, fault)
+}
+
+// Test whether a crash fault has been reached.
+func (faultFs *FaultFs) Crashed() bool {
+	faultFs.lock.Lock()
+	defer faultFs.lock.Unlock()
+	return faultFs.crashed
+}
+
+// List the calls made so far, each as the method and the path it was
+// called on.
+func (faultFs *FaultFs) Calls() []string {
+	faultFs.lock.Lock()
+	defer faultFs.lock.Unlock()
+	return append([]string{}, faultFs.calls...)
+}
+
+// Record a call, and get the cause of its failure if it is to fail.
+func (faultFs *FaultFs) check(op string, path string) os.Error {
+	faultFs.lock.Lock()
+	defer faultFs.lock.Unlock()
+
+	faultFs.calls = append(faultFs.calls, fmt.Sprintf("%s %s", op, path))
+	if faultFs.crashed {
+		return ErrCrashed
+	}
+
+	for _, fault := range faultFs.faults {
+		if !fault.matches(op, path) {
+			continue
+		}
+		if fault.After > 0 {
+			fault.After--
+			continue
+		}
+
+		if fault.Crash {
+			faultFs.crashed = true
+		}
+		return fault.Err
+	}
+	return nil
+}
+
+func (faultFs *FaultFs) pathError(op string, path string) os.Error {
+	if err := faultFs.check(op, path); err != nil {
+		return &os.PathError{Op: strings.ToLower(op), Path: path, Error: err}
+	}
+	return nil
+}
+
+func (faultFs *FaultFs) handle(fh fs.Handle, err os.Error) (fs.Handle, os.Error) {
+	if err != nil {
+		return nil, err
+	}
+	return &faultHandle{Handle: fh, faultFs: faultFs}, nil
+}
+
+func (faultFs *FaultFs) Open(name string) (fs.Handle, os.Error) {
+	if err := faultFs.pathError("Open", name); err != nil {
+		return nil, err
+	}
+	return faultFs.handle(faultFs.FileSystem.Open(name))
+}
+
+func (faultFs *FaultFs) Create(name string) (fs.Handle, os.Error) {
+	if err := faultFs.pathError("Create", name); err != nil {
+		return nil, err
+	}
+	return faultFs.handle(faultFs.FileSystem.Create(name))
+}
+
+func (faultFs *FaultFs) OpenFile(name string, flag int, perm uint32) (fs.Handle, os.Error) {
+	if err := faultFs.pathError("OpenFile", name); err != nil {
+		return nil, err
+	}
+	return faultFs.handle(faultFs.FileSystem.OpenFile(name, flag, perm))
+}
+
+func (faultFs *FaultFs) TempFile(dir string, prefix string) (fs.Handle, os.Error) {
+	if err := faultFs.pathError("TempFile", dir); err != nil {
+		return nil, err
+	}
+	return faultFs.handle(faultFs.FileSystem.TempFile(dir, prefix))
+}
+
+func (faultFs *FaultFs) Stat(name string) (*os.FileInfo, os.Error) {
+	if err := faultFs.pathError("Stat", name); err != nil {
+		return nil, err
+	}
+	return faultFs.FileSystem.Stat(name)
+}
+
+func (faultFs *FaultFs) Lstat(name string) (*os.FileInfo, os.Error) {
+	if err := faultFs.pathError("Lstat", name); err != nil {
+		return nil, err
+	}
+	return faultFs.FileSystem.Lstat(name)
+}
+
+func (faultFs *FaultFs) ReadDir(name string) ([]*os.FileInfo, os.Error) {
+	if err := faultFs.pathError("ReadDir", name); err != nil {
+		return nil, err
+	}
+	return faultFs.FileSystem.ReadDir(name)
+}
+
+func (faultFs *FaultFs) Mkdir(name string, perm uint32) os.Error {
+	if err := faultFs.pathError("Mkdir", name); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.Mkdir(name, perm)
+}
+
+func (faultFs *FaultFs) MkdirAll(path string, perm uint32) os.Error {
+	if err := faultFs.pathError("MkdirAll", path); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.MkdirAll(path, perm)
+}
+
+func (faultFs *FaultFs) Remove(name string) os.Error {
+	if err := faultFs.pathError("Remove", name); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.Remove(name)
+}
+
+func (faultFs *FaultFs) RemoveAll(path string) os.Error {
+	if err := faultFs.pathError("RemoveAll", path); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.RemoveAll(path)
+}
+
+// A rename is matched by either of its paths.
+func (faultFs *FaultFs) Rename(oldname string, newname string) os.Error {
+	if err := faultFs.check("Rename", oldname+" "+newname); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Error: err}
+	}
+	return faultFs.FileSystem.Rename(oldname, newname)
+}
+
+func (faultFs *FaultFs) Truncate(name string, size int64) os.Error {
+	if err := faultFs.pathError("Truncate", name); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.Truncate(name, size)
+}
+
+func (faultFs *FaultFs) Chmod(name string, mode uint32) os.Error {
+	if err := faultFs.pathError("Chmod", name); err != nil {
+		return err
+	}
+	return faultFs.FileSystem.Chmod(name, mode)
+}
+
+// A file opened on a FaultFs, whose reads and writes can be failed.
+type faultHandle struct {
+	fs.Handle
+	faultFs *FaultFs
+}
+
+func (fh *faultHandle) Read(buf []byte) (int, os.Error) {
+	if err := fh.faultFs.pathError("Read", fh.Name()); err != nil {
+		return 0, err
+	}
+	return fh.Handle.Read(buf)
+}
+
+func (fh *faultHandle) ReadAt(buf []byte, off int64) (int, os.Error) {
+	if err := fh.faultFs.pathError("ReadAt", fh.Name()); err != nil {
+		return 0, err
+	}
+	return fh.Handle.ReadAt(buf, off)
+}
+
+func (fh *faultHandle) Write(buf []byte) (int, os.Error) {
+	if err := fh.faultFs.pathError("Write", fh.Name()); err != nil {
+		return 0, err
+	}
+	return fh.Handle.Write(buf)
+}
+
+func (fh *faultHandle) Seek(offset int64, whence int) (int64, os.Error) {
+	if err := fh.faultFs.pathError("Seek", fh.Name()); err != nil {
+		return 0, err
+	}
+	return fh.Handle.Seek(offset, whence)
+}
+
+func (fh *faultHandle) Truncate(size int64) os.Error {
+	if err := fh.faultFs.pathError("Truncate", fh.Name()); err != nil {
+		return err
+	}
+	return fh.Handle.Truncate(size)
+}
+
+// The file is closed even when the close is failed, so that a failing
+// test does not leak it.
+func (fh *faultHandle) Close() os.Error {
+	err := fh.faultFs.pathError("Close", fh.Name())
+	if closeErr := fh.Handle.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Get the cause of a failed file operation.
+func ErrorCause(err os.Error) os.Error {
+	switch err := err.(type) {
+	case *os.PathError:
+		return err.Error
+	case *os.LinkError:
+		return err.Error
+	}
+	return err
+}
+
+func writeFile(t *testing.T, fileSys fs.FileSystem, path string, contents string) {
+	fh, err := fileSys.Create(path)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = fh.Write([]byte(contents))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, fh.Close() == nil)
+}
+
+func readFile(t *testing.T, fileSys fs.FileSystem, path string) string {
+	fh, err := fileSys.Open(path)
+	assert.Tf(t, err == nil, "%v", err)
+	defer fh.Close()
+	contents, err := ioutil.ReadAll(fh)
+	assert.Tf(t, err == nil, "%v", err)
+	return string(contents)
+}
+
+// Test the parts of the FileSystem contract the stores and patches rely on,
+// in an empty directory at root.
+func DoTestFileSystem(t *testing.T, fileSys fs.FileSystem, root string) {
+	foo := filepath.Join(root, "foo")
+	bar := filepath.Join(foo, "bar")
+
+	// Missing files
+	_, err := fileSys.Open(bar)
+	assert.Equal(t, os.ENOENT, ErrorCause(err))
+	_, err = fileSys.Create(bar)
+	assert.Equal(t, os.ENOENT, ErrorCause(err))
+
+	// Directories
+	assert.T(t, fileSys.Mkdir(foo, 0755) == nil)
+	assert.Equal(t, os.EEXIST, ErrorCause(fileSys.Mkdir(foo, 0755)))
+	assert.T(t, fileSys.MkdirAll(filepath.Join(foo, "a", "b"), 0755) == nil)
+	assert.T(t, fileSys.MkdirAll(filepath.Join(foo, "a", "b"), 0755) == nil)
+	info, err := fileSys.Stat(filepath.Join(foo, "a", "b"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, info.IsDirectory())
+	assert.Equal(t, "b", info.Name)
+
+	// Reading and writing
+	writeFile(t, fileSys, bar, "hello world")
+	entries, err := fileSys.ReadDir(foo)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "a", entries[0].Name)
+	assert.T(t, entries[0].IsDirectory())
+	assert.Equal(t, "bar", entries[1].Name)
+	assert.Equal(t, int64(11), entries[1].Size)
+	_, err = fileSys.ReadDir(bar)
+	assert.T(t, err != nil)
+
+	assert.Equal(t, "hello world", readFile(t, fileSys, bar))
+	info, err = fileSys.Stat(bar)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, info.IsRegular())
+	assert.Equal(t, int64(11), info.Size)
+
+	fh, err := fileSys.OpenFile(bar, os.O_RDWR, 0644)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = fh.Seek(6, 0)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = fh.Write([]byte("there"))
+	assert.Tf(t, err == nil, "%v", err)
+	buf := make([]byte, 5)
+	_, err = fh.ReadAt(buf, 0)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "hello", string(buf))
+	assert.T(t, fh.Truncate(20) == nil)
+	info, err = fh.Stat()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(20), info.Size)
+	assert.T(t, fh.Close() == nil)
+	assert.Equal(t, "hello there"+string(make([]byte, 9)), readFile(t, fileSys, bar))
+
+	assert.T(t, fileSys.Truncate(bar, 5) == nil)
+	assert.Equal(t, "hello", readFile(t, fileSys, bar))
+
+	fh, err = fileSys.OpenFile(bar, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = fh.Write([]byte(", again"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, fh.Close() == nil)
+	assert.Equal(t, "hello, again", readFile(t, fileSys, bar))
+
+	_, err = fileSys.OpenFile(bar, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	assert.Equal(t, os.EEXIST, ErrorCause(err))
+
+	// Modes
+	assert.T(t, fileSys.Chmod(bar, 0600) == nil)
+	info, err = fileSys.Stat(bar)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, uint32(0600), info.Mode&07777)
+
+	// Temporary files are new each time
+	temp1, err := fileSys.TempFile(foo, "temp")
+	assert.Tf(t, err == nil, "%v", err)
+	temp2, err := fileSys.TempFile(foo, "temp")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, temp1.Name() != temp2.Name())
+	assert.Tf(t, strings.HasPrefix(temp1.Name(), filepath.Join(foo, "temp")), "%s", temp1.Name())
+	temp1.Close()
+	temp2.Close()
+	assert.T(t, fileSys.Remove(temp2.Name()) == nil)
+
+	// Renames replace files, and keep open files open
+	fh, err = fileSys.Open(bar)
+	assert.Tf(t, err == nil, "%v", err)
+	writeFile(t, fileSys, temp1.Name(), "replaced")
+	assert.T(t, fileSys.Rename(temp1.Name(), bar) == nil)
+	_, err = fileSys.Stat(temp1.Name())
+	assert.Equal(t, os.ENOENT, ErrorCause(err))
+	assert.Equal(t, "replaced", readFile(t, fileSys, bar))
+	contents, err := ioutil.ReadAll(fh)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "hello, again", string(contents))
+	fh.Close()
+
+	// Renames move directories with their contents
+	assert.T(t, fileSys.Rename(filepath.Join(foo, "a"), filepath.Join(root, "a")) == nil)
+	info, err = fileSys.Stat(filepath.Join(root, "a", "b"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, info.IsDirectory())
+	assert.T(t, fileSys.Rename(filepath.Join(root, "a"), filepath.Join(root, "a", "b", "c")) != nil)
+
+	// Removal
+	assert.T(t, fileSys.Remove(filepath.Join(root, "a")) != nil)
+	assert.T(t, fileSys.RemoveAll(filepath.Join(root, "a")) == nil)
+	_, err = fileSys.Stat(filepath.Join(root, "a", "b"))
+	assert.Equal(t, os.ENOENT, ErrorCause(err))
+	assert.T(t, fileSys.Remove(bar) == nil)
+	assert.Equal(t, os.ENOENT, ErrorCause(fileSys.Remove(bar)))
+	assert.T(t, fileSys.Remove(foo) == nil)
+}
+
+// Copy the tree at src on the OS's filesystem to dst on another.
+func CopyToFs(t *testing.T, fileSys fs.FileSystem, src string, dst string) {
+	info, err := os.Stat(src)
+	assert.Tf(t, err == nil, "%v", err)
+
+	if !info.IsDirectory() {
+		contents, err := ioutil.ReadFile(src)
+		assert.Tf(t, err == nil, "%v", err)
+		writeFile(t, fileSys, dst, string(contents))
+		assert.T(t, fileSys.Chmod(dst, info.Mode&07777) == nil)
+		return
+	}
+
+	assert.T(t, fileSys.MkdirAll(dst, info.Mode&07777) == nil)
+	entries, err := ioutil.ReadDir(src)
+	assert.Tf(t, err == nil, "%v", err)
+	for _, entry := range entries {
+		CopyToFs(t, fileSys, filepath.Join(src, entry.Name), filepath.Join(dst, entry.Name))
+	}
+}
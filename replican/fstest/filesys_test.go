@@ -0,0 +1,99 @@
+package fstest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+func TestOsFileSystem(t *testing.T) {
+	root, err := ioutil.TempDir("", treegen.PREFIX)
+	assert.T(t, err == nil)
+	defer os.RemoveAll(root)
+
+	DoTestFileSystem(t, fs.OS, root)
+}
+
+func TestMemFileSystem(t *testing.T) {
+	memFs := fs.NewMemFs()
+	assert.T(t, memFs.MkdirAll("/root", 0755) == nil)
+	DoTestFileSystem(t, memFs, "/root")
+
+	DoTestFileSystem(t, fs.NewMemFs(), "")
+}
+
+func TestFaultFsPassThrough(t *testing.T) {
+	DoTestFileSystem(t, NewFaultFs(fs.NewMemFs()), "")
+}
+
+func TestFaultFs(t *testing.T) {
+	faultFs := NewFaultFs(fs.NewMemFs(),
+		&Fault{Op: "Write", Path: "full", After: 2, Err: os.ENOSPC},
+		&Fault{Op: "Create", Path: "denied", Err: os.EACCES})
+
+	fh, err := faultFs.Create("full")
+	assert.Tf(t, err == nil, "%v", err)
+	for i := 0; i < 2; i++ {
+		_, err = fh.Write([]byte("x"))
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	_, err = fh.Write([]byte("x"))
+	assert.Equal(t, os.ENOSPC, ErrorCause(err))
+	_, err = fh.Write([]byte("x"))
+	assert.Equal(t, os.ENOSPC, ErrorCause(err))
+	assert.T(t, fh.Close() == nil)
+
+	_, err = faultFs.Create(filepath.Join("some", "denied"))
+	assert.Equal(t, os.EACCES, ErrorCause(err))
+	_, err = faultFs.Create("allowed")
+	assert.Tf(t, err == nil, "%v", err)
+
+	faultFs.Inject(&Fault{Op: "Rename", Err: os.EXDEV})
+	err = faultFs.Rename("allowed", "elsewhere")
+	_, isLinkErr := err.(*os.LinkError)
+	assert.T(t, isLinkErr)
+	assert.Equal(t, os.EXDEV, ErrorCause(err))
+
+	// Nothing works after a crash
+	faultFs.Inject(&Fault{Op: "Remove", Crash: true, Err: ErrCrashed})
+	assert.T(t, !faultFs.Crashed())
+	assert.Equal(t, ErrCrashed, ErrorCause(faultFs.Remove("allowed")))
+	assert.T(t, faultFs.Crashed())
+	_, err = faultFs.Stat("allowed")
+	assert.Equal(t, ErrCrashed, ErrorCause(err))
+
+	calls := faultFs.Calls()
+	assert.Equal(t, "Create full", calls[0])
+	assert.Equal(t, "Stat allowed", calls[len(calls)-1])
+}
+
+// A tree indexes the same on any filesystem.
+func TestIndexMemFs(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.D("baz",
+			tg.F("quux", tg.B(43, 1000)),
+			tg.D("empty"))))
+	defer os.RemoveAll(path)
+
+	osIndexer := &fs.Indexer{Path: filepath.Join(path, "foo"), Repo: fs.NewMemRepo()}
+	osRoot, err := osIndexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+
+	memFs := fs.NewMemFs()
+	CopyToFs(t, memFs, filepath.Join(path, "foo"), "/foo")
+	memIndexer := &fs.Indexer{Path: "/foo", Repo: fs.NewMemRepo(), FileSystem: memFs}
+	memRoot, err := memIndexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, osRoot.Info().Strong, memRoot.Info().Strong)
+
+	fileInfo, _, err := fs.IndexFileWith("/foo/bar", fs.LocalOptions{FileSystem: memFs})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(65537), fileInfo.Size)
+}
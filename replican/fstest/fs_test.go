@@ -1,8 +1,11 @@
 package fstest
 
 import (
+	"io/ioutil"
 	"os"
 	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+	"path/filepath"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -53,3 +56,118 @@ func TestFsDirDescent(t *testing.T) {
 func TestFsParentRefs(t *testing.T) {
 	DoTestParentRefs(t, fs.NewMemRepo())
 }
+
+func TestFsDiff(t *testing.T) {
+	DoTestDiff(t, fs.NewMemRepo(), fs.NewMemRepo())
+}
+
+func TestFsObjectStore(t *testing.T) {
+	DoTestObjectStore(t, fs.NewMemRepo())
+}
+
+// Test that an object store left behind by a crash can be reopened and
+// written to.
+func TestFsObjectStoreCrashed(t *testing.T) {
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+
+	objects, err := fs.NewObjectStore(objpath, nil)
+	assert.Tf(t, err == nil, "%v", err)
+	before, err := objects.PutBlock([]byte("before"))
+	assert.Tf(t, err == nil, "%v", err)
+	objects.Close()
+
+	// Tear the last index entry, and leave a pack's data without an index
+	idxPaths, err := filepath.Glob(filepath.Join(objpath, "*.idx"))
+	assert.Tf(t, err == nil && len(idxPaths) == 1, "%v %v", idxPaths, err)
+	idx, err := os.OpenFile(idxPaths[0], os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = idx.WriteString("0123456789abcdef 6")
+	assert.Tf(t, err == nil, "%v", err)
+	idx.Close()
+	err = ioutil.WriteFile(filepath.Join(objpath, "pack-00000002.dat"), []byte("orphan"), 0644)
+	assert.Tf(t, err == nil, "%v", err)
+
+	objects, err = fs.NewObjectStore(objpath, nil)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, objects.HasBlock(before))
+	after, err := objects.PutBlock([]byte("after"))
+	assert.Tf(t, err == nil, "%v", err)
+	objects.Close()
+
+	objects, err = fs.NewObjectStore(objpath, nil)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+	for _, content := range []string{"before", "after"} {
+		buf, err := objects.ReadBlock(fs.StrongChecksum([]byte(content)))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, content, string(buf))
+	}
+	assert.Equal(t, fs.StrongChecksum([]byte("after")), after)
+}
+
+func TestFsRemove(t *testing.T) {
+	DoTestRemove(t, fs.NewMemRepo())
+}
+
+func TestFsObjectStoreCollect(t *testing.T) {
+	DoTestObjectStoreCollect(t, fs.NewMemRepo())
+}
+
+func TestFsMemRepoCollect(t *testing.T) {
+	tg := treegen.New()
+	v1path := treegen.TestTree(t, tg.D("foo",
+		tg.F("A", tg.B(42, 65537)),
+		tg.F("B", tg.B(43, 100))))
+	defer os.RemoveAll(v1path)
+
+	tg = treegen.New()
+	v2path := treegen.TestTree(t, tg.D("foo",
+		tg.F("A", tg.B(42, 65537))))
+	defer os.RemoveAll(v2path)
+
+	// Reindexing into the same repo replaces its root
+	repo := fs.NewMemRepo()
+	v1, _ := fs.IndexDir(filepath.Join(v1path, "foo"), repo)
+	v2, _ := fs.IndexDir(filepath.Join(v2path, "foo"), repo)
+
+	B, found := fs.Lookup(v1, "B")
+	assert.T(t, found)
+	_, found, _ = repo.File(B.(fs.File).Info().Strong)
+	assert.T(t, found)
+
+	report := repo.Collect()
+	assert.Equal(t, int64(1), report.Dirs)
+	assert.Equal(t, int64(2), report.Files)
+	assert.Equal(t, int64(10), report.Blocks)
+	assert.Equal(t, int64(65537+100), report.Bytes)
+
+	_, found, _ = repo.File(B.(fs.File).Info().Strong)
+	assert.T(t, !found)
+
+	A, found := fs.Lookup(v2, "A")
+	assert.T(t, found)
+	file, found, _ := repo.File(A.(fs.File).Info().Strong)
+	assert.T(t, found)
+	parent, _ := file.Parent()
+	assert.T(t, parent == v2)
+}
+
+func TestFsUpdateFile(t *testing.T) {
+	DoTestUpdateFile(t, fs.NewMemRepo())
+}
+
+func TestFsRename(t *testing.T) {
+	DoTestRename(t, fs.NewMemRepo())
+}
+
+func TestFsRemoveUpdatesStrongs(t *testing.T) {
+	DoTestRemoveUpdatesStrongs(t, fs.NewMemRepo())
+}
+
+func TestFsConformance(t *testing.T) {
+	DoTestConformance(t, func(_ *testing.T) (fs.NodeRepo, func()) {
+		return fs.NewMemRepo(), func() {}
+	})
+}
@@ -1,8 +1,11 @@
 package fstest
 
 import (
+	"bytes"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 
@@ -11,6 +14,18 @@ import (
 	"github.com/cmars/replican-sync/replican/fs"
 )
 
+// Get the root of a repo, failing the test if it cannot be read.
+func Root(t *testing.T, repo fs.NodeRepo) fs.FsNode {
+	root, err := repo.Root()
+	assert.Tf(t, err == nil, "%v", err)
+	return root
+}
+
+// Get the root directory of a repo.
+func RootDir(t *testing.T, repo fs.NodeRepo) fs.Dir {
+	return Root(t, repo).(fs.Dir)
+}
+
 func DoTestDirIndex(t *testing.T, repo fs.NodeRepo) {
 	dir, errors := fs.IndexDir("../../testroot", repo)
 	assert.T(t, dir != nil)
@@ -275,3 +290,536 @@ func DoTestParentRefs(t *testing.T, repo fs.NodeRepo) {
 
 	assert.Equal(t, 1, rootCount)
 }
+
+func DoTestDiff(t *testing.T, srcRepo fs.NodeRepo, dstRepo fs.NodeRepo) {
+	tg := treegen.New()
+	srcSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(43, 65537))),
+		tg.F("C", tg.B(44, 65537)),
+		tg.F("D", tg.B(45, 65537)))
+	srcpath := treegen.TestTree(t, srcSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	dstSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("quux",
+			tg.F("B", tg.B(43, 65537))),
+		tg.F("C", tg.B(46, 65537)),
+		tg.F("E", tg.B(47, 65537)))
+	dstpath := treegen.TestTree(t, dstSpec)
+	defer os.RemoveAll(dstpath)
+
+	src, errors := fs.IndexDir(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dst, errors := fs.IndexDir(filepath.Join(dstpath, "foo"), dstRepo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	changes := make(map[string]*fs.Change)
+	err := fs.Diff(src, dst, func(change *fs.Change) {
+		assert.Tf(t, !strings.HasPrefix(change.SrcPath, "bar"),
+			"unchanged subtree reported: %v", change)
+		changes[change.String()] = change
+	})
+	assert.Tf(t, err == nil, "%v", err)
+
+	assert.Equalf(t, 4, len(changes), "%v", changes)
+	for _, expect := range []string{
+		"moved\tbaz -> quux", "modified\tC", "removed\tD", "added\tE"} {
+		_, has := changes[expect]
+		assert.Tf(t, has, "missing change: %s", expect)
+	}
+
+	moved := changes["moved\tbaz -> quux"]
+	assert.T(t, moved.IsDir())
+	assert.Equal(t, "baz", moved.Src.Name())
+	assert.Equal(t, "quux", moved.Dst.Name())
+
+	// Identical trees have no changes
+	err = fs.Diff(src, src, func(change *fs.Change) {
+		t.Errorf("unexpected change: %v", change)
+	})
+	assert.Tf(t, err == nil, "%v", err)
+}
+
+func DoTestObjectStore(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(42, 65537)),
+		tg.F("blop", tg.B(43, 100)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+
+	local, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	objects, err := fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	err = objects.Backup(local)
+	assert.Tf(t, err == nil, "%v", err)
+	objects.Close()
+
+	// Reopen, and read everything back from the packs
+	objects, err = fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+
+	for _, relpath := range []string{
+		filepath.Join("foo", "bar"),
+		filepath.Join("foo", "blop")} {
+		node, found := fs.Lookup(RootDir(t, repo), relpath)
+		assert.T(t, found)
+		file := node.(fs.File)
+
+		for _, block := range file.Blocks() {
+			assert.T(t, objects.HasBlock(block.Info().Strong))
+		}
+
+		buf := &bytes.Buffer{}
+		n, err := objects.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, file.Info().Size, n)
+		assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+
+		// Read a range spanning a block boundary
+		buf.Reset()
+		n, err = objects.ReadInto(file.Info().Strong, 10, 8192, buf)
+		if file.Info().Size >= 10+8192 {
+			assert.Tf(t, err == nil, "%v", err)
+			assert.Equal(t, int64(8192), n)
+		} else {
+			assert.T(t, err != nil)
+		}
+	}
+
+	// bar and baz share the same blocks
+	packs, err := filepath.Glob(filepath.Join(objpath, "*.dat"))
+	assert.T(t, err == nil)
+	assert.Equal(t, 1, len(packs))
+	info, err := os.Stat(packs[0])
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(65537+100), info.Size)
+}
+
+// Test backing up into and reading from one ObjectStore from several
+// goroutines at once.
+func DoTestObjectStoreConcurrent(t *testing.T, repo fs.NodeRepo) {
+	// Run goroutines in parallel, so they interleave within calls
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("baz", tg.B(43, 65537)),
+		tg.F("blop", tg.B(44, 100)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+
+	local, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	objects, err := fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+
+	const writers = 4
+	errors := make(chan os.Error)
+	for i := 0; i < writers; i++ {
+		go func() {
+			errors <- objects.WithRepo(repo).Backup(local)
+		}()
+	}
+	for i := 0; i < writers; i++ {
+		err := <-errors
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	fs.Walk(RootDir(t, repo), func(node fs.Node) bool {
+		if file, isFile := node.(fs.File); isFile {
+			buf := &bytes.Buffer{}
+			_, err := objects.ReadInto(file.Info().Strong, 0, file.Info().Size, buf)
+			assert.Tf(t, err == nil, "%v", err)
+			assert.Equal(t, file.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+		}
+		return true
+	})
+
+	// Each block was only stored once
+	packs, err := filepath.Glob(filepath.Join(objpath, "*.dat"))
+	assert.T(t, err == nil)
+	size := int64(0)
+	for _, pack := range packs {
+		info, err := os.Stat(pack)
+		assert.T(t, err == nil)
+		size += info.Size
+	}
+	assert.Equal(t, int64(2*65537+100), size)
+}
+
+func DoTestRemove(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.D("quux",
+				tg.F("B", tg.B(43, 65537)))),
+		tg.F("C", tg.B(44, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	foo, errors := fs.IndexDir(filepath.Join(path, "foo"), repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	lookup := func(relpath string) fs.FsNode {
+		node, found := fs.Lookup(foo, relpath)
+		assert.Tf(t, found, "%s not found", relpath)
+		return node
+	}
+
+	// Removing one of two identical files leaves the other to be found
+	A := lookup(filepath.Join("bar", "A")).(fs.File)
+	strong := A.Info().Strong
+	weak := A.Blocks()[0].Info().Weak
+	assert.T(t, repo.RemoveFile(A) == nil)
+
+	_, found := fs.Lookup(foo, filepath.Join("bar", "A"))
+	assert.T(t, !found)
+	file, found, _ := repo.File(strong)
+	assert.T(t, found)
+	assert.Equal(t, "a", file.Name())
+	block, found, _ := repo.WeakBlock(weak)
+	assert.T(t, found)
+	parent, _ := block.Parent()
+	assert.Equal(t, "a", parent.Name())
+
+	// Removing the last copy leaves nothing to be found
+	bar := lookup("bar").(fs.Dir)
+	barStrong := bar.Info().Strong
+	assert.T(t, repo.RemoveDir(bar) == nil)
+
+	_, found = fs.Lookup(foo, "bar")
+	assert.T(t, !found)
+	_, found, _ = repo.File(strong)
+	assert.T(t, !found)
+	_, found, _ = repo.WeakBlock(weak)
+	assert.T(t, !found)
+	_, found, _ = repo.Dir(barStrong)
+	assert.T(t, !found)
+
+	// Subdirectories go with their parent
+	quux := lookup(filepath.Join("baz", "quux")).(fs.Dir)
+	quuxStrong := quux.Info().Strong
+	B := lookup(filepath.Join("baz", "quux", "B")).(fs.File)
+	BStrong := B.Info().Strong
+	assert.T(t, repo.RemoveDir(lookup("baz").(fs.Dir)) == nil)
+
+	_, found, _ = repo.Dir(quuxStrong)
+	assert.T(t, !found)
+	_, found, _ = repo.File(BStrong)
+	assert.T(t, !found)
+
+	// A single block
+	C := lookup("C").(fs.File)
+	nBlocks := len(C.Blocks())
+	assert.T(t, repo.RemoveBlock(C.Blocks()[0]) == nil)
+	C = lookup("C").(fs.File)
+	assert.Equal(t, nBlocks-1, len(C.Blocks()))
+
+	assert.Equal(t, 1, len(foo.Files()))
+	assert.Equal(t, 0, len(foo.SubDirs()))
+}
+
+func DoTestObjectStoreCollect(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("blop", tg.B(43, 100)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+
+	local, err := fs.NewLocalStore(path, repo)
+	assert.T(t, err == nil)
+
+	objects, err := fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+	err = objects.Backup(local)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Nothing to collect while everything is reachable
+	report, err := objects.Collect(Root(t, repo))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(0), report.Blocks)
+
+	node, found := fs.Lookup(RootDir(t, repo), filepath.Join("foo", "blop"))
+	assert.T(t, found)
+	blop := node.(fs.File)
+	blopBlock := blop.Blocks()[0].Info().Strong
+	assert.T(t, repo.RemoveFile(blop) == nil)
+
+	report, err = objects.Collect(Root(t, repo))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(1), report.Blocks)
+	assert.Equal(t, int64(100), report.Bytes)
+	assert.T(t, !objects.HasBlock(blopBlock))
+
+	// The pack holding blop was rewritten without it
+	packs, err := filepath.Glob(filepath.Join(objpath, "*.dat"))
+	assert.T(t, err == nil)
+	assert.Equal(t, 1, len(packs))
+	info, err := os.Stat(packs[0])
+	assert.T(t, err == nil)
+	assert.Equal(t, int64(65537), info.Size)
+
+	// What remains survives a reopen
+	objects.Close()
+	objects, err = fs.NewObjectStore(objpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	defer objects.Close()
+
+	node, found = fs.Lookup(RootDir(t, repo), filepath.Join("foo", "bar"))
+	assert.T(t, found)
+	bar := node.(fs.File)
+	buf := &bytes.Buffer{}
+	_, err = objects.ReadInto(bar.Info().Strong, 0, bar.Info().Size, buf)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, bar.Info().Strong, fs.StrongChecksum(buf.Bytes()))
+}
+
+// Assert that a repo's tree has the same strong checksum as a fresh
+// index of the path it was indexed from.
+func assertReindexed(t *testing.T, repo fs.NodeRepo, path string) {
+	expect, errors := fs.IndexDir(path, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	root := RootDir(t, repo)
+	assert.Equal(t, expect.Info().Strong, root.Info().Strong)
+	strong, err := fs.CalcStrong(root)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, expect.Info().Strong, strong)
+
+	dir, found, _ := repo.Dir(expect.Info().Strong)
+	assert.T(t, found)
+	_, hasParent := dir.Parent()
+	assert.T(t, !hasParent)
+}
+
+func DoTestUpdateFile(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("baz",
+				tg.F("A", tg.B(42, 65537)))),
+		tg.F("B", tg.B(43, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+	foo := filepath.Join(path, "foo")
+
+	root, errors := fs.IndexDir(foo, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	oldRootStrong := root.Info().Strong
+
+	node, found := fs.Lookup(root, filepath.Join("bar", "baz", "A"))
+	assert.T(t, found)
+	A := node.(fs.File)
+	oldStrong := A.Info().Strong
+	oldWeak := A.Blocks()[0].Info().Weak
+
+	Apath := filepath.Join(foo, "bar", "baz", "A")
+	err := ioutil.WriteFile(Apath, []byte("different"), 0644)
+	assert.T(t, err == nil)
+	fileInfo, blocksInfo, err := fs.IndexFile(Apath)
+	assert.T(t, err == nil)
+
+	// The file keeps its name, and the info passed in is left alone
+	fileInfo.Name = "Z"
+	A, err = repo.UpdateFile(A, fileInfo, blocksInfo)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "A", A.Name())
+	assert.Equal(t, "Z", fileInfo.Name)
+	assert.Equal(t, 1, len(A.Blocks()))
+	assertReindexed(t, repo, foo)
+
+	_, found, _ = repo.File(oldStrong)
+	assert.T(t, !found)
+	_, found, _ = repo.WeakBlock(oldWeak)
+	assert.T(t, !found)
+	_, found, _ = repo.Dir(oldRootStrong)
+	assert.T(t, !found)
+
+	file, found, _ := repo.File(fileInfo.Strong)
+	assert.T(t, found)
+	assert.Equal(t, filepath.Join("bar", "baz", "A"), fs.RelPath(file))
+	block, found, _ := repo.WeakBlock(blocksInfo[0].Weak)
+	assert.T(t, found)
+	parent, _ := block.Parent()
+	assert.Equal(t, "A", parent.Name())
+}
+
+func DoTestRename(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("baz",
+				tg.F("A", tg.B(42, 65537)))),
+		tg.D("quux"),
+		tg.F("B", tg.B(43, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+	foo := filepath.Join(path, "foo")
+
+	root, errors := fs.IndexDir(foo, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	lookup := func(relpath string) fs.FsNode {
+		node, found := fs.Lookup(RootDir(t, repo), relpath)
+		assert.Tf(t, found, "%s not found", relpath)
+		return node
+	}
+
+	// Rename a file within its directory
+	err := os.Rename(filepath.Join(foo, "B"), filepath.Join(foo, "C"))
+	assert.T(t, err == nil)
+	renamed, err := repo.Rename(lookup("B"), lookup("").(fs.Dir), "C")
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, "C", renamed.Name())
+	assertReindexed(t, repo, foo)
+	_, found := fs.Lookup(RootDir(t, repo), "B")
+	assert.T(t, !found)
+
+	// Move a file into another directory
+	err = os.Rename(filepath.Join(foo, "C"), filepath.Join(foo, "quux", "C"))
+	assert.T(t, err == nil)
+	_, err = repo.Rename(lookup("C"), lookup("quux").(fs.Dir), "C")
+	assert.Tf(t, err == nil, "%v", err)
+	assertReindexed(t, repo, foo)
+
+	file, found, _ := repo.File(lookup(filepath.Join("quux", "C")).(fs.File).Info().Strong)
+	assert.T(t, found)
+	assert.Equal(t, filepath.Join("quux", "C"), fs.RelPath(file))
+
+	// Move a directory up and rename it
+	err = os.Rename(filepath.Join(foo, "bar", "baz"), filepath.Join(foo, "zab"))
+	assert.T(t, err == nil)
+	_, err = repo.Rename(lookup(filepath.Join("bar", "baz")), root, "zab")
+	assert.Tf(t, err == nil, "%v", err)
+	assertReindexed(t, repo, foo)
+
+	A := lookup(filepath.Join("zab", "A")).(fs.File)
+	block, found, _ := repo.Block(A.Blocks()[0].Info().Strong)
+	assert.T(t, found)
+	parent, _ := block.Parent()
+	assert.Equal(t, filepath.Join("zab", "A"), fs.RelPath(parent))
+}
+
+// Test that renaming a node to the name of another in the same
+// directory fails, and leaves the tree as it was.
+func DoTestRenameCollision(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537))),
+		tg.F("B", tg.B(43, 65537)),
+		tg.F("C", tg.B(44, 65537)))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+	foo := filepath.Join(path, "foo")
+
+	_, errors := fs.IndexDir(foo, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	lookup := func(relpath string) fs.FsNode {
+		node, found := fs.Lookup(RootDir(t, repo), relpath)
+		assert.Tf(t, found, "%s not found", relpath)
+		return node
+	}
+
+	for _, rename := range [][]string{
+		{"B", "", "C"},
+		{"B", "", "bar"},
+		{"bar", "", "C"},
+		{filepath.Join("bar", "A"), "", "B"}} {
+		_, err := repo.Rename(lookup(rename[0]), lookup(rename[1]).(fs.Dir), rename[2])
+		assert.Tf(t, err != nil, "renamed %s to %s", rename[0], rename[2])
+		assertReindexed(t, repo, foo)
+	}
+	assert.Equal(t, "B", lookup("B").Name())
+
+	// Renaming a node to its own name is harmless
+	_, err := repo.Rename(lookup("B"), lookup("").(fs.Dir), "B")
+	assert.Tf(t, err == nil, "%v", err)
+	assertReindexed(t, repo, foo)
+
+	// Nodes are not moved between repos
+	other, errors := fs.IndexDir(foo, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	_, err = repo.Rename(lookup("B"), other, "D")
+	assert.T(t, err != nil)
+	otherB, found := fs.Lookup(other, "B")
+	assert.T(t, found)
+	_, err = repo.Rename(otherB, lookup("").(fs.Dir), "D")
+	assert.T(t, err != nil)
+	assertReindexed(t, repo, foo)
+}
+
+func DoTestRemoveUpdatesStrongs(t *testing.T, repo fs.NodeRepo) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("baz",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("B", tg.B(43, 65537))),
+			tg.D("quux",
+				tg.F("C", tg.B(44, 65537)))))
+
+	path := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(path)
+	foo := filepath.Join(path, "foo")
+
+	root, errors := fs.IndexDir(foo, repo)
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	relpath := filepath.Join("bar", "baz", "B")
+	node, found := fs.Lookup(root, relpath)
+	assert.T(t, found)
+	err := os.Remove(filepath.Join(foo, relpath))
+	assert.T(t, err == nil)
+	assert.T(t, repo.RemoveFile(node.(fs.File)) == nil)
+	assertReindexed(t, repo, foo)
+
+	relpath = filepath.Join("bar", "quux")
+	node, found = fs.Lookup(RootDir(t, repo), relpath)
+	assert.T(t, found)
+	err = os.RemoveAll(filepath.Join(foo, relpath))
+	assert.T(t, err == nil)
+	assert.T(t, repo.RemoveDir(node.(fs.Dir)) == nil)
+	assertReindexed(t, repo, foo)
+}
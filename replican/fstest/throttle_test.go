@@ -0,0 +1,76 @@
+package fstest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+func TestThrottleBytes(t *testing.T) {
+	throttle := fs.NewThrottle(1000000, 0)
+	buf := &bytes.Buffer{}
+	writer := throttle.Writer(buf)
+
+	start := time.Nanoseconds()
+	for i := 0; i < 11; i++ {
+		n, err := writer.Write(make([]byte, 20000))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equal(t, 20000, n)
+	}
+	elapsed := time.Nanoseconds() - start
+
+	// The first write goes straight through; the rest wait for it
+	assert.Equal(t, 220000, buf.Len())
+	assert.Tf(t, elapsed >= 190e6, "%d ns", elapsed)
+}
+
+func TestThrottleOps(t *testing.T) {
+	throttle := fs.NewThrottle(0, 100)
+	reader := throttle.Reader(bytes.NewBuffer(make([]byte, 11)))
+
+	start := time.Nanoseconds()
+	buf := make([]byte, 1)
+	for i := 0; i < 11; i++ {
+		_, err := reader.Read(buf)
+		assert.Tf(t, err == nil, "%v", err)
+	}
+	elapsed := time.Nanoseconds() - start
+	assert.Tf(t, elapsed >= 90e6, "%d ns", elapsed)
+
+	_, err := reader.Read(buf)
+	assert.Equal(t, os.EOF, err)
+}
+
+func TestThrottleNil(t *testing.T) {
+	var throttle *fs.Throttle
+	buf := &bytes.Buffer{}
+	assert.Equal(t, io.Writer(buf), throttle.Writer(buf))
+	assert.Equal(t, io.Reader(buf), throttle.Reader(buf))
+	throttle.Wait(1000)
+}
+
+// Indexing no faster than a limit indexes the same.
+func TestIndexFileLimit(t *testing.T) {
+	tg := treegen.New()
+	path := treegen.TestTree(t, tg.F("foo", tg.B(42, 65537)))
+	defer os.RemoveAll(path)
+
+	fileInfo, blocksInfo, err := fs.IndexFile(filepath.Join(path, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+
+	start := time.Nanoseconds()
+	limitedInfo, limitedBlocks, err := fs.IndexFileWith(
+		filepath.Join(path, "foo"), fs.LocalOptions{IndexLimit: fs.NewThrottle(500000, 0)})
+	elapsed := time.Nanoseconds() - start
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fileInfo.Strong, limitedInfo.Strong)
+	assert.Equal(t, len(blocksInfo), len(limitedBlocks))
+	assert.Tf(t, elapsed >= 100e6, "%d ns", elapsed)
+}
@@ -0,0 +1,138 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+const benchChunks = 8
+const benchChunkSize = 128 * 1024
+
+// A source file made of chunks of different random data,
+// so that destinations can be made by editing between them.
+func benchSrcFile(tg *treegen.TreeGen) *treegen.File {
+	contents := []treegen.Generated{}
+	for i := 0; i < benchChunks; i++ {
+		contents = append(contents, tg.B(int64(i), benchChunkSize))
+	}
+	return tg.F("src", contents...)
+}
+
+// Match a destination file against the bench source at each iteration.
+func benchmarkMatch(b *testing.B, name string, dst *treegen.File) {
+	timer := fstest.NewBenchTimer(b, name)
+	tg := treegen.New()
+	dst.Name = "dst"
+	path := fstest.BenchTree(tg.D("match", benchSrcFile(tg), dst))
+	defer os.RemoveAll(path)
+
+	srcFileInfo, srcBlocksInfo, err := fs.IndexFile(filepath.Join(path, "match", "src"))
+	if err != nil {
+		panic(err)
+	}
+	srcFile, err := fs.NewMemRepo().AddFile(nil, srcFileInfo, srcBlocksInfo)
+	if err != nil {
+		panic(err)
+	}
+
+	dstPath := filepath.Join(path, "match", "dst")
+	dstInfo, err := os.Stat(dstPath)
+	if err != nil {
+		panic(err)
+	}
+	b.SetBytes(dstInfo.Size)
+
+	for i := 0; i < b.N; i++ {
+		timer.Start()
+		_, err = MatchFile(srcFile, dstPath)
+		timer.Stop()
+
+		if err != nil {
+			panic(err)
+		}
+	}
+	timer.Report()
+}
+
+func BenchmarkMatchIdentical(b *testing.B) {
+	benchmarkMatch(b, "MatchIdentical", benchSrcFile(treegen.New()))
+}
+
+func BenchmarkMatchAppend(b *testing.B) {
+	dst := benchSrcFile(treegen.New())
+	dst.Contents = append(dst.Contents, treegen.New().B(100, benchChunkSize))
+	benchmarkMatch(b, "MatchAppend", dst)
+}
+
+func BenchmarkMatchPrepend(b *testing.B) {
+	dst := benchSrcFile(treegen.New())
+	dst.Contents = append([]treegen.Generated{treegen.New().B(100, 1000)}, dst.Contents...)
+	benchmarkMatch(b, "MatchPrepend", dst)
+}
+
+// Small insertions between chunks, which shift everything after them
+// out of block alignment, and one chunk overwritten.
+func BenchmarkMatchRandomEdits(b *testing.B) {
+	tg := treegen.New()
+	contents := []treegen.Generated{}
+	for i, chunk := range benchSrcFile(tg).Contents {
+		switch {
+		case i == benchChunks/2:
+			chunk = tg.B(200, benchChunkSize)
+		case i%2 == 1:
+			contents = append(contents, tg.B(int64(100+i), int64(10*i)))
+		}
+		contents = append(contents, chunk)
+	}
+	benchmarkMatch(b, "MatchRandomEdits", tg.F("dst", contents...))
+}
+
+// Patch an edited copy of a tree back into the original at each iteration.
+func BenchmarkPatchExec(b *testing.B) {
+	timer := fstest.NewBenchTimer(b, "PatchExec")
+	tg := treegen.New()
+	srcPath := fstest.BenchTree(tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(1, 4*benchChunkSize)),
+			tg.F("B", tg.B(2, 4*benchChunkSize))),
+		tg.D("baz",
+			benchSrcFile(tg))))
+	defer os.RemoveAll(srcPath)
+	b.SetBytes(16 * benchChunkSize)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcPath, "foo"), fs.NewMemRepo())
+	if err != nil {
+		panic(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		dstPath := fstest.BenchTree(tg.D("foo",
+			tg.D("bar",
+				tg.F("A", tg.B(1, 4*benchChunkSize), tg.B(3, 1000))),
+			tg.D("baz",
+				tg.F("src", tg.B(4, 100), tg.B(0, benchChunkSize)))))
+		dstStore, err := fs.NewLocalStore(filepath.Join(dstPath, "foo"), fs.NewMemRepo())
+		if err != nil {
+			panic(err)
+		}
+		plan, err := NewPatchPlan(srcStore, dstStore)
+		if err != nil {
+			panic(err)
+		}
+
+		timer.Start()
+		_, err = plan.Exec()
+		timer.Stop()
+
+		os.RemoveAll(dstPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	timer.Report()
+}
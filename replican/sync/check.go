@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Result of comparing two trees.
+type CheckReport struct {
+	Changes []*fs.Change
+}
+
+// Test if the trees compared were identical.
+func (report *CheckReport) Match() bool {
+	return len(report.Changes) == 0
+}
+
+func (report *CheckReport) String() string {
+	buf := &bytes.Buffer{}
+	for _, change := range report.Changes {
+		fmt.Fprintf(buf, "%v\n", change)
+	}
+	return string(buf.Bytes())
+}
+
+// Index the src and dst paths and report how dst differs from src.
+// Neither side is modified.
+func Check(src string, dst string) (*CheckReport, os.Error) {
+	return CheckRepos(src, dst, fs.NewMemRepo(), fs.NewMemRepo())
+}
+
+// Index the src and dst paths into the repos given, and report how dst
+// differs from src. Neither side is modified.
+func CheckRepos(src string, dst string, srcRepo fs.NodeRepo, dstRepo fs.NodeRepo) (*CheckReport, os.Error) {
+	srcStore, err := fs.NewLocalStore(src, srcRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	dstStore, err := fs.NewLocalStore(dst, dstRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	srcRoot, err := srcStore.Repo().Root()
+	if err != nil {
+		return nil, err
+	}
+
+	dstRoot, err := dstStore.Repo().Root()
+	if err != nil {
+		return nil, err
+	}
+
+	return CheckNodes(srcRoot, dstRoot)
+}
+
+// Compare two indexed trees by strong checksum, and report how dst differs from src.
+// Directories with equal strong checksums are considered identical,
+// and are not descended into.
+func CheckNodes(src fs.FsNode, dst fs.FsNode) (*CheckReport, os.Error) {
+	report := &CheckReport{}
+	err := fs.Diff(src, dst, func(change *fs.Change) {
+		report.Changes = append(report.Changes, change)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
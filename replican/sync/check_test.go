@@ -0,0 +1,127 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func changesByKind(report *CheckReport) map[fs.ChangeKind][]*fs.Change {
+	result := make(map[fs.ChangeKind][]*fs.Change)
+	for _, change := range report.Changes {
+		result[change.Kind] = append(result[change.Kind], change)
+	}
+	return result
+}
+
+// Test that identical trees check out as a match.
+func TestCheckIdentity(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar", tg.F("aleph", tg.B(42, 65537))),
+		tg.F("baz", tg.B(43, 10000)))
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	report, err := Check(srcpath, dstpath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Tf(t, report.Match(), "%v", report)
+}
+
+// Test detection of each kind of change between source and destination.
+func TestCheckChanges(t *testing.T) {
+	DoTestCheckChanges(t, mkMemRepo)
+}
+
+func TestDbCheckChanges(t *testing.T) {
+	DoTestCheckChanges(t, mkDbRepo)
+}
+
+func DoTestCheckChanges(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537)),
+			tg.F("beth", tg.B(43, 65537))),
+		tg.F("gimel", tg.B(44, 10000)),
+		tg.F("daleth", tg.B(45, 10000)),
+		tg.F("he", tg.B(46, 10000)))
+	srcpath := treegen.TestTree(t, srcSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	dstSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537)),
+			tg.F("beth", tg.B(99, 65537))),
+		tg.F("gimel", tg.B(44, 10000)),
+		tg.F("vav", tg.B(45, 10000)),
+		tg.F("zayin", tg.B(47, 10000)))
+	dstpath := treegen.TestTree(t, dstSpec)
+	defer os.RemoveAll(dstpath)
+
+	err := os.Chmod(filepath.Join(dstpath, "foo", "gimel"), 0600)
+	assert.T(t, err == nil)
+
+	report, err := CheckRepos(filepath.Join(srcpath, "foo"), filepath.Join(dstpath, "foo"),
+		mkrepo(t), mkrepo(t))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, !report.Match())
+
+	changes := changesByKind(report)
+	assert.Equalf(t, 5, len(report.Changes), "%v", report)
+
+	assert.Equal(t, 1, len(changes[fs.Modified]))
+	assert.Equal(t, filepath.Join("bar", "beth"), changes[fs.Modified][0].SrcPath)
+
+	assert.Equal(t, 1, len(changes[fs.ModeChanged]))
+	assert.Equal(t, "gimel", changes[fs.ModeChanged][0].SrcPath)
+
+	assert.Equal(t, 1, len(changes[fs.Moved]))
+	assert.Equal(t, "daleth", changes[fs.Moved][0].SrcPath)
+	assert.Equal(t, "vav", changes[fs.Moved][0].DstPath)
+
+	assert.Equal(t, 1, len(changes[fs.Removed]))
+	assert.Equal(t, "he", changes[fs.Removed][0].SrcPath)
+
+	assert.Equal(t, 1, len(changes[fs.Added]))
+	assert.Equal(t, "zayin", changes[fs.Added][0].DstPath)
+}
+
+// Test that a renamed directory is reported as a single move,
+// rather than a change for every file within it.
+func TestCheckMoveDir(t *testing.T) {
+	tg := treegen.New()
+	srcSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537)),
+			tg.F("beth", tg.B(43, 65537))))
+	srcpath := treegen.TestTree(t, srcSpec)
+	defer os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	dstSpec := tg.D("foo",
+		tg.D("baz",
+			tg.F("aleph", tg.B(42, 65537)),
+			tg.F("beth", tg.B(43, 65537))))
+	dstpath := treegen.TestTree(t, dstSpec)
+	defer os.RemoveAll(dstpath)
+
+	report, err := Check(filepath.Join(srcpath, "foo"), filepath.Join(dstpath, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+
+	assert.Equalf(t, 1, len(report.Changes), "%v", report)
+	move := report.Changes[0]
+	assert.Equal(t, fs.Moved, move.Kind)
+	assert.T(t, move.IsDir())
+	assert.Equal(t, "bar", move.SrcPath)
+	assert.Equal(t, "baz", move.DstPath)
+}
@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// File extensions whose contents are usually compressed already.
+var COMPRESSED_EXTS = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".lzma", ".z", ".zip", ".jar", ".7z", ".rar",
+	".jpg", ".jpeg", ".png", ".gif", ".mp3", ".ogg", ".flac", ".mp4", ".avi",
+	".mkv", ".mov"}
+
+// How to compress the literal data a patch reads from its source store,
+// when it is written to a delta.
+type Compression struct {
+	// The compression level, from compress/flate's BestSpeed to
+	// BestCompression, or DefaultCompression.
+	Level int
+
+	// Extensions of files whose contents are written without compressing
+	// them, matched without regard to case.
+	SkipExts []string
+
+	// How well the literal data has compressed so far.
+	Stats CompressionStats
+}
+
+// Compress at a level, skipping files with COMPRESSED_EXTS.
+func NewCompression(level int) *Compression {
+	return &Compression{Level: level, SkipExts: COMPRESSED_EXTS}
+}
+
+// Totals of the literal data written through a Compression.
+type CompressionStats struct {
+	// How many ranges were compressed, and how many were skipped.
+	Compressed int
+	Skipped    int
+
+	// Bytes read from the source, and the compressed size of those which
+	// were compressed.
+	RawBytes        int64
+	CompressedBytes int64
+
+	// Bytes read from the source for the ranges which were skipped.
+	SkippedBytes int64
+}
+
+// The compressed size of the compressed data as a fraction of its raw size.
+func (stats *CompressionStats) Ratio() float64 {
+	if stats.RawBytes == 0 {
+		return 1
+	}
+	return float64(stats.CompressedBytes) / float64(stats.RawBytes)
+}
+
+func (stats *CompressionStats) String() string {
+	return fmt.Sprintf("Compressed %d bytes to %d (%.1f%%) in %d ranges, skipped %d bytes in %d ranges",
+		stats.RawBytes, stats.CompressedBytes, 100*stats.Ratio(), stats.Compressed,
+		stats.SkippedBytes, stats.Skipped)
+}
+
+// Test whether a file's contents should be written without compressing them.
+func (compression *Compression) skip(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, skipExt := range compression.SkipExts {
+		if ext == strings.ToLower(skipExt) {
+			return true
+		}
+	}
+	return false
+}
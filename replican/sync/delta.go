@@ -0,0 +1,289 @@
+package sync
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Begins a delta stream, and gives its format version.
+const DELTA_MAGIC string = "rpdelta1"
+
+// The most data written to a delta stream in one piece.
+const DELTA_CHUNK int = fs.BLOCKSIZE
+
+// Write the literal data the plan copies from its source store to a delta
+// stream, compressing it if compression is not nil. Applying the plan with
+// ExecDelta then reads that data from the stream instead of the source,
+// so the source need not be reachable from the destination.
+//
+// A delta holds the data for the ranges of each file in the order the plan
+// copies them. Each range is compressed as a separate stream, so that
+// files which compression skips are written as they are. Nothing is held
+// in memory beyond a chunk of a range.
+func (plan *PatchPlan) WriteDelta(writer io.Writer, compression *Compression) os.Error {
+	if _, err := io.WriteString(writer, DELTA_MAGIC); err != nil {
+		return err
+	}
+
+	for _, cmd := range plan.Cmds {
+		var err os.Error
+		switch cmd := cmd.(type) {
+		case *SrcTempCopy:
+			err = plan.writeLiteral(writer, compression,
+				cmd.SrcStrong, cmd.SrcOffset, cmd.Length, cmd.Temp.Path.Resolve())
+		case *SrcFileDownload:
+			err = plan.writeLiteral(writer, compression,
+				cmd.SrcFile.Info().Strong, 0, cmd.SrcFile.Info().Size, cmd.Path.Resolve())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return binary.Write(writer, binary.BigEndian, uint8(0))
+}
+
+// Write the header of a range of literal data.
+func writeLiteralHeader(writer io.Writer, strong string, from int64, length int64, compressed bool) os.Error {
+	var flag uint8
+	if compressed {
+		flag = 1
+	}
+
+	for _, value := range []interface{}{uint8(1), uint16(len(strong))} {
+		if err := binary.Write(writer, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(writer, strong); err != nil {
+		return err
+	}
+	for _, value := range []interface{}{from, length, flag} {
+		if err := binary.Write(writer, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a range of a source file, which is copied to path, to a delta.
+func (plan *PatchPlan) writeLiteral(writer io.Writer, compression *Compression,
+	strong string, from int64, length int64, path string) os.Error {
+	compressed := compression != nil && !compression.skip(path)
+	if err := writeLiteralHeader(writer, strong, from, length, compressed); err != nil {
+		return err
+	}
+
+	chunks := &chunkWriter{writer: writer}
+	var n int64
+	var err os.Error
+	if compressed {
+		var gzipWriter *gzip.Compressor
+		if gzipWriter, err = gzip.NewWriterLevel(chunks, compression.Level); err != nil {
+			return err
+		}
+		n, err = plan.srcStore.ReadInto(strong, from, length, gzipWriter)
+		if closeErr := gzipWriter.Close(); err == nil {
+			err = closeErr
+		}
+	} else {
+		n, err = plan.srcStore.ReadInto(strong, from, length, chunks)
+	}
+	if closeErr := chunks.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil && n != length {
+		err = os.NewError(fmt.Sprintf(
+			"Read %d bytes at %d of %s for a delta, expected %d", n, from, strong, length))
+	}
+	if err != nil {
+		return err
+	}
+
+	if compression != nil {
+		if compressed {
+			compression.Stats.Compressed++
+			compression.Stats.RawBytes += n
+			compression.Stats.CompressedBytes += chunks.n
+		} else {
+			compression.Stats.Skipped++
+			compression.Stats.SkippedBytes += n
+		}
+	}
+	return nil
+}
+
+// Apply the plan, reading the literal data it copies from the source out of
+// a delta stream written for it by WriteDelta.
+func (plan *PatchPlan) ExecDelta(reader io.Reader) (failedCmd PatchCmd, err os.Error) {
+	magic := make([]byte, len(DELTA_MAGIC))
+	if _, err = io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != DELTA_MAGIC {
+		return nil, os.NewError("Not a delta stream")
+	}
+
+	failedCmd, err = plan.exec(&deltaStore{repo: plan.srcStore.Repo(), reader: reader})
+	if err != nil {
+		return failedCmd, err
+	}
+
+	var more uint8
+	if err = binary.Read(reader, binary.BigEndian, &more); err != nil {
+		return nil, err
+	}
+	if more != 0 {
+		return nil, os.NewError("Delta holds literal data the patch did not use")
+	}
+	return nil, nil
+}
+
+// A BlockStore which reads the source data of a patch from a delta stream.
+// Ranges can only be read in the order they were written.
+type deltaStore struct {
+	repo   fs.NodeRepo
+	reader io.Reader
+}
+
+func (delta *deltaStore) Repo() fs.NodeRepo { return delta.repo }
+
+func (delta *deltaStore) ReadBlock(strong string) ([]byte, os.Error) {
+	return nil, os.NewError(fmt.Sprintf("Block %s cannot be read from a delta", strong))
+}
+
+func (delta *deltaStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, os.Error) {
+	var more uint8
+	var strongLen uint16
+	if err := binary.Read(delta.reader, binary.BigEndian, &more); err != nil {
+		return 0, err
+	}
+	if more == 0 {
+		return 0, os.NewError(fmt.Sprintf("Delta ends before %d bytes at %d of %s", length, from, strong))
+	}
+	if err := binary.Read(delta.reader, binary.BigEndian, &strongLen); err != nil {
+		return 0, err
+	}
+	deltaStrong := make([]byte, strongLen)
+	if _, err := io.ReadFull(delta.reader, deltaStrong); err != nil {
+		return 0, err
+	}
+	var deltaFrom, deltaLength int64
+	var compressed uint8
+	for _, value := range []interface{}{&deltaFrom, &deltaLength, &compressed} {
+		if err := binary.Read(delta.reader, binary.BigEndian, value); err != nil {
+			return 0, err
+		}
+	}
+
+	if string(deltaStrong) != strong || deltaFrom != from || deltaLength != length {
+		return 0, os.NewError(fmt.Sprintf(
+			"Delta holds %d bytes at %d of %s where the patch needs %d bytes at %d of %s",
+			deltaLength, deltaFrom, deltaStrong, length, from, strong))
+	}
+
+	chunks := &chunkReader{reader: delta.reader}
+	var n int64
+	var err os.Error
+	if compressed != 0 {
+		var gzipReader *gzip.Decompressor
+		if gzipReader, err = gzip.NewReader(chunks); err != nil {
+			return 0, err
+		}
+		n, err = io.Copy(writer, gzipReader)
+		gzipReader.Close()
+	} else {
+		n, err = io.Copy(writer, chunks)
+	}
+
+	// Read to the end of the range, so the next one can be found
+	if _, drainErr := io.Copy(ioutil.Discard, chunks); err == nil {
+		err = drainErr
+	}
+
+	if err == nil && n != length {
+		err = os.NewError(fmt.Sprintf(
+			"Delta holds %d bytes at %d of %s, expected %d", n, from, strong, length))
+	}
+	return n, err
+}
+
+// Write data in chunks, each prefixed by its length, ending with an empty
+// chunk on Close. The data can then be found in a stream without knowing
+// its length before it is written.
+type chunkWriter struct {
+	writer io.Writer
+
+	// Bytes of data written, not counting the lengths.
+	n int64
+}
+
+func (chunks *chunkWriter) Write(buf []byte) (int, os.Error) {
+	written := 0
+	for len(buf) > 0 {
+		chunk := buf
+		if len(chunk) > DELTA_CHUNK {
+			chunk = chunk[:DELTA_CHUNK]
+		}
+		if err := binary.Write(chunks.writer, binary.BigEndian, uint32(len(chunk))); err != nil {
+			return written, err
+		}
+		n, err := chunks.writer.Write(chunk)
+		written += n
+		chunks.n += int64(n)
+		if err != nil {
+			return written, err
+		}
+		buf = buf[len(chunk):]
+	}
+	return written, nil
+}
+
+func (chunks *chunkWriter) Close() os.Error {
+	return binary.Write(chunks.writer, binary.BigEndian, uint32(0))
+}
+
+// Read data written by a chunkWriter, up to its empty chunk.
+type chunkReader struct {
+	reader io.Reader
+
+	// Bytes left in the current chunk.
+	left uint32
+	done bool
+}
+
+func (chunks *chunkReader) Read(buf []byte) (int, os.Error) {
+	if chunks.done {
+		return 0, os.EOF
+	}
+	if chunks.left == 0 {
+		if err := binary.Read(chunks.reader, binary.BigEndian, &chunks.left); err != nil {
+			return 0, err
+		}
+		if chunks.left == 0 {
+			chunks.done = true
+			return 0, os.EOF
+		}
+	}
+
+	if uint32(len(buf)) > chunks.left {
+		buf = buf[:chunks.left]
+	}
+	n, err := chunks.reader.Read(buf)
+	chunks.left -= uint32(n)
+	if err == os.EOF {
+		if chunks.left > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = nil
+		}
+	}
+	return n, err
+}
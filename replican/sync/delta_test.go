@@ -0,0 +1,118 @@
+package sync
+
+import (
+	"bytes"
+	"compress/flate"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+func TestPatchDelta(t *testing.T) {
+	DoTestPatchDelta(t, mkMemRepo)
+}
+
+func TestDbPatchDelta(t *testing.T) {
+	DoTestPatchDelta(t, mkDbRepo)
+}
+
+// A patch applied from a compressed delta matches the source, and the
+// delta is smaller than the literal data it carries.
+func DoTestPatchDelta(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.R(1000, tg.B(43, 100))),
+		tg.F("baz", tg.R(2000, tg.B(44, 100))),
+		tg.F("quux.gz", tg.B(45, 10000))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), dstRepo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+
+	compression := NewCompression(flate.BestCompression)
+	delta := &bytes.Buffer{}
+	assert.T(t, patchPlan.WriteDelta(delta, compression) == nil)
+
+	// The repeated data in bar and baz compresses; quux.gz is skipped
+	stats := compression.Stats
+	assert.Tf(t, stats.Compressed >= 2, "%v", &stats)
+	assert.Equal(t, 1, stats.Skipped)
+	assert.Equal(t, int64(10000), stats.SkippedBytes)
+	assert.Tf(t, stats.RawBytes > int64(200000), "%v", &stats)
+	assert.Tf(t, stats.Ratio() < 0.1, "%v", &stats)
+	assert.Tf(t, int64(delta.Len()) < stats.SkippedBytes+stats.RawBytes/10,
+		"delta of %d bytes for %v", delta.Len(), &stats)
+
+	// The source is not read when the delta is applied
+	os.RemoveAll(srcpath)
+	failedCmd, err := patchPlan.ExecDelta(delta)
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	assert.Equal(t, 0, delta.Len())
+
+	indexer := &fs.Indexer{Path: filepath.Join(dstpath, "foo"), Repo: fs.NewMemRepo()}
+	dstRoot, err := indexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fstest.RootDir(t, srcRepo).Info().Strong, dstRoot.Info().Strong)
+}
+
+// A delta which does not hold the data a plan needs is refused.
+func TestPatchDeltaMismatch(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 1000)),
+		tg.F("baz", tg.B(43, 1000))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo"))
+	defer os.RemoveAll(dstpath)
+
+	patchPlan, err := Patch(filepath.Join(srcpath, "foo"), filepath.Join(dstpath, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+
+	delta := &bytes.Buffer{}
+	assert.T(t, patchPlan.WriteDelta(delta, nil) == nil)
+
+	// Missing its last range
+	truncated := bytes.NewBuffer(delta.Bytes()[:delta.Len()-100])
+	_, err = patchPlan.ExecDelta(truncated)
+	assert.T(t, err != nil)
+
+	// Written for another plan
+	otherpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(44, 1000)),
+		tg.F("baz", tg.B(43, 1000))))
+	defer os.RemoveAll(otherpath)
+	otherPlan, err := Patch(filepath.Join(otherpath, "foo"), filepath.Join(dstpath, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = otherPlan.ExecDelta(bytes.NewBuffer(delta.Bytes()))
+	assert.T(t, err != nil)
+
+	_, err = patchPlan.ExecDelta(bytes.NewBufferString("not a delta"))
+	assert.T(t, err != nil)
+}
+
+// Files are skipped by extension, without regard to case.
+func TestCompressionSkip(t *testing.T) {
+	compression := &Compression{Level: flate.BestSpeed, SkipExts: []string{".ZIP"}}
+	assert.T(t, compression.skip("/foo/bar.zip"))
+	assert.T(t, !compression.skip("/foo/bar.zip.txt"))
+	assert.T(t, NewCompression(flate.DefaultCompression).skip("bar.tar.GZ"))
+	assert.Equal(t, float64(1), compression.Stats.Ratio())
+}
@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+	gosqlite3 "github.com/kuroneko/gosqlite3"
+)
+
+// Patch a destination whose files are patched through a FaultFs, and
+// get the error Exec stops with, if any.
+func execFaulty(t *testing.T, srcpath string, dstpath string, faults ...*fstest.Fault) (*fstest.FaultFs, os.Error) {
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+
+	faultFs := fstest.NewFaultFs(fs.OS, faults...)
+	dstStore, err := fs.NewLocalStoreWith(dstpath, fs.NewMemRepo(), fs.LocalOptions{FileSystem: faultFs})
+	assert.Tf(t, err == nil, "%v", err)
+
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = patchPlan.Exec()
+	return faultFs, err
+}
+
+func fileStrong(t *testing.T, path string) string {
+	info, _, err := fs.IndexFile(path)
+	assert.Tf(t, err == nil, "%v", err)
+	return info.Strong
+}
+
+// A file edited in place, which is patched through a temporary file.
+func editedTrees(t *testing.T) (srcpath string, dstpath string) {
+	tg := treegen.New()
+	srcpath = treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537), tg.B(43, 65537))))
+	dstpath = treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 65537))))
+	return srcpath, dstpath
+}
+
+func TestPatchNoSpace(t *testing.T) {
+	srcpath, dstpath := editedTrees(t)
+	defer os.RemoveAll(srcpath)
+	defer os.RemoveAll(dstpath)
+	dstFile := filepath.Join(dstpath, "foo", "bar")
+	origStrong := fileStrong(t, dstFile)
+
+	_, err := execFaulty(t, srcpath, dstpath, &fstest.Fault{Op: "Write", Err: os.ENOSPC})
+	assert.Equal(t, os.ENOSPC, fstest.ErrorCause(err))
+
+	// The destination is left as it was
+	assert.Equal(t, origStrong, fileStrong(t, dstFile))
+}
+
+func TestPatchAccessDenied(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 1000)), tg.F("baz", tg.B(43, 1000))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo", tg.F("bar", tg.B(42, 1000))))
+	defer os.RemoveAll(dstpath)
+
+	_, err := execFaulty(t, srcpath, dstpath, &fstest.Fault{Op: "Create", Path: "baz", Err: os.EACCES})
+	assert.Equal(t, os.EACCES, fstest.ErrorCause(err))
+}
+
+// Moves between filesystems fall back on copying.
+func TestPatchCrossDevice(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("a", tg.F("moved", tg.B(41, 1000))),
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("moved", tg.B(41, 1000)),
+		tg.F("bar", tg.B(42, 65537))))
+	defer os.RemoveAll(dstpath)
+
+	faultFs, err := execFaulty(t, srcpath, dstpath, &fstest.Fault{Op: "Rename", Err: os.EXDEV})
+	assert.Tf(t, err == nil, "%v", err)
+
+	renames := 0
+	for _, call := range faultFs.Calls() {
+		if strings.HasPrefix(call, "Rename ") {
+			renames++
+		}
+	}
+	assert.T(t, renames > 0)
+
+	srcFoo, dstFoo := filepath.Join(srcpath, "foo"), filepath.Join(dstpath, "foo")
+	assert.Equal(t, fileStrong(t, filepath.Join(srcFoo, "a", "moved")), fileStrong(t, filepath.Join(dstFoo, "a", "moved")))
+	assert.Equal(t, fileStrong(t, filepath.Join(srcFoo, "bar")), fileStrong(t, filepath.Join(dstFoo, "bar")))
+}
+
+// A crash while a patched file replaces the original leaves one or the
+// other in place.
+func TestPatchCrashReplace(t *testing.T) {
+	srcpath, dstpath := editedTrees(t)
+	defer os.RemoveAll(srcpath)
+	defer os.RemoveAll(dstpath)
+	dstFile := filepath.Join(dstpath, "foo", "bar")
+	origStrong := fileStrong(t, dstFile)
+
+	faultFs, err := execFaulty(t, srcpath, dstpath,
+		&fstest.Fault{Op: "Rename", Path: dstFile, Err: fstest.ErrCrashed, Crash: true})
+	assert.Equal(t, fstest.ErrCrashed, fstest.ErrorCause(err))
+	assert.T(t, faultFs.Crashed())
+
+	assert.Equal(t, origStrong, fileStrong(t, dstFile))
+}
+
+// A destination whose index cannot be read is not planned from, rather
+// than planned from the part of it which could be read.
+func TestPatchPlanReadError(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("baz", tg.B(42, 65537))),
+		tg.F("quux", tg.B(43, 1000)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+
+	dbF, err := ioutil.TempFile("", "test.db")
+	assert.T(t, err == nil)
+	dbF.Close()
+	defer os.Remove(dbF.Name())
+
+	dstRepo, err := sqlite3.NewDbRepo(dbF.Name())
+	assert.Tf(t, err == nil, "%v", err)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.Tf(t, err == nil, "%v", err)
+	srcStore, err := fs.NewLocalStore(srcpath, fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Lose the files from under the repo
+	db, err := gosqlite3.Open(dbF.Name())
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = db.Execute(`DROP TABLE files`)
+	assert.Tf(t, err == nil, "%v", err)
+	db.Close()
+
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.T(t, err != nil)
+	assert.T(t, patchPlan == nil)
+}
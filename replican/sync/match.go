@@ -33,17 +33,25 @@ func Match(src string, dst string) (match *FileMatch, err os.Error) {
 	}
 
 	repo := fs.NewMemRepo()
-	srcFile := repo.AddFile(nil, srcFileInfo, srcBlocksInfo)
+	srcFile, err := repo.AddFile(nil, srcFileInfo, srcBlocksInfo)
+	if err != nil {
+		return nil, err
+	}
 	match, err = MatchFile(srcFile, dst)
 	return match, err
 }
 
 func MatchFile(srcFile fs.File, dst string) (match *FileMatch, err os.Error) {
+	return FsMatchFile(fs.OS, srcFile, dst)
+}
+
+// Match a source file against a destination file on a FileSystem.
+func FsMatchFile(fileSys fs.FileSystem, srcFile fs.File, dst string) (match *FileMatch, err os.Error) {
 	match = &FileMatch{SrcSize: srcFile.Info().Size}
 	var dstOffset int64
 
-	dstF, err := os.Open(dst)
-	if dstF == nil {
+	dstF, err := fileSys.Open(dst)
+	if err != nil {
 		return nil, err
 	}
 	defer dstF.Close()
@@ -83,7 +91,9 @@ SCAN:
 
 			for {
 				// Check for a weak checksum match
-				if matchBlock, has := srcFile.Repo().WeakBlock(dstWeak.Get()); has {
+				if matchBlock, has, err := srcFile.Repo().WeakBlock(dstWeak.Get()); err != nil {
+					return nil, err
+				} else if has {
 
 					// Double-check with the strong checksum
 					if fs.StrongChecksum(window[:blocksize]) == matchBlock.Info().Strong {
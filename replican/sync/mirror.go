@@ -0,0 +1,451 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Keep a local destination directory a mirror of a source directory.
+//
+// The source is indexed once, or reconciled with an index kept from
+// before, and from then on only the paths reported as changed are
+// reindexed. Each change is patched into the destination
+// with a plan covering just that file or directory.
+type Mirror struct {
+	// If not nil, each patch plan is written here before it is executed.
+	Log io.Writer
+
+	src     fs.LocalStore
+	dstPath string
+
+	// Limits the rate of patching, if not nil.
+	limits *IOLimits
+
+	// Options the source and destination are indexed with.
+	local fs.LocalOptions
+}
+
+// Options for creating a Mirror.
+type MirrorOptions struct {
+	// Limits the rate of patching, when not nil.
+	Limits *IOLimits
+
+	// Limits the rate files are read at while they are indexed,
+	// when not nil.
+	IndexLimit *fs.Throttle
+}
+
+// Index the source directory into repo, and prepare to mirror it into dst.
+//
+// If repo already holds a directory, it is taken to be an index of src
+// kept from an earlier mirror. Only the paths which have been added or
+// removed since, or whose size or modification time has changed, are
+// indexed again.
+func NewMirror(src string, dst string, repo fs.NodeRepo) (*Mirror, os.Error) {
+	return NewMirrorWith(src, dst, repo, MirrorOptions{})
+}
+
+// Prepare to mirror src into dst like NewMirror, with the given options.
+func NewMirrorWith(src string, dst string, repo fs.NodeRepo, options MirrorOptions) (*Mirror, os.Error) {
+	src = filepath.Clean(src)
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	} else if !srcInfo.IsDirectory() {
+		return nil, os.NewError(fmt.Sprintf("Cannot mirror %s, not a directory", src))
+	}
+
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return nil, err
+	}
+
+	root, err := repo.Root()
+	if err != nil {
+		return nil, err
+	}
+
+	mirror := &Mirror{
+		dstPath: dst,
+		limits:  options.Limits,
+		local:   fs.LocalOptions{IndexLimit: options.IndexLimit}}
+	if _, isDir := root.(fs.Dir); isDir {
+		err = mirror.reconcile(src, repo)
+	} else {
+		err = mirror.reindex(src, repo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mirror, nil
+}
+
+func (mirror *Mirror) SrcPath() string { return mirror.src.RootPath() }
+
+func (mirror *Mirror) DstPath() string { return mirror.dstPath }
+
+// Test if a path in the source should be mirrored.
+func (mirror *Mirror) Match(path string, info *os.FileInfo) bool {
+	return mirror.src.Repo().IndexFilter()(path, info)
+}
+
+// Get the path of a file in the source, relative to the source directory.
+func (mirror *Mirror) RelPath(path string) string {
+	return mirror.src.RelPath(filepath.Clean(path))
+}
+
+// Discard the whole index of the source and rebuild it.
+func (mirror *Mirror) reindex(src string, repo fs.NodeRepo) (err os.Error) {
+	var root fs.FsNode
+	for root, err = repo.Root(); root != nil && err == nil; root, err = repo.Root() {
+		switch node := root.(type) {
+		case fs.Dir:
+			err = repo.RemoveDir(node)
+		case fs.File:
+			err = repo.RemoveFile(node)
+		default:
+			err = os.NewError(fmt.Sprintf("Cannot remove index root %v", root))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	mirror.src, err = fs.NewLocalStoreWith(src, repo, mirror.local)
+	return err
+}
+
+// Bring an index kept from an earlier mirror of src up to date, reindexing
+// only what has changed.
+func (mirror *Mirror) reconcile(src string, repo fs.NodeRepo) (err os.Error) {
+	if mirror.src, err = fs.OpenLocalStore(src, repo, mirror.local); err != nil {
+		return err
+	}
+
+	root, err := repo.Root()
+	if err != nil {
+		return err
+	}
+
+	changed, err := mirror.changedPaths(root.(fs.Dir), "", []string{})
+	if err != nil {
+		return err
+	}
+
+	for _, relpath := range outermostPaths(changed) {
+		if err = mirror.refresh(relpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the paths under an indexed directory of the source which differ
+// from the index to changed.
+func (mirror *Mirror) changedPaths(dir fs.Dir, relpath string, changed []string) ([]string, os.Error) {
+	path := filepath.Join(mirror.SrcPath(), relpath)
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	subdirs, err := fs.ReadSubDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fs.ReadFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexed := make(map[string]fs.FsNode)
+	for _, subdir := range subdirs {
+		indexed[subdir.Info().Name] = subdir
+	}
+	for _, file := range files {
+		indexed[file.Info().Name] = file
+	}
+
+	for _, info := range infos {
+		childPath := filepath.Join(relpath, info.Name)
+		node, has := indexed[info.Name]
+		indexed[info.Name] = nil, false
+
+		if !mirror.Match(filepath.Join(path, info.Name), info) {
+			if has {
+				changed = append(changed, childPath)
+			}
+			continue
+		}
+
+		switch node := node.(type) {
+		case fs.Dir:
+			if info.IsDirectory() {
+				if changed, err = mirror.changedPaths(node, childPath, changed); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		case fs.File:
+			if info.IsRegular() && info.Size == node.Info().Size && info.Mtime_ns == node.Info().Mtime {
+				continue
+			}
+		}
+
+		if has || info.IsDirectory() || info.IsRegular() {
+			changed = append(changed, childPath)
+		}
+	}
+
+	// Whatever is left was removed
+	for name, _ := range indexed {
+		changed = append(changed, filepath.Join(relpath, name))
+	}
+	return changed, nil
+}
+
+// Patch the whole source into the destination.
+func (mirror *Mirror) Sync() os.Error {
+	return mirror.patch("")
+}
+
+// Reindex the given source paths, which may have been changed, added or
+// removed, and patch each of them into the destination. An empty path
+// stands for the whole source.
+func (mirror *Mirror) Update(relpaths []string) (err os.Error) {
+	relpaths = outermostPaths(relpaths)
+
+	for _, relpath := range relpaths {
+		if refreshErr := mirror.refresh(relpath); refreshErr != nil && err == nil {
+			err = refreshErr
+		}
+	}
+
+	for _, relpath := range relpaths {
+		if patchErr := mirror.patch(relpath); patchErr != nil && err == nil {
+			err = patchErr
+		}
+	}
+
+	return err
+}
+
+// Bring the index of a source path up to date with the filesystem.
+func (mirror *Mirror) refresh(relpath string) os.Error {
+	repo := mirror.src.Repo()
+	if relpath == "" {
+		return mirror.reindex(mirror.SrcPath(), repo)
+	}
+
+	rootNode, err := repo.Root()
+	if err != nil {
+		return err
+	}
+	root, isDir := rootNode.(fs.Dir)
+	if !isDir {
+		return mirror.reindex(mirror.SrcPath(), repo)
+	}
+
+	parentPath, name := splitRelPath(relpath)
+	node, hasParent, err := fs.CheckedLookup(root, parentPath)
+	if err != nil {
+		return err
+	}
+	parent, isDir := node.(fs.Dir)
+	if !hasParent || !isDir {
+		// The parent is new as well, and brings this path with it.
+		return mirror.refresh(parentPath)
+	}
+
+	node, has, err := fs.CheckedLookup(parent, name)
+	if err != nil {
+		return err
+	}
+	if has {
+		switch node := node.(type) {
+		case fs.Dir:
+			err = repo.RemoveDir(node)
+		case fs.File:
+			err = repo.RemoveFile(node)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(mirror.SrcPath(), relpath)
+	if info, statErr := os.Lstat(path); statErr == nil && mirror.Match(path, info) {
+		if info.IsDirectory() {
+			subdir, errors := fs.IndexDirWith(path, fs.NewMemRepo(), mirror.local)
+			if subdir != nil {
+				subdir.Info().Name = name
+				_, err = fs.CopyInto(subdir, parent, repo)
+			}
+			if len(errors) > 0 && err == nil {
+				err = errors[0]
+			}
+		} else if info.IsRegular() {
+			var fileInfo *fs.FileInfo
+			var blocksInfo []*fs.BlockInfo
+			if fileInfo, blocksInfo, err = fs.IndexFileWith(path, mirror.local); err == nil {
+				_, err = repo.AddFile(parent, fileInfo, blocksInfo)
+			}
+		}
+	}
+
+	if strongErr := fs.UpdateStrongsToRoot(parent); strongErr != nil && err == nil {
+		err = strongErr
+	}
+	return err
+}
+
+// Patch a source path into the same path in the destination,
+// removing it from the destination if it is no longer in the source.
+func (mirror *Mirror) patch(relpath string) os.Error {
+	dstPath := filepath.Join(mirror.dstPath, relpath)
+
+	root, err := mirror.src.Repo().Root()
+	if err != nil {
+		return err
+	}
+
+	var node fs.FsNode
+	found := false
+	if root, isDir := root.(fs.Dir); isDir {
+		if node, found, err = fs.CheckedLookup(root, relpath); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return os.RemoveAll(dstPath)
+	}
+
+	// Make way for a file replaced by a directory, or the other way around
+	_, srcIsDir := node.(fs.Dir)
+	if dstInfo, err := os.Lstat(dstPath); err == nil && dstInfo.IsDirectory() != srcIsDir {
+		if err = os.RemoveAll(dstPath); err != nil {
+			return err
+		}
+	}
+
+	plan, err := RestoreWith(mirror.src, relpath, dstPath, mirror.local)
+	if err != nil {
+		return err
+	}
+	plan.Limit(mirror.limits)
+
+	if mirror.Log != nil {
+		fmt.Fprintf(mirror.Log, "%v", plan)
+	}
+
+	if failedCmd, err := plan.Exec(); err != nil {
+		return os.NewError(fmt.Sprintf("%v: %v", failedCmd, err))
+	}
+
+	errors := make(chan os.Error)
+	go func() {
+		plan.Clean(errors)
+		plan.SetMode(errors)
+		plan.pruneDirs(errors)
+		close(errors)
+	}()
+
+	for planErr := range errors {
+		if err == nil {
+			err = planErr
+		}
+	}
+	return err
+}
+
+// Remove directories in the destination which are not in the source.
+func (plan *PatchPlan) pruneDirs(errors chan<- os.Error) {
+	srcNode, err := plan.srcStore.Repo().Root()
+	var dstRoot fs.FsNode
+	if err == nil {
+		dstRoot, err = plan.dstStore.Repo().Root()
+	}
+	if err != nil {
+		if errors != nil {
+			errors <- err
+		}
+		return
+	}
+
+	srcRoot, isDir := srcNode.(fs.Dir)
+	if !isDir {
+		return
+	}
+
+	// A directory is only removed once both trees are known to be without
+	// it, so the walk stops at the first node which cannot be read.
+	var walkErr os.Error
+	err = fs.CheckedWalk(dstRoot, func(dstNode fs.Node) bool {
+		dstDir, isDir := dstNode.(fs.Dir)
+		if !isDir || walkErr != nil {
+			return false
+		}
+
+		var dstPath string
+		if dstPath, walkErr = fs.CheckedRelPath(dstDir); walkErr != nil {
+			return false
+		}
+		srcNode, has, lookupErr := fs.CheckedLookup(srcRoot, dstPath)
+		if lookupErr != nil {
+			walkErr = lookupErr
+			return false
+		}
+		if has {
+			_, isDir = srcNode.(fs.Dir)
+			return isDir
+		}
+
+		if err := os.RemoveAll(plan.dstStore.Resolve(dstPath)); err != nil && errors != nil {
+			errors <- err
+		}
+		return false
+	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil && errors != nil {
+		errors <- err
+	}
+}
+
+// Split a relative path into its parent directory and name.
+func splitRelPath(relpath string) (string, string) {
+	parentPath, name := filepath.Split(relpath)
+	return strings.TrimRight(parentPath, "/\\"), name
+}
+
+// Reduce a set of relative paths to those not contained by another.
+func outermostPaths(relpaths []string) []string {
+	sorted := append([]string{}, relpaths...)
+	sort.SortStrings(sorted)
+
+	result := []string{}
+	for _, relpath := range sorted {
+		contained := false
+		for _, outer := range result {
+			if outer == "" || relpath == outer ||
+				strings.HasPrefix(relpath, outer+string(os.PathSeparator)) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			result = append(result, relpath)
+		}
+	}
+	return result
+}
@@ -0,0 +1,190 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+// Assert that a mirror's index and destination both match its source.
+func assertMirrored(t *testing.T, mirror *Mirror) {
+	srcDir, errors := fs.IndexDir(mirror.SrcPath(), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	dstDir, errors := fs.IndexDir(mirror.DstPath(), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	indexed := fstest.RootDir(t, mirror.src.Repo())
+	assert.Equal(t, srcDir.Info().Strong, indexed.Info().Strong)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+}
+
+// Get the strong checksum of a file in a mirror's index.
+func indexedStrong(t *testing.T, repo fs.NodeRepo, relpath string) string {
+	node, has := fs.Lookup(fstest.RootDir(t, repo), relpath)
+	file, isFile := node.(fs.File)
+	assert.Tf(t, has && isFile, "%s is not indexed", relpath)
+	return file.Info().Strong
+}
+
+// Test keeping a mirror current by updating only changed paths.
+
+func TestMirror(t *testing.T) {
+	DoTestMirror(t, mkMemRepo)
+}
+
+func TestDbMirror(t *testing.T) {
+	DoTestMirror(t, mkDbRepo)
+}
+
+func DoTestMirror(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537)),
+			tg.F("a", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.D("deep",
+				tg.F("B", tg.B(43, 65537)))),
+		tg.F("C", tg.B(44, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	dstpath, err := ioutil.TempDir("", "mirror")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dstpath)
+
+	repo := mkrepo(t)
+	defer repo.Close()
+
+	mirror, err := NewMirror(filepath.Join(srcpath, "foo"), dstpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	err = mirror.Sync()
+	assert.Tf(t, err == nil, "%v", err)
+	assertMirrored(t, mirror)
+
+	// Change a file, add a file, remove a tree and add a tree
+	foo := mirror.SrcPath()
+	err = ioutil.WriteFile(filepath.Join(foo, "C"), []byte("changed"), 0644)
+	assert.T(t, err == nil)
+	err = ioutil.WriteFile(filepath.Join(foo, "bar", "new"), []byte("new"), 0644)
+	assert.T(t, err == nil)
+	err = os.RemoveAll(filepath.Join(foo, "baz"))
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	err = treegen.Fab(foo, tg.D("quux", tg.D("deeper", tg.F("Q", tg.B(45, 100)))))
+	assert.Tf(t, err == nil, "%v", err)
+
+	err = mirror.Update([]string{
+		"C",
+		filepath.Join("bar", "new"),
+		filepath.Join("baz", "deep", "B"),
+		filepath.Join("baz", "deep"),
+		"baz",
+		filepath.Join("quux", "deeper", "Q")})
+	assert.Tf(t, err == nil, "%v", err)
+	assertMirrored(t, mirror)
+
+	_, err = os.Stat(filepath.Join(dstpath, "baz"))
+	assert.T(t, err != nil)
+
+	// Replace a file with a directory
+	err = os.Remove(filepath.Join(foo, "C"))
+	assert.T(t, err == nil)
+	tg = treegen.New()
+	err = treegen.Fab(foo, tg.D("C", tg.F("c", tg.B(46, 100))))
+	assert.Tf(t, err == nil, "%v", err)
+
+	err = mirror.Update([]string{"C", filepath.Join("C", "c")})
+	assert.Tf(t, err == nil, "%v", err)
+	assertMirrored(t, mirror)
+}
+
+// Test that a mirror reuses an index kept from before, reindexing only
+// the paths which changed while it was not running.
+
+func TestMirrorReuse(t *testing.T) {
+	DoTestMirrorReuse(t, mkMemRepo)
+}
+
+func TestDbMirrorReuse(t *testing.T) {
+	DoTestMirrorReuse(t, mkDbRepo)
+}
+
+func DoTestMirrorReuse(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537))),
+		tg.D("baz",
+			tg.F("B", tg.B(43, 65537))),
+		tg.F("C", tg.B(44, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	dstpath, err := ioutil.TempDir("", "mirror")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dstpath)
+
+	repo := mkrepo(t)
+	defer repo.Close()
+
+	mirror, err := NewMirror(filepath.Join(srcpath, "foo"), dstpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	err = mirror.Sync()
+	assert.Tf(t, err == nil, "%v", err)
+
+	foo := mirror.SrcPath()
+	staleA := indexedStrong(t, repo, filepath.Join("bar", "A"))
+
+	// Change A without changing its size or modification time, which
+	// only reading it again would notice
+	pathA := filepath.Join(foo, "bar", "A")
+	infoA, err := os.Stat(pathA)
+	assert.T(t, err == nil)
+	data, err := ioutil.ReadFile(pathA)
+	assert.T(t, err == nil)
+	data[0]++
+	err = ioutil.WriteFile(pathA, data, 0644)
+	assert.T(t, err == nil)
+	err = os.Chtimes(pathA, infoA.Atime_ns, infoA.Mtime_ns)
+	assert.T(t, err == nil)
+
+	// Make changes which should be noticed
+	err = ioutil.WriteFile(filepath.Join(foo, "C"), []byte("changed"), 0644)
+	assert.T(t, err == nil)
+	err = ioutil.WriteFile(filepath.Join(foo, "bar", "new"), []byte("new"), 0644)
+	assert.T(t, err == nil)
+	err = os.RemoveAll(filepath.Join(foo, "baz"))
+	assert.T(t, err == nil)
+
+	mirror, err = NewMirror(foo, dstpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	assert.Equal(t, staleA, indexedStrong(t, repo, filepath.Join("bar", "A")))
+	assert.Equal(t, fs.StrongChecksum([]byte("changed")), indexedStrong(t, repo, "C"))
+	assert.Equal(t, fs.StrongChecksum([]byte("new")), indexedStrong(t, repo, filepath.Join("bar", "new")))
+	_, has := fs.Lookup(fstest.RootDir(t, repo), "baz")
+	assert.T(t, !has)
+
+	// Once A is known to have changed, it is all mirrored
+	err = mirror.Update([]string{filepath.Join("bar", "A")})
+	assert.Tf(t, err == nil, "%v", err)
+	err = mirror.Sync()
+	assert.Tf(t, err == nil, "%v", err)
+	assertMirrored(t, mirror)
+}
+
+func TestOutermostPaths(t *testing.T) {
+	sep := string(os.PathSeparator)
+	assert.Equal(t, []string{"a", "a-b", "c"},
+		outermostPaths([]string{"a" + sep + "b", "c", "a", "a-b", "a"}))
+	assert.Equal(t, []string{""}, outermostPaths([]string{"a", "", "b"}))
+}
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
-	//	"log"
 	"os"
 	"path/filepath"
 	"github.com/cmars/replican-sync/replican/fs"
@@ -13,14 +11,22 @@ import (
 
 type PathRef interface {
 	Resolve() string
+
+	// The filesystem on which the path resolves.
+	FileSystem() fs.FileSystem
 }
 
+// A path on the operating system's filesystem.
 type AbsolutePath string
 
 func (absPath AbsolutePath) Resolve() string {
 	return string(absPath)
 }
 
+func (absPath AbsolutePath) FileSystem() fs.FileSystem {
+	return fs.OS
+}
+
 type LocalPath struct {
 	LocalStore fs.LocalStore
 	RelPath    string
@@ -34,6 +40,10 @@ func (localPath *LocalPath) Resolve() string {
 	return localPath.LocalStore.Resolve(localPath.RelPath)
 }
 
+func (localPath *LocalPath) FileSystem() fs.FileSystem {
+	return localPath.LocalStore.FileSystem()
+}
+
 type PatchCmd interface {
 	String() string
 
@@ -42,7 +52,7 @@ type PatchCmd interface {
 
 func mkParentDirs(path PathRef) os.Error {
 	dir, _ := filepath.Split(path.Resolve())
-	if err := os.MkdirAll(dir, 0755); err != nil {
+	if err := path.FileSystem().MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 	return nil
@@ -53,6 +63,9 @@ type Transfer struct {
 	From *LocalPath
 	To   *LocalPath
 
+	// Limits the rate of a copy, if not nil.
+	Limits *IOLimits
+
 	relocRefs map[string]int
 }
 
@@ -80,19 +93,20 @@ func (transfer *Transfer) copy(srcStore fs.BlockStore) os.Error {
 		return err
 	}
 
-	srcF, err := os.Open(transfer.From.Resolve())
+	fileSys := transfer.To.FileSystem()
+	srcF, err := fileSys.Open(transfer.From.Resolve())
 	if err != nil {
 		return err
 	}
 	defer srcF.Close()
 
-	dstF, err := os.Create(transfer.To.Resolve())
+	dstF, err := fileSys.Create(transfer.To.Resolve())
 	if err != nil {
 		return err
 	}
 	defer dstF.Close()
 
-	_, err = io.Copy(dstF, srcF)
+	_, err = io.Copy(transfer.Limits.writer(dstF), transfer.Limits.reader(srcF))
 	return err
 }
 
@@ -101,7 +115,7 @@ func (transfer *Transfer) move(srcStore fs.BlockStore) os.Error {
 		return err
 	}
 
-	return fs.Move(transfer.From.Resolve(), transfer.To.Resolve())
+	return fs.FsMove(transfer.To.FileSystem(), transfer.From.Resolve(), transfer.To.Resolve())
 }
 
 // Keep a file. Yeah, that's right. Just leave it alone.
@@ -135,7 +149,7 @@ func (conflict *Conflict) Exec(srcStore fs.BlockStore) (err os.Error) {
 }
 
 func (conflict *Conflict) Cleanup() os.Error {
-	return os.RemoveAll(conflict.relocPath)
+	return conflict.Path.FileSystem().RemoveAll(conflict.relocPath)
 }
 
 // Set a file to a different size. Paths are relative.
@@ -149,7 +163,7 @@ func (resize *Resize) String() string {
 }
 
 func (resize *Resize) Exec(srcStore fs.BlockStore) os.Error {
-	return os.Truncate(resize.Path.Resolve(), resize.Size)
+	return resize.Path.FileSystem().Truncate(resize.Path.Resolve(), resize.Size)
 }
 
 // Start a temp file to recieve changes on a local destination file.
@@ -158,8 +172,8 @@ type LocalTemp struct {
 	Path PathRef
 	Size int64
 
-	localFh *os.File
-	tempFh  *os.File
+	localFh fs.Handle
+	tempFh  fs.Handle
 }
 
 func (localTemp *LocalTemp) String() string {
@@ -167,14 +181,15 @@ func (localTemp *LocalTemp) String() string {
 }
 
 func (localTemp *LocalTemp) Exec(srcStore fs.BlockStore) (err os.Error) {
-	localTemp.localFh, err = os.Open(localTemp.Path.Resolve())
+	fileSys := localTemp.Path.FileSystem()
+	localTemp.localFh, err = fileSys.Open(localTemp.Path.Resolve())
 	if err != nil {
 		return err
 	}
 
 	localDir, localName := filepath.Split(localTemp.Path.Resolve())
 
-	localTemp.tempFh, err = ioutil.TempFile(localDir, localName)
+	localTemp.tempFh, err = fileSys.TempFile(localDir, localName)
 	if err != nil {
 		return err
 	}
@@ -201,12 +216,9 @@ func (rwt *ReplaceWithTemp) Exec(srcStore fs.BlockStore) (err os.Error) {
 	rwt.Temp.tempFh.Close()
 	rwt.Temp.tempFh = nil
 
-	err = os.Remove(rwt.Temp.Path.Resolve())
-	if err != nil {
-		return err
-	}
-
-	err = fs.Move(tempName, rwt.Temp.Path.Resolve())
+	// Rename the temporary over the local file, so that one or the other
+	// is always there
+	err = fs.FsMove(rwt.Temp.Path.FileSystem(), tempName, rwt.Temp.Path.Resolve())
 	if err != nil {
 		return err
 	}
@@ -220,6 +232,9 @@ type LocalTempCopy struct {
 	LocalOffset int64
 	TempOffset  int64
 	Length      int64
+
+	// Limits the rate of the copy, if not nil.
+	Limits *IOLimits
 }
 
 func (ltc *LocalTempCopy) String() string {
@@ -238,7 +253,7 @@ func (ltc *LocalTempCopy) Exec(srcStore fs.BlockStore) (err os.Error) {
 		return err
 	}
 
-	_, err = io.Copyn(ltc.Temp.tempFh, ltc.Temp.localFh, ltc.Length)
+	_, err = io.Copyn(ltc.Limits.writer(ltc.Temp.tempFh), ltc.Limits.reader(ltc.Temp.localFh), ltc.Length)
 	return err
 }
 
@@ -249,6 +264,9 @@ type SrcTempCopy struct {
 	SrcOffset  int64
 	TempOffset int64
 	Length     int64
+
+	// Limits the rate of the copy, if not nil.
+	Limits *IOLimits
 }
 
 func (stc *SrcTempCopy) String() string {
@@ -258,7 +276,7 @@ func (stc *SrcTempCopy) String() string {
 
 func (stc *SrcTempCopy) Exec(srcStore fs.BlockStore) os.Error {
 	stc.Temp.tempFh.Seek(stc.TempOffset, 0)
-	_, err := srcStore.ReadInto(stc.SrcStrong, stc.SrcOffset, stc.Length, stc.Temp.tempFh)
+	_, err := srcStore.ReadInto(stc.SrcStrong, stc.SrcOffset, stc.Length, stc.Limits.srcWriter(stc.Temp.tempFh))
 	return err
 }
 
@@ -267,6 +285,9 @@ type SrcFileDownload struct {
 	SrcFile fs.File
 	Path    PathRef
 	Length  int64
+
+	// Limits the rate of the copy, if not nil.
+	Limits *IOLimits
 }
 
 func (sfd *SrcFileDownload) String() string {
@@ -278,12 +299,13 @@ func (sfd *SrcFileDownload) Exec(srcStore fs.BlockStore) os.Error {
 		return err
 	}
 
-	dstFh, err := os.Create(sfd.Path.Resolve())
-	if dstFh == nil {
+	dstFh, err := sfd.Path.FileSystem().Create(sfd.Path.Resolve())
+	if err != nil {
 		return err
 	}
+	defer dstFh.Close()
 
-	_, err = srcStore.ReadInto(sfd.SrcFile.Info().Strong, 0, sfd.SrcFile.Info().Size, dstFh)
+	_, err = srcStore.ReadInto(sfd.SrcFile.Info().Strong, 0, sfd.SrcFile.Info().Size, sfd.Limits.srcWriter(dstFh))
 	return err
 }
 
@@ -296,25 +318,57 @@ type PatchPlan struct {
 	dstStore fs.LocalStore
 }
 
-func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
+// Plan how to patch the tree in dstStore to match the one in srcStore.
+//
+// A failure to read either tree stops planning, and is returned. A plan
+// made from part of a tree would delete or overwrite what it missed.
+func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) (*PatchPlan, os.Error) {
 	plan := &PatchPlan{srcStore: srcStore, dstStore: dstStore}
 
 	plan.dstFileUnmatch = make(map[string]fs.File)
 
-	fs.Walk(dstStore.Repo().Root(), func(dstNode fs.Node) bool {
+	dstRoot, err := dstStore.Repo().Root()
+	if err != nil {
+		return nil, err
+	}
+	srcRoot, err := srcStore.Repo().Root()
+	if err != nil {
+		return nil, err
+	}
+
+	// The first failure to read a tree, which stops the walk over it
+	var walkErr os.Error
+
+	err = fs.CheckedWalk(dstRoot, func(dstNode fs.Node) bool {
+		if walkErr != nil {
+			return false
+		}
 
 		dstFile, isDstFile := dstNode.(fs.File)
 		if isDstFile {
-			plan.dstFileUnmatch[fs.RelPath(dstFile)] = dstFile
+			var dstPath string
+			if dstPath, walkErr = fs.CheckedRelPath(dstFile); walkErr != nil {
+				return false
+			}
+			plan.dstFileUnmatch[dstPath] = dstFile
 		}
 
 		return !isDstFile
 	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
 
 	relocRefs := make(map[string]int)
 
 	// Find all the FsNode matches
-	fs.Walk(srcStore.Repo().Root(), func(srcNode fs.Node) bool {
+	err = fs.CheckedWalk(srcRoot, func(srcNode fs.Node) bool {
+		if walkErr != nil {
+			return false
+		}
 
 		// Ignore non-FsNodes
 		srcFsNode, isSrcFsNode := srcNode.(fs.FsNode)
@@ -325,7 +379,11 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 		//		log.Printf("In src: %s", fs.RelPath(srcFsNode))
 
 		srcFile, isSrcFile := srcNode.(fs.File)
-		srcPath := fs.RelPath(srcFsNode)
+		srcPath, err := fs.CheckedRelPath(srcFsNode)
+		if err != nil {
+			walkErr = err
+			return false
+		}
 
 		// Remove this srcPath from dst unmatched, if it was present
 		plan.dstFileUnmatch[srcPath] = nil, false
@@ -339,9 +397,13 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 
 		var dstNode fs.FsNode
 		var hasDstNode bool
-		dstNode, hasDstNode = dstStore.Repo().File(srcStrong)
-		if !hasDstNode {
-			dstNode, hasDstNode = dstStore.Repo().Dir(srcStrong)
+		dstNode, hasDstNode, err = dstStore.Repo().File(srcStrong)
+		if err == nil && !hasDstNode {
+			dstNode, hasDstNode, err = dstStore.Repo().Dir(srcStrong)
+		}
+		if err != nil {
+			walkErr = err
+			return false
 		}
 
 		isDstFile := false
@@ -350,11 +412,15 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 		}
 
 		dstFilePath := dstStore.Resolve(srcPath)
-		dstFileInfo, _ := os.Stat(dstFilePath)
+		dstFileInfo, _ := dstStore.FileSystem().Stat(dstFilePath)
 
 		// Resolve dst node that matches strong checksum with source
 		if hasDstNode && isSrcFile == isDstFile {
-			dstPath := fs.RelPath(dstNode)
+			dstPath, err := fs.CheckedRelPath(dstNode)
+			if err != nil {
+				walkErr = err
+				return false
+			}
 			relocRefs[dstPath]++ // dstPath will be used in this cmd, inc ref count
 
 			//			log.Printf("srcPath=%s dstPath=%s", srcPath, dstPath)
@@ -369,6 +435,12 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 				// Same path, keep it where it is
 				plan.Cmds = append(plan.Cmds, &Keep{
 					Path: &LocalPath{LocalStore: dstStore, RelPath: srcPath}})
+
+				// Identical directory in the same place, skip the whole subtree
+				if dstDir, isDstDir := dstNode.(fs.Dir); isDstDir {
+					walkErr = plan.keepSubtree(dstDir, relocRefs)
+					return false
+				}
 			}
 
 			// If its a file, figure out what to do with it
@@ -392,7 +464,7 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 
 			// Destination file exists, add block-level commands
 			default:
-				plan.appendFilePlan(srcFile, srcPath)
+				walkErr = plan.appendFilePlan(srcFile, srcPath)
 				break
 			}
 
@@ -408,12 +480,61 @@ func NewPatchPlan(srcStore fs.BlockStore, dstStore fs.LocalStore) *PatchPlan {
 
 		return !isSrcFile
 	})
+	if err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// Account for everything beneath a destination directory kept in place,
+// without planning the equivalent source subtree node by node.
+func (plan *PatchPlan) keepSubtree(dstDir fs.Dir, relocRefs map[string]int) os.Error {
+	var pathErr os.Error
+	visitor := func(dstNode fs.Node) bool {
+		dstFsNode, isDstFsNode := dstNode.(fs.FsNode)
+		if !isDstFsNode || pathErr != nil {
+			return false
+		}
+
+		var dstPath string
+		if dstPath, pathErr = fs.CheckedRelPath(dstFsNode); pathErr != nil {
+			return false
+		}
+		relocRefs[dstPath]++ // dstPath must not be moved out from under the keep
+		plan.dstFileUnmatch[dstPath] = nil, false
+
+		_, isDstDir := dstNode.(fs.Dir)
+		return isDstDir
+	}
+
+	subdirs, err := fs.ReadSubDirs(dstDir)
+	if err != nil {
+		return err
+	}
+	files, err := fs.ReadFiles(dstDir)
+	if err != nil {
+		return err
+	}
 
-	return plan
+	for _, subdir := range subdirs {
+		if err = fs.CheckedWalk(subdir, visitor); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if err = fs.CheckedWalk(file, visitor); err != nil {
+			return err
+		}
+	}
+	return pathErr
 }
 
 func (plan *PatchPlan) appendFilePlan(srcFile fs.File, dstPath string) os.Error {
-	match, err := MatchFile(srcFile, plan.dstStore.Resolve(dstPath))
+	match, err := FsMatchFile(plan.dstStore.FileSystem(), srcFile, plan.dstStore.Resolve(dstPath))
 	if match == nil {
 		return err
 	}
@@ -457,9 +578,14 @@ func (plan *PatchPlan) appendFilePlan(srcFile fs.File, dstPath string) os.Error
 }
 
 func (plan *PatchPlan) Exec() (failedCmd PatchCmd, err os.Error) {
+	return plan.exec(plan.srcStore)
+}
+
+// Apply the plan, reading the literal data it copies from srcStore.
+func (plan *PatchPlan) exec(srcStore fs.BlockStore) (failedCmd PatchCmd, err os.Error) {
 	conflicts := []*Conflict{}
 	for _, cmd := range plan.Cmds {
-		err = cmd.Exec(plan.srcStore)
+		err = cmd.Exec(srcStore)
 		if err != nil {
 			return cmd, err
 		}
@@ -477,16 +603,30 @@ func (plan *PatchPlan) Exec() (failedCmd PatchCmd, err os.Error) {
 }
 
 func (plan *PatchPlan) SetMode(errors chan<- os.Error) {
-	fs.Walk(plan.srcStore.Repo().Root(), func(srcNode fs.Node) bool {
-		var err os.Error
+	srcRoot, err := plan.srcStore.Repo().Root()
+	if err != nil {
+		if errors != nil {
+			errors <- err
+		}
+		return
+	}
+
+	err = fs.CheckedWalk(srcRoot, func(srcNode fs.Node) bool {
 		srcFsNode, is := srcNode.(fs.FsNode)
 		if !is {
 			return false
 		}
 
-		srcPath := fs.RelPath(srcFsNode)
+		srcPath, err := fs.CheckedRelPath(srcFsNode)
+		if err != nil {
+			if errors != nil {
+				errors <- err
+			}
+			return false
+		}
+
 		if absPath := plan.dstStore.Resolve(srcPath); absPath != "" {
-			err = os.Chmod(absPath, srcFsNode.Mode())
+			err = plan.dstStore.FileSystem().Chmod(absPath, srcFsNode.Mode())
 		} else {
 			err = os.NewError(fmt.Sprintf("Expected %s not found in destination", srcPath))
 		}
@@ -498,12 +638,15 @@ func (plan *PatchPlan) SetMode(errors chan<- os.Error) {
 		_, is = srcNode.(fs.Dir)
 		return is
 	})
+	if err != nil && errors != nil {
+		errors <- err
+	}
 }
 
 func (plan *PatchPlan) Clean(errors chan<- os.Error) {
 	for dstPath, _ := range plan.dstFileUnmatch {
 		absPath := plan.dstStore.Resolve(dstPath)
-		err := os.Remove(absPath)
+		err := plan.dstStore.FileSystem().Remove(absPath)
 		if err != nil && errors != nil {
 			errors <- err
 		}
@@ -529,5 +672,5 @@ func Patch(src string, dst string) (*PatchPlan, os.Error) {
 		return nil, err
 	}
 
-	return NewPatchPlan(srcStore, dstStore), nil
+	return NewPatchPlan(srcStore, dstStore)
 }
@@ -3,10 +3,12 @@ package sync
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"github.com/cmars/replican-sync/replican/fs"
 	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/fstest"
 	"github.com/cmars/replican-sync/replican/treegen"
 	"strings"
 	"testing"
@@ -91,7 +93,7 @@ func DoTestPatchIdentity(t *testing.T, mkrepo repoMaker) {
 	assert.T(t, err == nil)
 
 	assert.Equal(t, "1b1979b8746948cedc81488e92d1ad715e38bbfc",
-		srcStore.Repo().Root().(fs.Dir).Info().Strong)
+		fstest.RootDir(t, srcStore.Repo()).Info().Strong)
 
 	dstpath := treegen.TestTree(t, treeSpec)
 	defer os.RemoveAll(dstpath)
@@ -101,9 +103,10 @@ func DoTestPatchIdentity(t *testing.T, mkrepo repoMaker) {
 	assert.T(t, err == nil)
 
 	assert.Equal(t, "1b1979b8746948cedc81488e92d1ad715e38bbfc",
-		dstStore.Repo().Root().(fs.Dir).Info().Strong)
+		fstest.RootDir(t, dstStore.Repo()).Info().Strong)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	assert.T(t, len(patchPlan.Cmds) > 0)
@@ -140,7 +143,8 @@ func TestMatchAppend(t *testing.T) {
 	assert.Equal(t, 9, len(dstBlocksInfo))
 
 	srcRepo := fs.NewMemRepo()
-	srcFile := srcRepo.AddFile(nil, srcFileInfo, srcBlocksInfo)
+	srcFile, err := srcRepo.AddFile(nil, srcFileInfo, srcBlocksInfo)
+	assert.T(t, err == nil)
 
 	match, err := MatchFile(srcFile, filepath.Join(dstpath, "bar"))
 	assert.T(t, err == nil, "%v", err)
@@ -186,7 +190,8 @@ func DoTestPatchFileAppend(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	complete := false
@@ -259,7 +264,8 @@ func DoTestPatchFileTruncate(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	complete := false
@@ -331,7 +337,8 @@ func DoTestPatchAdd(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 
 	//	printPlan(patchPlan)
 
@@ -372,7 +379,8 @@ func DoTestPatchRenameFileSameDir(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 
 	assert.Equal(t, 1, len(patchPlan.Cmds))
 	rename, isRename := patchPlan.Cmds[0].(*Transfer)
@@ -420,7 +428,8 @@ func DoTestPatchRenameFileDifferentDir(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	assert.Equal(t, 2, len(patchPlan.Cmds))
 	for i := 0; i < len(patchPlan.Cmds); i++ {
 		_, isRename := patchPlan.Cmds[0].(*Transfer)
@@ -428,7 +437,8 @@ func DoTestPatchRenameFileDifferentDir(t *testing.T, mkrepo repoMaker) {
 	}
 
 	// Now flip
-	patchPlan = NewPatchPlan(dstStore, srcStore)
+	patchPlan, err = NewPatchPlan(dstStore, srcStore)
+	assert.Tf(t, err == nil, "%v", err)
 	assert.Equal(t, 2, len(patchPlan.Cmds))
 	for i := 0; i < len(patchPlan.Cmds); i++ {
 		_, isRename := patchPlan.Cmds[0].(*Transfer)
@@ -476,7 +486,8 @@ func DoTestPatchSimpleDirFileConflict(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	failedCmd, err := patchPlan.Exec()
@@ -553,7 +564,8 @@ func DoTestPatchRelocConflict(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	assert.Equal(t, 3, len(patchPlan.Cmds))
@@ -616,7 +628,8 @@ func DoTestPatchDepConflict(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	failedCmd, err := patchPlan.Exec()
@@ -658,16 +671,17 @@ func DoTestPatchWeakCollision(t *testing.T, mkrepo repoMaker) {
 
 	// Src and dst blocks have same weak checksum
 	assert.Equal(t,
-		(srcStore.Repo().Root().(fs.Dir)).SubDirs()[0].Files()[0].Blocks()[0].Info().Weak,
-		(dstStore.Repo().Root().(fs.Dir)).SubDirs()[0].Files()[0].Blocks()[0].Info().Weak)
+		fstest.RootDir(t, srcStore.Repo()).SubDirs()[0].Files()[0].Blocks()[0].Info().Weak,
+		fstest.RootDir(t, dstStore.Repo()).SubDirs()[0].Files()[0].Blocks()[0].Info().Weak)
 
 	// Src and dst blocks have different strong checksum
-	srcRoot := srcStore.Repo().Root().(fs.Dir)
-	dstRoot := dstStore.Repo().Root().(fs.Dir)
+	srcRoot := fstest.RootDir(t, srcStore.Repo())
+	dstRoot := fstest.RootDir(t, dstStore.Repo())
 	assert.Tf(t, srcRoot.Info().Strong != dstRoot.Info().Strong,
 		"wtf: %v == %v", srcRoot.Info().Strong, dstRoot.Info().Strong)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	failedCmd, err := patchPlan.Exec()
@@ -713,7 +727,8 @@ func DoTestPatchRenameScope(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	failedCmd, err := patchPlan.Exec()
@@ -776,7 +791,8 @@ func DoTestPatchPreserveKeeps(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	//	printPlan(patchPlan)
 
 	failedCmd, err := patchPlan.Exec()
@@ -844,7 +860,8 @@ func DoTestClean(t *testing.T, mkrepo repoMaker) {
 	_, err = os.Stat(onePath)
 	assert.Tf(t, err == nil, "%v", err)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	failedCmd, err := patchPlan.Exec()
 	assert.Tf(t, failedCmd == nil, "%v", failedCmd)
 	assert.Tf(t, err == nil, "%v", err)
@@ -896,7 +913,8 @@ func DoTestSetModeNew(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	failedCmd, err := patchPlan.Exec()
 	assert.Tf(t, failedCmd == nil, "%v", failedCmd)
 	assert.Tf(t, err == nil, "%v", err)
@@ -967,7 +985,8 @@ func DoTestSetModeOverwrite(t *testing.T, mkrepo repoMaker) {
 	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
 	assert.T(t, err == nil)
 
-	patchPlan := NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
 	failedCmd, err := patchPlan.Exec()
 	assert.Tf(t, failedCmd == nil, "%v %v", failedCmd, err)
 	assert.Tf(t, err == nil, "%v", err)
@@ -998,3 +1017,249 @@ func DoTestSetModeOverwrite(t *testing.T, mkrepo repoMaker) {
 	assert.T(t, fileinfo != nil)
 	assert.Equal(t, uint32(0711), fileinfo.Permission())
 }
+
+// Test that the patch planner keeps an identical directory in place
+// without planning each of its contents.
+
+func TestPatchKeepSubtree(t *testing.T) {
+	DoTestPatchKeepSubtree(t, mkMemRepo)
+}
+
+func TestDbPatchKeepSubtree(t *testing.T) {
+	DoTestPatchKeepSubtree(t, mkDbRepo)
+}
+
+func DoTestPatchKeepSubtree(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.D("aleph",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("a", tg.B(42, 65537)))),
+		tg.F("baz", tg.B(43, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.D("bar",
+			tg.D("aleph",
+				tg.F("A", tg.B(42, 65537)),
+				tg.F("a", tg.B(42, 65537)))),
+		tg.F("baz", tg.B(44, 65537)))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	//	printPlan(patchPlan)
+
+	barPath := filepath.Join("foo", "bar")
+	keptBar := false
+	for _, cmd := range patchPlan.Cmds {
+		if keep, is := cmd.(*Keep); is && keep.Path.(*LocalPath).RelPath == barPath {
+			keptBar = true
+			continue
+		}
+		assert.Tf(t, !strings.Contains(cmd.String(), barPath), "unexpected: %v", cmd)
+	}
+	assert.T(t, keptBar)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+
+	srcDir, errs := fs.IndexDir(srcpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errs), "%v", errs)
+	dstDir, errs := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errs), "%v", errs)
+	assert.Equal(t, srcDir.Info().Strong, dstDir.Info().Strong)
+}
+
+// Test restoring a tree backed up into an object store,
+// after the original tree has been changed.
+
+func TestPatchFromObjects(t *testing.T) {
+	DoTestPatchFromObjects(t, mkMemRepo)
+}
+
+func TestDbPatchFromObjects(t *testing.T) {
+	DoTestPatchFromObjects(t, mkDbRepo)
+}
+
+func DoTestPatchFromObjects(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537), tg.B(43, 10000))),
+		tg.F("baz", tg.B(44, 65537)))
+	origpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(origpath)
+	origRoot, errors := fs.IndexDir(origpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	assert.T(t, err == nil)
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+	objects, err := fs.NewObjectStore(objpath, srcRepo)
+	assert.T(t, err == nil)
+	defer objects.Close()
+
+	err = objects.Backup(srcStore)
+	assert.Tf(t, err == nil, "%v", err)
+
+	// Trash the original, the objects are all we have now
+	os.RemoveAll(srcpath)
+
+	tg = treegen.New()
+	treeSpec = tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537))))
+	dstpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(dstpath)
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	assert.T(t, err == nil)
+
+	patchPlan, err := NewPatchPlan(objects, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	//	printPlan(patchPlan)
+
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	dstRoot, errors := fs.IndexDir(dstpath, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, origRoot.Info().Strong, dstRoot.Info().Strong)
+}
+
+// Patch trees held entirely in memory.
+func TestPatchMemFs(t *testing.T) {
+	DoTestPatchMemFs(t, mkMemRepo)
+}
+
+func TestDbPatchMemFs(t *testing.T) {
+	DoTestPatchMemFs(t, mkDbRepo)
+}
+
+func DoTestPatchMemFs(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537), tg.B(43, 10000)),
+			tg.F("beth", tg.B(44, 1000))),
+		tg.F("baz", tg.B(45, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("aleph", tg.B(42, 65537)),
+		tg.F("baz", tg.B(46, 100), tg.B(45, 65537)),
+		tg.F("gimel", tg.B(47, 1000))))
+	defer os.RemoveAll(dstpath)
+
+	memFs := fs.NewMemFs()
+	fstest.CopyToFs(t, memFs, filepath.Join(srcpath, "foo"), "/src/foo")
+	fstest.CopyToFs(t, memFs, filepath.Join(dstpath, "foo"), "/dst/foo")
+
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStoreWith("/src/foo", srcRepo, fs.LocalOptions{FileSystem: memFs})
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStoreWith("/dst/foo", dstRepo, fs.LocalOptions{FileSystem: memFs})
+	assert.Tf(t, err == nil, "%v", err)
+
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	patchPlan.Clean(nil)
+
+	indexer := &fs.Indexer{Path: "/dst/foo", Repo: fs.NewMemRepo(), FileSystem: memFs}
+	dstRoot, err := indexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fstest.RootDir(t, srcRepo).Info().Strong, dstRoot.Info().Strong)
+
+	// The trees on disk are untouched
+	_, err = os.Stat(filepath.Join(dstpath, "foo", "gimel"))
+	assert.T(t, err == nil)
+}
+
+func TestPatchFromArchive(t *testing.T) {
+	DoTestPatchFromArchive(t, mkMemRepo)
+}
+
+func TestDbPatchFromArchive(t *testing.T) {
+	DoTestPatchFromArchive(t, mkDbRepo)
+}
+
+// Patch a directory on disk from a tarball of a newer tree.
+func DoTestPatchFromArchive(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537), tg.B(43, 10000)),
+			tg.F("beth", tg.B(44, 1000))),
+		tg.F("baz", tg.B(45, 65537))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("aleph", tg.B(42, 65537)),
+		tg.F("baz", tg.B(46, 100), tg.B(45, 65537)),
+		tg.F("gimel", tg.B(47, 1000))))
+	defer os.RemoveAll(dstpath)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.Tf(t, err == nil, "%v", err)
+	tarPath := filepath.Join(srcpath, "foo.tar")
+	tarFh, err := os.Create(tarPath)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, fs.ExportTar(srcStore, tarFh) == nil)
+	tarFh.Close()
+
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	archiveStore, err := fs.NewArchiveStore(tarPath, "", srcRepo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(filepath.Join(dstpath, "foo"), dstRepo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	patchPlan, err := NewPatchPlan(archiveStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	failedCmd, err := patchPlan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	patchPlan.Clean(nil)
+
+	indexer := &fs.Indexer{Path: filepath.Join(dstpath, "foo"), Repo: fs.NewMemRepo()}
+	dstRoot, err := indexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fstest.RootDir(t, srcRepo).Info().Strong, dstRoot.Info().Strong)
+	assert.Equal(t, fstest.RootDir(t, srcStore.Repo()).Info().Strong, dstRoot.Info().Strong)
+}
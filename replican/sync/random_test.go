@@ -0,0 +1,360 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"rand"
+	"strings"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+// Randomized tests of patching. Each case generates a source tree, and
+// derives a destination from it with a series of random mutations. Once
+// patched, the destination must be identical to the source. A failing
+// case is shrunk to the fewest mutations and the smallest source which
+// still fail, and reported as treegen expressions.
+
+const randomCases = 20
+const maxMutations = 6
+
+const (
+	mutEdit     = iota // Overwrite the end of part of a file
+	mutInsert          // Insert new content into a file
+	mutTruncate        // Cut off the end of a file
+	mutRename          // Rename an entry within its directory
+	mutMove            // Move an entry into another directory
+	mutSwap            // Replace a file with a directory, or the other way around
+	mutDelete          // Remove an entry
+	nMutations
+)
+
+var mutationNames = []string{"edit", "insert", "truncate", "rename", "move", "swap", "delete"}
+
+// A change to a generated tree. Its target is chosen by index among the
+// candidates in the tree, modulo their number, so that a mutation still
+// applies after others are dropped, or the tree is shrunk.
+type mutation struct {
+	op     int
+	target int
+	seed   int64
+}
+
+func (m *mutation) String() string {
+	return fmt.Sprintf("%s(target=%d, seed=%d)", mutationNames[m.op], m.target, m.seed)
+}
+
+// An entry in a generated tree, by its place in its directory,
+// and its path from the root.
+type specEntry struct {
+	parent *treegen.Dir
+	index  int
+	path   string
+}
+
+func (e *specEntry) node() treegen.Generated { return e.parent.Contents[e.index] }
+
+func (e *specEntry) remove() {
+	e.parent.Contents = append(e.parent.Contents[:e.index], e.parent.Contents[e.index+1:]...)
+}
+
+// List the entries beneath dir, depth first.
+func specEntries(dir *treegen.Dir) []*specEntry {
+	entries := []*specEntry{}
+	for i, g := range dir.Contents {
+		e := &specEntry{dir, i, specName(g)}
+		entries = append(entries, e)
+		if subdir, is := g.(*treegen.Dir); is {
+			for _, sub := range specEntries(subdir) {
+				sub.path = e.path + "/" + sub.path
+				entries = append(entries, sub)
+			}
+		}
+	}
+	return entries
+}
+
+// List the byte ranges of every file beneath dir, depth first.
+func specBytes(dir *treegen.Dir) []*treegen.Bytes {
+	result := []*treegen.Bytes{}
+	for _, e := range specEntries(dir) {
+		if file, is := e.node().(*treegen.File); is {
+			for _, g := range file.Contents {
+				result = append(result, g.(*treegen.Bytes))
+			}
+		}
+	}
+	return result
+}
+
+func specName(g treegen.Generated) string {
+	switch g := g.(type) {
+	case *treegen.Dir:
+		return g.Name
+	case *treegen.File:
+		return g.Name
+	}
+	return ""
+}
+
+// The treegen operation a mutation makes on the candidate it targets
+// in a tree, or nil if there is no candidate.
+func (m *mutation) operation(root *treegen.Dir) treegen.Op {
+	entries := specEntries(root)
+	files := []*specEntry{}
+	for _, e := range entries {
+		if _, is := e.node().(*treegen.File); is {
+			files = append(files, e)
+		}
+	}
+
+	switch m.op {
+	case mutEdit, mutInsert, mutTruncate:
+		if len(files) == 0 {
+			return nil
+		}
+		e := files[m.target%len(files)]
+		file := e.node().(*treegen.File)
+		n := len(file.Contents)
+
+		// The offset of the k'th range of bytes in the file
+		offset := func(k int) (result int64) {
+			for _, g := range file.Contents[:k] {
+				result += g.(*treegen.Bytes).Length
+			}
+			return result
+		}
+
+		switch {
+		case m.op == mutInsert:
+			k := int(m.seed % int64(n+1))
+			return &treegen.Insert{Path: e.path, Offset: offset(k),
+				Contents: []treegen.Generated{&treegen.Bytes{Seed: m.seed, Length: 1 + m.seed%500}}}
+		case n == 0:
+			return nil
+		case m.op == mutEdit:
+			k := int(m.seed % int64(n))
+			old := file.Contents[k].(*treegen.Bytes)
+			keep := old.Length / 2
+			return &treegen.Overwrite{Path: e.path, Offset: offset(k) + keep,
+				Contents: []treegen.Generated{&treegen.Bytes{Seed: m.seed, Length: old.Length - keep}}}
+		case m.op == mutTruncate:
+			k := int(m.seed % int64(n))
+			old := file.Contents[k].(*treegen.Bytes)
+			return &treegen.Truncate{Path: e.path, Length: offset(k) + old.Length/2}
+		}
+
+	default:
+		if len(entries) == 0 {
+			return nil
+		}
+		e := entries[m.target%len(entries)]
+
+		switch m.op {
+		case mutRename:
+			return &treegen.Rename{Path: e.path, Name: fmt.Sprintf("r%d", m.seed)}
+
+		case mutMove:
+			// Any directory but the entry itself, or one beneath it
+			dirs := []string{""}
+			for _, other := range entries {
+				if _, is := other.node().(*treegen.Dir); is &&
+					other.path != e.path && !strings.HasPrefix(other.path, e.path+"/") {
+					dirs = append(dirs, other.path)
+				}
+			}
+			return &treegen.Move{Path: e.path, Dir: dirs[int(m.seed%int64(len(dirs)))]}
+
+		case mutSwap:
+			switch e.node().(type) {
+			case *treegen.File:
+				return &treegen.Swap{Path: e.path, Contents: []treegen.Generated{&treegen.File{Name: "s",
+					Contents: []treegen.Generated{&treegen.Bytes{Seed: m.seed, Length: 100}}}}}
+			case *treegen.Dir:
+				return &treegen.Swap{Path: e.path,
+					Contents: []treegen.Generated{&treegen.Bytes{Seed: m.seed, Length: 1000}}}
+			}
+
+		case mutDelete:
+			return &treegen.Remove{Path: e.path}
+		}
+	}
+	return nil
+}
+
+// Derive a destination tree from a source, and list the operations
+// which derived it. A mutation whose operation fails, as when it would
+// collide with an existing name, changes nothing.
+func mutated(src *treegen.Dir, mutations []*mutation) (*treegen.Dir, []treegen.Op) {
+	dst := treegen.Copy(src).(*treegen.Dir)
+	ops := []treegen.Op{}
+	for _, m := range mutations {
+		op := m.operation(dst)
+		if op == nil {
+			continue
+		}
+		if next, err := treegen.Mutate(dst, op); err == nil {
+			dst = next.(*treegen.Dir)
+			ops = append(ops, op)
+		}
+	}
+	return dst, ops
+}
+
+func randomDir(rnd *rand.Rand, name string, depth int) *treegen.Dir {
+	dir := &treegen.Dir{Name: name}
+	for i := rnd.Intn(4) + 1; i > 0; i-- {
+		name := fmt.Sprintf("e%d", len(dir.Contents))
+		if depth > 0 && rnd.Intn(3) == 0 {
+			dir.Contents = append(dir.Contents, randomDir(rnd, name, depth-1))
+		} else {
+			dir.Contents = append(dir.Contents, randomFile(rnd, name))
+		}
+	}
+	return dir
+}
+
+// Files draw from only a few seeds, so content is often repeated
+// within and between them.
+func randomFile(rnd *rand.Rand, name string) *treegen.File {
+	file := &treegen.File{Name: name}
+	for i := rnd.Intn(4); i > 0; i-- {
+		file.Contents = append(file.Contents, &treegen.Bytes{
+			Seed:   int64(rnd.Intn(8)),
+			Length: int64(rnd.Intn(3 * fs.BLOCKSIZE))})
+	}
+	return file
+}
+
+// Mutations use seeds apart from those of the source, so their
+// content is new to it.
+func randomMutations(rnd *rand.Rand) []*mutation {
+	mutations := []*mutation{}
+	for i := rnd.Intn(maxMutations) + 1; i > 0; i-- {
+		mutations = append(mutations, &mutation{
+			op:     rnd.Intn(nMutations),
+			target: rnd.Intn(100),
+			seed:   1000 + rnd.Int63n(1000)})
+	}
+	return mutations
+}
+
+// Fabricate the source and mutated destination, patch the destination,
+// and report how it still differs from the source, if it does.
+func patchCase(t *testing.T, mkrepo repoMaker, src *treegen.Dir, mutations []*mutation) os.Error {
+	srcpath := treegen.TestTree(t, src)
+	defer os.RemoveAll(srcpath)
+	dst, _ := mutated(src, mutations)
+	dstpath := treegen.TestTree(t, dst)
+	defer os.RemoveAll(dstpath)
+
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	if err != nil {
+		return err
+	}
+
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	if err != nil {
+		return err
+	}
+
+	plan, err := NewPatchPlan(srcStore, dstStore)
+	if err != nil {
+		return err
+	}
+	if failedCmd, err := plan.Exec(); err != nil {
+		return os.NewError(fmt.Sprintf("%v: %v", failedCmd, err))
+	}
+
+	errors := make(chan os.Error)
+	go func() {
+		plan.Clean(errors)
+		plan.SetMode(errors)
+		plan.pruneDirs(errors)
+		close(errors)
+	}()
+	for planErr := range errors {
+		if err == nil {
+			err = planErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	report, err := Check(srcpath, dstpath)
+	if err != nil {
+		return err
+	} else if !report.Match() {
+		return os.NewError(fmt.Sprintf("Destination differs from source:\n%v", report))
+	}
+	return nil
+}
+
+// Shrink a failing case for as long as it still fails: drop mutations,
+// then entries of the source, then halve the lengths of its contents.
+func shrinkCase(t *testing.T, mkrepo repoMaker, src *treegen.Dir, mutations []*mutation) (*treegen.Dir, []*mutation, os.Error) {
+	err := patchCase(t, mkrepo, src, mutations)
+
+	for shrunk := true; shrunk; {
+		shrunk = false
+
+		for i := 0; i < len(mutations) && !shrunk; i++ {
+			fewer := append(append([]*mutation{}, mutations[:i]...), mutations[i+1:]...)
+			if caseErr := patchCase(t, mkrepo, src, fewer); caseErr != nil {
+				mutations, err, shrunk = fewer, caseErr, true
+			}
+		}
+
+		for i := 0; i < len(specEntries(src)) && !shrunk; i++ {
+			smaller := treegen.Copy(src).(*treegen.Dir)
+			specEntries(smaller)[i].remove()
+			if caseErr := patchCase(t, mkrepo, smaller, mutations); caseErr != nil {
+				src, err, shrunk = smaller, caseErr, true
+			}
+		}
+
+		for i := 0; i < len(specBytes(src)) && !shrunk; i++ {
+			smaller := treegen.Copy(src).(*treegen.Dir)
+			b := specBytes(smaller)[i]
+			if b.Length == 0 {
+				continue
+			}
+			b.Length /= 2
+			if caseErr := patchCase(t, mkrepo, smaller, mutations); caseErr != nil {
+				src, err, shrunk = smaller, caseErr, true
+			}
+		}
+	}
+
+	return src, mutations, err
+}
+
+func TestRandomPatch(t *testing.T) {
+	DoTestRandomPatch(t, mkMemRepo)
+}
+
+func TestDbRandomPatch(t *testing.T) {
+	DoTestRandomPatch(t, mkDbRepo)
+}
+
+func DoTestRandomPatch(t *testing.T, mkrepo repoMaker) {
+	for i := 0; i < randomCases; i++ {
+		rnd := rand.New(rand.NewSource(int64(i)))
+		src := randomDir(rnd, "foo", 2)
+		mutations := randomMutations(rnd)
+
+		if err := patchCase(t, mkrepo, src, mutations); err != nil {
+			src, mutations, err = shrinkCase(t, mkrepo, src, mutations)
+			dst, ops := mutated(src, mutations)
+			t.Errorf("Case %d: %v\nsource: %v\nmutations: %v\ndestination: %v",
+				i, err, src, ops, dst)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// A BlockStore presenting a different tree model of the same contents.
+type rerootedStore struct {
+	fs.BlockStore
+	repo fs.NodeRepo
+}
+
+func (store *rerootedStore) Repo() fs.NodeRepo { return store.repo }
+
+// Plan the restoration of a tree from src into the local path dst.
+//
+// If relpath is not empty, only the file or directory found at relpath in
+// src is restored, and dst takes its place. A single file restored into
+// an existing directory is placed within it. The dst directory is created
+// if it does not exist. Any content already in dst which matches the
+// source is reused.
+func Restore(src fs.BlockStore, relpath string, dst string) (*PatchPlan, os.Error) {
+	return RestoreWith(src, relpath, dst, fs.LocalOptions{})
+}
+
+// Plan a restoration like Restore, indexing and patching dst with the
+// given options.
+func RestoreWith(src fs.BlockStore, relpath string, dst string, options fs.LocalOptions) (*PatchPlan, os.Error) {
+	src, err := subtreeStore(src, relpath)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := src.Repo().Root()
+	if err != nil {
+		return nil, err
+	}
+
+	fileSys := options.FileSystem
+	if fileSys == nil {
+		fileSys = fs.OS
+	}
+
+	if _, isDir := root.(fs.Dir); isDir {
+		if err := fileSys.MkdirAll(dst, 0755); err != nil {
+			return nil, err
+		}
+	} else {
+		info, err := fileSys.Stat(dst)
+		if err == nil && info.IsDirectory() {
+			dst = filepath.Join(dst, root.Name())
+			_, err = fileSys.Stat(dst)
+		}
+
+		if err != nil {
+			if err = fileSys.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return nil, err
+			}
+
+			fh, err := fileSys.Create(dst)
+			if err != nil {
+				return nil, err
+			}
+			fh.Close()
+		}
+	}
+
+	dstStore, err := fs.NewLocalStoreWith(dst, fs.NewMemRepo(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPatchPlan(src, dstStore)
+}
+
+// Get a store of the file or directory found at relpath in src,
+// with that node as its root. If relpath is empty, src is the store.
+func subtreeStore(src fs.BlockStore, relpath string) (fs.BlockStore, os.Error) {
+	root, err := src.Repo().Root()
+	if err != nil {
+		return nil, err
+	} else if root == nil {
+		return nil, os.NewError("Source is empty")
+	}
+
+	if relpath == "" {
+		return src, nil
+	}
+
+	rootDir, isDir := root.(fs.Dir)
+	if !isDir {
+		return nil, os.NewError(fmt.Sprintf("Cannot find %s in a file", relpath))
+	}
+
+	node, found, err := fs.CheckedLookup(rootDir, relpath)
+	if err != nil {
+		return nil, err
+	} else if !found {
+		return nil, os.NewError(fmt.Sprintf("%s not found", relpath))
+	}
+
+	repo := fs.NewMemRepo()
+	if _, err = fs.CopyTree(node, repo); err != nil {
+		return nil, err
+	}
+	return &rerootedStore{BlockStore: src, repo: repo}, nil
+}
@@ -0,0 +1,122 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+func execRestore(t *testing.T, plan *PatchPlan) {
+	failedCmd, err := plan.Exec()
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+
+	errors := make(chan os.Error)
+	go func() {
+		plan.Clean(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		assert.Tf(t, err == nil, "%v", err)
+	}
+}
+
+// Test restoring whole snapshots and parts of them from an object store.
+func TestRestoreSnapshot(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("aleph", tg.B(42, 65537), tg.B(43, 10000)),
+			tg.F("beth", tg.B(44, 100))),
+		tg.F("baz", tg.B(45, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), fs.NewMemRepo())
+	assert.T(t, err == nil)
+	srcRoot := fstest.RootDir(t, srcStore.Repo())
+
+	backupRepo, err := sqlite3.NewDbRepo(":memory:")
+	assert.T(t, err == nil)
+	defer backupRepo.Close()
+
+	objpath, err := ioutil.TempDir("", "objects")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(objpath)
+	objects, err := fs.NewObjectStore(objpath, nil)
+	assert.T(t, err == nil)
+	defer objects.Close()
+
+	err = objects.Backup(srcStore)
+	assert.Tf(t, err == nil, "%v", err)
+	_, err = backupRepo.Snapshot("v1", srcRoot)
+	assert.Tf(t, err == nil, "%v", err)
+
+	os.RemoveAll(srcpath)
+
+	snapshot, err := backupRepo.OpenSnapshot("v1")
+	assert.Tf(t, err == nil, "%v", err)
+	snapStore := objects.WithRepo(snapshot)
+
+	// Restore everything into a new directory
+	dstpath, err := ioutil.TempDir("", "restore")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dstpath)
+
+	plan, err := Restore(snapStore, "", filepath.Join(dstpath, "all"))
+	assert.Tf(t, err == nil, "%v", err)
+	execRestore(t, plan)
+
+	dstRoot, errors := fs.IndexDir(filepath.Join(dstpath, "all"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcRoot.Info().Strong, dstRoot.Info().Strong)
+
+	// Restore a subdirectory over one with other contents
+	tg = treegen.New()
+	treeSpec = tg.D("sub",
+		tg.F("aleph", tg.B(42, 65537)),
+		tg.F("gimel", tg.B(46, 100)))
+	err = treegen.Fab(dstpath, treeSpec)
+	assert.Tf(t, err == nil, "%v", err)
+
+	plan, err = Restore(snapStore, "bar", filepath.Join(dstpath, "sub"))
+	assert.Tf(t, err == nil, "%v", err)
+	execRestore(t, plan)
+
+	srcBar, _ := fs.Lookup(srcRoot, "bar")
+	dstBar, errors := fs.IndexDir(filepath.Join(dstpath, "sub"), fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errors), "%v", errors)
+	assert.Equal(t, srcBar.(fs.Dir).Info().Strong, dstBar.Info().Strong)
+
+	// Restore a single file
+	plan, err = Restore(snapStore, filepath.Join("bar", "aleph"), filepath.Join(dstpath, "aleph"))
+	assert.Tf(t, err == nil, "%v", err)
+	execRestore(t, plan)
+
+	srcAleph, _ := fs.Lookup(srcRoot, filepath.Join("bar", "aleph"))
+	dstAleph, _, err := fs.IndexFile(filepath.Join(dstpath, "aleph"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, srcAleph.(fs.File).Info().Strong, dstAleph.Strong)
+
+	// Restore a single file into an existing directory
+	intopath := filepath.Join(dstpath, "into")
+	assert.T(t, os.Mkdir(intopath, 0755) == nil)
+	plan, err = Restore(snapStore, filepath.Join("bar", "beth"), intopath)
+	assert.Tf(t, err == nil, "%v", err)
+	execRestore(t, plan)
+
+	srcBeth, _ := fs.Lookup(srcRoot, filepath.Join("bar", "beth"))
+	dstBeth, _, err := fs.IndexFile(filepath.Join(intopath, "beth"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, srcBeth.(fs.File).Info().Strong, dstBeth.Strong)
+
+	_, err = Restore(snapStore, "nope", filepath.Join(dstpath, "nope"))
+	assert.T(t, err != nil)
+}
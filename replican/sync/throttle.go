@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"io"
+
+	"github.com/cmars/replican-sync/replican/fs"
+)
+
+// Limits on the rate a patch reads and writes data at. Reads are those
+// from the source store and from the destination files being reused, and
+// writes those to the destination. Either may be nil, for no limit.
+type IOLimits struct {
+	Read  *fs.Throttle
+	Write *fs.Throttle
+}
+
+// Limit the rate of reads from reader, if there are limits.
+func (limits *IOLimits) reader(reader io.Reader) io.Reader {
+	if limits == nil {
+		return reader
+	}
+	return limits.Read.Reader(reader)
+}
+
+// Limit the rate of writes to writer, if there are limits.
+func (limits *IOLimits) writer(writer io.Writer) io.Writer {
+	if limits == nil {
+		return writer
+	}
+	return limits.Write.Writer(writer)
+}
+
+// Limit the rate of writes to writer of data read from a source store,
+// counting them as both reads and writes.
+func (limits *IOLimits) srcWriter(writer io.Writer) io.Writer {
+	if limits == nil {
+		return writer
+	}
+	return limits.Read.Writer(limits.Write.Writer(writer))
+}
+
+// Limit the rate the plan reads and writes file contents at.
+func (plan *PatchPlan) Limit(limits *IOLimits) {
+	for _, cmd := range plan.Cmds {
+		switch cmd := cmd.(type) {
+		case *Transfer:
+			cmd.Limits = limits
+		case *LocalTempCopy:
+			cmd.Limits = limits
+		case *SrcTempCopy:
+			cmd.Limits = limits
+		case *SrcFileDownload:
+			cmd.Limits = limits
+		}
+	}
+}
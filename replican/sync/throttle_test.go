@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fstest"
+	"github.com/cmars/replican-sync/replican/treegen"
+)
+
+func TestPatchLimited(t *testing.T) {
+	DoTestPatchLimited(t, mkMemRepo)
+}
+
+func TestDbPatchLimited(t *testing.T) {
+	DoTestPatchLimited(t, mkDbRepo)
+}
+
+func DoTestPatchLimited(t *testing.T, mkrepo repoMaker) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 65537)),
+		tg.F("baz", tg.B(44, 65537)),
+		tg.D("quux",
+			tg.F("aleph", tg.B(45, 1000)))))
+	defer os.RemoveAll(srcpath)
+	dstpath := treegen.TestTree(t, tg.D("foo",
+		tg.F("bar", tg.B(42, 65537)),
+		tg.F("aleph", tg.B(45, 1000))))
+	defer os.RemoveAll(dstpath)
+
+	srcRepo := mkrepo(t)
+	defer srcRepo.Close()
+	srcStore, err := fs.NewLocalStore(filepath.Join(srcpath, "foo"), srcRepo)
+	assert.Tf(t, err == nil, "%v", err)
+
+	dstRepo := mkrepo(t)
+	defer dstRepo.Close()
+	dstStore, err := fs.NewLocalStoreWith(filepath.Join(dstpath, "foo"), dstRepo,
+		fs.LocalOptions{IndexLimit: fs.NewThrottle(10000000, 0)})
+	assert.Tf(t, err == nil, "%v", err)
+
+	// About 200k is written, at no more than 1M a second
+	limits := &IOLimits{Read: fs.NewThrottle(0, 1000), Write: fs.NewThrottle(1000000, 0)}
+	patchPlan, err := NewPatchPlan(srcStore, dstStore)
+	assert.Tf(t, err == nil, "%v", err)
+	patchPlan.Limit(limits)
+
+	start := time.Nanoseconds()
+	failedCmd, err := patchPlan.Exec()
+	elapsed := time.Nanoseconds() - start
+	assert.Tf(t, failedCmd == nil && err == nil, "%v: %v", failedCmd, err)
+	assert.Tf(t, elapsed >= 150e6, "%d ns", elapsed)
+	patchPlan.Clean(nil)
+
+	indexer := &fs.Indexer{Path: filepath.Join(dstpath, "foo"), Repo: fs.NewMemRepo()}
+	dstRoot, err := indexer.Index()
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, fstest.RootDir(t, srcRepo).Info().Strong, dstRoot.Info().Strong)
+}
@@ -0,0 +1,10 @@
+package sync
+
+import (
+	"os"
+)
+
+// Watching for changes requires inotify, which is only available on Linux.
+func (mirror *Mirror) Watch(quiet int64, latest int64, errors chan<- os.Error, stop <-chan bool) os.Error {
+	return os.NewError("Watching for changes is not supported on this platform")
+}
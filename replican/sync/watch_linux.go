@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"exp/inotify"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Events which indicate a change to the contents of a watched directory.
+const watchMask = inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_MODIFY |
+	inotify.IN_CLOSE_WRITE | inotify.IN_ATTRIB |
+	inotify.IN_MOVED_FROM | inotify.IN_MOVED_TO
+
+// Watch the source of a mirror for changes until stop receives a value,
+// or is closed.
+//
+// Changed paths are collected until quiet nanoseconds have passed without
+// any further changes, or latest nanoseconds have passed since the first
+// of them, and then updated in the mirror together. Errors in watching and
+// updating are sent to errors, if it is not nil, and do not stop the watch.
+func (mirror *Mirror) Watch(quiet int64, latest int64, errors chan<- os.Error, stop <-chan bool) os.Error {
+	watcher, err := inotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	report := func(err os.Error) {
+		if err != nil && errors != nil {
+			errors <- err
+		}
+	}
+
+	if err = mirror.watchTree(watcher, mirror.SrcPath()); err != nil {
+		return err
+	}
+
+	pending := make(map[string]bool)
+
+	// A single timer is outstanding while changes are pending. Timers
+	// cannot be reset, so rather than replacing it on each change, a new
+	// one is only started when it fires before the source has settled
+	// and before the update is overdue, for the time left until then.
+	var timer *time.Timer
+	var fired <-chan int64
+	var first, last int64
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	update := func() {
+		timer, fired = nil, nil
+
+		relpaths := []string{}
+		for relpath, _ := range pending {
+			relpaths = append(relpaths, relpath)
+		}
+		pending = make(map[string]bool)
+
+		report(mirror.Update(relpaths))
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case err := <-watcher.Error:
+			report(err)
+
+		case event := <-watcher.Event:
+			if event.Mask&inotify.IN_Q_OVERFLOW != 0 {
+				// Events were lost, so anything may have changed.
+				pending[""] = true
+			} else if event.Mask&watchMask != 0 {
+				if info, err := os.Lstat(event.Name); err == nil {
+					if !mirror.Match(event.Name, info) {
+						continue
+					}
+
+					// New directories need watching too
+					if info.IsDirectory() &&
+						event.Mask&(inotify.IN_CREATE|inotify.IN_MOVED_TO) != 0 {
+						report(mirror.watchTree(watcher, event.Name))
+					}
+				}
+
+				pending[mirror.RelPath(event.Name)] = true
+			} else {
+				continue
+			}
+
+			last = time.Nanoseconds()
+			if timer == nil {
+				first = last
+				timer = time.NewTimer(quiet)
+				fired = timer.C
+			}
+
+		case <-fired:
+			// A source which never goes quiet is still mirrored in time
+			due := last + quiet
+			if first+latest < due {
+				due = first + latest
+			}
+			if now := time.Nanoseconds(); now < due {
+				timer = time.NewTimer(due - now)
+				fired = timer.C
+			} else {
+				update()
+			}
+		}
+	}
+	panic("Impossible")
+}
+
+// Add watches on a directory and every directory beneath it.
+func (mirror *Mirror) watchTree(watcher *inotify.Watcher, path string) (err os.Error) {
+	errors := make(chan os.Error)
+	go func() {
+		filepath.Walk(path, &dirWatcher{mirror: mirror, watcher: watcher, errors: errors}, errors)
+		close(errors)
+	}()
+
+	// Report the first error, after the walk has finished
+	for walkErr := range errors {
+		if err == nil {
+			err = walkErr
+		}
+	}
+	return err
+}
+
+// A filepath.Visitor which adds watches on directories.
+type dirWatcher struct {
+	mirror  *Mirror
+	watcher *inotify.Watcher
+	errors  chan<- os.Error
+}
+
+func (dw *dirWatcher) VisitDir(path string, f *os.FileInfo) bool {
+	if !dw.mirror.Match(path, f) {
+		return false
+	}
+
+	if err := dw.watcher.AddWatch(path, watchMask); err != nil {
+		dw.errors <- err
+	}
+	return true
+}
+
+func (dw *dirWatcher) VisitFile(path string, f *os.FileInfo) {}
@@ -0,0 +1,130 @@
+package sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/treegen"
+
+	"github.com/bmizerany/assert"
+)
+
+// Test that changes to a watched source reach the destination.
+func TestWatch(t *testing.T) {
+	tg := treegen.New()
+	treeSpec := tg.D("foo",
+		tg.D("bar",
+			tg.F("A", tg.B(42, 65537))),
+		tg.F("C", tg.B(44, 65537)))
+	srcpath := treegen.TestTree(t, treeSpec)
+	defer os.RemoveAll(srcpath)
+
+	dstpath, err := ioutil.TempDir("", "mirror")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dstpath)
+
+	repo := mkDbRepo(t)
+	defer repo.Close()
+
+	mirror, err := NewMirror(filepath.Join(srcpath, "foo"), dstpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	err = mirror.Sync()
+	assert.Tf(t, err == nil, "%v", err)
+
+	errors := make(chan os.Error, 10)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		err := mirror.Watch(50*1000*1000, 5000*1000*1000, errors, stop)
+		assert.Tf(t, err == nil, "%v", err)
+		close(done)
+	}()
+
+	// Give the watches a moment to be placed
+	time.Sleep(200 * 1000 * 1000)
+
+	foo := mirror.SrcPath()
+	err = ioutil.WriteFile(filepath.Join(foo, "bar", "A"), []byte("changed"), 0644)
+	assert.T(t, err == nil)
+	err = os.Mkdir(filepath.Join(foo, "new"), 0755)
+	assert.T(t, err == nil)
+	time.Sleep(100 * 1000 * 1000)
+	err = ioutil.WriteFile(filepath.Join(foo, "new", "N"), []byte("new"), 0644)
+	assert.T(t, err == nil)
+
+	srcDir, errs := fs.IndexDir(foo, fs.NewMemRepo())
+	assert.Equalf(t, 0, len(errs), "%v", errs)
+
+	mirrored := false
+	for i := 0; i < 50 && !mirrored; i++ {
+		time.Sleep(100 * 1000 * 1000)
+		dstDir, _ := fs.IndexDir(dstpath, fs.NewMemRepo())
+		mirrored = dstDir != nil && dstDir.Info().Strong == srcDir.Info().Strong
+	}
+
+	stop <- true
+	<-done
+
+	close(errors)
+	for err := range errors {
+		t.Errorf("%v", err)
+	}
+	assert.T(t, mirrored)
+}
+
+// Test that a source which keeps changing is still mirrored, once the
+// first change has waited long enough.
+func TestWatchLatest(t *testing.T) {
+	tg := treegen.New()
+	srcpath := treegen.TestTree(t, tg.D("foo", tg.F("C", tg.B(44, 100))))
+	defer os.RemoveAll(srcpath)
+
+	dstpath, err := ioutil.TempDir("", "mirror")
+	assert.T(t, err == nil)
+	defer os.RemoveAll(dstpath)
+
+	repo := mkDbRepo(t)
+	defer repo.Close()
+
+	mirror, err := NewMirror(filepath.Join(srcpath, "foo"), dstpath, repo)
+	assert.Tf(t, err == nil, "%v", err)
+	err = mirror.Sync()
+	assert.Tf(t, err == nil, "%v", err)
+
+	errors := make(chan os.Error, 10)
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		// Never quiet for long enough, but at most 300ms late
+		err := mirror.Watch(1000*1000*1000, 300*1000*1000, errors, stop)
+		assert.Tf(t, err == nil, "%v", err)
+		close(done)
+	}()
+
+	time.Sleep(200 * 1000 * 1000)
+
+	// Keep changing the source more often than it can go quiet
+	mirrored := false
+	srcC := filepath.Join(mirror.SrcPath(), "C")
+	for i := 0; i < 100 && !mirrored; i++ {
+		err = ioutil.WriteFile(srcC, []byte("changed"), 0644)
+		assert.T(t, err == nil)
+		time.Sleep(20 * 1000 * 1000)
+
+		data, _ := ioutil.ReadFile(filepath.Join(dstpath, "C"))
+		mirrored = string(data) == "changed"
+	}
+
+	stop <- true
+	<-done
+
+	close(errors)
+	for err := range errors {
+		t.Errorf("%v", err)
+	}
+	assert.T(t, mirrored)
+}
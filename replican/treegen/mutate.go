@@ -0,0 +1,489 @@
+package treegen
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A change to a generated tree. Entries are addressed by slash-separated
+// paths relative to the root, and file contents by byte offset. Content
+// introduced by an operation is itself generated, so a mutated tree is
+// as reproducible as the one it came from.
+type Op interface {
+	apply(root Generated) (Generated, os.Error)
+	String() string
+}
+
+// Insert contents into a file at Offset.
+type Insert struct {
+	Path     string
+	Offset   int64
+	Contents []Generated
+}
+
+// Remove Length bytes from a file at Offset.
+type Cut struct {
+	Path   string
+	Offset int64
+	Length int64
+}
+
+// Overwrite a file with contents at Offset, extending it if need be.
+type Overwrite struct {
+	Path     string
+	Offset   int64
+	Contents []Generated
+}
+
+// Cut off a file at Length.
+type Truncate struct {
+	Path   string
+	Length int64
+}
+
+// Rename an entry within its directory.
+type Rename struct {
+	Path string
+	Name string
+}
+
+// Move an entry into the directory at Dir.
+type Move struct {
+	Path string
+	Dir  string
+}
+
+// Replace a file with a directory of the same name holding Contents,
+// or a directory with a file of Contents.
+type Swap struct {
+	Path     string
+	Contents []Generated
+}
+
+// Set the permission bits of an entry.
+type Chmod struct {
+	Path string
+	Perm uint32
+}
+
+// Remove an entry.
+type Remove struct {
+	Path string
+}
+
+// Apply operations in order to a copy of a generated tree.
+func Mutate(g Generated, ops ...Op) (Generated, os.Error) {
+	g = Copy(g)
+	for _, op := range ops {
+		var err os.Error
+		if g, err = op.apply(g); err != nil {
+			return nil, os.NewError(fmt.Sprintf("%v: %v", op, err))
+		}
+	}
+	return g, nil
+}
+
+// Make a deep copy of a generated tree.
+func Copy(g Generated) Generated {
+	switch g := g.(type) {
+	case *Dir:
+		return &Dir{Name: g.Name, Contents: copyContents(g.Contents)}
+	case *File:
+		return &File{Name: g.Name, Contents: copyContents(g.Contents)}
+	case *Bytes:
+		return &Bytes{Seed: g.Seed, Length: g.Length, Offset: g.Offset}
+	case *Sum:
+		return &Sum{Strong: g.Strong, Length: g.Length}
+	case *Symlink:
+		return &Symlink{Name: g.Name, Target: g.Target}
+	case *HardLink:
+		return &HardLink{Name: g.Name, Target: g.Target}
+	case *Mode:
+		return &Mode{Perm: g.Perm}
+	case *Mtime:
+		return &Mtime{Seconds: g.Seconds}
+	case *Hole:
+		return &Hole{Length: g.Length}
+	case *Repeat:
+		return &Repeat{Count: g.Count, Contents: copyContents(g.Contents)}
+	}
+	panic(fmt.Sprintf("WTF is this: %v?", g))
+}
+
+func copyContents(contents []Generated) []Generated {
+	result := make([]Generated, len(contents))
+	for i, g := range contents {
+		result[i] = Copy(g)
+	}
+	return result
+}
+
+func (op *Insert) String() string {
+	return fmt.Sprintf("Insert(%q, %d%s)", op.Path, op.Offset, contentsString(op.Contents))
+}
+
+func (op *Cut) String() string {
+	return fmt.Sprintf("Cut(%q, %d, %d)", op.Path, op.Offset, op.Length)
+}
+
+func (op *Overwrite) String() string {
+	return fmt.Sprintf("Overwrite(%q, %d%s)", op.Path, op.Offset, contentsString(op.Contents))
+}
+
+func (op *Truncate) String() string {
+	return fmt.Sprintf("Truncate(%q, %d)", op.Path, op.Length)
+}
+
+func (op *Rename) String() string {
+	return fmt.Sprintf("Rename(%q, %q)", op.Path, op.Name)
+}
+
+func (op *Move) String() string {
+	return fmt.Sprintf("Move(%q, %q)", op.Path, op.Dir)
+}
+
+func (op *Swap) String() string {
+	return fmt.Sprintf("Swap(%q%s)", op.Path, contentsString(op.Contents))
+}
+
+func (op *Chmod) String() string {
+	return fmt.Sprintf("Chmod(%q, 0%o)", op.Path, op.Perm)
+}
+
+func (op *Remove) String() string {
+	return fmt.Sprintf("Remove(%q)", op.Path)
+}
+
+// Where an entry is in a tree. The root has no parent.
+type location struct {
+	parent *Dir
+	index  int
+	node   Generated
+}
+
+func (loc *location) replace(root Generated, g Generated) Generated {
+	if loc.parent == nil {
+		return g
+	}
+	loc.parent.Contents[loc.index] = g
+	return root
+}
+
+func locate(root Generated, path string) (*location, os.Error) {
+	loc := &location{node: root}
+	if path == "" {
+		return loc, nil
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		dir, isDir := loc.node.(*Dir)
+		if !isDir {
+			return nil, os.NewError(fmt.Sprintf("%s not found", path))
+		}
+
+		loc = &location{parent: dir, index: -1}
+		for i, g := range dir.Contents {
+			if entryName(g) == name {
+				loc.index, loc.node = i, g
+				break
+			}
+		}
+		if loc.index < 0 {
+			return nil, os.NewError(fmt.Sprintf("%s not found", path))
+		}
+	}
+	return loc, nil
+}
+
+func locateFile(root Generated, path string) (*File, os.Error) {
+	loc, err := locate(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if file, isFile := loc.node.(*File); isFile {
+		return file, nil
+	}
+	return nil, os.NewError(fmt.Sprintf("%s is not a file", path))
+}
+
+func locateDir(root Generated, path string) (*Dir, os.Error) {
+	loc, err := locate(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if dir, isDir := loc.node.(*Dir); isDir {
+		return dir, nil
+	}
+	return nil, os.NewError(fmt.Sprintf("%s is not a directory", path))
+}
+
+func hasEntry(dir *Dir, name string) bool {
+	for _, g := range dir.Contents {
+		if entryName(g) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// The number of bytes contents generate.
+func contentsLength(contents []Generated) (length int64) {
+	for _, g := range contents {
+		switch g := g.(type) {
+		case *Bytes:
+			length += g.Length
+		case *Sum:
+			length += g.Length
+		case *Hole:
+			length += g.Length
+		case *Repeat:
+			length += g.Count * contentsLength(g.Contents)
+		}
+	}
+	return length
+}
+
+// Split file contents at an offset, leaving out their attributes.
+// Ranges of bytes and holes are split in two, and repeats are
+// expanded when the offset falls within them.
+func splitContents(contents []Generated, offset int64) (before []Generated, after []Generated, err os.Error) {
+	for i, g := range contents {
+		if offset == 0 {
+			for _, rest := range contents[i:] {
+				switch rest.(type) {
+				case *Mode, *Mtime:
+				default:
+					after = append(after, rest)
+				}
+			}
+			return before, after, nil
+		}
+
+		switch g := g.(type) {
+		case *Mode, *Mtime:
+			continue
+
+		case *Bytes:
+			if offset < g.Length {
+				before = append(before, &Bytes{Seed: g.Seed, Length: offset, Offset: g.Offset})
+				contents = append([]Generated{&Bytes{Seed: g.Seed,
+					Length: g.Length - offset, Offset: g.Offset + offset}}, contents[i+1:]...)
+				after, err = appendContents(after, contents)
+				return before, after, err
+			}
+			offset -= g.Length
+
+		case *Hole:
+			if offset < g.Length {
+				before = append(before, &Hole{Length: offset})
+				contents = append([]Generated{&Hole{Length: g.Length - offset}}, contents[i+1:]...)
+				after, err = appendContents(after, contents)
+				return before, after, err
+			}
+			offset -= g.Length
+
+		case *Repeat:
+			length := g.Count * contentsLength(g.Contents)
+			if offset < length {
+				expanded := []Generated{}
+				for j := int64(0); j < g.Count; j++ {
+					expanded = append(expanded, copyContents(g.Contents)...)
+				}
+				head, tail, err := splitContents(expanded, offset)
+				if err != nil {
+					return nil, nil, err
+				}
+				before = append(before, head...)
+				after, err = appendContents(tail, contents[i+1:])
+				return before, after, err
+			}
+			offset -= length
+
+		default:
+			return nil, nil, os.NewError(fmt.Sprintf("Cannot split %v", g))
+		}
+		before = append(before, g)
+	}
+
+	if offset > 0 {
+		return nil, nil, os.NewError("Offset is past the end of the file")
+	}
+	return before, after, nil
+}
+
+// Append contents, leaving out their attributes.
+func appendContents(result []Generated, contents []Generated) ([]Generated, os.Error) {
+	_, rest, err := splitContents(contents, 0)
+	return append(result, rest...), err
+}
+
+// The attributes among file or directory contents.
+func attrs(contents []Generated) []Generated {
+	result := []Generated{}
+	for _, g := range contents {
+		switch g.(type) {
+		case *Mode, *Mtime:
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+// Replace the byte range of a file from offset to end with contents.
+// An end of -1 replaces everything after offset.
+func (file *File) splice(offset int64, end int64, contents []Generated) os.Error {
+	before, after, err := splitContents(file.Contents, offset)
+	if err != nil {
+		return err
+	}
+
+	if end < 0 {
+		after = nil
+	} else if length := contentsLength(after); end-offset >= length {
+		after = nil
+	} else if _, after, err = splitContents(after, end-offset); err != nil {
+		return err
+	}
+
+	result := append(before, copyContents(contents)...)
+	result = append(result, after...)
+	file.Contents = append(result, attrs(file.Contents)...)
+	return nil
+}
+
+func (op *Insert) apply(root Generated) (Generated, os.Error) {
+	file, err := locateFile(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	return root, file.splice(op.Offset, op.Offset, op.Contents)
+}
+
+func (op *Cut) apply(root Generated) (Generated, os.Error) {
+	file, err := locateFile(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if op.Offset+op.Length > contentsLength(file.Contents) {
+		return nil, os.NewError("Range is past the end of the file")
+	}
+	return root, file.splice(op.Offset, op.Offset+op.Length, nil)
+}
+
+func (op *Overwrite) apply(root Generated) (Generated, os.Error) {
+	file, err := locateFile(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	return root, file.splice(op.Offset, op.Offset+contentsLength(op.Contents), op.Contents)
+}
+
+func (op *Truncate) apply(root Generated) (Generated, os.Error) {
+	file, err := locateFile(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	return root, file.splice(op.Length, -1, nil)
+}
+
+func (op *Rename) apply(root Generated) (Generated, os.Error) {
+	loc, err := locate(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if loc.parent != nil && hasEntry(loc.parent, op.Name) {
+		return nil, os.NewError(fmt.Sprintf("%s already exists", op.Name))
+	}
+
+	switch node := loc.node.(type) {
+	case *Dir:
+		node.Name = op.Name
+	case *File:
+		node.Name = op.Name
+	case *Symlink:
+		node.Name = op.Name
+	case *HardLink:
+		node.Name = op.Name
+	}
+	return root, nil
+}
+
+func (op *Move) apply(root Generated) (Generated, os.Error) {
+	loc, err := locate(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if loc.parent == nil {
+		return nil, os.NewError("Cannot move the root")
+	}
+	if op.Dir == op.Path || strings.HasPrefix(op.Dir, op.Path+"/") {
+		return nil, os.NewError("Cannot move a directory beneath itself")
+	}
+
+	dir, err := locateDir(root, op.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if hasEntry(dir, entryName(loc.node)) {
+		return nil, os.NewError(fmt.Sprintf("%s already exists in %s", entryName(loc.node), op.Dir))
+	}
+
+	loc.parent.Contents = append(loc.parent.Contents[:loc.index], loc.parent.Contents[loc.index+1:]...)
+	dir.Contents = append(dir.Contents, loc.node)
+	return root, nil
+}
+
+func (op *Swap) apply(root Generated) (Generated, os.Error) {
+	loc, err := locate(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := loc.node.(type) {
+	case *File:
+		return loc.replace(root, &Dir{Name: node.Name, Contents: copyContents(op.Contents)}), nil
+	case *Dir:
+		return loc.replace(root, &File{Name: node.Name, Contents: copyContents(op.Contents)}), nil
+	}
+	return nil, os.NewError(fmt.Sprintf("Cannot swap %v", loc.node))
+}
+
+func (op *Chmod) apply(root Generated) (Generated, os.Error) {
+	loc, err := locate(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents *[]Generated
+	switch node := loc.node.(type) {
+	case *Dir:
+		contents = &node.Contents
+	case *File:
+		contents = &node.Contents
+	default:
+		return nil, os.NewError(fmt.Sprintf("Cannot chmod %v", loc.node))
+	}
+
+	result := []Generated{}
+	for _, g := range *contents {
+		if _, isMode := g.(*Mode); !isMode {
+			result = append(result, g)
+		}
+	}
+	*contents = append(result, &Mode{Perm: op.Perm})
+	return root, nil
+}
+
+func (op *Remove) apply(root Generated) (Generated, os.Error) {
+	loc, err := locate(root, op.Path)
+	if err != nil {
+		return nil, err
+	}
+	if loc.parent == nil {
+		return nil, os.NewError("Cannot remove the root")
+	}
+
+	loc.parent.Contents = append(loc.parent.Contents[:loc.index], loc.parent.Contents[loc.index+1:]...)
+	return root, nil
+}
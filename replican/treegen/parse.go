@@ -0,0 +1,312 @@
+package treegen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// Parse a tree from its DSL expression, such as
+//
+//	D("foo", F("bar", B(42, 65537)))
+//
+// Whitespace is insignificant, and // begins a comment running to the
+// end of the line. As with D and F, empty names are randomly generated.
+func (treeGen *TreeGen) Parse(text string) (Generated, os.Error) {
+	p := &parser{treeGen: treeGen, text: text}
+	g, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpace(); p.pos < len(p.text) {
+		return nil, p.errorf("Unexpected %q after expression", p.text[p.pos])
+	}
+	return g, nil
+}
+
+// Parse a tree from a file holding its DSL expression.
+func (treeGen *TreeGen) ParseFile(path string) (Generated, os.Error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g, err := treeGen.Parse(string(text))
+	if err != nil {
+		return nil, os.NewError(fmt.Sprintf("%s: %v", path, err))
+	}
+	return g, nil
+}
+
+type parser struct {
+	treeGen *TreeGen
+	text    string
+	pos     int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) os.Error {
+	line, col := 1, 1
+	for _, c := range p.text[:p.pos] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return os.NewError(fmt.Sprintf("%d:%d: %s", line, col, fmt.Sprintf(format, args...)))
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		case c == '/' && p.pos+1 < len(p.text) && p.text[p.pos+1] == '/':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Test whether the next token is c, and consume it if it is.
+func (p *parser) accept(c byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.text) && p.text[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(c byte) os.Error {
+	if !p.accept(c) {
+		if p.pos < len(p.text) {
+			return p.errorf("Expected %q, found %q", c, p.text[p.pos])
+		}
+		return p.errorf("Expected %q, found end of input", c)
+	}
+	return nil
+}
+
+func (p *parser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.text) && ('A' <= p.text[p.pos] && p.text[p.pos] <= 'Z' ||
+		'a' <= p.text[p.pos] && p.text[p.pos] <= 'z') {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// A double-quoted Go string literal.
+func (p *parser) str() (string, os.Error) {
+	if err := p.expect('"'); err != nil {
+		return "", err
+	}
+
+	start := p.pos - 1
+	for ; p.pos < len(p.text) && p.text[p.pos] != '"'; p.pos++ {
+		if p.text[p.pos] == '\\' {
+			p.pos++
+		}
+	}
+	if p.pos >= len(p.text) {
+		return "", p.errorf("Unterminated string")
+	}
+	p.pos++
+
+	s, err := strconv.Unquote(p.text[start:p.pos])
+	if err != nil {
+		return "", p.errorf("Bad string %s: %v", p.text[start:p.pos], err)
+	}
+	return s, nil
+}
+
+// An integer in any of the bases Go allows, so that modes may be octal.
+func (p *parser) integer() (int64, os.Error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.text) && p.text[p.pos] == '-' {
+		p.pos++
+	}
+	for p.pos < len(p.text) && ('0' <= p.text[p.pos] && p.text[p.pos] <= '9' ||
+		'a' <= p.text[p.pos] && p.text[p.pos] <= 'f' ||
+		'A' <= p.text[p.pos] && p.text[p.pos] <= 'F' ||
+		p.text[p.pos] == 'x' || p.text[p.pos] == 'X') {
+		p.pos++
+	}
+
+	n, err := strconv.Btoi64(p.text[start:p.pos], 0)
+	if err != nil {
+		p.pos = start
+		return 0, p.errorf("Expected an integer")
+	}
+	return n, nil
+}
+
+// The name and contents of a directory or file.
+func (p *parser) entry() (string, []Generated, os.Error) {
+	name, err := p.str()
+	if err != nil {
+		return "", nil, err
+	}
+
+	contents := []Generated{}
+	for p.accept(',') {
+		// Allow a trailing comma
+		if p.skipSpace(); p.pos < len(p.text) && p.text[p.pos] == ')' {
+			break
+		}
+
+		g, err := p.expr()
+		if err != nil {
+			return "", nil, err
+		}
+		contents = append(contents, g)
+	}
+	return name, contents, nil
+}
+
+func (p *parser) expr() (g Generated, err os.Error) {
+	start := p.pos
+	kind := p.ident()
+	if err = p.expect('('); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case "D":
+		name, contents, err := p.entry()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contents {
+			switch c.(type) {
+			case *Dir, *File, *Symlink, *HardLink, *Mode, *Mtime:
+			default:
+				return nil, p.errorf("A directory cannot contain %v", c)
+			}
+		}
+		g = p.treeGen.D(name, contents...)
+
+	case "F":
+		name, contents, err := p.entry()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contents {
+			switch c.(type) {
+			case *Bytes, *Sum, *Hole, *Repeat, *Mode, *Mtime:
+			default:
+				return nil, p.errorf("A file cannot contain %v", c)
+			}
+		}
+		g = p.treeGen.F(name, contents...)
+
+	case "B":
+		seed, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(','); err != nil {
+			return nil, err
+		}
+		length, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		b := p.treeGen.B(seed, length)
+		if p.accept(',') {
+			if b.Offset, err = p.integer(); err != nil {
+				return nil, err
+			}
+		}
+		g = b
+
+	case "S":
+		strong, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(','); err != nil {
+			return nil, err
+		}
+		length, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		g = p.treeGen.S(strong, length)
+
+	case "L", "H":
+		name, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(','); err != nil {
+			return nil, err
+		}
+		target, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if kind == "L" {
+			g = p.treeGen.L(name, target)
+		} else {
+			g = p.treeGen.H(name, target)
+		}
+
+	case "M", "T", "Z":
+		n, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "M":
+			g = p.treeGen.M(uint32(n))
+		case "T":
+			g = p.treeGen.T(n)
+		case "Z":
+			g = p.treeGen.Z(n)
+		}
+
+	case "R":
+		count, err := p.integer()
+		if err != nil {
+			return nil, err
+		}
+		contents := []Generated{}
+		for p.accept(',') {
+			if p.skipSpace(); p.pos < len(p.text) && p.text[p.pos] == ')' {
+				break
+			}
+
+			c, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			switch c.(type) {
+			case *Bytes, *Hole, *Repeat:
+			default:
+				return nil, p.errorf("Cannot repeat %v", c)
+			}
+			contents = append(contents, c)
+		}
+		g = p.treeGen.R(count, contents...)
+
+	default:
+		p.pos = start
+		p.skipSpace()
+		return nil, p.errorf("Expected D, F, B, S, L, H, M, T, Z or R, found %q", kind)
+	}
+
+	if err = p.expect(')'); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
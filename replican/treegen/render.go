@@ -0,0 +1,339 @@
+package treegen
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// Render an existing file or directory as a DSL expression. Entries are
+// listed by name, and file contents are given by their checksums.
+// Hard links are rendered as the files they link to, and permission
+// bits and mtimes are not rendered.
+func Render(path string) (Generated, os.Error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	_, name := filepath.Split(filepath.Clean(path))
+
+	switch {
+	case info.IsDirectory():
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		dir := &Dir{Name: name}
+		for _, entry := range entries {
+			g, err := Render(filepath.Join(path, entry.Name))
+			if err != nil {
+				return nil, err
+			}
+			dir.Contents = append(dir.Contents, g)
+		}
+		return dir, nil
+
+	case info.IsRegular():
+		sum, err := fileSum(path)
+		if err != nil {
+			return nil, err
+		}
+		return &File{Name: name, Contents: []Generated{sum}}, nil
+
+	case info.IsSymlink():
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return &Symlink{Name: name, Target: target}, nil
+	}
+
+	return nil, os.NewError(fmt.Sprintf("Cannot render %s", path))
+}
+
+// Reduce a generated tree to the form Render gives the tree it makes,
+// so that the two can be compared. Hard links can only be digested when
+// their targets are in the same directory or below it.
+func Digest(g Generated) (Generated, os.Error) {
+	switch g := g.(type) {
+	case *Dir:
+		dir := &Dir{Name: g.Name}
+		for _, entry := range g.Contents {
+			switch entry := entry.(type) {
+			case *Mode, *Mtime:
+				continue
+			case *HardLink:
+				target, err := linkTarget(dir, entry)
+				if err != nil {
+					return nil, err
+				}
+				dir.Contents = append(dir.Contents,
+					&File{Name: entry.Name, Contents: target.Contents})
+				continue
+			}
+
+			digested, err := Digest(entry)
+			if err != nil {
+				return nil, err
+			}
+			dir.Contents = append(dir.Contents, digested)
+		}
+		sort.Sort(byName(dir.Contents))
+		return dir, nil
+
+	case *Symlink:
+		return &Symlink{Name: g.Name, Target: g.Target}, nil
+
+	case *File:
+		if len(g.Contents) == 1 {
+			if sum, isSum := g.Contents[0].(*Sum); isSum {
+				return &File{Name: g.Name, Contents: []Generated{sum}}, nil
+			}
+		}
+
+		h := sha1.New()
+		length, err := writeContents(h, g.Contents)
+		if err != nil {
+			return nil, os.NewError(fmt.Sprintf("Cannot digest the contents of %s: %v", g.Name, err))
+		}
+		return &File{Name: g.Name, Contents: []Generated{&Sum{Strong: hexSum(h), Length: length}}}, nil
+	}
+
+	return nil, os.NewError(fmt.Sprintf("Cannot digest %v", g))
+}
+
+// Write the bytes that file contents would be fabricated with.
+func writeContents(w io.Writer, contents []Generated) (length int64, err os.Error) {
+	for _, g := range contents {
+		switch g := g.(type) {
+		case *Bytes:
+			if err = g.write(w); err != nil {
+				return length, err
+			}
+			length += g.Length
+
+		case *Hole:
+			zeros := make([]byte, CHUNKSIZE)
+			for toWrite := g.Length; toWrite > 0; toWrite -= int64(len(zeros)) {
+				if toWrite < int64(len(zeros)) {
+					zeros = zeros[:toWrite]
+				}
+				if _, err = w.Write(zeros); err != nil {
+					return length, err
+				}
+			}
+			length += g.Length
+
+		case *Repeat:
+			for i := int64(0); i < g.Count; i++ {
+				n, err := writeContents(w, g.Contents)
+				if err != nil {
+					return length, err
+				}
+				length += n
+			}
+
+		case *Mode, *Mtime:
+
+		default:
+			return length, os.NewError(fmt.Sprintf("%v has no bytes", g))
+		}
+	}
+	return length, nil
+}
+
+// Find the digested file a hard link refers to, among the entries of
+// its directory digested so far.
+func linkTarget(dir *Dir, link *HardLink) (*File, os.Error) {
+	var entry Generated = dir
+	for _, name := range strings.Split(filepath.Clean(link.Target), string(filepath.Separator)) {
+		d, isD := entry.(*Dir)
+		if !isD {
+			entry = nil
+			break
+		}
+
+		entry = nil
+		for _, child := range d.Contents {
+			if entryName(child) == name {
+				entry = child
+				break
+			}
+		}
+	}
+
+	if f, isF := entry.(*File); isF {
+		return f, nil
+	}
+	return nil, os.NewError(fmt.Sprintf("Cannot digest %v, its target is not a file before it", link))
+}
+
+// Sort directory entries by name.
+type byName []Generated
+
+func (entries byName) Len() int { return len(entries) }
+
+func (entries byName) Less(i, j int) bool { return entryName(entries[i]) < entryName(entries[j]) }
+
+func (entries byName) Swap(i, j int) { entries[i], entries[j] = entries[j], entries[i] }
+
+func entryName(g Generated) string {
+	switch g := g.(type) {
+	case *Dir:
+		return g.Name
+	case *File:
+		return g.Name
+	case *Symlink:
+		return g.Name
+	case *HardLink:
+		return g.Name
+	}
+	return ""
+}
+
+func hexSum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum())
+}
+
+func fileSum(path string) (*Sum, os.Error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	h := sha1.New()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return nil, err
+	}
+	return &Sum{Strong: hexSum(h), Length: n}, nil
+}
+
+// Compare the trees at two paths by the names, types and permissions of
+// their entries, and the contents of their files. Each difference found
+// is described by a line, relative to the roots of the trees.
+func DiffTrees(expect string, actual string) ([]string, os.Error) {
+	diffs := []string{}
+	err := diffTrees(expect, actual, "", &diffs)
+	return diffs, err
+}
+
+func diffTrees(expect string, actual string, relpath string, diffs *[]string) os.Error {
+	difference := func(format string, args ...interface{}) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: %s", relpath, fmt.Sprintf(format, args...)))
+	}
+	if relpath == "" {
+		relpath = "."
+	}
+
+	expectInfo, err := os.Lstat(expect)
+	if err != nil {
+		return err
+	}
+	actualInfo, err := os.Lstat(actual)
+	if err != nil {
+		return err
+	}
+
+	if kindOf(expectInfo) != kindOf(actualInfo) {
+		difference("expected %s, found %s", kindOf(expectInfo), kindOf(actualInfo))
+		return nil
+	}
+
+	// Links are compared by their targets, rather than what they link to
+	if expectInfo.IsSymlink() {
+		expectTarget, err := os.Readlink(expect)
+		if err != nil {
+			return err
+		}
+		actualTarget, err := os.Readlink(actual)
+		if err != nil {
+			return err
+		}
+		if expectTarget != actualTarget {
+			difference("expected a link to %q, found a link to %q", expectTarget, actualTarget)
+		}
+		return nil
+	}
+
+	if expectMode, actualMode := expectInfo.Mode&07777, actualInfo.Mode&07777; expectMode != actualMode {
+		difference("expected mode %o, found %o", expectMode, actualMode)
+	}
+
+	if !expectInfo.IsDirectory() {
+		expectSum, err := fileSum(expect)
+		if err != nil {
+			return err
+		}
+		actualSum, err := fileSum(actual)
+		if err != nil {
+			return err
+		}
+		if expectSum.Strong != actualSum.Strong || expectSum.Length != actualSum.Length {
+			difference("expected contents %v, found %v", expectSum, actualSum)
+		}
+		return nil
+	}
+
+	expectEntries, err := ioutil.ReadDir(expect)
+	if err != nil {
+		return err
+	}
+	actualEntries, err := ioutil.ReadDir(actual)
+	if err != nil {
+		return err
+	}
+
+	// Both are sorted by name
+	for len(expectEntries) > 0 || len(actualEntries) > 0 {
+		switch {
+		case len(actualEntries) == 0 ||
+			len(expectEntries) > 0 && expectEntries[0].Name < actualEntries[0].Name:
+			difference("missing %s", expectEntries[0].Name)
+			expectEntries = expectEntries[1:]
+
+		case len(expectEntries) == 0 || actualEntries[0].Name < expectEntries[0].Name:
+			difference("unexpected %s", actualEntries[0].Name)
+			actualEntries = actualEntries[1:]
+
+		default:
+			name := expectEntries[0].Name
+			err = diffTrees(filepath.Join(expect, name), filepath.Join(actual, name),
+				filepath.Join(relpath, name), diffs)
+			if err != nil {
+				return err
+			}
+			expectEntries, actualEntries = expectEntries[1:], actualEntries[1:]
+		}
+	}
+	return nil
+}
+
+func kindOf(info *os.FileInfo) string {
+	switch {
+	case info.IsDirectory():
+		return "a directory"
+	case info.IsSymlink():
+		return "a symbolic link"
+	}
+	return "a file"
+}
+
+// Assert that the trees at two paths are the same, as DiffTrees compares them.
+func AssertSameTree(t *testing.T, expect string, actual string) {
+	diffs, err := DiffTrees(expect, actual)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Tf(t, len(diffs) == 0, "%s differs from %s:\n%s",
+		actual, expect, strings.Join(diffs, "\n"))
+}
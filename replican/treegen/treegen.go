@@ -23,6 +23,27 @@ This allows us to specify a repeatable sequence of bytes at an
 arbitrary location in the generated file in a very compact way,
 useful for testing match & patch.
 
+The same expressions can be read as text with TreeGen.Parse, so trees
+can be kept in fixture files, and an existing tree can be rendered back
+into one with Render. Rendered file contents take the form
+S("SHA-1", LENGTH), which can be compared but not fabricated.
+
+Beyond directories and random bytes, a tree may hold:
+
+	L("name", "target")   a symbolic link, which may dangle or loop
+	H("name", "target")   a hard link to a file generated before it
+	M(0755)               the permission bits of its directory or file
+	T(1300000000)         the mtime of its directory or file, in seconds
+	Z(LENGTH)             a sparse hole in a file, cheap at any size
+	R(COUNT, B(1, 2))     file contents repeated COUNT times
+
+Permission bits and mtimes are set after the rest of the contents of
+their directory or file are generated.
+
+Mutate derives an edited copy of a tree with operations such as
+Insert, Cut, Overwrite, Rename, Move, Swap and Chmod, so that a test
+can fabricate a tree and another made from it by known changes.
+
 */
 
 package treegen
@@ -30,6 +51,7 @@ package treegen
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -52,9 +74,56 @@ type File struct {
 	Contents []Generated
 }
 
+// Length bytes generated from Seed, starting Offset bytes into the
+// sequence, so that a range of bytes can be split in two.
 type Bytes struct {
 	Seed   int64
 	Length int64
+	Offset int64
+}
+
+// File content known only by its SHA-1 checksum and length, as rendered
+// from an existing tree. It can be compared, but not fabricated.
+type Sum struct {
+	Strong string
+	Length int64
+}
+
+// A symbolic link to Target, which need not exist.
+type Symlink struct {
+	Name   string
+	Target string
+}
+
+// A hard link to the file at Target, relative to the link's directory.
+// The file must be generated before the link.
+type HardLink struct {
+	Name   string
+	Target string
+}
+
+// The permission bits of the directory or file containing it,
+// set once its contents are generated.
+type Mode struct {
+	Perm uint32
+}
+
+// The modification time of the directory or file containing it,
+// in seconds since the epoch, set once its contents are generated.
+type Mtime struct {
+	Seconds int64
+}
+
+// A sparse region of a file, which reads as zeros but is not written.
+// A file of a few bytes with a large hole has a large virtual size.
+type Hole struct {
+	Length int64
+}
+
+// File contents repeated Count times.
+type Repeat struct {
+	Count    int64
+	Contents []Generated
 }
 
 type TreeGen struct {
@@ -129,6 +198,92 @@ func (treeGen *TreeGen) B(seed int64, length int64) *Bytes {
 	return &Bytes{Seed: seed, Length: length}
 }
 
+func (treeGen *TreeGen) S(strong string, length int64) *Sum {
+	return &Sum{Strong: strong, Length: length}
+}
+
+func (treeGen *TreeGen) L(name string, target string) *Symlink {
+	if name == "" {
+		name = treeGen.randomName()
+	}
+	return &Symlink{Name: name, Target: target}
+}
+
+func (treeGen *TreeGen) H(name string, target string) *HardLink {
+	if name == "" {
+		name = treeGen.randomName()
+	}
+	return &HardLink{Name: name, Target: target}
+}
+
+func (treeGen *TreeGen) M(perm uint32) *Mode {
+	return &Mode{Perm: perm}
+}
+
+func (treeGen *TreeGen) T(seconds int64) *Mtime {
+	return &Mtime{Seconds: seconds}
+}
+
+func (treeGen *TreeGen) Z(length int64) *Hole {
+	return &Hole{Length: length}
+}
+
+func (treeGen *TreeGen) R(count int64, contents ...Generated) *Repeat {
+	return &Repeat{Count: count, Contents: contents}
+}
+
+// Render a generated tree as the DSL expression which makes it.
+func (d *Dir) String() string {
+	return fmt.Sprintf("D(%q%s)", d.Name, contentsString(d.Contents))
+}
+
+func (f *File) String() string {
+	return fmt.Sprintf("F(%q%s)", f.Name, contentsString(f.Contents))
+}
+
+func (b *Bytes) String() string {
+	if b.Offset != 0 {
+		return fmt.Sprintf("B(%d, %d, %d)", b.Seed, b.Length, b.Offset)
+	}
+	return fmt.Sprintf("B(%d, %d)", b.Seed, b.Length)
+}
+
+func (sum *Sum) String() string {
+	return fmt.Sprintf("S(%q, %d)", sum.Strong, sum.Length)
+}
+
+func (link *Symlink) String() string {
+	return fmt.Sprintf("L(%q, %q)", link.Name, link.Target)
+}
+
+func (link *HardLink) String() string {
+	return fmt.Sprintf("H(%q, %q)", link.Name, link.Target)
+}
+
+func (mode *Mode) String() string {
+	return fmt.Sprintf("M(0%o)", mode.Perm)
+}
+
+func (mtime *Mtime) String() string {
+	return fmt.Sprintf("T(%d)", mtime.Seconds)
+}
+
+func (hole *Hole) String() string {
+	return fmt.Sprintf("Z(%d)", hole.Length)
+}
+
+func (r *Repeat) String() string {
+	return fmt.Sprintf("R(%d%s)", r.Count, contentsString(r.Contents))
+}
+
+func contentsString(contents []Generated) string {
+	buf := &bytes.Buffer{}
+	for _, g := range contents {
+		fmt.Fprintf(buf, ", %v", g)
+	}
+	return string(buf.Bytes())
+}
+
 const PREFIX string = "treegen"
 
 func TestTree(t *testing.T, g Generated) string {
@@ -142,54 +297,80 @@ func TestTree(t *testing.T, g Generated) string {
 }
 
 func Fab(parent string, g Generated) os.Error {
-	if d, isD := g.(*Dir); isD {
-		return d.fab(parent)
-	} else if f, isF := g.(*File); isF {
-		return f.fab(parent)
-	} else if b, isB := g.(*Bytes); isB {
-		return b.fab(parent)
+	switch g := g.(type) {
+	case *Dir:
+		return g.fab(parent)
+	case *File:
+		return g.fab(parent)
+	case *Bytes:
+		return g.fab(parent)
+	case *Sum:
+		return os.NewError(fmt.Sprintf("Cannot fabricate %v, known only by its checksum", g))
+	case *Symlink:
+		return os.Symlink(g.Target, filepath.Join(parent, g.Name))
+	case *HardLink:
+		return os.Link(filepath.Join(parent, g.Target), filepath.Join(parent, g.Name))
+	case *Mode:
+		return os.Chmod(parent, g.Perm)
+	case *Mtime:
+		return os.Chtimes(parent, g.Seconds*1e9, g.Seconds*1e9)
+	case *Hole:
+		return g.fab(parent)
+	case *Repeat:
+		for i := int64(0); i < g.Count; i++ {
+			for _, c := range g.Contents {
+				if err := Fab(parent, c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
 	}
 
 	return os.NewError(fmt.Sprintf("WTF is this: %v?", g))
 }
 
-func (d *Dir) fab(parent string) os.Error {
-	name := d.Name
+// Generate the contents of a directory or file, and then set the
+// attributes among them.
+func fabContents(path string, contents []Generated) os.Error {
+	attrs := []Generated{}
+	for _, g := range contents {
+		switch g.(type) {
+		case *Mode, *Mtime:
+			attrs = append(attrs, g)
+		default:
+			if err := Fab(path, g); err != nil {
+				return err
+			}
+		}
+	}
 
-	path := filepath.Join(parent, name)
-	err := os.Mkdir(path, 0777)
-	if err != nil {
-		return err
+	for _, g := range attrs {
+		if err := Fab(path, g); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	switch len(d.Contents) {
-	case 0:
-		return nil
-	case 1:
-		return fabEntries(path, d.Contents[0], []Generated{})
+func (d *Dir) fab(parent string) os.Error {
+	path := filepath.Join(parent, d.Name)
+	if err := os.Mkdir(path, 0777); err != nil {
+		return err
 	}
 
-	return fabEntries(path, d.Contents[0], d.Contents[1:])
+	return fabContents(path, d.Contents)
 }
 
 func (f *File) fab(parent string) os.Error {
-	name := f.Name
-
-	path := filepath.Join(parent, name)
+	path := filepath.Join(parent, f.Name)
 	fh, err := os.Create(path)
 	if fh == nil {
 		return err
 	}
 	fh.Close()
 
-	switch len(f.Contents) {
-	case 0:
-		return nil
-	case 1:
-		return fabEntries(path, f.Contents[0], []Generated{})
-	}
-
-	return fabEntries(path, f.Contents[0], f.Contents[1:])
+	return fabContents(path, f.Contents)
 }
 
 const CHUNKSIZE int = 8192
@@ -201,7 +382,15 @@ func (b *Bytes) fab(parent string) os.Error {
 	}
 	defer fh.Close()
 
+	return b.write(fh)
+}
+
+// Write the generated bytes.
+func (b *Bytes) write(w io.Writer) (err os.Error) {
 	rnd := rand.New(rand.NewSource(b.Seed))
+	for i := int64(0); i < b.Offset; i++ {
+		rnd.Int()
+	}
 
 	for toWrite := b.Length; toWrite > 0; {
 		buf := &bytes.Buffer{}
@@ -211,7 +400,7 @@ func (b *Bytes) fab(parent string) os.Error {
 			toWrite--
 		}
 
-		_, err = buf.WriteTo(fh)
+		_, err = buf.WriteTo(w)
 		if err != nil {
 			return err
 		}
@@ -220,14 +409,16 @@ func (b *Bytes) fab(parent string) os.Error {
 	return nil
 }
 
-func fabEntries(path string, first Generated, rest []Generated) os.Error {
-	if err := Fab(path, first); err != nil {
+func (hole *Hole) fab(parent string) os.Error {
+	fh, err := os.OpenFile(parent, os.O_RDWR, 0644)
+	if fh == nil {
 		return err
 	}
+	defer fh.Close()
 
-	if len(rest) == 0 {
-		return nil
+	info, err := fh.Stat()
+	if err != nil {
+		return err
 	}
-
-	return fabEntries(path, rest[0], rest[1:])
+	return fh.Truncate(info.Size + hole.Length)
 }
@@ -1,8 +1,12 @@
 package treegen
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bmizerany/assert"
@@ -22,3 +26,336 @@ func TestSimple1(t *testing.T) {
 	assert.Tf(t, fileInfo.IsRegular(), "no bar")
 	assert.Equal(t, int64(65537), fileInfo.Size)
 }
+
+func TestString(t *testing.T) {
+	tg := New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(43, 1)),
+		tg.D("baz"))
+	assert.Equal(t, `D("foo", F("bar", B(42, 65537), B(43, 1)), D("baz"))`, treeSpec.String())
+}
+
+func TestParse(t *testing.T) {
+	tg := New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 65537), tg.B(-43, 1)),
+		tg.D("baz \"quoted\"",
+			tg.F("empty")),
+		tg.F("sum", tg.S("da39a3ee5e6b4b0d3255bfef95601890afd80709", 0)))
+
+	g, err := tg.Parse(treeSpec.String())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, treeSpec.String(), g.(*Dir).String())
+
+	g, err = tg.Parse(`
+		// A fixture
+		D("foo",
+			F("bar", B(1, 2)), // trailing commas are fine
+		)`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, `D("foo", F("bar", B(1, 2)))`, g.(*Dir).String())
+
+	// Empty names are generated
+	g, err = tg.Parse(`D("", F(""))`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.T(t, g.(*Dir).Name != "")
+	assert.T(t, g.(*Dir).Contents[0].(*File).Name != "")
+
+	for _, bad := range []string{
+		``,
+		`D("foo"`,
+		`D(foo)`,
+		`X("foo")`,
+		`D("foo", B(1, 2))`,
+		`F("foo", F("bar"))`,
+		`B(1)`,
+		`B(1, 2) B(3, 4)`,
+		`D("foo", F("bar", B(1, x)))`,
+	} {
+		_, err = tg.Parse(bad)
+		assert.Tf(t, err != nil, "%s parsed", bad)
+	}
+
+	_, err = tg.Parse("D(\"foo\",\n\tF(\"bar\", B(1, 2)),\n\tX())")
+	assert.T(t, err != nil)
+	assert.Tf(t, strings.HasPrefix(err.String(), "3:2:"), "%v", err)
+}
+
+func TestParseFile(t *testing.T) {
+	fixture, err := ioutil.TempFile("", PREFIX)
+	assert.T(t, err == nil)
+	defer os.Remove(fixture.Name())
+	fmt.Fprintf(fixture, "D(\"foo\", F(\"bar\", B(42, 100)))\n")
+	fixture.Close()
+
+	tg := New()
+	treeSpec, err := tg.ParseFile(fixture.Name())
+	assert.Tf(t, err == nil, "%v", err)
+
+	tempdir := TestTree(t, treeSpec)
+	defer os.RemoveAll(tempdir)
+	fileInfo, _ := os.Stat(filepath.Join(tempdir, "foo", "bar"))
+	assert.Equal(t, int64(100), fileInfo.Size)
+}
+
+func TestRender(t *testing.T) {
+	tg := New()
+	treeSpec := tg.D("foo",
+		tg.F("C", tg.B(42, 65537), tg.B(43, 1)),
+		tg.D("B",
+			tg.F("empty")),
+		tg.F("A", tg.B(42, 100)))
+	tempdir := TestTree(t, treeSpec)
+	defer os.RemoveAll(tempdir)
+
+	rendered, err := Render(filepath.Join(tempdir, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+	digested, err := Digest(treeSpec)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, digested.(*Dir).String(), rendered.(*Dir).String())
+
+	// Rendered trees can be read back, but not fabricated
+	parsed, err := tg.Parse(rendered.(*Dir).String())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, rendered.(*Dir).String(), parsed.(*Dir).String())
+	assert.T(t, Fab(tempdir, tg.D("bar", parsed.(*Dir).Contents[0])) != nil)
+}
+
+func TestDiffTrees(t *testing.T) {
+	tg := New()
+	expect := TestTree(t, tg.D("foo",
+		tg.F("A", tg.B(42, 1000)),
+		tg.F("B", tg.B(43, 1000)),
+		tg.D("C", tg.F("c", tg.B(44, 1000))),
+		tg.F("D", tg.B(45, 1000)),
+		tg.F("E", tg.B(46, 1000))))
+	defer os.RemoveAll(expect)
+
+	actual := TestTree(t, tg.D("foo",
+		tg.F("A", tg.B(42, 1000)),
+		tg.F("B", tg.B(43, 999)),
+		tg.F("C", tg.B(44, 1000)),
+		tg.F("E", tg.B(46, 1000)),
+		tg.F("F", tg.B(47, 1000))))
+	defer os.RemoveAll(actual)
+	err := os.Chmod(filepath.Join(actual, "foo", "E"), 0600)
+	assert.T(t, err == nil)
+
+	diffs, err := DiffTrees(filepath.Join(expect, "foo"), filepath.Join(actual, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equalf(t, 5, len(diffs), "%v", diffs)
+	for i, prefix := range []string{"B: expected contents", "C: expected a directory",
+		".: missing D", "E: expected mode", ".: unexpected F"} {
+		assert.Tf(t, strings.HasPrefix(diffs[i], prefix), "%s", diffs[i])
+	}
+
+	AssertSameTree(t, filepath.Join(expect, "foo", "C"), filepath.Join(expect, "foo", "C"))
+}
+
+func TestParseAll(t *testing.T) {
+	tg := New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(1, 2), tg.Z(1<<40), tg.R(3, tg.B(4, 5), tg.Z(6)), tg.M(0600), tg.T(1300000000)),
+		tg.L("baz", "bar"),
+		tg.H("quux", "bar"),
+		tg.M(0755))
+	assert.Equal(t, `D("foo", F("bar", B(1, 2), Z(1099511627776), R(3, B(4, 5), Z(6)), M(0600), T(1300000000)), `+
+		`L("baz", "bar"), H("quux", "bar"), M(0755))`, treeSpec.String())
+
+	g, err := tg.Parse(treeSpec.String())
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, treeSpec.String(), g.(*Dir).String())
+
+	g, err = tg.Parse(`F("foo", B(1, 2, 3))`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(3), g.(*File).Contents[0].(*Bytes).Offset)
+
+	g, err = tg.Parse(`F("foo", M(0x1ed))`)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, `F("foo", M(0755))`, g.(*File).String())
+
+	for _, bad := range []string{
+		`F("foo", L("bar", "baz"))`,
+		`D("foo", Z(1))`,
+		`R(2, F("foo"))`,
+		`L("foo")`,
+		`M(09)`,
+	} {
+		_, err = tg.Parse(bad)
+		assert.Tf(t, err != nil, "%s parsed", bad)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	tg := New()
+	treeSpec := tg.D("foo",
+		tg.F("bar", tg.B(42, 1000)),
+		tg.D("baz",
+			tg.H("hard", "../bar"),
+			tg.L("soft", "../bar")),
+		tg.L("dangling", "nowhere"),
+		tg.L("loop1", "loop2"),
+		tg.L("loop2", "loop1"),
+		tg.H("hard", "bar"))
+	tempdir := TestTree(t, treeSpec)
+	defer os.RemoveAll(tempdir)
+
+	barInfo, err := os.Lstat(filepath.Join(tempdir, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	for _, hard := range []string{"hard", filepath.Join("baz", "hard")} {
+		info, err := os.Lstat(filepath.Join(tempdir, "foo", hard))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Tf(t, info.IsRegular(), "%s is not a file", hard)
+		assert.Equal(t, barInfo.Ino, info.Ino)
+	}
+
+	info, err := os.Stat(filepath.Join(tempdir, "foo", "baz", "soft"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(1000), info.Size)
+	_, err = os.Stat(filepath.Join(tempdir, "foo", "dangling"))
+	assert.T(t, err != nil)
+	_, err = os.Stat(filepath.Join(tempdir, "foo", "loop1"))
+	assert.T(t, err != nil)
+
+	rendered, err := Render(filepath.Join(tempdir, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, `L("loop1", "loop2")`, rendered.(*Dir).Contents[4].String())
+	_, err = Digest(treeSpec)
+	assert.T(t, err != nil, "hard link outside its directory was digested")
+
+	// Without the link out of baz, the tree digests as it renders
+	treeSpec.Contents[1].(*Dir).Contents = treeSpec.Contents[1].(*Dir).Contents[1:]
+	os.Remove(filepath.Join(tempdir, "foo", "baz", "hard"))
+	rendered, err = Render(filepath.Join(tempdir, "foo"))
+	assert.Tf(t, err == nil, "%v", err)
+	digested, err := Digest(treeSpec)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, digested.(*Dir).String(), rendered.(*Dir).String())
+}
+
+func TestModes(t *testing.T) {
+	tg := New()
+	tempdir := TestTree(t, tg.D("foo",
+		tg.M(0700), tg.T(1200000000),
+		tg.F("bar", tg.T(1300000000), tg.B(42, 1000), tg.M(0640)),
+		tg.D("baz", tg.M(0555), tg.F("quux"))))
+	defer os.RemoveAll(tempdir)
+	defer os.Chmod(filepath.Join(tempdir, "foo", "baz"), 0755)
+
+	for _, expect := range []struct {
+		path  string
+		mode  uint32
+		mtime int64
+	}{
+		{"foo", 0700, 1200000000},
+		{filepath.Join("foo", "bar"), 0640, 1300000000},
+		{filepath.Join("foo", "baz"), 0555, 0},
+	} {
+		info, err := os.Stat(filepath.Join(tempdir, expect.path))
+		assert.Tf(t, err == nil, "%v", err)
+		assert.Equalf(t, expect.mode, info.Mode&07777, "%s", expect.path)
+		if expect.mtime != 0 {
+			assert.Equalf(t, expect.mtime*1e9, info.Mtime_ns, "%s", expect.path)
+		}
+	}
+
+	// Modes and mtimes are set after contents
+	info, err := os.Stat(filepath.Join(tempdir, "foo", "bar"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(1000), info.Size)
+	_, err = os.Stat(filepath.Join(tempdir, "foo", "baz", "quux"))
+	assert.Tf(t, err == nil, "%v", err)
+}
+
+func TestSparse(t *testing.T) {
+	tg := New()
+	treeSpec := tg.F("big", tg.B(42, 100), tg.Z(5<<30), tg.B(43, 100))
+	tempdir := TestTree(t, treeSpec)
+	defer os.RemoveAll(tempdir)
+
+	info, err := os.Stat(filepath.Join(tempdir, "big"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(5<<30+200), info.Size)
+	assert.Tf(t, info.Blocks*512 < 1<<20, "%d blocks allocated", info.Blocks)
+
+	fh, err := os.Open(filepath.Join(tempdir, "big"))
+	assert.Tf(t, err == nil, "%v", err)
+	defer fh.Close()
+	buf := make([]byte, 200)
+	_, err = fh.ReadAt(buf, 5<<30-100)
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, make([]byte, 200), buf)
+	_, err = fh.ReadAt(buf[:100], 5<<30+100)
+	assert.Tf(t, err == nil, "%v", err)
+	expect := &bytes.Buffer{}
+	tg.B(43, 100).write(expect)
+	assert.Equal(t, expect.Bytes(), buf[:100])
+}
+
+func TestRepeat(t *testing.T) {
+	tg := New()
+	tempdir := TestTree(t, tg.D("foo",
+		tg.F("repeated", tg.R(3, tg.B(42, 1000), tg.R(2, tg.Z(10)))),
+		tg.F("written", tg.B(42, 1000), tg.Z(20), tg.B(42, 1000), tg.Z(20), tg.B(42, 1000), tg.Z(20))))
+	defer os.RemoveAll(tempdir)
+
+	AssertSameTree(t, filepath.Join(tempdir, "foo", "repeated"), filepath.Join(tempdir, "foo", "written"))
+	info, err := os.Stat(filepath.Join(tempdir, "foo", "repeated"))
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, int64(3060), info.Size)
+}
+
+func TestMutate(t *testing.T) {
+	tg := New()
+	src := tg.D("foo",
+		tg.F("a", tg.B(1, 1000)),
+		tg.D("b", tg.F("c", tg.B(2, 500))),
+		tg.F("d", tg.B(3, 100)),
+		tg.F("r", tg.R(3, tg.B(4, 10)), tg.M(0600)))
+	srcString := src.String()
+
+	dst, err := Mutate(src,
+		&Insert{Path: "a", Offset: 100, Contents: []Generated{tg.B(7, 50)}},
+		&Cut{Path: "a", Offset: 500, Length: 100},
+		&Overwrite{Path: "b/c", Offset: 400, Contents: []Generated{tg.B(8, 200)}},
+		&Rename{Path: "d", Name: "e"},
+		&Move{Path: "e", Dir: "b"},
+		&Truncate{Path: "b/e", Length: 60},
+		&Chmod{Path: "a", Perm: 0640},
+		&Cut{Path: "r", Offset: 5, Length: 10})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, srcString, src.String())
+	assert.Equal(t, `D("foo", F("a", B(1, 100), B(7, 50), B(1, 350, 100), B(1, 450, 550), M(0640)), `+
+		`D("b", F("c", B(2, 400), B(8, 200)), F("e", B(3, 60))), F("r", B(4, 5), B(4, 5, 5), B(4, 10), M(0600)))`,
+		dst.String())
+
+	// Split ranges of bytes generate what they did whole
+	tempdir := TestTree(t, tg.D("foo",
+		tg.F("whole", tg.B(1, 1000)),
+		tg.F("split", tg.B(1, 100), tg.B(1, 900, 100))))
+	defer os.RemoveAll(tempdir)
+	AssertSameTree(t, filepath.Join(tempdir, "foo", "whole"), filepath.Join(tempdir, "foo", "split"))
+
+	dst, err = Mutate(src,
+		&Swap{Path: "a", Contents: []Generated{tg.F("s", tg.B(9, 10))}},
+		&Swap{Path: "b", Contents: []Generated{tg.B(10, 10)}},
+		&Remove{Path: "d"})
+	assert.Tf(t, err == nil, "%v", err)
+	assert.Equal(t, `D("foo", D("a", F("s", B(9, 10))), F("b", B(10, 10)), F("r", R(3, B(4, 10)), M(0600)))`,
+		dst.String())
+
+	for _, op := range []Op{
+		&Rename{Path: "a", Name: "d"},
+		&Move{Path: "b", Dir: "b"},
+		&Move{Path: "a", Dir: "d"},
+		&Move{Path: "d", Dir: ""},
+		&Cut{Path: "a", Offset: 900, Length: 200},
+		&Insert{Path: "b", Offset: 0},
+		&Truncate{Path: "nowhere", Length: 0},
+		&Remove{Path: ""},
+	} {
+		_, err = Mutate(src, op)
+		assert.Tf(t, err != nil, "%v applied", op)
+	}
+	assert.Equal(t, srcString, src.String())
+}
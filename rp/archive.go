@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// Patch <dst> to match the tree in an archive, or the directory at <path>
+// within it, without extracting the archive to disk.
+func unpack(relpath string, limits *sync.IOLimits, indexLimit *fs.Throttle, args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s unpack [<limits>] [-p <path>] <archive> <dst>", os.Args[0]), nil)
+	}
+
+	archivePath := args[0]
+	dstpath := args[1]
+
+	srcRepo, srcDbPath := tempDbRepo("srcdb", "archive")
+	defer os.RemoveAll(srcDbPath)
+	srcStore, err := fs.NewArchiveStore(archivePath, relpath, srcRepo)
+	if err != nil {
+		die(fmt.Sprintf("Failed to read archive %s", archivePath), err)
+	}
+
+	if err = os.MkdirAll(dstpath, 0755); err != nil {
+		die(fmt.Sprintf("Failed to create destination %s", dstpath), err)
+	}
+
+	dstRepo, dstDbPath := tempDbRepo("dstdb", "destination")
+	defer os.RemoveAll(dstDbPath)
+	dstStore, err := fs.NewLocalStoreWith(dstpath, dstRepo, fs.LocalOptions{IndexLimit: indexLimit})
+	if err != nil {
+		die(fmt.Sprintf("Failed to read destination %s", dstpath), err)
+	}
+
+	patchPlan, err := sync.NewPatchPlan(srcStore, dstStore)
+	if err != nil {
+		die(fmt.Sprintf("Failed to plan patch from %s to %s", archivePath, dstpath), err)
+	}
+	patchPlan.Limit(limits)
+	if failedCmd, err := patchPlan.Exec(); err != nil {
+		die(failedCmd.String(), err)
+	}
+
+	status := 0
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		patchPlan.SetMode(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		status = 1
+	}
+
+	return status
+}
+
+// Write the tree at <src> out to the tar file <tar>.
+func export(args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s export <src> <tar>", os.Args[0]), nil)
+	}
+
+	srcpath := args[0]
+	tarpath := args[1]
+
+	srcRepo, srcDbPath := tempDbRepo("srcdb", "source")
+	defer os.RemoveAll(srcDbPath)
+	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
+	}
+
+	tarFh, err := os.Create(tarpath)
+	if err != nil {
+		die(fmt.Sprintf("Failed to create %s", tarpath), err)
+	}
+	defer tarFh.Close()
+
+	if err = fs.ExportTar(srcStore, tarFh); err != nil {
+		die(fmt.Sprintf("Failed to export %s to %s", srcpath, tarpath), err)
+	}
+
+	return 0
+}
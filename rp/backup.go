@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"exec"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// A backup repository is a directory containing an index database
+// of snapshots, and an object directory of their contents.
+//
+// An encrypted repository also has a key file, from which its keys are
+// derived with the secret it was created with.
+const repoIndex = "index.db"
+const repoObjects = "objects"
+const repoKeys = "keys"
+
+// Open a backup repository, unlocking it with secret if it is encrypted.
+// A new repository is created only for a backup, and is encrypted if a
+// secret is given for it.
+func openBackupRepo(repopath string, options sqlite3.DbOptions, secret []byte) (*sqlite3.DbRepo, *fs.ObjectStore) {
+	if repopath == "" {
+		die("A backup repository must be given with -r <repo>", nil)
+	}
+
+	if options.ReadOnly {
+		if _, err := os.Stat(repopath); err != nil {
+			die(fmt.Sprintf("Repository %s not found", repopath), err)
+		}
+	} else if err := os.MkdirAll(repopath, 0755); err != nil {
+		die(fmt.Sprintf("Failed to create repository %s", repopath), err)
+	}
+
+	_, indexErr := os.Stat(filepath.Join(repopath, repoIndex))
+	_, keysErr := os.Stat(filepath.Join(repopath, repoKeys))
+	switch {
+	case secret == nil && keysErr == nil:
+		die(fmt.Sprintf("Repository %s is encrypted, and must be unlocked with -k <key file> or -P", repopath), nil)
+	case secret != nil && keysErr != nil && (indexErr == nil || options.ReadOnly):
+		die(fmt.Sprintf("Repository %s is not encrypted", repopath), nil)
+	case secret != nil:
+		keys, err := fs.UnlockKeys(filepath.Join(repopath, repoKeys), secret)
+		if err != nil {
+			die(fmt.Sprintf("Failed to unlock repository %s", repopath), err)
+		}
+		options.Keys = keys
+	}
+
+	index, err := sqlite3.OpenDbRepo(filepath.Join(repopath, repoIndex), options)
+	if err != nil {
+		die(fmt.Sprintf("Failed to open repository index in %s", repopath), err)
+	}
+
+	objects, err := fs.NewEncryptedObjectStore(filepath.Join(repopath, repoObjects), nil, options.Keys)
+	if err != nil {
+		die(fmt.Sprintf("Failed to open repository objects in %s", repopath), err)
+	}
+
+	return index, objects
+}
+
+// Store the current contents of <src> in the repository as a new snapshot.
+func backup(repopath string, secret []byte, indexLimit *fs.Throttle, args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s backup -r <repo> [-k <key file> | -P] [-X <rate>] <src> <snapshot>", os.Args[0]), nil)
+	}
+
+	srcpath := args[0]
+	name := args[1]
+
+	index, objects := openBackupRepo(repopath, sqlite3.DbOptions{Durable: true}, secret)
+	defer index.Close()
+	defer objects.Close()
+
+	srcRepo, srcDbPath := tempDbRepo("srcdb", "source")
+	defer os.RemoveAll(srcDbPath)
+	srcStore, err := fs.NewLocalStoreWith(srcpath, srcRepo, fs.LocalOptions{IndexLimit: indexLimit})
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
+	}
+
+	if err = objects.Backup(srcStore); err != nil {
+		die(fmt.Sprintf("Failed to back up %s", srcpath), err)
+	}
+
+	srcRoot, err := srcStore.Repo().Root()
+	if err != nil {
+		die(fmt.Sprintf("Failed to read index of %s", srcpath), err)
+	}
+
+	snapshot, err := index.Snapshot(name, srcRoot)
+	if err != nil {
+		die(fmt.Sprintf("Failed to create snapshot %s", name), err)
+	}
+
+	fmt.Printf("%s\t%s\n", snapshot.Name, snapshot.Strong)
+	return 0
+}
+
+// Read the secret to unlock a repository with: the contents of a key file,
+// or a passphrase read from the first line of standard input, which is not
+// echoed if it is a terminal. Returns nil if neither is asked for.
+func readSecret(keyFile string, askPassphrase bool) []byte {
+	switch {
+	case keyFile != "" && askPassphrase:
+		die("Give either -k <key file> or -P, not both", nil)
+	case keyFile != "":
+		secret, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			die(fmt.Sprintf("Failed to read key file %s", keyFile), err)
+		}
+		return secret
+	case askPassphrase:
+		fmt.Fprint(os.Stderr, "Passphrase: ")
+		echoOff := stty("-echo") == nil
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if echoOff {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}
+		if err != nil && err != os.EOF {
+			die("Failed to read passphrase", err)
+		}
+		passphrase := strings.TrimRight(line, "\r\n")
+		if passphrase == "" {
+			die("The passphrase must not be empty", nil)
+		}
+		return []byte(passphrase)
+	}
+	return nil
+}
+
+// Change a setting of the terminal on standard input. Fails if standard
+// input is not a terminal.
+func stty(setting string) os.Error {
+	cmd := exec.Command("stty", setting)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+// Materialize a snapshot, or the part of it at <path>, into <dst>.
+func restore(repopath string, relpath string, secret []byte, limits *sync.IOLimits, indexLimit *fs.Throttle, args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s restore -r <repo> [-k <key file> | -P] [<limits>] [-p <path>] <snapshot> <dst>", os.Args[0]), nil)
+	}
+
+	name := args[0]
+	dstpath := args[1]
+
+	index, objects := openBackupRepo(repopath, sqlite3.DbOptions{ReadOnly: true}, secret)
+	defer index.Close()
+	defer objects.Close()
+
+	snapshot, err := index.OpenSnapshot(name)
+	if err != nil {
+		die(fmt.Sprintf("Cannot restore %s", name), err)
+	}
+
+	patchPlan, err := sync.RestoreWith(objects.WithRepo(snapshot), relpath, dstpath,
+		fs.LocalOptions{IndexLimit: indexLimit})
+	if err != nil {
+		die(fmt.Sprintf("Cannot restore %s to %s", name, dstpath), err)
+	}
+	patchPlan.Limit(limits)
+
+	if failedCmd, err := patchPlan.Exec(); err != nil {
+		die(failedCmd.String(), err)
+	}
+
+	status := 0
+	errors := make(chan os.Error)
+	go func() {
+		patchPlan.Clean(errors)
+		patchPlan.SetMode(errors)
+		close(errors)
+	}()
+	for err := range errors {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		status = 1
+	}
+
+	return status
+}
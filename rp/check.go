@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// Compare <src> and <dst> by strong checksum without modifying either.
+// Returns a non-zero exit status if any differences are found.
+func check(args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s check <src> <dst>", os.Args[0]), nil)
+	}
+
+	srcpath := args[0]
+	dstpath := args[1]
+
+	srcRepo, srcDbPath := tempDbRepo("srcdb", "source")
+	defer os.RemoveAll(srcDbPath)
+	dstRepo, dstDbPath := tempDbRepo("dstdb", "destination")
+	defer os.RemoveAll(dstDbPath)
+
+	report, err := sync.CheckRepos(srcpath, dstpath, srcRepo, dstRepo)
+	if err != nil {
+		die(fmt.Sprintf("Failed to compare %s with %s", srcpath, dstpath), err)
+	}
+	fmt.Print(report)
+
+	if !report.Match() {
+		return 2
+	}
+	return 0
+}
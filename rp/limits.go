@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// Parse a rate such as 512k or 10m, in bytes or operations per second.
+// An empty rate is no limit.
+func parseRate(option string, rate string) int64 {
+	if rate == "" {
+		return 0
+	}
+
+	multiplier := int64(1)
+	switch strings.ToLower(rate[len(rate)-1:]) {
+	case "k":
+		multiplier = 1024
+	case "m":
+		multiplier = 1024 * 1024
+	case "g":
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		rate = rate[:len(rate)-1]
+	}
+
+	n, err := strconv.Atoi64(rate)
+	if err != nil || n <= 0 {
+		die(fmt.Sprintf("%s must be a positive rate, such as 512k or 10m", option), nil)
+	}
+	return n * multiplier
+}
+
+// Get the limits on patching and indexing given by the rate options.
+// Reads and writes are limited separately, but each to the same rate of
+// operations.
+func parseLimits(readRate string, writeRate string, iops string, indexRate string) (*sync.IOLimits, *fs.Throttle) {
+	var limits *sync.IOLimits
+	readBytes := parseRate("--read-rate", readRate)
+	writeBytes := parseRate("--write-rate", writeRate)
+	ops := parseRate("--iops", iops)
+	if readBytes > 0 || writeBytes > 0 || ops > 0 {
+		limits = &sync.IOLimits{
+			Read:  fs.NewThrottle(readBytes, ops),
+			Write: fs.NewThrottle(writeBytes, ops)}
+	}
+
+	var indexLimit *fs.Throttle
+	if indexBytes := parseRate("--index-rate", indexRate); indexBytes > 0 {
+		indexLimit = fs.NewThrottle(indexBytes, 0)
+	}
+
+	return limits, indexLimit
+}
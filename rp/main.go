@@ -12,8 +12,32 @@ import (
 	"optarg.googlecode.com/hg/optarg"
 )
 
+const usage = `Usage: %s [<limits>] <src> <dst>
+       check <src> <dst>
+       backup -r <repo> [-k <key file> | -P] [-X <rate>] <src> <snapshot>
+       restore -r <repo> [-k <key file> | -P] [<limits>] [-p <path>] <snapshot> <dst>
+       watch [-i <index>] [<limits>] <src> <dst>
+       unpack [<limits>] [-p <path>] <archive> <dst>
+       export <src> <tar>
+
+Limits, in bytes or operations per second, such as 512k or 10m:
+       -R, --read-rate <rate>    reads from the source and reused files
+       -W, --write-rate <rate>   writes to the destination
+       -I, --iops <rate>         reads and writes, each counted separately
+       -X, --index-rate <rate>   reads while indexing
+`
+
 func main() {
 	verboseOpt := optarg.NewBoolOption("v", "verbose")
+	repoOpt := optarg.NewStringOption("r", "repo")
+	pathOpt := optarg.NewStringOption("p", "path")
+	indexOpt := optarg.NewStringOption("i", "index")
+	keyFileOpt := optarg.NewStringOption("k", "key-file")
+	passphraseOpt := optarg.NewBoolOption("P", "passphrase")
+	readRateOpt := optarg.NewStringOption("R", "read-rate")
+	writeRateOpt := optarg.NewStringOption("W", "write-rate")
+	iopsOpt := optarg.NewStringOption("I", "iops")
+	indexRateOpt := optarg.NewStringOption("X", "index-rate")
 
 	files, err := optarg.Parse()
 	if err != nil {
@@ -22,8 +46,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	limits, indexLimit := parseLimits(
+		readRateOpt.Value, writeRateOpt.Value, iopsOpt.Value, indexRateOpt.Value)
+
+	if len(files) > 0 {
+		switch files[0] {
+		case "check":
+			os.Exit(check(files[1:]))
+		case "backup":
+			if limits != nil {
+				die("Backups can only be limited while indexing, with -X <rate>", nil)
+			}
+			os.Exit(backup(repoOpt.Value, readSecret(keyFileOpt.Value, passphraseOpt.Value),
+				indexLimit, files[1:]))
+		case "restore":
+			os.Exit(restore(repoOpt.Value, pathOpt.Value,
+				readSecret(keyFileOpt.Value, passphraseOpt.Value), limits, indexLimit, files[1:]))
+		case "watch":
+			os.Exit(watch(indexOpt.Value, verboseOpt.Value, limits, indexLimit, files[1:]))
+		case "unpack":
+			os.Exit(unpack(pathOpt.Value, limits, indexLimit, files[1:]))
+		case "export":
+			os.Exit(export(files[1:]))
+		}
+	}
+
 	if len(files) < 2 {
-		die(fmt.Sprintf("Usage: %s <src> <dst>", os.Args[0]), nil)
+		die(fmt.Sprintf(usage, os.Args[0]), nil)
 	}
 
 	srcpath := files[0]
@@ -43,38 +92,27 @@ func main() {
 			srcinfo, dstinfo), nil)
 	}
 
-	srcDbF, err := ioutil.TempFile("", "srcdb")
-	if err != nil {
-		die("Failed to create source index database", err)
-	}
-	srcDbF.Close()
-	defer os.RemoveAll(srcDbF.Name())
-	srcRepo, err := sqlite3.NewDbRepo(srcDbF.Name())
-	if err != nil {
-		die("Failed to create source index database", err)
-	}
+	srcRepo, srcDbPath := tempDbRepo("srcdb", "source")
+	defer os.RemoveAll(srcDbPath)
 
-	srcStore, err := fs.NewLocalStore(srcpath, srcRepo)
+	srcStore, err := fs.NewLocalStoreWith(srcpath, srcRepo, fs.LocalOptions{IndexLimit: indexLimit})
 	if err != nil {
 		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
 	}
 
-	dstDbF, err := ioutil.TempFile("", "dstdb")
-	if err != nil {
-		die("Failed to create destination index database", err)
-	}
-	defer os.RemoveAll(dstDbF.Name())
-	dstRepo, err := sqlite3.NewDbRepo(dstDbF.Name())
-	if err != nil {
-		die("Failed to create source index database", err)
-	}
+	dstRepo, dstDbPath := tempDbRepo("dstdb", "destination")
+	defer os.RemoveAll(dstDbPath)
 
-	dstStore, err := fs.NewLocalStore(dstpath, dstRepo)
+	dstStore, err := fs.NewLocalStoreWith(dstpath, dstRepo, fs.LocalOptions{IndexLimit: indexLimit})
 	if err != nil {
 		die(fmt.Sprintf("Failed to read destination %s", srcpath), err)
 	}
 
-	patchPlan := sync.NewPatchPlan(srcStore, dstStore)
+	patchPlan, err := sync.NewPatchPlan(srcStore, dstStore)
+	if err != nil {
+		die(fmt.Sprintf("Failed to plan patch from %s to %s", srcpath, dstpath), err)
+	}
+	patchPlan.Limit(limits)
 
 	if verboseOpt.Value {
 		fmt.Printf("%v\n", patchPlan)
@@ -88,6 +126,22 @@ func main() {
 	os.Exit(0)
 }
 
+// Create a temporary index database for one side of an operation.
+func tempDbRepo(prefix string, side string) (*sqlite3.DbRepo, string) {
+	dbF, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		die(fmt.Sprintf("Failed to create %s index database", side), err)
+	}
+	dbF.Close()
+
+	repo, err := sqlite3.NewDbRepo(dbF.Name())
+	if err != nil {
+		os.RemoveAll(dbF.Name())
+		die(fmt.Sprintf("Failed to create %s index database", side), err)
+	}
+	return repo, dbF.Name()
+}
+
 func die(message string, err os.Error) {
 	if err == nil {
 		fmt.Fprint(os.Stderr, message)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/cmars/replican-sync/replican/fs"
+	"github.com/cmars/replican-sync/replican/fs/sqlite3"
+	"github.com/cmars/replican-sync/replican/sync"
+)
+
+// How long the source must be free of changes before they are mirrored,
+// in nanoseconds.
+const watchQuiet int64 = 500 * 1000 * 1000
+
+// The longest changes wait to be mirrored while the source stays busy,
+// in nanoseconds.
+const watchLatest int64 = 5 * 1000 * 1000 * 1000
+
+// Mirror <src> into <dst>, and keep it current until interrupted.
+// The source index is kept in the database at indexpath, or in a
+// temporary database if indexpath is empty.
+func watch(indexpath string, verbose bool, limits *sync.IOLimits, indexLimit *fs.Throttle, args []string) int {
+	if len(args) < 2 {
+		die(fmt.Sprintf("Usage: %s watch [-i <index>] [<limits>] <src> <dst>", os.Args[0]), nil)
+	}
+
+	srcpath := args[0]
+	dstpath := args[1]
+
+	var repo *sqlite3.DbRepo
+	if indexpath == "" {
+		var dbpath string
+		repo, dbpath = tempDbRepo("srcdb", "source")
+		defer os.RemoveAll(dbpath)
+	} else {
+		var err os.Error
+		// The index outlives this process, so don't let a crash corrupt it
+		options := sqlite3.DbOptions{Durable: true}
+		if repo, err = sqlite3.OpenDbRepo(indexpath, options); err != nil {
+			die(fmt.Sprintf("Failed to open index %s", indexpath), err)
+		}
+	}
+	defer repo.Close()
+
+	mirror, err := sync.NewMirrorWith(srcpath, dstpath, repo,
+		sync.MirrorOptions{Limits: limits, IndexLimit: indexLimit})
+	if err != nil {
+		die(fmt.Sprintf("Failed to read source %s", srcpath), err)
+	}
+	if verbose {
+		mirror.Log = os.Stdout
+	}
+
+	if err = mirror.Sync(); err != nil {
+		die(fmt.Sprintf("Failed to mirror %s to %s", srcpath, dstpath), err)
+	}
+
+	stop := make(chan bool)
+	go func() {
+		for sig := range signal.Incoming {
+			if sig == signal.SIGINT || sig == signal.SIGTERM {
+				close(stop)
+				return
+			}
+		}
+	}()
+
+	errors := make(chan os.Error)
+	go func() {
+		for err := range errors {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}()
+
+	err = mirror.Watch(watchQuiet, watchLatest, errors, stop)
+	close(errors)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to watch %s: %v\n", srcpath, err)
+		return 1
+	}
+	return 0
+}